@@ -1,10 +1,10 @@
 package account
 
 import (
-	"crypto/md5"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"strconv"
 	"time"
@@ -19,14 +19,22 @@ import (
 type Account struct {
 	Id                            int64
 	Email                         string               `sql:"unique; type:varchar(60);" validate:"nonzero"`
-	Nickname                      string               `sql:"type:varchar(15); validate:"nonzero"`
+	Nickname                      string               `sql:"type:varchar(15);" validate:"nonzero"`
 	Password                      string               `sql:"type:varchar(60);"`
 	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	VerificationCodeIssuedAt      nullables.NullTime
 	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
-	CurrentSession                nullables.NullString `sql:"type:varchar(32)"`
-	SessionExpires                nullables.NullTime
+	ResetPasswordCodeIssuedAt     nullables.NullTime
 	VoteBank                      int64
-	Admin                         bool
+	Role                          Role                 `sql:"type:varchar(20)"`
+	TotpSecret                    nullables.NullString `sql:"type:varchar(32)"` //set when two factor authentication setup starts
+	TotpEnabled                   bool                 //set once the account's owner has confirmed their authenticator app works
+	TotpLastStep                  int64                //the time step of the last code used, so that codes can't be reused
+	RecoveryCodes                 string               `sql:"type:text"` //hashes of the unused recovery codes, one per line
+	PasswordResetRequired         bool                 //set by an admin to make them choose a new password before signing in
+	SuspendedUntil                nullables.NullTime
+	Banned                        bool
+	SuspensionReason              string `sql:"type:varchar(255)"` //why it was suspended or banned, which is shown to them
 	CreatedAt                     nullables.NullTime
 	UpdatedAt                     nullables.NullTime
 	DeletedAt                     nullables.NullTime
@@ -35,35 +43,73 @@ type Account struct {
 type AccountStorer interface {
 	LoadAccountFromEmail(email string) (*Account, error)
 	LoadAccountFromId(int64) (*Account, error)
-	LoadAccountFromSession(sessionId string) (*Account, error)
+	LoadAccountFromSession(tokenHash string) (*Account, *Session, error)
 	CreateAccount(*Account) error
 	SaveAccount(*Account) error
+	ListAccountsWithRole(Role) ([]Account, error) //in order of email address
+	ListAccounts(AccountQuery) (*AccountPage, error)
+
+	CreateSession(*Session) error
+	SaveSession(*Session) error
+	ListSessions(accountId int64) ([]Session, error) //most recently seen first
+	DeleteSession(accountId int64, sessionId int64) error
+	DeleteAllSessions(accountId int64) error
+	DeleteExpiredSessions(accountId int64, now time.Time) error
 }
 
 var (
 	NoVotesLeft                      error = errors.New("No votes left in bank!")
 	InvalidUsernameOrPassword        error = errors.New("Invalid Username/Password")
+	SessionExpired                   error = errors.New("Session expired.")
 	AccountNotYetVerified            error = errors.New("Account not yet verified.")
 	AccountNicknameTooLong           error = errors.New("Your nickname cannot be longer than 15 characters!")
 	AccountDoesNotNeedVerification   error = errors.New("Account doesn't need verifying!")
 	AccountVerificationCodeNotMatch  error = errors.New("Bad verification code!")
+	VerificationCodeExpired          error = errors.New("That verification link has expired. You can ask for a new one to be sent.")
 	AccountPasswordResetNotRequested error = errors.New("Password reset not requested!")
+	PasswordResetCodeExpired         error = errors.New("That password reset link has expired. Please request another one.")
+	CodeSentTooRecently              error = errors.New("We've only just sent you an email. Please wait a few minutes before asking for another one.")
 	EmailAddressAlreadyInUse         error = errors.New("This email address is already in use!")
 	PasswordNotAcceptable            error = errors.New("Password must contain at least 3 of types of characters from uppercase, lowercase, punctuation, and digits, and be at least 8 characters long.")
 )
 
+const (
+	VerificationCodeLifetime  = 7 * 24 * time.Hour
+	ResetPasswordCodeLifetime = time.Hour
+	ResendCodeCooldown        = 5 * time.Minute //how long someone has to wait before another verification or reset email is sent
+	NewAccountVoteBank        = 10              //how many votes new accounts start with
+)
+
+//Returns a new random code for verification and password reset links (32 hex characters)
 func GenerateValidationKey() (nullables.NullString, error) {
 	//generate validation key
-	b := make([]byte, 10)
+	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err != nil {
 		return nullables.NullString{}, err
 	}
 
-	return nullables.NullString{String: fmt.Sprintf("%x", md5.Sum(b)), Valid: true}, nil
+	return nullables.NullString{String: hex.EncodeToString(b), Valid: true}, nil
+}
+
+//Compares a code from a link with the one that was sent, in constant time so that the code can't be guessed a character at a time
+func codeMatches(expected nullables.NullString, code string) bool {
+	return expected.Valid && subtle.ConstantTimeCompare([]byte(expected.String), []byte(code)) == 1
+}
+
+//Returns true if a code issued at issuedAt has run out at time now. Codes without an issue time have always run out
+func codeExpired(issuedAt nullables.NullTime, lifetime time.Duration, now time.Time) bool {
+	return !issuedAt.Valid || !now.Before(issuedAt.Time.Add(lifetime))
+}
+
+//Returns true if a code issued at issuedAt was sent less than ResendCodeCooldown before now
+func codeSentRecently(issuedAt nullables.NullTime, now time.Time) bool {
+	return issuedAt.Valid && now.Before(issuedAt.Time.Add(ResendCodeCooldown))
 }
 
-func AttemptLogin(as AccountStorer, propEmail string, propPassword string, willExpire bool) (*Account, error) {
+//Checks an email address and password. If they are right, the caller should start a session with StartSession
+//Signing in cancels any password reset that was requested, as they evidently remember their password
+func AttemptLogin(as AccountStorer, propEmail string, propPassword string) (*Account, error) {
 	propUser, err := as.LoadAccountFromEmail(propEmail)
 
 	if err == nil {
@@ -72,18 +118,18 @@ func AttemptLogin(as AccountStorer, propEmail string, propPassword string, willE
 			if propUser.VerificationCode.Valid {
 				return nil, AccountNotYetVerified
 			}
-			//successful login.
-			//generate session
-			propUser.CurrentSession, err = GenerateValidationKey()
-			if err != nil {
+			if err := propUser.Suspension(time.Now()); err != nil {
 				return nil, err
 			}
-			if willExpire {
-				propUser.SessionExpires = nullables.NullTime{Time: time.Now().Add(3600 * time.Second), Valid: true} //expires in 1 hour if they don't want to be remembered
-			} else {
-				propUser.SessionExpires = nullables.NullTime{Time: time.Now().AddDate(0, 1, 0), Valid: true} //expires in 1 month if they want to be remembered
+			if propUser.PasswordResetRequired {
+				return nil, PasswordResetRequired
+			}
+			//accounts with two factor authentication need to pass AttemptSecondFactorLogin before they get a session
+			if propUser.TwoFactorEnabled() {
+				return propUser, SecondFactorRequired
 			}
-			return propUser, as.SaveAccount(propUser)
+			//successful login.
+			return propUser, propUser.cancelPasswordReset(as)
 		}
 		return nil, InvalidUsernameOrPassword
 	}
@@ -156,22 +202,38 @@ func CanAccountBeMade(as AccountStorer, a *Account, passwordClearText string) er
 
 }
 
+//Changes the account's password (which the caller needs to save). Any password reset link that was sent stops working
 func (a *Account) SetPassword(cleartext string) error {
 	hashpass, err := bcrypt.GenerateFromPassword([]byte(cleartext), 10)
 	if err != nil {
 		return err
 	}
 	a.Password = string(hashpass)
+	a.PasswordResetRequired = false
+	a.ResetPasswordVerificationCode = nullables.NullString{}
+	a.ResetPasswordCodeIssuedAt = nullables.NullTime{}
 	return nil
 }
 
+//Stops any password reset link that was sent from working, and saves the account if there was one
+//Links sent because an admin forced a password reset are kept, as they still need to choose a new password
+func (a *Account) cancelPasswordReset(as AccountStorer) error {
+	if !a.ResetPasswordVerificationCode.Valid || a.PasswordResetRequired {
+		return nil
+	}
+	a.ResetPasswordVerificationCode = nullables.NullString{}
+	a.ResetPasswordCodeIssuedAt = nullables.NullTime{}
+	return as.SaveAccount(a)
+}
+
 func CheckAndCreateAccount(as AccountStorer, email string, password string, nickname string) error {
 	//check if account is valid
 
 	a := &Account{
 		Nickname: nickname,
 		Email:    email,
-		VoteBank: 10,
+		VoteBank: NewAccountVoteBank,
+		Role:     RoleMember,
 	}
 
 	if err := CanAccountBeMade(as, a, password); err != nil {
@@ -188,49 +250,97 @@ func CheckAndCreateAccount(as AccountStorer, email string, password string, nick
 	if a.VerificationCode, err = GenerateValidationKey(); err != nil {
 		return err
 	}
+	a.VerificationCodeIssuedAt = nullables.NullTime{Time: time.Now(), Valid: true}
 
 	//create account, send validation email
 	if err = as.CreateAccount(a); err != nil {
 		return err
 	}
 
-	sendEmail(a.Email, "Verification code", "Hello!\r\n\r\nTo validate your hey.fyi account, you need to follow this link:\r\nhttp://hey.fyi/verify/"+strconv.FormatInt(a.Id, 10)+"/"+a.VerificationCode.String+"\r\n\r\nI hope you enjoy using the service!\r\n\r\nRegards,\r\nhey.fyi")
+	sendVerificationEmail(a)
+	return nil
+}
+
+func sendVerificationEmail(a *Account) {
+	sendEmail(a.Email, "Verification code", "Hello!\r\n\r\nTo validate your hey.fyi account, you need to follow this link:\r\nhttp://hey.fyi/verify/"+strconv.FormatInt(a.Id, 10)+"/"+a.VerificationCode.String+"\r\n\r\nThe link will work for 7 days. I hope you enjoy using the service!\r\n\r\nRegards,\r\nhey.fyi")
 	log.Printf("Verification code for user %s is %s\n", a.Email, a.VerificationCode.String)
+}
+
+//Emails the account's owner, eg to tell them what happened to a fact they submitted
+func (a *Account) SendEmail(subject string, message string) error {
+	return sendEmail(a.Email, subject, message)
+}
+
+//Sends a new verification link to an account that hasn't been verified yet. The old link stops working
+//Returns CodeSentTooRecently if one was sent less than ResendCodeCooldown ago
+func ResendVerificationCode(as AccountStorer, email string, now time.Time) error {
+	a, err := as.LoadAccountFromEmail(email)
+	if err != nil {
+		return err
+	}
+	if !a.VerificationCode.Valid {
+		return AccountDoesNotNeedVerification
+	}
+	if codeSentRecently(a.VerificationCodeIssuedAt, now) {
+		return CodeSentTooRecently
+	}
 
+	if a.VerificationCode, err = GenerateValidationKey(); err != nil {
+		return err
+	}
+	a.VerificationCodeIssuedAt = nullables.NullTime{Time: now, Valid: true}
+	if err := as.SaveAccount(a); err != nil {
+		return err
+	}
+
+	sendVerificationEmail(a)
 	return nil
 }
 
-func DoPasswordResetRequestIfPossible(as AccountStorer, email string) error {
+//Sends a password reset link to the account with the given email address, if there is one
+//Returns CodeSentTooRecently if one was sent less than ResendCodeCooldown ago
+func DoPasswordResetRequestIfPossible(as AccountStorer, email string, now time.Time) error {
 	a, err := as.LoadAccountFromEmail(email)
 	if err != nil {
 		return err
 	}
+	if codeSentRecently(a.ResetPasswordCodeIssuedAt, now) {
+		return CodeSentTooRecently
+	}
 
 	if a.ResetPasswordVerificationCode, err = GenerateValidationKey(); err != nil {
 		return err
 	}
+	a.ResetPasswordCodeIssuedAt = nullables.NullTime{Time: now, Valid: true}
+	if err := as.SaveAccount(a); err != nil {
+		return err
+	}
 
-	sendEmail(a.Email, "Password Reset Request", "Hello!\r\n\r\nSomeone requested a password reset to your hey.fyi account.\r\nIf you didn't request this, simply ignore this email.\r\n\r\nOtherwise, follow this link:\r\nhttp://hey.fyi/reset/"+strconv.FormatInt(a.Id, 10)+"/"+a.ResetPasswordVerificationCode.String+"\r\n\r\nRegards,\r\nhey.fyi")
-	log.Printf("Reset Password verification code for user %s is %s\n", a.Email, a.VerificationCode.String)
+	sendEmail(a.Email, "Password Reset Request", "Hello!\r\n\r\nSomeone requested a password reset to your hey.fyi account.\r\nIf you didn't request this, simply ignore this email.\r\n\r\nOtherwise, follow this link within the next hour:\r\nhttp://hey.fyi/reset/"+strconv.FormatInt(a.Id, 10)+"/"+a.ResetPasswordVerificationCode.String+"\r\n\r\nRegards,\r\nhey.fyi")
+	log.Printf("Reset Password verification code for user %s is %s\n", a.Email, a.ResetPasswordVerificationCode.String)
 
-	return as.SaveAccount(a)
+	return nil
 }
 
 func (a Account) Valid() error {
 	return validator.Validate(a)
 }
 
-func (a *Account) ApplyVerificationCode(as AccountStorer, verificationCode string) error {
+func (a *Account) ApplyVerificationCode(as AccountStorer, verificationCode string, now time.Time) error {
 	if a.VerificationCode.Valid == false {
 		return AccountDoesNotNeedVerification
 	}
 
-	if a.VerificationCode.String != verificationCode {
+	if !codeMatches(a.VerificationCode, verificationCode) {
 		return AccountVerificationCodeNotMatch
 	}
 
-	a.VerificationCode.String = ""
-	a.VerificationCode.Valid = false
+	if codeExpired(a.VerificationCodeIssuedAt, VerificationCodeLifetime, now) {
+		return VerificationCodeExpired
+	}
+
+	a.VerificationCode = nullables.NullString{}
+	a.VerificationCodeIssuedAt = nullables.NullTime{}
 
 	return as.SaveAccount(a)
 }
@@ -239,31 +349,49 @@ func (a *Account) AwaitingPasswordReset() bool {
 	return a.ResetPasswordVerificationCode.Valid
 }
 
-func (a *Account) ApplyPasswordResetVerificationCode(as AccountStorer, resetVerificationCode string, newPassword string) error {
+//Checks a code from a password reset link, without using it up
+func (a *Account) CheckPasswordResetCode(resetVerificationCode string, now time.Time) error {
 	if a.AwaitingPasswordReset() == false {
 		return AccountPasswordResetNotRequested
 	}
 
-	if a.ResetPasswordVerificationCode.String != resetVerificationCode {
+	if !codeMatches(a.ResetPasswordVerificationCode, resetVerificationCode) {
 		return AccountVerificationCodeNotMatch
 	}
 
+	if codeExpired(a.ResetPasswordCodeIssuedAt, ResetPasswordCodeLifetime, now) {
+		return PasswordResetCodeExpired
+	}
+	return nil
+}
+
+//Sets a new password using the code from a password reset link. The code can only be used once
+func (a *Account) ApplyPasswordResetVerificationCode(as AccountStorer, resetVerificationCode string, newPassword string, now time.Time) error {
+	if err := a.CheckPasswordResetCode(resetVerificationCode, now); err != nil {
+		return err
+	}
+
 	if !IsPasswordAcceptable(newPassword) {
 		return PasswordNotAcceptable
 	}
 
+	//this also clears the reset code
 	if err := a.SetPassword(newPassword); err != nil {
 		return err
 	}
 
-	a.ResetPasswordVerificationCode.String = ""
-	a.ResetPasswordVerificationCode.Valid = false
-
 	return as.SaveAccount(a)
 }
 
+//Returns true if voting up (or down) on a fact that the account has currently voted currentAccountVote on
+//will cost a vote from the bank, and false if it retracts one of their earlier votes (which is refunded)
+func IsCastingVote(up bool, currentAccountVote int64) bool {
+	return (up && currentAccountVote >= 0) || (!up && currentAccountVote <= 0)
+}
+
+//Note that this isn't atomic with recording the vote itself - the server uses AnyStorer.CastVote instead
 func (a *Account) UpdateVoteBank(as AccountStorer, up bool, currentAccountVote int64) error {
-	if (up && currentAccountVote >= 0) || (!up && currentAccountVote <= 0) { //they are casting a vote
+	if IsCastingVote(up, currentAccountVote) { //they are casting a vote
 		if a.VoteBank <= 0 {
 			return NoVotesLeft
 		} else {
@@ -275,12 +403,3 @@ func (a *Account) UpdateVoteBank(as AccountStorer, up bool, currentAccountVote i
 	a.VoteBank++
 	return as.SaveAccount(a)
 }
-
-func (a *Account) ExpireSession(as AccountStorer) error {
-	a.CurrentSession.Valid = false
-	a.CurrentSession.String = ""
-
-	a.SessionExpires.Time = time.Now()
-
-	return as.SaveAccount(a)
-}
@@ -10,6 +10,7 @@ import (
 
 type DummyAccountStorer struct {
 	OnlyAccount *Account
+	Sessions    map[int64]Session //must be made before starting sessions
 }
 
 func (d DummyAccountStorer) LoadAccountFromEmail(email string) (*Account, error) {
@@ -23,8 +24,13 @@ func (d DummyAccountStorer) LoadAccountFromId(id int64) (*Account, error) {
 	return d.OnlyAccount, nil
 }
 
-func (d DummyAccountStorer) LoadAccountFromSession(sessionId string) (*Account, error) {
-	return d.OnlyAccount, nil
+func (d DummyAccountStorer) LoadAccountFromSession(tokenHash string) (*Account, *Session, error) {
+	for _, s := range d.Sessions {
+		if s.TokenHash == tokenHash {
+			return d.OnlyAccount, &s, nil
+		}
+	}
+	return nil, nil, gorm.RecordNotFound
 }
 func (d DummyAccountStorer) CreateAccount(a *Account) error {
 	d.OnlyAccount = a
@@ -34,44 +40,93 @@ func (d DummyAccountStorer) SaveAccount(a *Account) error {
 	d.OnlyAccount = a
 	return nil
 }
+func (d DummyAccountStorer) ListAccountsWithRole(role Role) ([]Account, error) {
+	if d.OnlyAccount.Role == role {
+		return []Account{*d.OnlyAccount}, nil
+	}
+	return nil, nil
+}
+func (d DummyAccountStorer) ListAccounts(q AccountQuery) (*AccountPage, error) {
+	return &AccountPage{Query: q.Normalised(), Accounts: []AccountSummary{{Account: *d.OnlyAccount}}, Total: 1}, nil
+}
+func (d DummyAccountStorer) CreateSession(s *Session) error {
+	for id := range d.Sessions {
+		if id >= s.Id {
+			s.Id = id + 1
+		}
+	}
+	if s.Id == 0 {
+		s.Id = 1
+	}
+	d.Sessions[s.Id] = *s
+	return nil
+}
+func (d DummyAccountStorer) SaveSession(s *Session) error {
+	d.Sessions[s.Id] = *s
+	return nil
+}
+func (d DummyAccountStorer) ListSessions(accountId int64) ([]Session, error) {
+	var sessions []Session
+	for _, s := range d.Sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+func (d DummyAccountStorer) DeleteSession(accountId int64, sessionId int64) error {
+	if _, ok := d.Sessions[sessionId]; !ok {
+		return SessionNotFound
+	}
+	delete(d.Sessions, sessionId)
+	return nil
+}
+func (d DummyAccountStorer) DeleteAllSessions(accountId int64) error {
+	for id := range d.Sessions {
+		delete(d.Sessions, id)
+	}
+	return nil
+}
+func (d DummyAccountStorer) DeleteExpiredSessions(accountId int64, now time.Time) error {
+	for id, s := range d.Sessions {
+		if s.Expired(now) {
+			delete(d.Sessions, id)
+		}
+	}
+	return nil
+}
 
 var testStorage = DummyAccountStorer{
 	OnlyAccount: &Account{
 		Id:       1,
 		Email:    "test@test",
 		Password: "$2a$10$3NIEDlO7169hXn11bnIoGupnxlHmY7VB278/pxn4iIOFKqb8GGXaS", //bcrypt for "testing1+"
-		Admin:    true,
+		Role:     RoleAdmin,
 		Nickname: "Test account",
 		VoteBank: 10,
 	},
 }
 
 func TestAttemptLogin(t *testing.T) {
-	account, err := AttemptLogin(testStorage, "test@test", "not_testing1+", true)
+	account, err := AttemptLogin(testStorage, "test@test", "not_testing1+")
 	if err == nil {
 		t.Fatal("Incorrect password logged in")
 	} else if err != InvalidUsernameOrPassword {
 		t.Fatal("Incorrect password not logged in but wrong error message: " + err.Error())
 	}
 
-	account, err = AttemptLogin(testStorage, "not_test@test", "testing1+", true)
+	account, err = AttemptLogin(testStorage, "not_test@test", "testing1+")
 	if err == nil {
 		t.Fatal("Incorrect email logged in")
 	} else if err != InvalidUsernameOrPassword {
 		t.Fatal("Incorrect email not logged in but wrong error message: " + err.Error())
 	}
 
-	account, err = AttemptLogin(testStorage, "test@test", "testing1+", true)
+	account, err = AttemptLogin(testStorage, "test@test", "testing1+")
 	if err != nil {
 		t.Fatal("Correct email/password did not log in")
 	}
 
-	if account.CurrentSession.Valid == false || len(account.CurrentSession.String) != 32 {
-		t.Fatalf("Logging in did not set current session correctly: %+v", account.CurrentSession)
-	}
-
-	if account.SessionExpires.Valid == false {
-		t.Fatalf("Logging in did not set session expires correctly: %+v", account.SessionExpires)
+	if account != testStorage.OnlyAccount {
+		t.Fatalf("Logging in did not return the account: %+v", account)
 	}
 }
 
@@ -139,42 +194,145 @@ func TestCanAccountBeMade(t *testing.T) {
 
 func TestApplyVerificationCode(t *testing.T) {
 	account := testStorage.OnlyAccount
+	now := time.Now()
 
-	if err := account.ApplyVerificationCode(testStorage, "not_the_verification_code"); err != AccountDoesNotNeedVerification {
+	if err := account.ApplyVerificationCode(testStorage, "not_the_verification_code", now); err != AccountDoesNotNeedVerification {
 		t.Fatal("Verification code incorrectly able to be applied or incorrect error returned (account should not need verification) - Actual error: ", err)
 	}
 	var err error
 	if account.VerificationCode, err = GenerateValidationKey(); err != nil {
 		t.Fatal("Generating Validation Key failed:", err.Error())
 	}
+	account.VerificationCodeIssuedAt = nullables.NullTime{Time: now, Valid: true}
 
-	if err := account.ApplyVerificationCode(testStorage, "not_the_verification_code"); err != AccountVerificationCodeNotMatch {
+	if err := account.ApplyVerificationCode(testStorage, "not_the_verification_code", now); err != AccountVerificationCodeNotMatch {
 		t.Fatal("Verification code incorrectly able to be applied or incorrect error returned (verification code should not match) - Actual error: ", err)
 	}
 
-	if err := account.ApplyVerificationCode(testStorage, account.VerificationCode.String); err != nil {
+	if err := account.ApplyVerificationCode(testStorage, account.VerificationCode.String, now); err != nil {
 		t.Fatal("Verification code incorrectly not be able to be applied - Actual error: ", err)
 	}
 }
 
 func TestApplyPasswordResetVerificationCode(t *testing.T) {
 	account := testStorage.OnlyAccount
+	now := time.Now()
 
-	if err := account.ApplyPasswordResetVerificationCode(testStorage, "not_the_verification_code", "rtyrty1+"); err != AccountPasswordResetNotRequested {
+	if err := account.ApplyPasswordResetVerificationCode(testStorage, "not_the_verification_code", "rtyrty1+", now); err != AccountPasswordResetNotRequested {
 		t.Fatal("Password Reset Verification code incorrectly able to be applied or incorrect error returned (account should not need password reset) - Actual error: ", err)
 	}
 	var err error
 	if account.ResetPasswordVerificationCode, err = GenerateValidationKey(); err != nil {
 		t.Fatal("Generating Validation Key failed:", err.Error())
 	}
+	account.ResetPasswordCodeIssuedAt = nullables.NullTime{Time: now, Valid: true}
 
-	if err := account.ApplyPasswordResetVerificationCode(testStorage, "not_the_verification_code", "rtyrty1+"); err != AccountVerificationCodeNotMatch {
+	if err := account.ApplyPasswordResetVerificationCode(testStorage, "not_the_verification_code", "rtyrty1+", now); err != AccountVerificationCodeNotMatch {
 		t.Fatal("Password Reset Verification code incorrectly able to be applied or incorrect error returned (verification code should not match) - Actual error: ", err)
 	}
 
-	if err := account.ApplyPasswordResetVerificationCode(testStorage, account.ResetPasswordVerificationCode.String, "rtyrty1+"); err != nil {
+	code := account.ResetPasswordVerificationCode.String
+	if err := account.ApplyPasswordResetVerificationCode(testStorage, code, "rtyrty1+", now); err != nil {
 		t.Fatal("Password Reset Verification code incorrectly not be able to be applied - Actual error: ", err)
 	}
+
+	if err := account.ApplyPasswordResetVerificationCode(testStorage, code, "hjkYUO12", now); err != AccountPasswordResetNotRequested {
+		t.Fatal("Password Reset Verification code was able to be used twice - Actual error: ", err)
+	}
+}
+
+func TestVerificationCodeExpiry(t *testing.T) {
+	a := &Account{Id: 4, Email: "verify@test", Nickname: "Verify"}
+	as := DummyAccountStorer{OnlyAccount: a}
+	issued := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	a.VerificationCode, _ = GenerateValidationKey()
+	a.VerificationCodeIssuedAt = nullables.NullTime{Time: issued, Valid: true}
+
+	if err := a.ApplyVerificationCode(as, a.VerificationCode.String, issued.Add(VerificationCodeLifetime)); err != VerificationCodeExpired {
+		t.Fatal("An expired verification code was accepted, got ", err)
+	}
+
+	//resending is only allowed once the cooldown has passed, and the old code stops working
+	if err := ResendVerificationCode(as, "verify@test", issued.Add(time.Minute)); err != CodeSentTooRecently {
+		t.Fatal("A verification code was resent during the cooldown, got ", err)
+	}
+	old := a.VerificationCode.String
+	resent := issued.Add(VerificationCodeLifetime + time.Minute)
+	if err := ResendVerificationCode(as, "verify@test", resent); err != nil {
+		t.Fatal("ResendVerificationCode failed: ", err)
+	}
+	if a.VerificationCode.String == old || !a.VerificationCodeIssuedAt.Time.Equal(resent) {
+		t.Fatalf("ResendVerificationCode did not issue a new code: %+v", a)
+	}
+	if err := a.ApplyVerificationCode(as, old, resent); err != AccountVerificationCodeNotMatch {
+		t.Fatal("The old verification code still works after a new one was sent, got ", err)
+	}
+	if err := a.ApplyVerificationCode(as, a.VerificationCode.String, resent.Add(time.Hour)); err != nil {
+		t.Fatal("The new verification code was not accepted: ", err)
+	}
+
+	if err := ResendVerificationCode(as, "verify@test", resent.Add(time.Hour)); err != AccountDoesNotNeedVerification {
+		t.Fatal("A verification code was sent to a verified account, got ", err)
+	}
+
+	//codes from before they had issue times have expired
+	a.VerificationCode, _ = GenerateValidationKey()
+	a.VerificationCodeIssuedAt = nullables.NullTime{}
+	if err := a.ApplyVerificationCode(as, a.VerificationCode.String, resent); err != VerificationCodeExpired {
+		t.Fatal("A verification code without an issue time was accepted, got ", err)
+	}
+}
+
+func TestPasswordResetCodeExpiry(t *testing.T) {
+	a := &Account{Id: 4, Email: "reset@test", Nickname: "Reset"}
+	as := DummyAccountStorer{OnlyAccount: a}
+	requested := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := DoPasswordResetRequestIfPossible(as, "reset@test", requested); err != nil {
+		t.Fatal("DoPasswordResetRequestIfPossible failed: ", err)
+	}
+	code := a.ResetPasswordVerificationCode.String
+	if err := DoPasswordResetRequestIfPossible(as, "reset@test", requested.Add(time.Minute)); err != CodeSentTooRecently || a.ResetPasswordVerificationCode.String != code {
+		t.Fatal("A password reset was sent again during the cooldown, got ", err)
+	}
+
+	if err := a.CheckPasswordResetCode(code, requested.Add(ResetPasswordCodeLifetime-time.Second)); err != nil {
+		t.Fatal("CheckPasswordResetCode rejected a good code: ", err)
+	}
+	if err := a.ApplyPasswordResetVerificationCode(as, code, "rtyrty1+", requested.Add(ResetPasswordCodeLifetime)); err != PasswordResetCodeExpired {
+		t.Fatal("An expired password reset code was accepted, got ", err)
+	}
+}
+
+func TestSignInCancelsPasswordReset(t *testing.T) {
+	a := &Account{Id: 4, Email: "cancel@test", Nickname: "Cancel"}
+	if err := a.SetPassword("testing1+"); err != nil {
+		t.Fatal(err)
+	}
+	as := DummyAccountStorer{OnlyAccount: a}
+	now := time.Now()
+
+	if err := DoPasswordResetRequestIfPossible(as, "cancel@test", now); err != nil {
+		t.Fatal("DoPasswordResetRequestIfPossible failed: ", err)
+	}
+	code := a.ResetPasswordVerificationCode.String
+	if _, err := AttemptLogin(as, "cancel@test", "testing1+"); err != nil {
+		t.Fatal("AttemptLogin failed: ", err)
+	}
+	if err := a.CheckPasswordResetCode(code, now); err != AccountPasswordResetNotRequested {
+		t.Fatal("A password reset code still works after signing in, got ", err)
+	}
+
+	if err := DoPasswordResetRequestIfPossible(as, "cancel@test", now.Add(ResendCodeCooldown)); err != nil {
+		t.Fatal("DoPasswordResetRequestIfPossible failed: ", err)
+	}
+	code = a.ResetPasswordVerificationCode.String
+	if err := a.SetPassword("hjkYUO12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CheckPasswordResetCode(code, now.Add(ResendCodeCooldown)); err != AccountPasswordResetNotRequested {
+		t.Fatal("A password reset code still works after the password was changed, got ", err)
+	}
 }
 
 func TestUpdateVoteBank(t *testing.T) {
@@ -201,17 +359,3 @@ func TestUpdateVoteBank(t *testing.T) {
 		t.Fatal("Refunding a vote did not increment vote bank correctly.")
 	}
 }
-
-func TestExpireSession(t *testing.T) {
-	account := testStorage.OnlyAccount
-	account.CurrentSession = nullables.NullString{String: "some_session_id", Valid: true}
-	account.SessionExpires = nullables.NullTime{Time: time.Now().AddDate(0, 0, -1), Valid: true}
-
-	account.ExpireSession(testStorage)
-
-	time.Sleep(10 * time.Millisecond) //get some time to pass
-
-	if account.CurrentSession.Valid == true || !account.SessionExpires.Time.Before(time.Now()) {
-		t.Fatal("Session not expired correctly")
-	}
-}
@@ -0,0 +1,245 @@
+package account
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/kiwih/nullables"
+)
+
+const (
+	DefaultAccountPageSize = 50
+	MaxAccountPageSize     = 200
+
+	maxSuspensionReasonLength = 255
+)
+
+//AccountQuery describes one page of the admin's account listing
+type AccountQuery struct {
+	Search   string //matched against email addresses and nicknames, or "" for every account
+	Page     int    //starting from 1
+	PageSize int
+}
+
+//AccountSummary is an account along with how much it has done, as listed for admins
+type AccountSummary struct {
+	Account
+	FactsSubmitted int64
+	VotesCast      int64 //the votes it currently has on facts, which is what it has spent from its vote bank
+}
+
+//AccountPage is one page of accounts returned by ListAccounts (in order of email address), along with how many matched in total
+type AccountPage struct {
+	Query    AccountQuery
+	Accounts []AccountSummary
+	Total    int64
+}
+
+//Returns the query with the page and page size set to sensible values if they were missing or out of range
+func (q AccountQuery) Normalised() AccountQuery {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = DefaultAccountPageSize
+	}
+	if q.PageSize > MaxAccountPageSize {
+		q.PageSize = MaxAccountPageSize
+	}
+	return q
+}
+
+//The number of accounts to skip before this page starts
+func (q AccountQuery) Offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+//The number of pages needed for every matching account
+func (p AccountPage) Pages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.Query.PageSize) - 1) / int64(p.Query.PageSize))
+}
+
+func (p AccountPage) HasPrevious() bool {
+	return p.Query.Page > 1
+}
+
+func (p AccountPage) HasNext() bool {
+	return p.Query.Page < p.Pages()
+}
+
+func (p AccountPage) PreviousPage() int {
+	return p.Query.Page - 1
+}
+
+func (p AccountPage) NextPage() int {
+	return p.Query.Page + 1
+}
+
+//AccountSuspendedError is returned when a suspended or banned account tries to sign in or use a session
+type AccountSuspendedError struct {
+	Until  time.Time //zero if the account is banned
+	Reason string
+}
+
+func (e *AccountSuspendedError) Error() string {
+	msg := "This account has been banned."
+	if !e.Until.IsZero() {
+		msg = "This account has been suspended until " + e.Until.UTC().Format("2 Jan 2006 15:04 MST") + "."
+	}
+	if e.Reason != "" {
+		msg += " Reason: " + e.Reason
+	}
+	return msg
+}
+
+var (
+	PasswordResetRequired   error = errors.New("You need to choose a new password before you can sign in. We've emailed you a link to do so, or you can ask for another one.")
+	CannotManageOwnAccount  error = errors.New("You can't do that to your own account.")
+	SuspensionReasonMissing error = errors.New("Please give a reason, as it is shown to them when they try to sign in.")
+	SuspensionReasonTooLong error = errors.New("The reason can't be longer than 255 characters.")
+	SuspensionTooShort      error = errors.New("A suspension has to end in the future.")
+)
+
+//Returns an *AccountSuspendedError if the account is banned or suspended at time now, and nil otherwise
+func (a *Account) Suspension(now time.Time) error {
+	if a.Banned {
+		return &AccountSuspendedError{Reason: a.SuspensionReason}
+	}
+	if a.SuspendedUntil.Valid && now.Before(a.SuspendedUntil.Time) {
+		return &AccountSuspendedError{Until: a.SuspendedUntil.Time, Reason: a.SuspensionReason}
+	}
+	return nil
+}
+
+//Returns true if the account is banned, or suspended at time now
+func (a *Account) Suspended(now time.Time) bool {
+	return a.Suspension(now) != nil
+}
+
+//Returns true if the account hasn't followed the link in its verification email yet
+func (a *Account) AwaitingVerification() bool {
+	return a.VerificationCode.Valid
+}
+
+//Checks that changedBy is allowed to manage a, which they can't do to themselves
+func (a *Account) checkManagedBy(changedBy *Account) error {
+	if !changedBy.Can(ManageUsers) {
+		return NotAllowedToManageUsers
+	}
+	if a.Id == changedBy.Id {
+		return CannotManageOwnAccount
+	}
+	return nil
+}
+
+func checkSuspensionReason(reason string) error {
+	if reason == "" {
+		return SuspensionReasonMissing
+	}
+	if len(reason) > maxSuspensionReasonLength {
+		return SuspensionReasonTooLong
+	}
+	return nil
+}
+
+//Verifies the account for its owner, as if they had followed the link in their verification email
+func (a *Account) VerifyFor(as AccountStorer, changedBy *Account) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	if !a.AwaitingVerification() {
+		return AccountDoesNotNeedVerification
+	}
+	a.VerificationCode = nullables.NullString{}
+	a.VerificationCodeIssuedAt = nullables.NullTime{}
+	return as.SaveAccount(a)
+}
+
+//Stops the account from being used until the given time. Its sessions are kept, but LoadSession rejects them (with the
+//reason) until then, so that it is signed out with an explanation rather than just finding itself signed out
+func (a *Account) Suspend(as AccountStorer, until time.Time, reason string, changedBy *Account, now time.Time) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	if err := checkSuspensionReason(reason); err != nil {
+		return err
+	}
+	if !until.After(now) {
+		return SuspensionTooShort
+	}
+	a.SuspendedUntil = nullables.NullTime{Time: until, Valid: true}
+	a.SuspensionReason = reason
+	return as.SaveAccount(a)
+}
+
+//Stops the account from ever being used again (unless it is reinstated). Like Suspend, its sessions stop working
+func (a *Account) Ban(as AccountStorer, reason string, changedBy *Account) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	if err := checkSuspensionReason(reason); err != nil {
+		return err
+	}
+	a.Banned = true
+	a.SuspendedUntil = nullables.NullTime{}
+	a.SuspensionReason = reason
+	return as.SaveAccount(a)
+}
+
+//Lifts a suspension or ban
+func (a *Account) Reinstate(as AccountStorer, changedBy *Account) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	a.Banned = false
+	a.SuspendedUntil = nullables.NullTime{}
+	a.SuspensionReason = ""
+	return as.SaveAccount(a)
+}
+
+//Puts the account's vote bank back to what new accounts start with
+func (a *Account) ResetVoteBank(as AccountStorer, changedBy *Account) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	a.VoteBank = NewAccountVoteBank
+	return as.SaveAccount(a)
+}
+
+//Makes the account's owner choose a new password before they can sign in again, eg if their password may have leaked
+//They are signed out everywhere and sent a password reset link
+func (a *Account) ForcePasswordReset(as AccountStorer, changedBy *Account, now time.Time) error {
+	if err := a.checkManagedBy(changedBy); err != nil {
+		return err
+	}
+	code, err := GenerateValidationKey()
+	if err != nil {
+		return err
+	}
+	a.PasswordResetRequired = true
+	a.ResetPasswordVerificationCode = code
+	a.ResetPasswordCodeIssuedAt = nullables.NullTime{Time: now, Valid: true}
+	if err := as.SaveAccount(a); err != nil {
+		return err
+	}
+	if err := a.EndAllSessions(as); err != nil {
+		return err
+	}
+
+	sendEmail(a.Email, "Please choose a new password", "Hello!\r\n\r\nAn administrator of hey.fyi has asked you to choose a new password for your account before you sign in again.\r\n\r\nTo do so, follow this link within the next hour:\r\nhttp://hey.fyi/reset/"+strconv.FormatInt(a.Id, 10)+"/"+a.ResetPasswordVerificationCode.String+"\r\n\r\nIf the link has expired, you can ask for another one with \"Forgot Password?\".\r\n\r\nRegards,\r\nhey.fyi")
+	log.Printf("Forced password reset code for user %s is %s\n", a.Email, a.ResetPasswordVerificationCode.String)
+	return nil
+}
+
+//Signs the account out everywhere, as an admin
+func (a *Account) ExpireSessions(as AccountStorer, changedBy *Account) error {
+	if !changedBy.Can(ManageUsers) {
+		return NotAllowedToManageUsers
+	}
+	return a.EndAllSessions(as)
+}
@@ -0,0 +1,111 @@
+package account
+
+import (
+	"testing"
+	"time"
+)
+
+func newManagedAccount(t *testing.T) (*Account, DummyAccountStorer) {
+	a := &Account{Id: 7, Email: "managed@test", Nickname: "Managed", Role: RoleMember, VoteBank: 2}
+	if err := a.SetPassword("testing1+"); err != nil {
+		t.Fatal("SetPassword failed: ", err)
+	}
+	return a, DummyAccountStorer{OnlyAccount: a, Sessions: make(map[int64]Session)}
+}
+
+func TestSuspend(t *testing.T) {
+	a, as := newManagedAccount(t)
+	admin := &Account{Id: 1, Role: RoleAdmin}
+	now := time.Now()
+
+	token, _, err := a.StartSession(as, false, "laptop", "203.0.113.1", now)
+	if err != nil {
+		t.Fatal("StartSession failed: ", err)
+	}
+
+	if err := a.Suspend(as, now.Add(time.Hour), "Spamming", &Account{Id: 2, Role: RoleModerator}, now); err != NotAllowedToManageUsers {
+		t.Fatal("A moderator suspended an account, got ", err)
+	}
+	if err := admin.Suspend(as, now.Add(time.Hour), "Spamming", admin, now); err != CannotManageOwnAccount {
+		t.Fatal("An admin suspended themselves, got ", err)
+	}
+	if err := a.Suspend(as, now.Add(time.Hour), "", admin, now); err != SuspensionReasonMissing {
+		t.Fatal("An account was suspended without a reason, got ", err)
+	}
+	if err := a.Suspend(as, now.Add(time.Hour), "Spamming", admin, now); err != nil {
+		t.Fatal("Suspend failed: ", err)
+	}
+	_, err = AttemptLogin(as, "managed@test", "testing1+")
+	suspended, ok := err.(*AccountSuspendedError)
+	if !ok || suspended.Reason != "Spamming" || !suspended.Until.Equal(now.Add(time.Hour)) {
+		t.Fatal("A suspended account signed in, got ", err)
+	}
+
+	if _, _, err := LoadSession(as, token, "203.0.113.1", now); err == nil {
+		t.Fatal("LoadSession returned a suspended account")
+	}
+	if _, _, err := LoadSession(as, token, "203.0.113.1", now.Add(2*time.Hour)); err != nil {
+		t.Fatal("The suspension did not end, got ", err)
+	}
+
+	if err := a.Reinstate(as, admin); err != nil || a.Suspended(now) {
+		t.Fatal("Reinstate failed: ", err)
+	}
+	if _, err := AttemptLogin(as, "managed@test", "testing1+"); err != nil {
+		t.Fatal("A reinstated account could not sign in, got ", err)
+	}
+}
+
+func TestBan(t *testing.T) {
+	a, as := newManagedAccount(t)
+	admin := &Account{Id: 1, Role: RoleAdmin}
+
+	if err := a.Ban(as, "Abuse", admin); err != nil {
+		t.Fatal("Ban failed: ", err)
+	}
+	if err, ok := a.Suspension(time.Now().AddDate(10, 0, 0)).(*AccountSuspendedError); !ok || !err.Until.IsZero() {
+		t.Fatal("A ban ended, got ", err)
+	}
+	if _, err := AttemptLogin(as, "managed@test", "testing1+"); err == nil || err.Error() != "This account has been banned. Reason: Abuse" {
+		t.Fatal("A banned account signed in, got ", err)
+	}
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	a, as := newManagedAccount(t)
+	admin := &Account{Id: 1, Role: RoleAdmin}
+	now := time.Now()
+
+	if err := a.ForcePasswordReset(as, admin, now); err != nil {
+		t.Fatal("ForcePasswordReset failed: ", err)
+	}
+	if _, err := AttemptLogin(as, "managed@test", "testing1+"); err != PasswordResetRequired {
+		t.Fatal("An account that has to choose a new password signed in with its old one, got ", err)
+	}
+	if err := a.cancelPasswordReset(as); err != nil || !a.AwaitingPasswordReset() {
+		t.Fatal("A forced password reset was cancelled")
+	}
+
+	if err := a.ApplyPasswordResetVerificationCode(as, a.ResetPasswordVerificationCode.String, "testing2+", now); err != nil {
+		t.Fatal("ApplyPasswordResetVerificationCode failed: ", err)
+	}
+	if _, err := AttemptLogin(as, "managed@test", "testing2+"); err != nil {
+		t.Fatal("The account could not sign in with its new password, got ", err)
+	}
+}
+
+func TestVerifyForAndResetVoteBank(t *testing.T) {
+	a, as := newManagedAccount(t)
+	a.VerificationCode, _ = GenerateValidationKey()
+	admin := &Account{Id: 1, Role: RoleAdmin}
+
+	if err := a.VerifyFor(as, admin); err != nil || a.AwaitingVerification() {
+		t.Fatal("VerifyFor failed: ", err)
+	}
+	if err := a.VerifyFor(as, admin); err != AccountDoesNotNeedVerification {
+		t.Fatal("VerifyFor verified an account twice, got ", err)
+	}
+	if err := a.ResetVoteBank(as, admin); err != nil || a.VoteBank != NewAccountVoteBank {
+		t.Fatal("ResetVoteBank failed: ", err)
+	}
+}
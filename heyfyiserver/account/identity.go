@@ -0,0 +1,139 @@
+package account
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiwih/nullables"
+)
+
+//An ExternalIdentity links an account to someone at an identity provider, so that they can sign in with it instead of a password
+type ExternalIdentity struct {
+	Id         int64
+	AccountId  int64
+	Issuer     string `sql:"type:varchar(255)"`
+	Subject    string `sql:"type:varchar(255)"` //the provider's id for them, which (unlike their email address) never changes
+	Email      string `sql:"type:varchar(60)"`  //the address it was linked by
+	CreatedAt  nullables.NullTime
+	LastUsedAt nullables.NullTime
+}
+
+//ExternalIdentityStorer is what signing in with an identity provider needs from a storage backend
+type ExternalIdentityStorer interface {
+	LoadExternalIdentity(issuer string, subject string) (*ExternalIdentity, error)
+	CreateExternalIdentity(*ExternalIdentity) error
+	SaveExternalIdentity(*ExternalIdentity) error
+}
+
+//ExternalLogin is what an identity provider says about someone who has just signed in with it
+type ExternalLogin struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+var (
+	ExternalEmailNotVerified error = errors.New("Your identity provider hasn't verified your email address, so it can't be used to sign in to hey.fyi.")
+)
+
+//Signs in someone who has signed in with an identity provider. If they haven't signed in with it before, their identity
+//is linked to the account with the same (verified) email address, or a new account is made for them
+//Returns true if a new account was made. Like AttemptLogin, SecondFactorRequired is returned (with the account) for accounts
+//with two factor authentication, and the caller should start a session with StartSession otherwise
+func AttemptExternalLogin(as AccountStorer, is ExternalIdentityStorer, login ExternalLogin, now time.Time) (*Account, bool, error) {
+	if identity, err := is.LoadExternalIdentity(login.Issuer, login.Subject); err == nil {
+		a, err := as.LoadAccountFromId(identity.AccountId)
+		if err != nil {
+			return nil, false, err
+		}
+		identity.LastUsedAt = nullables.NullTime{Time: now, Valid: true}
+		if err := is.SaveExternalIdentity(identity); err != nil {
+			return nil, false, err
+		}
+		return finishExternalLogin(as, a, false)
+	}
+
+	//their email address can only be trusted to link them to an account if the provider has checked it
+	email := strings.TrimSpace(login.Email)
+	if email == "" || !login.EmailVerified {
+		return nil, false, ExternalEmailNotVerified
+	}
+
+	created := false
+	a, err := as.LoadAccountFromEmail(email)
+	if err != nil {
+		if a, err = createExternalAccount(as, email, login.Name); err != nil {
+			return nil, false, err
+		}
+		created = true
+	} else if a.VerificationCode.Valid {
+		//the provider has verified their email address, so the link we sent isn't needed any more
+		a.VerificationCode = nullables.NullString{}
+		a.VerificationCodeIssuedAt = nullables.NullTime{}
+		if err := as.SaveAccount(a); err != nil {
+			return nil, false, err
+		}
+	}
+
+	identity := &ExternalIdentity{
+		AccountId:  a.Id,
+		Issuer:     login.Issuer,
+		Subject:    login.Subject,
+		Email:      email,
+		CreatedAt:  nullables.NullTime{Time: now, Valid: true},
+		LastUsedAt: nullables.NullTime{Time: now, Valid: true},
+	}
+	if err := is.CreateExternalIdentity(identity); err != nil {
+		return nil, false, err
+	}
+	return finishExternalLogin(as, a, created)
+}
+
+func finishExternalLogin(as AccountStorer, a *Account, created bool) (*Account, bool, error) {
+	//the provider vouches for who they are, so an admin asking for a new password doesn't stop them from signing in this way
+	if err := a.Suspension(time.Now()); err != nil {
+		return nil, false, err
+	}
+	if a.TwoFactorEnabled() {
+		return a, created, SecondFactorRequired
+	}
+	return a, created, a.cancelPasswordReset(as)
+}
+
+//Makes a verified account without a password for someone signing in with an identity provider
+//They can set a password later with a password reset if they want to sign in without it
+func createExternalAccount(as AccountStorer, email string, name string) (*Account, error) {
+	a := &Account{
+		Email:    email,
+		Nickname: externalNickname(email, name),
+		VoteBank: NewAccountVoteBank,
+		Role:     RoleMember,
+	}
+	if err := a.Valid(); err != nil {
+		return nil, err
+	}
+	if err := as.CreateAccount(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+//Returns a nickname for a new account from the name the provider gave (or the email address if it didn't), cut down to fit
+func externalNickname(email string, name string) string {
+	nickname := strings.TrimSpace(name)
+	if nickname == "" {
+		nickname = strings.SplitN(email, "@", 2)[0]
+	}
+	for len(nickname) > 15 {
+		_, size := utf8.DecodeLastRuneInString(nickname)
+		nickname = nickname[:len(nickname)-size]
+	}
+	if nickname = strings.TrimSpace(nickname); nickname == "" {
+		nickname = "Anonymous"
+	}
+	return nickname
+}
@@ -0,0 +1,119 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/nullables"
+)
+
+type DummyExternalIdentityStorer struct {
+	Identities map[string]*ExternalIdentity //by issuer and subject
+}
+
+func (d DummyExternalIdentityStorer) LoadExternalIdentity(issuer string, subject string) (*ExternalIdentity, error) {
+	if identity, ok := d.Identities[issuer+" "+subject]; ok {
+		copied := *identity
+		return &copied, nil
+	}
+	return nil, gorm.RecordNotFound
+}
+func (d DummyExternalIdentityStorer) CreateExternalIdentity(identity *ExternalIdentity) error {
+	identity.Id = int64(len(d.Identities) + 1)
+	return d.SaveExternalIdentity(identity)
+}
+func (d DummyExternalIdentityStorer) SaveExternalIdentity(identity *ExternalIdentity) error {
+	copied := *identity
+	d.Identities[identity.Issuer+" "+identity.Subject] = &copied
+	return nil
+}
+
+func TestAttemptExternalLoginLinksByEmail(t *testing.T) {
+	a := &Account{
+		Id:                       4,
+		Email:                    "linked@test",
+		Nickname:                 "Linked",
+		VerificationCode:         nullables.NullString{String: "not_used", Valid: true},
+		VerificationCodeIssuedAt: nullables.NullTime{Time: time.Now(), Valid: true},
+	}
+	as := DummyAccountStorer{OnlyAccount: a}
+	is := DummyExternalIdentityStorer{Identities: make(map[string]*ExternalIdentity)}
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	login := ExternalLogin{Issuer: "https://login.test", Subject: "abc", Email: "linked@test", Name: "Someone Else"}
+
+	if _, _, err := AttemptExternalLogin(as, is, login, now); err != ExternalEmailNotVerified {
+		t.Fatal("An unverified email address was used to link an account, got ", err)
+	}
+
+	login.EmailVerified = true
+	linked, created, err := AttemptExternalLogin(as, is, login, now)
+	if err != nil || linked != a || created {
+		t.Fatalf("AttemptExternalLogin did not link the account, got %+v, %v, %v", linked, created, err)
+	}
+	if a.VerificationCode.Valid || a.Nickname != "Linked" {
+		t.Fatalf("Linking the account did not verify it (or changed its nickname): %+v", a)
+	}
+	identity, err := is.LoadExternalIdentity("https://login.test", "abc")
+	if err != nil || identity.AccountId != a.Id || identity.Email != "linked@test" {
+		t.Fatalf("AttemptExternalLogin did not save the identity, got %+v, %v", identity, err)
+	}
+
+	//once it's linked, the identity is used even if their email address changes
+	later := now.Add(time.Hour)
+	login.Email = "changed@test"
+	login.EmailVerified = false
+	if signedIn, _, err := AttemptExternalLogin(as, is, login, later); err != nil || signedIn != a {
+		t.Fatalf("A linked identity could not sign in after its email address changed, got %+v, %v", signedIn, err)
+	}
+	if identity, _ := is.LoadExternalIdentity("https://login.test", "abc"); !identity.LastUsedAt.Time.Equal(later) {
+		t.Fatal("AttemptExternalLogin did not record when the identity was used")
+	}
+}
+
+func TestAttemptExternalLoginCreatesAccount(t *testing.T) {
+	as := DummyAccountStorer{OnlyAccount: &Account{Id: 1, Email: "someone@test"}}
+	is := DummyExternalIdentityStorer{Identities: make(map[string]*ExternalIdentity)}
+	login := ExternalLogin{Issuer: "https://login.test", Subject: "xyz", Email: "new@test", EmailVerified: true, Name: "A Very Long Name Indeed"}
+
+	a, created, err := AttemptExternalLogin(as, is, login, time.Now())
+	if err != nil || !created {
+		t.Fatalf("AttemptExternalLogin did not make an account, got %+v, %v, %v", a, created, err)
+	}
+	if a.Email != "new@test" || a.Nickname != "A Very Long Nam" || a.VoteBank != NewAccountVoteBank || a.VerificationCode.Valid || a.Role != RoleMember {
+		t.Fatalf("AttemptExternalLogin made the account wrong: %+v", a)
+	}
+	if _, err := AttemptLogin(as, "new@test", ""); err == nil {
+		t.Fatal("An account made by signing in with an identity provider can be signed in to without a password")
+	}
+}
+
+func TestAttemptExternalLoginWithSecondFactor(t *testing.T) {
+	a, as := newTwoFactorAccount(t)
+	now := time.Now()
+	code, _ := TotpCode(a.TotpSecret.String, now.Add(-time.Minute))
+	if _, err := a.EnableTwoFactor(as, code, now.Add(-time.Minute)); err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+	is := DummyExternalIdentityStorer{Identities: make(map[string]*ExternalIdentity)}
+
+	pending, _, err := AttemptExternalLogin(as, is, ExternalLogin{Issuer: "https://login.test", Subject: "2fa", Email: "twofactor@test", EmailVerified: true}, now)
+	if err != SecondFactorRequired || pending != a {
+		t.Fatalf("AttemptExternalLogin did not ask for a second factor, got %+v, %v", pending, err)
+	}
+}
+
+func TestExternalNickname(t *testing.T) {
+	tests := map[[2]string]string{
+		{"jo@test", "Jo Bloggs"}:            "Jo Bloggs",
+		{"jo.bloggs@test", " "}:             "jo.bloggs",
+		{"jo@test", "Āāāāāāāāāāāāāāāāāāāā"}: "Āāāāāāā",
+		{"averyveryverylongname@test", ""}:  "averyveryverylo",
+		{"@test", ""}:                       "Anonymous",
+	}
+	for in, expected := range tests {
+		if nickname := externalNickname(in[0], in[1]); nickname != expected {
+			t.Errorf("externalNickname(%q, %q) returned %q, expected %q", in[0], in[1], nickname, expected)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package account
+
+import (
+	"errors"
+)
+
+//A Role says what an account is allowed to do, as a set of Permissions
+type Role string
+
+const (
+	RoleMember    Role = "member"    //can submit, edit and delete their own facts, and vote
+	RoleTrusted   Role = "trusted"   //can also see facts that are awaiting moderation
+	RoleModerator Role = "moderator" //can also moderate, edit and delete anyone's facts, and hide comments
+	RoleAdmin     Role = "admin"     //can do everything, including managing accounts
+)
+
+//Every role, from the least to the most allowed
+var Roles = []Role{RoleMember, RoleTrusted, RoleModerator, RoleAdmin}
+
+//A Permission is something that only some roles are allowed to do
+type Permission string
+
+const (
+	ModerateFact    Permission = "moderate_fact"    //approve facts that are awaiting moderation, and hide or delete comments
+	DeleteAnyFact   Permission = "delete_any_fact"  //delete facts submitted by other accounts
+	EditAnyFact     Permission = "edit_any_fact"    //edit other accounts' facts (and roll them back) without them needing moderation again, and manage tags
+	ManageUsers     Permission = "manage_users"     //change accounts' roles, and unlock sign ins
+	ViewUnmoderated Permission = "view_unmoderated" //see facts that are awaiting moderation
+	ViewAuditLog    Permission = "view_audit_log"   //see and export the audit log of everything that has been changed, and by whom
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleMember:    {},
+	RoleTrusted:   {ViewUnmoderated},
+	RoleModerator: {ViewUnmoderated, ModerateFact, EditAnyFact, DeleteAnyFact},
+	RoleAdmin:     {ViewUnmoderated, ModerateFact, EditAnyFact, DeleteAnyFact, ManageUsers, ViewAuditLog},
+}
+
+var (
+	UnknownRole             error = errors.New("There is no such role.")
+	CannotChangeOwnRole     error = errors.New("You can't change your own role.")
+	NotAllowedToManageUsers error = errors.New("You aren't allowed to manage accounts.")
+)
+
+//Returns true if r is one of Roles
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+//Returns true if the role has the permission
+func (r Role) Can(p Permission) bool {
+	for _, allowed := range rolePermissions[r] {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the permissions the role has
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+//Can is the one place that decides what an account is allowed to do. It is false for a nil account (ie for someone who
+//isn't signed in), so it can be used without checking that first
+func (a *Account) Can(p Permission) bool {
+	if a == nil {
+		return false
+	}
+	return a.Role.Can(p)
+}
+
+//Returns true if the account is an admin
+func (a *Account) IsAdmin() bool {
+	return a != nil && a.Role == RoleAdmin
+}
+
+//Gives the account a new role, as changed by the account changedBy (which must be allowed to ManageUsers)
+func (a *Account) SetRole(as AccountStorer, role Role, changedBy *Account) error {
+	if !changedBy.Can(ManageUsers) {
+		return NotAllowedToManageUsers
+	}
+	if !role.Valid() {
+		return UnknownRole
+	}
+	//so that the last admin can't lock everyone out
+	if a.Id == changedBy.Id {
+		return CannotChangeOwnRole
+	}
+	a.Role = role
+	return as.SaveAccount(a)
+}
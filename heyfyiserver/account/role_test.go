@@ -0,0 +1,54 @@
+package account
+
+import (
+	"testing"
+)
+
+func TestCan(t *testing.T) {
+	tests := map[Role][]Permission{
+		RoleMember:    {},
+		RoleTrusted:   {ViewUnmoderated},
+		RoleModerator: {ViewUnmoderated, ModerateFact, EditAnyFact, DeleteAnyFact},
+		RoleAdmin:     {ViewUnmoderated, ModerateFact, EditAnyFact, DeleteAnyFact, ManageUsers, ViewAuditLog},
+		"":            {}, //accounts made before roles existed are members
+		"superuser":   {},
+	}
+	all := []Permission{ModerateFact, DeleteAnyFact, EditAnyFact, ManageUsers, ViewUnmoderated, ViewAuditLog}
+	for role, allowed := range tests {
+		a := &Account{Role: role}
+		for _, p := range all {
+			expected := false
+			for _, q := range allowed {
+				expected = expected || p == q
+			}
+			if a.Can(p) != expected {
+				t.Errorf("Role %q Can(%s) returned %v", role, p, !expected)
+			}
+		}
+	}
+
+	var nobody *Account
+	if nobody.Can(ViewUnmoderated) || nobody.IsAdmin() {
+		t.Fatal("Someone who isn't signed in has permissions")
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	admin := &Account{Id: 1, Role: RoleAdmin}
+	moderator := &Account{Id: 2, Role: RoleModerator}
+	a := &Account{Id: 3, Role: RoleMember}
+	as := DummyAccountStorer{OnlyAccount: a}
+
+	if err := a.SetRole(as, RoleModerator, moderator); err != NotAllowedToManageUsers || a.Role != RoleMember {
+		t.Fatal("A moderator changed an account's role, got ", err)
+	}
+	if err := a.SetRole(as, "superuser", admin); err != UnknownRole {
+		t.Fatal("SetRole accepted an unknown role, got ", err)
+	}
+	if err := admin.SetRole(as, RoleMember, admin); err != CannotChangeOwnRole || !admin.IsAdmin() {
+		t.Fatal("An admin changed their own role, got ", err)
+	}
+	if err := a.SetRole(as, RoleTrusted, admin); err != nil || a.Role != RoleTrusted || !a.Can(ViewUnmoderated) {
+		t.Fatal("SetRole failed: ", err)
+	}
+}
@@ -0,0 +1,128 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/kiwih/nullables"
+)
+
+//A Session is one browser or device that an account is signed in on. An account can have any number of them
+//The token that identifies a session is only ever given to the browser (in its cookie). Only a hash of it is stored,
+//so that someone who can read the sessions table still can't use it to sign in
+type Session struct {
+	Id         int64
+	AccountId  int64
+	TokenHash  string `sql:"unique;type:varchar(64)"`
+	UserAgent  string `sql:"type:varchar(255)"`
+	Ip         string `sql:"type:varchar(45)"` //the address the session was last seen from
+	CreatedAt  nullables.NullTime
+	LastSeenAt nullables.NullTime
+	ExpiresAt  nullables.NullTime
+}
+
+const (
+	ShortSessionTime = time.Hour
+	LongSessionTime  = 30 * 24 * time.Hour
+
+	//LastSeenAt is only updated when it is at least this old, so that every request doesn't write to the database
+	sessionSeenInterval = 5 * time.Minute
+
+	maxUserAgentLength = 255
+)
+
+var (
+	SessionNotFound error = errors.New("That session has already been signed out.")
+)
+
+//Returns the hash of a session token that is stored instead of the token itself
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//Returns true if the session has expired at time now
+func (s *Session) Expired(now time.Time) bool {
+	return s.ExpiresAt.Valid && s.ExpiresAt.Time.Before(now)
+}
+
+//Starts a new session for the account on the device with the given user agent and IP address, and saves it
+//Returns the session's token, which is what the device uses to identify it (and which can't be got back later)
+func (a *Account) StartSession(as AccountStorer, willExpire bool, userAgent string, ip string, now time.Time) (string, *Session, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	length := LongSessionTime //expires in a month if they want to be remembered
+	if willExpire {
+		length = ShortSessionTime //or in an hour if they don't
+	}
+
+	s := &Session{
+		AccountId:  a.Id,
+		TokenHash:  HashSessionToken(token),
+		UserAgent:  userAgent,
+		Ip:         ip,
+		CreatedAt:  nullables.NullTime{Time: now, Valid: true},
+		LastSeenAt: nullables.NullTime{Time: now, Valid: true},
+		ExpiresAt:  nullables.NullTime{Time: now.Add(length), Valid: true},
+	}
+
+	//tidy up the account's old sessions while we're here
+	if err := as.DeleteExpiredSessions(a.Id, now); err != nil {
+		return "", nil, err
+	}
+	if err := as.CreateSession(s); err != nil {
+		return "", nil, err
+	}
+	return token, s, nil
+}
+
+//Returns the account and session that a session token belongs to, and records that the session was seen at time now from ip
+func LoadSession(as AccountStorer, token string, ip string, now time.Time) (*Account, *Session, error) {
+	a, s, err := as.LoadAccountFromSession(HashSessionToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.Expired(now) {
+		return nil, nil, SessionExpired
+	}
+	if err := a.Suspension(now); err != nil {
+		return nil, nil, err
+	}
+
+	if !s.LastSeenAt.Valid || now.Sub(s.LastSeenAt.Time) >= sessionSeenInterval || s.Ip != ip {
+		s.LastSeenAt = nullables.NullTime{Time: now, Valid: true}
+		s.Ip = ip
+		if err := as.SaveSession(s); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a, s, nil
+}
+
+//Signs the account out of one of its sessions
+func (a *Account) EndSession(as AccountStorer, sessionId int64) error {
+	return as.DeleteSession(a.Id, sessionId)
+}
+
+//Signs the account out everywhere
+func (a *Account) EndAllSessions(as AccountStorer) error {
+	return as.DeleteAllSessions(a.Id)
+}
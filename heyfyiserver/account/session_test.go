@@ -0,0 +1,101 @@
+package account
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartSession(t *testing.T) {
+	a := &Account{Id: 3, Email: "sessions@test", Nickname: "Sessions"}
+	as := DummyAccountStorer{OnlyAccount: a, Sessions: make(map[int64]Session)}
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	token, s, err := a.StartSession(as, true, strings.Repeat("x", 300), "203.0.113.1", now)
+	if err != nil {
+		t.Fatal("StartSession failed: ", err)
+	}
+	if len(token) != 64 || s.TokenHash == token || s.TokenHash != HashSessionToken(token) {
+		t.Fatalf("StartSession stored the token instead of its hash, got %s, %+v", token, s)
+	}
+	if !s.ExpiresAt.Time.Equal(now.Add(ShortSessionTime)) || len(s.UserAgent) != maxUserAgentLength || s.Ip != "203.0.113.1" {
+		t.Fatalf("StartSession did not set up the session correctly: %+v", s)
+	}
+
+	remembered, long, err := a.StartSession(as, false, "phone", "203.0.113.2", now)
+	if err != nil || remembered == token || !long.ExpiresAt.Time.Equal(now.Add(LongSessionTime)) {
+		t.Fatalf("StartSession did not start a second, remembered, session: %+v, %v", long, err)
+	}
+
+	//starting a session after the first one has expired tidies it up
+	later := now.Add(2 * ShortSessionTime)
+	if _, _, err := a.StartSession(as, false, "tablet", "203.0.113.3", later); err != nil {
+		t.Fatal("StartSession failed: ", err)
+	}
+	if _, ok := as.Sessions[s.Id]; ok || len(as.Sessions) != 2 {
+		t.Fatalf("StartSession did not delete the expired session: %+v", as.Sessions)
+	}
+}
+
+func TestLoadSession(t *testing.T) {
+	a := &Account{Id: 3, Email: "sessions@test", Nickname: "Sessions"}
+	as := DummyAccountStorer{OnlyAccount: a, Sessions: make(map[int64]Session)}
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	token, s, err := a.StartSession(as, true, "laptop", "203.0.113.1", now)
+	if err != nil {
+		t.Fatal("StartSession failed: ", err)
+	}
+
+	if _, _, err := LoadSession(as, "not_the_token", "203.0.113.1", now); err == nil {
+		t.Fatal("LoadSession accepted the wrong token")
+	}
+	if _, _, err := LoadSession(as, s.TokenHash, "203.0.113.1", now); err == nil {
+		t.Fatal("LoadSession accepted the stored hash as a token")
+	}
+
+	loaded, session, err := LoadSession(as, token, "203.0.113.1", now.Add(time.Minute))
+	if err != nil || loaded != a || session.Id != s.Id {
+		t.Fatalf("LoadSession did not return the session, got %+v, %+v, %v", loaded, session, err)
+	}
+	if !as.Sessions[s.Id].LastSeenAt.Time.Equal(now) {
+		t.Fatal("LoadSession updated when the session was last seen too soon")
+	}
+
+	if _, _, err := LoadSession(as, token, "203.0.113.9", now.Add(10*time.Minute)); err != nil {
+		t.Fatal("LoadSession failed: ", err)
+	}
+	if seen := as.Sessions[s.Id]; !seen.LastSeenAt.Time.Equal(now.Add(10*time.Minute)) || seen.Ip != "203.0.113.9" {
+		t.Fatalf("LoadSession did not record when and where the session was seen: %+v", seen)
+	}
+
+	if _, _, err := LoadSession(as, token, "203.0.113.1", now.Add(2*ShortSessionTime)); err != SessionExpired {
+		t.Fatal("LoadSession did not return SessionExpired, got ", err)
+	}
+}
+
+func TestEndSessions(t *testing.T) {
+	a := &Account{Id: 3, Email: "sessions@test", Nickname: "Sessions"}
+	as := DummyAccountStorer{OnlyAccount: a, Sessions: make(map[int64]Session)}
+	now := time.Now()
+
+	laptop, _, _ := a.StartSession(as, false, "laptop", "203.0.113.1", now)
+	phone, phoneSession, _ := a.StartSession(as, false, "phone", "203.0.113.2", now)
+
+	if err := a.EndSession(as, phoneSession.Id); err != nil {
+		t.Fatal("EndSession failed: ", err)
+	}
+	if _, _, err := LoadSession(as, phone, "203.0.113.2", now); err == nil {
+		t.Fatal("A session could still be used after it was ended")
+	}
+	if _, _, err := LoadSession(as, laptop, "203.0.113.1", now); err != nil {
+		t.Fatal("Ending one session ended another: ", err)
+	}
+
+	if err := a.EndAllSessions(as); err != nil {
+		t.Fatal("EndAllSessions failed: ", err)
+	}
+	if _, _, err := LoadSession(as, laptop, "203.0.113.1", now); err == nil {
+		t.Fatal("A session could still be used after signing out everywhere")
+	}
+}
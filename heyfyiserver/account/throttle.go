@@ -0,0 +1,186 @@
+package account
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/kiwih/nullables"
+)
+
+//A LoginThrottle counts the failed sign ins for one email address, one IP address or one account's second factor, so that
+//passwords and codes can't be guessed quickly
+//They are kept by the storage layer, so that they survive restarts and are shared between servers
+type LoginThrottle struct {
+	Id            int64
+	ThrottleKey   string `sql:"unique;type:varchar(80)"` //see EmailThrottleKey, IpThrottleKey and SecondFactorThrottleKey
+	Failures      int    //failures since the last success (or since failures were last forgotten)
+	LastFailureAt nullables.NullTime
+	BlockedUntil  nullables.NullTime //no sign ins are allowed until this time
+	LockedOut     bool               //set once there have been so many failures that the account (or address) was locked
+}
+
+//LoginThrottleStorer is what the login throttle needs from a storage backend
+type LoginThrottleStorer interface {
+	LoadLoginThrottle(key string) (*LoginThrottle, error)
+	//Adds a failure to the throttle with the given key (making it if needed), and returns it. If its last failure was
+	//before forgetBefore, the earlier failures are forgotten (and it is unlocked) first. This must be atomic, as more
+	//than one server could be recording failures for the same key
+	RecordLoginFailure(key string, now time.Time, forgetBefore time.Time) (*LoginThrottle, error)
+	SaveLoginThrottle(*LoginThrottle) error
+	DeleteLoginThrottle(key string) error
+	ListLockedLoginThrottles(now time.Time) ([]LoginThrottle, error) //those that are LockedOut and still blocked at time now
+}
+
+//A ThrottlePolicy says how quickly sign ins are slowed down as they fail
+type ThrottlePolicy struct {
+	FreeFailures int           //how many failures are allowed before sign ins are slowed down
+	BaseDelay    time.Duration //the wait after the first failure past FreeFailures, which doubles with each failure after that
+	MaxDelay     time.Duration
+	LockAfter    int //how many failures lock the account or address
+	LockFor      time.Duration
+}
+
+var (
+	//Sign ins for an email address
+	EmailThrottlePolicy = ThrottlePolicy{FreeFailures: 3, BaseDelay: 2 * time.Second, MaxDelay: 5 * time.Minute, LockAfter: 10, LockFor: time.Hour}
+	//Sign ins from an IP address. Lots of people can share an address, so it is allowed more failures
+	IpThrottlePolicy = ThrottlePolicy{FreeFailures: 20, BaseDelay: time.Second, MaxDelay: 5 * time.Minute, LockAfter: 100, LockFor: time.Hour}
+)
+
+//Failures are forgotten once there haven't been any for this long
+const ForgetLoginFailuresAfter = 24 * time.Hour
+
+//LoginThrottledError is returned when sign ins for an account or from an address are being slowed down or have been locked
+type LoginThrottledError struct {
+	Until     time.Time
+	LockedOut bool
+	now       time.Time
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.LockedOut {
+		return "Too many sign in attempts have failed, so signing in has been locked for " + waitText(e.Until.Sub(e.now)) + ". If this wasn't you, an admin can unlock it."
+	}
+	return "Too many sign in attempts have failed. Please wait " + waitText(e.Until.Sub(e.now)) + " before trying again."
+}
+
+//Returns a wait like "5 minutes" or "30 seconds"
+func waitText(d time.Duration) string {
+	if d > time.Minute {
+		minutes := int((d + time.Minute - 1) / time.Minute)
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds <= 1 {
+		return "a second"
+	}
+	return fmt.Sprintf("%d seconds", seconds)
+}
+
+func EmailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IpThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+//Returns how long sign ins have to wait after the given number of failures, and whether they are locked
+func (p ThrottlePolicy) wait(failures int) (time.Duration, bool) {
+	if failures >= p.LockAfter {
+		return p.LockFor, true
+	}
+	if failures <= p.FreeFailures {
+		return 0, false
+	}
+	delay := p.BaseDelay
+	for i := p.FreeFailures + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay, false
+}
+
+//Returns a LoginThrottledError if sign ins for the email address, or from the IP address, have to wait at time now
+func CheckLoginThrottle(ts LoginThrottleStorer, email string, ip string, now time.Time) error {
+	for _, key := range []string{EmailThrottleKey(email), IpThrottleKey(ip)} {
+		t, err := ts.LoadLoginThrottle(key)
+		if err != nil {
+			continue //there isn't one, so they haven't failed
+		}
+		if t.BlockedUntil.Valid && now.Before(t.BlockedUntil.Time) {
+			return &LoginThrottledError{Until: t.BlockedUntil.Time, LockedOut: t.LockedOut, now: now}
+		}
+	}
+	return nil
+}
+
+//Records a failed sign in for the email address from the IP address, slowing down or locking further sign ins as needed
+//The account's owner is emailed when their account is locked
+func RecordFailedLogin(ts LoginThrottleStorer, as AccountStorer, email string, ip string, now time.Time) error {
+	emailLocked, err := recordFailure(ts, EmailThrottleKey(email), EmailThrottlePolicy, now)
+	if err != nil {
+		return err
+	}
+	if _, err := recordFailure(ts, IpThrottleKey(ip), IpThrottlePolicy, now); err != nil {
+		return err
+	}
+
+	if emailLocked {
+		if a, err := as.LoadAccountFromEmail(email); err == nil {
+			sendEmail(a.Email, "Your account has been locked", "Hello!\r\n\r\nThere have been "+fmt.Sprint(EmailThrottlePolicy.LockAfter)+" failed attempts to sign in to your hey.fyi account, so signing in has been locked for the next hour.\r\n\r\nIf this was you, you can try again later, or reset your password at http://hey.fyi/reset.\r\nIf it wasn't, someone may be trying to guess your password. Your account is safe as long as they haven't guessed it, but please make sure you use a strong password (and turn on two-factor authentication).\r\n\r\nRegards,\r\nhey.fyi")
+			log.Printf("Signing in to %s has been locked after too many failed attempts\n", a.Email)
+		}
+	}
+	return nil
+}
+
+//Records a failure for one key. Returns true if this failure locked it (when it wasn't already)
+func recordFailure(ts LoginThrottleStorer, key string, p ThrottlePolicy, now time.Time) (bool, error) {
+	t, err := ts.RecordLoginFailure(key, now, now.Add(-ForgetLoginFailuresAfter))
+	if err != nil {
+		return false, err
+	}
+	wait, locked := p.wait(t.Failures)
+	if wait == 0 {
+		return false, nil
+	}
+
+	newlyLocked := locked && !t.LockedOut
+	t.BlockedUntil = nullables.NullTime{Time: now.Add(wait), Valid: true}
+	t.LockedOut = t.LockedOut || locked
+	return newlyLocked, ts.SaveLoginThrottle(t)
+}
+
+//Forgets the failed sign ins for an email address, once someone has signed in to it
+//The failures from their IP address are kept, so that signing in to one account doesn't allow more guesses at others
+func ResetLoginThrottle(ts LoginThrottleStorer, email string) error {
+	return ts.DeleteLoginThrottle(EmailThrottleKey(email))
+}
+
+//Signs in like AttemptLogin, but first checks that sign ins for the email address and from the IP address aren't being
+//slowed down, and records the failure if the password is wrong
+func AttemptThrottledLogin(as AccountStorer, ts LoginThrottleStorer, email string, password string, ip string, now time.Time) (*Account, error) {
+	if err := CheckLoginThrottle(ts, email, ip, now); err != nil {
+		return nil, err
+	}
+
+	a, err := AttemptLogin(as, email, password)
+	if err == InvalidUsernameOrPassword {
+		if err := RecordFailedLogin(ts, as, email, ip, now); err != nil {
+			return nil, err
+		}
+		return nil, InvalidUsernameOrPassword
+	}
+	if err == nil || err == SecondFactorRequired {
+		//the password was right
+		if err := ResetLoginThrottle(ts, email); err != nil {
+			return nil, err
+		}
+	}
+	return a, err
+}
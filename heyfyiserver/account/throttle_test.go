@@ -0,0 +1,155 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type DummyLoginThrottleStorer struct {
+	Throttles map[string]*LoginThrottle
+}
+
+func (d DummyLoginThrottleStorer) LoadLoginThrottle(key string) (*LoginThrottle, error) {
+	if t, ok := d.Throttles[key]; ok {
+		copied := *t
+		return &copied, nil
+	}
+	return nil, gorm.RecordNotFound
+}
+func (d DummyLoginThrottleStorer) RecordLoginFailure(key string, now time.Time, forgetBefore time.Time) (*LoginThrottle, error) {
+	t, ok := d.Throttles[key]
+	if !ok || t.LastFailureAt.Time.Before(forgetBefore) {
+		t = &LoginThrottle{ThrottleKey: key}
+		d.Throttles[key] = t
+	}
+	t.Failures++
+	t.LastFailureAt.Time, t.LastFailureAt.Valid = now, true
+	copied := *t
+	return &copied, nil
+}
+func (d DummyLoginThrottleStorer) SaveLoginThrottle(t *LoginThrottle) error {
+	copied := *t
+	d.Throttles[t.ThrottleKey] = &copied
+	return nil
+}
+func (d DummyLoginThrottleStorer) DeleteLoginThrottle(key string) error {
+	delete(d.Throttles, key)
+	return nil
+}
+func (d DummyLoginThrottleStorer) ListLockedLoginThrottles(now time.Time) ([]LoginThrottle, error) {
+	var locked []LoginThrottle
+	for _, t := range d.Throttles {
+		if t.LockedOut && t.BlockedUntil.Time.After(now) {
+			locked = append(locked, *t)
+		}
+	}
+	return locked, nil
+}
+
+func newThrottledAccount(t *testing.T) (DummyAccountStorer, DummyLoginThrottleStorer) {
+	a := &Account{Id: 5, Email: "throttle@test", Nickname: "Throttle"}
+	if err := a.SetPassword("testing1+"); err != nil {
+		t.Fatal(err)
+	}
+	return DummyAccountStorer{OnlyAccount: a}, DummyLoginThrottleStorer{Throttles: make(map[string]*LoginThrottle)}
+}
+
+func TestThrottlePolicyWait(t *testing.T) {
+	p := ThrottlePolicy{FreeFailures: 3, BaseDelay: 2 * time.Second, MaxDelay: 10 * time.Second, LockAfter: 10, LockFor: time.Hour}
+	tests := map[int]time.Duration{
+		1:  0,
+		3:  0,
+		4:  2 * time.Second,
+		5:  4 * time.Second,
+		6:  8 * time.Second,
+		7:  10 * time.Second,
+		9:  10 * time.Second,
+		10: time.Hour,
+	}
+	for failures, expected := range tests {
+		wait, locked := p.wait(failures)
+		if wait != expected || locked != (failures >= 10) {
+			t.Errorf("%d failures waits %v (locked %v), expected %v", failures, wait, locked, expected)
+		}
+	}
+}
+
+func TestAttemptThrottledLogin(t *testing.T) {
+	as, ts := newThrottledAccount(t)
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < EmailThrottlePolicy.FreeFailures; i++ {
+		if _, err := AttemptThrottledLogin(as, ts, "throttle@test", "wrong", "203.0.113.1", now); err != InvalidUsernameOrPassword {
+			t.Fatal("A wrong password did not return InvalidUsernameOrPassword, got ", err)
+		}
+	}
+
+	//the next failure means they have to wait before trying again, even with the right password
+	if _, err := AttemptThrottledLogin(as, ts, "throttle@test", "wrong", "203.0.113.1", now); err != InvalidUsernameOrPassword {
+		t.Fatal("A wrong password did not return InvalidUsernameOrPassword, got ", err)
+	}
+	_, err := AttemptThrottledLogin(as, ts, "Throttle@Test ", "testing1+", "203.0.113.2", now.Add(time.Second))
+	if throttled, ok := err.(*LoginThrottledError); !ok || throttled.LockedOut || !throttled.Until.Equal(now.Add(EmailThrottlePolicy.BaseDelay)) {
+		t.Fatalf("Signing in straight after too many failures was not throttled, got %#v", err)
+	}
+
+	//once the wait is over, the right password works and the failures are forgotten
+	a, err := AttemptThrottledLogin(as, ts, "throttle@test", "testing1+", "203.0.113.1", now.Add(EmailThrottlePolicy.BaseDelay))
+	if err != nil || a == nil {
+		t.Fatal("The right password did not sign in after the wait: ", err)
+	}
+	if _, err := ts.LoadLoginThrottle(EmailThrottleKey("throttle@test")); err == nil {
+		t.Fatal("Signing in did not reset the throttle for the email address")
+	}
+	if ip, err := ts.LoadLoginThrottle(IpThrottleKey("203.0.113.1")); err != nil || ip.Failures != EmailThrottlePolicy.FreeFailures+1 {
+		t.Fatalf("Signing in reset the throttle for the IP address: %+v, %v", ip, err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	as, ts := newThrottledAccount(t)
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	//wait out each delay, so that every attempt is counted
+	for i := 0; i < EmailThrottlePolicy.LockAfter; i++ {
+		if _, err := AttemptThrottledLogin(as, ts, "throttle@test", "wrong", "203.0.113.1", now); err != InvalidUsernameOrPassword {
+			t.Fatalf("Attempt %d did not return InvalidUsernameOrPassword, got %v", i+1, err)
+		}
+		now = now.Add(EmailThrottlePolicy.MaxDelay)
+	}
+
+	_, err := AttemptThrottledLogin(as, ts, "throttle@test", "testing1+", "203.0.113.1", now)
+	if throttled, ok := err.(*LoginThrottledError); !ok || !throttled.LockedOut {
+		t.Fatalf("The account was not locked after %d failures, got %#v", EmailThrottlePolicy.LockAfter, err)
+	}
+	if locked, _ := ts.ListLockedLoginThrottles(now); len(locked) != 1 || locked[0].ThrottleKey != EmailThrottleKey("throttle@test") {
+		t.Fatalf("ListLockedLoginThrottles did not return the locked account: %+v", locked)
+	}
+
+	//an admin unlocking it lets them straight back in
+	if err := ResetLoginThrottle(ts, "throttle@test"); err != nil {
+		t.Fatal("ResetLoginThrottle failed: ", err)
+	}
+	if _, err := AttemptThrottledLogin(as, ts, "throttle@test", "testing1+", "203.0.113.1", now); err != nil {
+		t.Fatal("Signing in after the account was unlocked failed: ", err)
+	}
+}
+
+func TestLoginFailuresAreForgotten(t *testing.T) {
+	as, ts := newThrottledAccount(t)
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i <= EmailThrottlePolicy.FreeFailures; i++ {
+		AttemptThrottledLogin(as, ts, "throttle@test", "wrong", "203.0.113.1", now)
+	}
+	now = now.Add(ForgetLoginFailuresAfter + time.Minute)
+	AttemptThrottledLogin(as, ts, "throttle@test", "wrong", "203.0.113.1", now)
+	if throttle, err := ts.LoadLoginThrottle(EmailThrottleKey("throttle@test")); err != nil || throttle.Failures != 1 {
+		t.Fatalf("Old failures were not forgotten: %+v, %v", throttle, err)
+	}
+	if err := CheckLoginThrottle(ts, "throttle@test", "203.0.113.1", now); err != nil {
+		t.Fatal("Sign ins were throttled after the old failures were forgotten: ", err)
+	}
+}
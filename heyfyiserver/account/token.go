@@ -0,0 +1,202 @@
+package account
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiwih/nullables"
+)
+
+//A Scope is one kind of thing that an API token can be used to do
+type Scope string
+
+const (
+	ScopeRead     Scope = "read"     //see facts, references, votes and the account
+	ScopeVote     Scope = "vote"     //vote on facts
+	ScopeSubmit   Scope = "submit"   //submit, edit and delete facts and their references
+	ScopeModerate Scope = "moderate" //moderate facts, which the account also has to be allowed to do
+)
+
+//Every scope, in the order they are offered when making a token
+var Scopes = []Scope{ScopeRead, ScopeVote, ScopeSubmit, ScopeModerate}
+
+//An ApiToken lets scripts and bots use the API as an account, without its password. Like a session, only a hash of
+//the token is stored, so it is only shown to its owner once, when it is made. A token can only do what its scopes allow,
+//and only what its account is allowed to do
+type ApiToken struct {
+	Id         int64
+	AccountId  int64
+	Name       string `sql:"type:varchar(60)"` //what its owner called it, eg "Tag tidying bot"
+	TokenHash  string `sql:"unique;type:varchar(64)"`
+	Prefix     string `sql:"type:varchar(12)"`  //the start of the token, so that its owner can tell which one it is
+	Scopes     string `sql:"type:varchar(100)"` //separated by commas
+	CreatedAt  nullables.NullTime
+	ExpiresAt  nullables.NullTime
+	LastUsedAt nullables.NullTime
+	LastUsedIp string `sql:"type:varchar(45)"`
+	Uses       int64
+}
+
+//ApiTokenStorer is what API tokens need from a storage backend
+type ApiTokenStorer interface {
+	CreateApiToken(*ApiToken) error
+	LoadApiToken(tokenHash string) (*ApiToken, error)
+	ListApiTokens(accountId int64) ([]ApiToken, error) //newest first
+	RecordApiTokenUse(t *ApiToken) error               //saves LastUsedAt and LastUsedIp, and adds one to Uses
+	DeleteApiToken(accountId int64, tokenId int64) error
+}
+
+const (
+	//every token starts with this, so that they are easy to recognise (eg when one has been pasted somewhere it shouldn't be)
+	ApiTokenPrefix = "hfy_"
+
+	MaxApiTokens          = 20 //the most tokens an account can have at once
+	MaxApiTokenLifetime   = 365 * 24 * time.Hour
+	maxApiTokenNameLength = 60
+	apiTokenPrefixLength  = len(ApiTokenPrefix) + 8
+)
+
+var (
+	ApiTokenNameMissing     error = errors.New("Please give the token a name, so that you can tell what it is for.")
+	ApiTokenNameTooLong     error = errors.New("Token names can't be longer than 60 characters.")
+	ApiTokenScopeMissing    error = errors.New("Please choose at least one thing that the token can do.")
+	UnknownApiTokenScope    error = errors.New("There is no such scope.")
+	ApiTokenScopeNotAllowed error = errors.New("You can't make a token that can do something you aren't allowed to do.")
+	BadApiTokenLifetime     error = errors.New("Tokens have to expire within a year.")
+	TooManyApiTokens        error = errors.New("You have too many tokens. Please revoke one you don't use any more first.")
+	ApiTokenNotFound        error = errors.New("That token has already been revoked.")
+	ApiTokenExpired         error = errors.New("That token has expired.")
+	BadApiToken             error = errors.New("That isn't a valid API token.")
+)
+
+//Returns true if s is one of Scopes
+func (s Scope) Valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the token's scopes
+func (t *ApiToken) ScopeList() []Scope {
+	var scopes []Scope
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s != "" {
+			scopes = append(scopes, Scope(s))
+		}
+	}
+	return scopes
+}
+
+//Returns true if the token has the scope
+func (t *ApiToken) Allows(scope Scope) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns true if the token has expired at time now
+func (t *ApiToken) Expired(now time.Time) bool {
+	return t.ExpiresAt.Valid && !now.Before(t.ExpiresAt.Time)
+}
+
+//Makes a new API token for the account, which can do what the scopes allow until it expires after lifetime
+//Returns the token, which is only shown to them now (as only its hash is saved)
+func (a *Account) CreateApiToken(ts ApiTokenStorer, name string, scopes []Scope, lifetime time.Duration, now time.Time) (string, *ApiToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, ApiTokenNameMissing
+	}
+	if utf8.RuneCountInString(name) > maxApiTokenNameLength {
+		return "", nil, ApiTokenNameTooLong
+	}
+	if len(scopes) == 0 {
+		return "", nil, ApiTokenScopeMissing
+	}
+	var names []string
+	for _, s := range scopes {
+		if !s.Valid() {
+			return "", nil, UnknownApiTokenScope
+		}
+		if s == ScopeModerate && !a.Can(ModerateFact) {
+			return "", nil, ApiTokenScopeNotAllowed
+		}
+		names = append(names, string(s))
+	}
+	if lifetime <= 0 || lifetime > MaxApiTokenLifetime {
+		return "", nil, BadApiTokenLifetime
+	}
+
+	existing, err := ts.ListApiTokens(a.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(existing) >= MaxApiTokens {
+		return "", nil, TooManyApiTokens
+	}
+
+	secret, err := generateSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+	token := ApiTokenPrefix + secret
+
+	t := &ApiToken{
+		AccountId: a.Id,
+		Name:      name,
+		TokenHash: HashSessionToken(token), //hashed the same way as session tokens
+		Prefix:    token[:apiTokenPrefixLength],
+		Scopes:    strings.Join(names, ","),
+		CreatedAt: nullables.NullTime{Time: now, Valid: true},
+		ExpiresAt: nullables.NullTime{Time: now.Add(lifetime), Valid: true},
+	}
+	if err := ts.CreateApiToken(t); err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+//Returns the account and API token that a token belongs to, and records that it was used at time now from ip
+//Tokens stop working while their account is suspended or has to choose a new password, as their password may have leaked
+func LoadApiToken(as AccountStorer, ts ApiTokenStorer, token string, ip string, now time.Time) (*Account, *ApiToken, error) {
+	if !strings.HasPrefix(token, ApiTokenPrefix) {
+		return nil, nil, BadApiToken
+	}
+	t, err := ts.LoadApiToken(HashSessionToken(token))
+	if err != nil {
+		return nil, nil, BadApiToken
+	}
+	if t.Expired(now) {
+		return nil, nil, ApiTokenExpired
+	}
+	a, err := as.LoadAccountFromId(t.AccountId)
+	if err != nil {
+		return nil, nil, BadApiToken
+	}
+	if err := a.Suspension(now); err != nil {
+		return nil, nil, err
+	}
+	if a.PasswordResetRequired {
+		return nil, nil, PasswordResetRequired
+	}
+
+	t.LastUsedAt = nullables.NullTime{Time: now, Valid: true}
+	t.LastUsedIp = ip
+	if err := ts.RecordApiTokenUse(t); err != nil {
+		return nil, nil, err
+	}
+	t.Uses++
+	return a, t, nil
+}
+
+//Revokes one of the account's tokens, so that it can't be used again
+func (a *Account) RevokeApiToken(ts ApiTokenStorer, tokenId int64) error {
+	return ts.DeleteApiToken(a.Id, tokenId)
+}
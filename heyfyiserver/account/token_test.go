@@ -0,0 +1,161 @@
+package account
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type DummyApiTokenStorer struct {
+	Tokens map[int64]*ApiToken
+}
+
+func (d DummyApiTokenStorer) CreateApiToken(t *ApiToken) error {
+	t.Id = int64(len(d.Tokens) + 1)
+	copied := *t
+	d.Tokens[t.Id] = &copied
+	return nil
+}
+func (d DummyApiTokenStorer) LoadApiToken(tokenHash string) (*ApiToken, error) {
+	for _, t := range d.Tokens {
+		if t.TokenHash == tokenHash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, gorm.RecordNotFound
+}
+func (d DummyApiTokenStorer) ListApiTokens(accountId int64) ([]ApiToken, error) {
+	var tokens []ApiToken
+	for _, t := range d.Tokens {
+		if t.AccountId == accountId {
+			tokens = append(tokens, *t)
+		}
+	}
+	return tokens, nil
+}
+func (d DummyApiTokenStorer) RecordApiTokenUse(t *ApiToken) error {
+	existing := d.Tokens[t.Id]
+	existing.LastUsedAt = t.LastUsedAt
+	existing.LastUsedIp = t.LastUsedIp
+	existing.Uses++
+	return nil
+}
+func (d DummyApiTokenStorer) DeleteApiToken(accountId int64, tokenId int64) error {
+	if t, ok := d.Tokens[tokenId]; !ok || t.AccountId != accountId {
+		return ApiTokenNotFound
+	}
+	delete(d.Tokens, tokenId)
+	return nil
+}
+
+func TestCreateApiToken(t *testing.T) {
+	a := &Account{Id: 3, Email: "tokens@test", Nickname: "Tokens"}
+	ts := DummyApiTokenStorer{Tokens: make(map[int64]*ApiToken)}
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		scopes   []Scope
+		lifetime time.Duration
+		err      error
+	}{
+		{" ", []Scope{ScopeRead}, week, ApiTokenNameMissing},
+		{strings.Repeat("x", maxApiTokenNameLength+1), []Scope{ScopeRead}, week, ApiTokenNameTooLong},
+		{"Bot", nil, week, ApiTokenScopeMissing},
+		{"Bot", []Scope{ScopeRead, "admin"}, week, UnknownApiTokenScope},
+		{"Bot", []Scope{ScopeModerate}, week, ApiTokenScopeNotAllowed},
+		{"Bot", []Scope{ScopeRead}, 0, BadApiTokenLifetime},
+		{"Bot", []Scope{ScopeRead}, MaxApiTokenLifetime + time.Hour, BadApiTokenLifetime},
+	}
+	for _, test := range tests {
+		if _, _, err := a.CreateApiToken(ts, test.name, test.scopes, test.lifetime, now); err != test.err {
+			t.Errorf("CreateApiToken(%q, %v, %v) returned %v", test.name, test.scopes, test.lifetime, err)
+		}
+	}
+
+	token, apiToken, err := a.CreateApiToken(ts, " Bot ", []Scope{ScopeRead, ScopeVote}, week, now)
+	if err != nil {
+		t.Fatal("CreateApiToken failed: ", err)
+	}
+	if !strings.HasPrefix(token, ApiTokenPrefix) || apiToken.TokenHash == token || apiToken.TokenHash != HashSessionToken(token) {
+		t.Fatalf("CreateApiToken stored the token instead of its hash, got %s, %+v", token, apiToken)
+	}
+	if apiToken.Name != "Bot" || apiToken.Scopes != "read,vote" || !strings.HasPrefix(token, apiToken.Prefix) || !apiToken.ExpiresAt.Time.Equal(now.Add(week)) {
+		t.Fatalf("CreateApiToken did not set up the token correctly: %+v", apiToken)
+	}
+	if !apiToken.Allows(ScopeVote) || apiToken.Allows(ScopeSubmit) {
+		t.Fatal("Allows didn't match the token's scopes: ", apiToken.ScopeList())
+	}
+
+	a.Role = RoleAdmin
+	if _, _, err := a.CreateApiToken(ts, "Moderator bot", []Scope{ScopeModerate}, week, now); err != nil {
+		t.Fatal("CreateApiToken didn't let an admin make a moderate token: ", err)
+	}
+
+	for len(ts.Tokens) < MaxApiTokens {
+		if _, _, err := a.CreateApiToken(ts, "Bot", []Scope{ScopeRead}, week, now); err != nil {
+			t.Fatal("CreateApiToken failed: ", err)
+		}
+	}
+	if _, _, err := a.CreateApiToken(ts, "One too many", []Scope{ScopeRead}, week, now); err != TooManyApiTokens {
+		t.Fatal("CreateApiToken made more than MaxApiTokens tokens, got ", err)
+	}
+}
+
+func TestLoadApiToken(t *testing.T) {
+	a := &Account{Id: 3, Email: "tokens@test", Nickname: "Tokens"}
+	as := DummyAccountStorer{OnlyAccount: a}
+	ts := DummyApiTokenStorer{Tokens: make(map[int64]*ApiToken)}
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	token, apiToken, err := a.CreateApiToken(ts, "Bot", []Scope{ScopeRead}, time.Hour, now)
+	if err != nil {
+		t.Fatal("CreateApiToken failed: ", err)
+	}
+
+	if _, _, err := LoadApiToken(as, ts, "not_the_token", "203.0.113.1", now); err != BadApiToken {
+		t.Fatal("LoadApiToken accepted the wrong token, got ", err)
+	}
+	if _, _, err := LoadApiToken(as, ts, apiToken.TokenHash, "203.0.113.1", now); err != BadApiToken {
+		t.Fatal("LoadApiToken accepted the stored hash as a token, got ", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		loaded, used, err := LoadApiToken(as, ts, token, "203.0.113.1", now.Add(time.Minute))
+		if err != nil || loaded != a || used.Id != apiToken.Id || used.Uses != int64(i) {
+			t.Fatalf("LoadApiToken did not return the account and token, got %+v, %+v, %v", loaded, used, err)
+		}
+	}
+	if stored := ts.Tokens[apiToken.Id]; stored.Uses != 2 || stored.LastUsedIp != "203.0.113.1" || !stored.LastUsedAt.Time.Equal(now.Add(time.Minute)) {
+		t.Fatalf("LoadApiToken did not record the token's use: %+v", stored)
+	}
+
+	if _, _, err := LoadApiToken(as, ts, token, "203.0.113.1", now.Add(time.Hour)); err != ApiTokenExpired {
+		t.Fatal("LoadApiToken did not return ApiTokenExpired, got ", err)
+	}
+
+	a.PasswordResetRequired = true
+	if _, _, err := LoadApiToken(as, ts, token, "203.0.113.1", now); err != PasswordResetRequired {
+		t.Fatal("LoadApiToken worked for an account that has to choose a new password, got ", err)
+	}
+	a.PasswordResetRequired = false
+	a.Banned = true
+	if _, _, err := LoadApiToken(as, ts, token, "203.0.113.1", now); err == nil {
+		t.Fatal("LoadApiToken worked for a banned account")
+	}
+	a.Banned = false
+
+	if err := a.RevokeApiToken(ts, apiToken.Id); err != nil {
+		t.Fatal("RevokeApiToken failed: ", err)
+	}
+	if _, _, err := LoadApiToken(as, ts, token, "203.0.113.1", now); err != BadApiToken {
+		t.Fatal("LoadApiToken accepted a revoked token, got ", err)
+	}
+	if err := a.RevokeApiToken(ts, apiToken.Id); err != ApiTokenNotFound {
+		t.Fatal("RevokeApiToken revoked a token twice, got ", err)
+	}
+}
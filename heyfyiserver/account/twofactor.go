@@ -0,0 +1,293 @@
+package account
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiwih/nullables"
+)
+
+//Two factor authentication uses time based one time passwords (TOTP, RFC 6238) from an authenticator app,
+//with SHA1, 6 digit codes and a 30 second period, as those are the settings that every app supports
+
+const (
+	TotpIssuer        = "hey.fyi"
+	totpDigits        = 6
+	totpPeriod        = 30 //seconds
+	totpSkew          = 1  //how many periods either side of now a code is accepted for, to allow for clocks being a little out
+	RecoveryCodeCount = 10
+)
+
+//If true, admins have to set up two factor authentication before they can use the site
+var RequireTwoFactorForAdmins = true
+
+//Second factor codes for an account, once its password has been entered. There are only a million codes, so they are
+//locked quickly; whoever is guessing them already knows the password
+var SecondFactorThrottlePolicy = ThrottlePolicy{FreeFailures: 2, BaseDelay: 5 * time.Second, MaxDelay: time.Minute, LockAfter: 5, LockFor: time.Hour}
+
+var (
+	SecondFactorRequired    error = errors.New("Enter the code from your authenticator app to finish signing in.")
+	BadSecondFactorCode     error = errors.New("That code isn't right. Check that the time on your phone is correct, or use one of your recovery codes.")
+	TwoFactorAlreadyEnabled error = errors.New("Two-factor authentication is already turned on.")
+	TwoFactorNotEnabled     error = errors.New("Two-factor authentication isn't turned on.")
+	TwoFactorNotStarted     error = errors.New("Two-factor authentication setup hasn't been started.")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//Returns a new random secret, base32 encoded for authenticator apps
+func GenerateTotpSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+//Returns the code for the given secret and time step (RFC 4226 section 5.3)
+func totpCodeForStep(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+//Returns the code that an authenticator app would show at time t
+func TotpCode(secret string, t time.Time) (string, error) {
+	return totpCodeForStep(secret, totpStep(t))
+}
+
+//Returns the time step that code is valid for at time now, and whether it is valid at all
+//Steps at or before lastStep are rejected, so that a code can't be used twice
+func matchTotp(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= lastStep {
+			continue
+		}
+		expected, err := totpCodeForStep(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+//removes the spaces and dashes that people type into codes
+func normaliseCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normaliseCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+//Returns new recovery codes (to show to the account's owner once) and the hashes of them to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+//Returns true if the account has set up and confirmed two factor authentication
+func (a *Account) TwoFactorEnabled() bool {
+	return a.TotpEnabled && a.TotpSecret.Valid
+}
+
+//Returns true if the account is an admin that has to set up two factor authentication before doing anything else
+func (a *Account) MustSetUpTwoFactor() bool {
+	return a.IsAdmin() && RequireTwoFactorForAdmins && !a.TwoFactorEnabled()
+}
+
+//Returns how many unused recovery codes the account has
+func (a *Account) RecoveryCodesLeft() int {
+	if a.RecoveryCodes == "" {
+		return 0
+	}
+	return len(strings.Split(a.RecoveryCodes, "\n"))
+}
+
+//Returns the otpauth:// URI that authenticator apps use to add the account (usually by scanning it as a QR code)
+func (a *Account) TotpUri() string {
+	label := url.PathEscape(TotpIssuer + ":" + a.Email)
+	values := url.Values{}
+	values.Set("secret", a.TotpSecret.String)
+	values.Set("issuer", TotpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+//Starts setting up two factor authentication by giving the account a new secret, which isn't used until it is confirmed by EnableTwoFactor
+//If setup was already started, the same secret is kept so that it can be finished
+func (a *Account) BeginTwoFactorSetup(as AccountStorer) error {
+	if a.TwoFactorEnabled() {
+		return TwoFactorAlreadyEnabled
+	}
+	if a.TotpSecret.Valid {
+		return nil
+	}
+	secret, err := GenerateTotpSecret()
+	if err != nil {
+		return err
+	}
+	a.TotpSecret = nullables.NullString{String: secret, Valid: true}
+	a.TotpLastStep = 0
+	return as.SaveAccount(a)
+}
+
+//Turns on two factor authentication once the account's owner has shown that their app works by entering a code from it
+//Returns the new recovery codes, which can only be shown to them now
+func (a *Account) EnableTwoFactor(as AccountStorer, code string, now time.Time) ([]string, error) {
+	if a.TwoFactorEnabled() {
+		return nil, TwoFactorAlreadyEnabled
+	}
+	if !a.TotpSecret.Valid {
+		return nil, TwoFactorNotStarted
+	}
+
+	step, ok := matchTotp(a.TotpSecret.String, normaliseCode(code), now, a.TotpLastStep)
+	if !ok {
+		return nil, BadSecondFactorCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	a.TotpEnabled = true
+	a.TotpLastStep = step
+	a.RecoveryCodes = strings.Join(hashes, "\n")
+	return codes, as.SaveAccount(a)
+}
+
+//Checks a code from the account's authenticator app, or one of its recovery codes (which is then used up)
+//Each authenticator code can only be used once
+func (a *Account) CheckSecondFactor(as AccountStorer, code string, now time.Time) error {
+	if !a.TwoFactorEnabled() {
+		return TwoFactorNotEnabled
+	}
+	code = normaliseCode(code)
+
+	if step, ok := matchTotp(a.TotpSecret.String, code, now, a.TotpLastStep); ok {
+		a.TotpLastStep = step
+		return as.SaveAccount(a)
+	}
+
+	hash := hashRecoveryCode(code)
+	hashes := strings.Split(a.RecoveryCodes, "\n")
+	for i, h := range hashes {
+		if h != "" && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			a.RecoveryCodes = strings.Join(append(hashes[:i:i], hashes[i+1:]...), "\n")
+			return as.SaveAccount(a)
+		}
+	}
+	return BadSecondFactorCode
+}
+
+//Replaces the account's recovery codes with new ones, after checking a code from their app (or a recovery code)
+func (a *Account) RegenerateRecoveryCodes(as AccountStorer, code string, now time.Time) ([]string, error) {
+	if err := a.CheckSecondFactor(as, code, now); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	a.RecoveryCodes = strings.Join(hashes, "\n")
+	return codes, as.SaveAccount(a)
+}
+
+//Turns off two factor authentication, after checking a code from their app (or a recovery code)
+func (a *Account) DisableTwoFactor(as AccountStorer, code string, now time.Time) error {
+	if err := a.CheckSecondFactor(as, code, now); err != nil {
+		return err
+	}
+	a.TotpEnabled = false
+	a.TotpSecret = nullables.NullString{}
+	a.TotpLastStep = 0
+	a.RecoveryCodes = ""
+	return as.SaveAccount(a)
+}
+
+//Finishes checking an account that has two factor authentication, once AttemptLogin has returned SecondFactorRequired
+//Failed codes are counted in the login throttle for the account, so that starting the sign in again doesn't allow more guesses
+//If the code is right, the caller should start a session with StartSession
+func AttemptSecondFactorLogin(as AccountStorer, ts LoginThrottleStorer, accountId int64, code string, now time.Time) (*Account, error) {
+	key := SecondFactorThrottleKey(accountId)
+	if t, err := ts.LoadLoginThrottle(key); err == nil && t.BlockedUntil.Valid && now.Before(t.BlockedUntil.Time) {
+		return nil, &LoginThrottledError{Until: t.BlockedUntil.Time, LockedOut: t.LockedOut, now: now}
+	}
+
+	a, err := as.LoadAccountFromId(accountId)
+	if err != nil {
+		return nil, InvalidUsernameOrPassword
+	}
+	if err := a.CheckSecondFactor(as, code, now); err != nil {
+		if err != BadSecondFactorCode {
+			return nil, err
+		}
+		locked, err := recordFailure(ts, key, SecondFactorThrottlePolicy, now)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			sendEmail(a.Email, "Your account has been locked", "Hello!\r\n\r\nSomeone entered your hey.fyi password and then got your two-factor authentication code wrong "+fmt.Sprint(SecondFactorThrottlePolicy.LockAfter)+" times, so signing in has been locked for the next hour.\r\n\r\nIf this was you, you can try again later.\r\nIf it wasn't, someone knows your password. Please reset it at http://hey.fyi/reset straight away.\r\n\r\nRegards,\r\nhey.fyi")
+			log.Printf("Signing in to %s has been locked after too many failed second factor codes\n", a.Email)
+		}
+		return nil, BadSecondFactorCode
+	}
+	//they may have been suspended since they entered their password
+	if err := a.Suspension(now); err != nil {
+		return nil, err
+	}
+	if err := ts.DeleteLoginThrottle(key); err != nil {
+		return nil, err
+	}
+	return a, a.cancelPasswordReset(as)
+}
+
+func SecondFactorThrottleKey(accountId int64) string {
+	return "2fa:" + strconv.FormatInt(accountId, 10)
+}
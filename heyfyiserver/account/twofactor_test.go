@@ -0,0 +1,193 @@
+package account
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//the SHA1 test vectors from RFC 6238 appendix B, cut down to 6 digits
+func TestTotpCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range tests {
+		if code, err := TotpCode(secret, time.Unix(unix, 0)); err != nil || code != expected {
+			t.Errorf("TotpCode at %d returned %s, %v, expected %s", unix, code, err, expected)
+		}
+	}
+}
+
+func newTwoFactorAccount(t *testing.T) (*Account, DummyAccountStorer) {
+	a := &Account{Id: 2, Email: "twofactor@test", Nickname: "Two factor"}
+	if err := a.SetPassword("testing1+"); err != nil {
+		t.Fatal(err)
+	}
+	as := DummyAccountStorer{OnlyAccount: a}
+	if err := a.BeginTwoFactorSetup(as); err != nil || !a.TotpSecret.Valid {
+		t.Fatal("BeginTwoFactorSetup did not give the account a secret: ", err)
+	}
+	return a, as
+}
+
+func TestEnableTwoFactor(t *testing.T) {
+	a, as := newTwoFactorAccount(t)
+	secret := a.TotpSecret.String
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := a.BeginTwoFactorSetup(as); err != nil || a.TotpSecret.String != secret {
+		t.Fatal("Starting setup again changed the secret")
+	}
+	if !strings.HasPrefix(a.TotpUri(), "otpauth://totp/hey.fyi:twofactor@test?") || !strings.Contains(a.TotpUri(), "secret="+secret) {
+		t.Fatal("TotpUri is wrong: ", a.TotpUri())
+	}
+
+	if _, err := a.EnableTwoFactor(as, "000000", now); err != BadSecondFactorCode || a.TwoFactorEnabled() {
+		t.Fatal("EnableTwoFactor accepted a bad code, got ", err)
+	}
+
+	//a code from the last period is still accepted, in case the phone's clock is slow
+	code, _ := TotpCode(secret, now.Add(-30*time.Second))
+	codes, err := a.EnableTwoFactor(as, code, now)
+	if err != nil || !a.TwoFactorEnabled() || len(codes) != RecoveryCodeCount || a.RecoveryCodesLeft() != RecoveryCodeCount {
+		t.Fatalf("EnableTwoFactor failed, got %v, %v", codes, err)
+	}
+	if strings.Contains(a.RecoveryCodes, codes[0]) || strings.Contains(a.RecoveryCodes, strings.Replace(codes[0], "-", "", 1)) {
+		t.Fatal("The recovery codes were stored without being hashed")
+	}
+	if _, err := a.EnableTwoFactor(as, code, now); err != TwoFactorAlreadyEnabled {
+		t.Fatal("TwoFactorAlreadyEnabled was not returned, got ", err)
+	}
+	if a.MustSetUpTwoFactor() {
+		t.Fatal("MustSetUpTwoFactor is true for an account with two factor authentication")
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	a, as := newTwoFactorAccount(t)
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	code, _ := TotpCode(a.TotpSecret.String, now)
+	codes, err := a.EnableTwoFactor(as, code, now)
+	if err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+
+	//the code used to enable it can't be used again
+	if err := a.CheckSecondFactor(as, code, now); err != BadSecondFactorCode {
+		t.Fatal("A code was accepted twice, got ", err)
+	}
+
+	now = now.Add(time.Minute)
+	code, _ = TotpCode(a.TotpSecret.String, now)
+	if err := a.CheckSecondFactor(as, " "+code[:3]+" "+code[3:], now); err != nil {
+		t.Fatal("CheckSecondFactor rejected a good code: ", err)
+	}
+
+	//codes are only accepted for one period either side of now
+	late, _ := TotpCode(a.TotpSecret.String, now.Add(2*time.Minute))
+	if err := a.CheckSecondFactor(as, late, now); err != BadSecondFactorCode {
+		t.Fatal("A code from the future was accepted, got ", err)
+	}
+
+	//recovery codes work once each, and can be typed in upper case without the dash
+	recovery := strings.ToUpper(strings.Replace(codes[3], "-", "", 1))
+	if err := a.CheckSecondFactor(as, recovery, now); err != nil || a.RecoveryCodesLeft() != RecoveryCodeCount-1 {
+		t.Fatal("CheckSecondFactor rejected a recovery code: ", err)
+	}
+	if err := a.CheckSecondFactor(as, codes[3], now); err != BadSecondFactorCode {
+		t.Fatal("A recovery code was accepted twice, got ", err)
+	}
+
+	newCodes, err := a.RegenerateRecoveryCodes(as, codes[0], now)
+	if err != nil || len(newCodes) != RecoveryCodeCount || a.RecoveryCodesLeft() != RecoveryCodeCount {
+		t.Fatal("RegenerateRecoveryCodes failed: ", err)
+	}
+	if err := a.CheckSecondFactor(as, codes[1], now); err != BadSecondFactorCode {
+		t.Fatal("An old recovery code was accepted after they were regenerated, got ", err)
+	}
+
+	if err := a.DisableTwoFactor(as, newCodes[0], now); err != nil || a.TwoFactorEnabled() || a.TotpSecret.Valid || a.RecoveryCodes != "" {
+		t.Fatal("DisableTwoFactor failed: ", err)
+	}
+	if err := a.CheckSecondFactor(as, newCodes[1], now); err != TwoFactorNotEnabled {
+		t.Fatal("TwoFactorNotEnabled was not returned, got ", err)
+	}
+}
+
+func TestAttemptLoginWithSecondFactor(t *testing.T) {
+	a, as := newTwoFactorAccount(t)
+	now := time.Now()
+	code, _ := TotpCode(a.TotpSecret.String, now.Add(-time.Minute))
+	if _, err := a.EnableTwoFactor(as, code, now.Add(-time.Minute)); err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+
+	pending, err := AttemptLogin(as, "twofactor@test", "testing1+")
+	if err != SecondFactorRequired || pending == nil {
+		t.Fatalf("AttemptLogin did not ask for a second factor, got %+v, %v", pending, err)
+	}
+
+	ts := DummyLoginThrottleStorer{Throttles: make(map[string]*LoginThrottle)}
+	if _, err := AttemptSecondFactorLogin(as, ts, a.Id, "123456", now); err != BadSecondFactorCode {
+		t.Fatal("AttemptSecondFactorLogin accepted a bad code, got ", err)
+	}
+	code, _ = TotpCode(a.TotpSecret.String, now)
+	loggedIn, err := AttemptSecondFactorLogin(as, ts, a.Id, code, now)
+	if err != nil || loggedIn != a {
+		t.Fatalf("AttemptSecondFactorLogin did not return the account, got %+v, %v", loggedIn, err)
+	}
+	if _, err := ts.LoadLoginThrottle(SecondFactorThrottleKey(a.Id)); err == nil {
+		t.Fatal("The failed code was not forgotten after signing in")
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	a, as := newTwoFactorAccount(t)
+	now := time.Now()
+	code, _ := TotpCode(a.TotpSecret.String, now.Add(-time.Minute))
+	if _, err := a.EnableTwoFactor(as, code, now.Add(-time.Minute)); err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+	ts := DummyLoginThrottleStorer{Throttles: make(map[string]*LoginThrottle)}
+
+	//wait out each delay, so that every attempt is counted
+	for i := 0; i < SecondFactorThrottlePolicy.LockAfter; i++ {
+		if _, err := AttemptSecondFactorLogin(as, ts, a.Id, "123456", now); err != BadSecondFactorCode {
+			t.Fatalf("Attempt %d did not return BadSecondFactorCode, got %v", i+1, err)
+		}
+		now = now.Add(SecondFactorThrottlePolicy.MaxDelay)
+	}
+
+	//even the right code is refused until it is unlocked
+	code, _ = TotpCode(a.TotpSecret.String, now)
+	_, err := AttemptSecondFactorLogin(as, ts, a.Id, code, now)
+	if throttled, ok := err.(*LoginThrottledError); !ok || !throttled.LockedOut {
+		t.Fatalf("The second factor was not locked after %d failures, got %#v", SecondFactorThrottlePolicy.LockAfter, err)
+	}
+	if err := ts.DeleteLoginThrottle(SecondFactorThrottleKey(a.Id)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AttemptSecondFactorLogin(as, ts, a.Id, code, now); err != nil {
+		t.Fatal("Signing in after the second factor was unlocked failed: ", err)
+	}
+}
+
+func TestMustSetUpTwoFactor(t *testing.T) {
+	admin := Account{Role: RoleAdmin}
+	if !admin.MustSetUpTwoFactor() {
+		t.Fatal("An admin without two factor authentication does not have to set it up")
+	}
+	RequireTwoFactorForAdmins = false
+	defer func() { RequireTwoFactorForAdmins = true }()
+	if admin.MustSetUpTwoFactor() {
+		t.Fatal("MustSetUpTwoFactor ignored RequireTwoFactorForAdmins")
+	}
+	if (&Account{}).MustSetUpTwoFactor() {
+		t.Fatal("An account that isn't an admin has to set up two factor authentication")
+	}
+}
@@ -0,0 +1,753 @@
+package heyfyiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/nullables"
+)
+
+//Used for the versioned JSON API under ApiUrl. Unlike the rest of the site, every response (including errors) is JSON,
+//and handlers that need an account return an error rather than redirecting to sign in
+type ApiContext struct {
+	*Context
+}
+
+//The largest request body the API will read
+const maxApiRequestSize = 1 << 20
+
+//The body of every API error response
+type apiErrorResponse struct {
+	Error apiError
+}
+
+type apiError struct {
+	Status    int    //the HTTP status code
+	Code      string //the status as a word, eg "not_found", for clients that would rather not compare numbers
+	Message   string //a sentence that can be shown to people
+	Reference *int   `json:",omitempty"` //the index of the reference that caused the error, if one did
+}
+
+var (
+	apiNotSignedIn       = errors.New("You need to sign in to make this request.")
+	apiForbidden         = errors.New("You don't have permission to make this request.")
+	apiFactNotFound      = errors.New("Fact not found.")
+	apiReferenceNotFound = errors.New("Reference not found.")
+)
+
+//Returns true if the request is to the JSON API, whose errors are always JSON
+func isApiRequest(req *web.Request) bool {
+	return req.URL.Path == ApiUrl.String() || strings.HasPrefix(req.URL.Path, ApiUrl.String()+"/")
+}
+
+//Returns true if the request would rather have JSON than HTML, either because its Accept header prefers application/json
+//or because it has ?format=json. Browsers accept */*, which isn't enough, as they should still get the page
+func wantsJSON(req *web.Request) bool {
+	if req.URL.Query().Get("format") == "json" {
+		return true
+	}
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+//Writes v as the JSON body of a response with the given status
+func writeJSON(rw web.ResponseWriter, status int, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(j)
+}
+
+//Writes err as the JSON error envelope with the given status
+func writeJSONError(rw web.ResponseWriter, status int, err error) {
+	body := apiErrorResponse{Error: apiError{
+		Status:  status,
+		Code:    strings.Replace(strings.ToLower(http.StatusText(status)), " ", "_", -1),
+		Message: err.Error(),
+	}}
+	if index, ok := fact.BadReferenceIndex(err); ok {
+		body.Error.Reference = &index
+	}
+	j, _ := json.MarshalIndent(body, "", "\t")
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(j)
+}
+
+//Writes an error as JSON if the request wants it (see wantsJSON), or as the usual "404: Not found" text otherwise
+//For pages that can also be fetched as JSON
+func writeError(rw web.ResponseWriter, req *web.Request, status int, message string) {
+	if wantsJSON(req) {
+		writeJSONError(rw, status, errors.New(message))
+		return
+	}
+	http.Error(rw, strconv.Itoa(status)+": "+message, status)
+}
+
+//Returns the HTTP status that an error from the fact or account packages should be reported with
+func apiStatus(err error) int {
+	if _, ok := fact.BadReferenceIndex(err); ok {
+		return http.StatusUnprocessableEntity
+	}
+	switch err {
+	case fact.AllFieldsAreCompulsory, fact.NotEnoughReferences, fact.BadTagName, fact.TooManyTags,
+		fact.BadModerationDecision, fact.ModerationReasonMissing, fact.ModerationNoteTooLong:
+		return http.StatusUnprocessableEntity
+	case fact.NotAllowedToEdit:
+		return http.StatusForbidden
+	case fact.FactWasRejected, account.NoVotesLeft:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+//MIDDLEWARE
+
+//Answers requests to the API that aren't for anything with a JSON error, and everything else with the usual 404
+func (c *Context) NotFoundHandler(rw web.ResponseWriter, req *web.Request) {
+	if isApiRequest(req) || wantsJSON(req) {
+		writeJSONError(rw, http.StatusNotFound, errors.New("There is nothing at "+req.URL.Path+"."))
+		return
+	}
+	http.Error(rw, "404: Page not found", http.StatusNotFound)
+}
+
+//Writes a 403 and returns false if the request was made with an API token that doesn't have the scope. Requests made
+//by someone signed in on the site can do anything that their account can
+func (c *ApiContext) allow(rw web.ResponseWriter, scope account.Scope) bool {
+	if c.ApiToken != nil && !c.ApiToken.Allows(scope) {
+		writeJSONError(rw, http.StatusForbidden, errors.New("This API token can't make this request, as it doesn't have the \""+string(scope)+"\" scope."))
+		return false
+	}
+	return true
+}
+
+//Writes a 401 and returns false if nobody is signed in, or a 403 if their API token doesn't have the scope
+func (c *ApiContext) requireAccount(rw web.ResponseWriter, scope account.Scope) bool {
+	if c.Account == nil {
+		writeJSONError(rw, http.StatusUnauthorized, apiNotSignedIn)
+		return false
+	}
+	return c.allow(rw, scope)
+}
+
+//Decodes the JSON request body into v, writing a 400 and returning false if it can't be
+func decodeApiRequest(rw web.ResponseWriter, req *web.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxApiRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, errors.New("Bad request body: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+//REPRESENTATIONS
+
+//Returns the time, or nil if it isn't set
+func apiTime(t nullables.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+//A fact as listed by the API. Facts fetched on their own (apiFact) also have their explanations, references, tags and votes
+type apiFactSummary struct {
+	Id              int64
+	Fact            string
+	State           fact.ModerationState
+	AwaitModeration bool
+	AuthorId        int64
+	CreatedAt       *time.Time
+	EditedAt        *time.Time
+	Url             string //the fact's page on the site
+}
+
+type apiFact struct {
+	apiFactSummary
+	Explain        string
+	ExplainFurther string
+	Tags           []string
+	References     []apiReference
+	Score          fact.VoteScore //AccountVote is the signed in account's vote
+}
+
+//Editing a fact (or any of its references) gives all of its references new Ids
+type apiReference struct {
+	Id            int64
+	Url           string
+	Publisher     string
+	Title         string
+	LinkBroken    bool
+	LinkCheckedAt *time.Time
+}
+
+//The current account, which is all that the API shows of accounts
+type apiAccount struct {
+	Id               int64
+	Email            string
+	Nickname         string
+	Role             account.Role
+	Permissions      []account.Permission
+	VoteBank         int64
+	TwoFactorEnabled bool
+	CreatedAt        *time.Time
+	Scopes           []account.Scope `json:",omitempty"` //what the API token the request was made with can do, if it was made with one
+}
+
+type apiFactPage struct {
+	Page     int
+	PageSize int
+	Pages    int
+	Total    int64
+	Facts    []apiFactSummary
+}
+
+type apiVotes struct {
+	FactId   int64
+	Score    fact.VoteScore
+	VoteBank int64 //the signed in account's vote bank, or 0 if nobody is
+}
+
+func newApiFactSummary(f *fact.Fact) apiFactSummary {
+	return apiFactSummary{
+		Id:              f.Id,
+		Fact:            f.Fact,
+		State:           f.State(),
+		AwaitModeration: f.AwaitModeration,
+		AuthorId:        f.AccountId,
+		CreatedAt:       apiTime(f.CreatedAt),
+		EditedAt:        apiTime(f.EditedAt),
+		Url:             GetViewFactUrl(f.Id),
+	}
+}
+
+func newApiReference(r fact.Reference) apiReference {
+	return apiReference{
+		Id:            r.Id,
+		Url:           r.Url,
+		Publisher:     r.Publisher,
+		Title:         r.Title,
+		LinkBroken:    r.LinkBroken(),
+		LinkCheckedAt: apiTime(r.LinkCheckedAt),
+	}
+}
+
+func newApiReferences(references []fact.Reference) []apiReference {
+	list := []apiReference{}
+	for _, r := range references {
+		list = append(list, newApiReference(r))
+	}
+	return list
+}
+
+//viewerId is the signed in account, whose vote is given in Score.AccountVote
+func newApiFact(f *fact.Fact, viewerId int64) apiFact {
+	tags := []string{}
+	for _, t := range f.Tags {
+		tags = append(tags, t.Name)
+	}
+	return apiFact{
+		apiFactSummary: newApiFactSummary(f),
+		Explain:        f.Explain,
+		ExplainFurther: f.ExplainFurther,
+		Tags:           tags,
+		References:     newApiReferences(f.References),
+		Score:          f.GetScore(viewerId),
+	}
+}
+
+func newApiFactPage(page *fact.FactPage) apiFactPage {
+	response := apiFactPage{
+		Page:     page.Query.Page,
+		PageSize: page.Query.PageSize,
+		Pages:    page.Pages(),
+		Total:    page.Total,
+		Facts:    []apiFactSummary{},
+	}
+	for i := range page.Facts {
+		response.Facts = append(response.Facts, newApiFactSummary(&page.Facts[i]))
+	}
+	return response
+}
+
+func newApiAccount(a *account.Account) apiAccount {
+	permissions := a.Role.Permissions()
+	if permissions == nil {
+		permissions = []account.Permission{}
+	}
+	return apiAccount{
+		Id:               a.Id,
+		Email:            a.Email,
+		Nickname:         a.Nickname,
+		Role:             a.Role,
+		Permissions:      permissions,
+		VoteBank:         a.VoteBank,
+		TwoFactorEnabled: a.TotpEnabled,
+		CreatedAt:        apiTime(a.CreatedAt),
+	}
+}
+
+//Returns the id of the signed in account, or 0 if nobody is
+func (c *Context) viewerId() int64 {
+	if c.Account == nil {
+		return 0
+	}
+	return c.Account.Id
+}
+
+//REQUESTS
+
+//A reference as it is sent to the API to add or change one
+type apiReferenceRequest struct {
+	Url       string
+	Publisher string
+	Title     string
+}
+
+//A fact as it is sent to the API to submit one
+type apiFactRequest struct {
+	Fact           string
+	Explain        string
+	ExplainFurther string
+	Tags           []string
+	References     []apiReferenceRequest
+}
+
+//Changes to a fact. Only the fields that are given are changed, and References (if given) replaces all of them
+type apiFactPatch struct {
+	Fact           *string
+	Explain        *string
+	ExplainFurther *string
+	Tags           *[]string
+	References     *[]apiReferenceRequest
+}
+
+//Changes to a reference. Only the fields that are given are changed
+type apiReferencePatch struct {
+	Url       *string
+	Publisher *string
+	Title     *string
+}
+
+type apiVoteRequest struct {
+	Up bool
+}
+
+type apiModerationRequest struct {
+	Decision fact.ModerationDecision //"approve", "reject" or "request_changes"
+	Reason   string                  //shown to the fact's author, and needed for anything but approving
+}
+
+func (r apiReferenceRequest) reference() fact.Reference {
+	return fact.Reference{Url: r.Url, Publisher: r.Publisher, Title: r.Title}
+}
+
+func apiTags(names []string) []fact.Tag {
+	tags := []fact.Tag{}
+	for _, name := range names {
+		tags = append(tags, fact.Tag{Name: name})
+	}
+	return tags
+}
+
+func apiReferences(requests []apiReferenceRequest) []fact.Reference {
+	var references []fact.Reference
+	for _, r := range requests {
+		references = append(references, r.reference())
+	}
+	return references
+}
+
+//Returns a copy of f that can be changed and passed to editFact, without changing f's references
+func editableFact(f *fact.Fact) fact.Fact {
+	edited := *f
+	edited.References = append([]fact.Reference(nil), f.References...)
+	return edited
+}
+
+//HANDLERS
+
+//Loads the fact in the URL, writing a 404 and returning false if it doesn't exist or the signed in account can't see it
+func (c *ApiContext) loadFact(rw web.ResponseWriter, req *web.Request) (*fact.Fact, bool) {
+	factId, err := strconv.ParseInt(req.PathParams["factId"], 10, 64)
+	if err != nil {
+		writeJSONError(rw, http.StatusNotFound, apiFactNotFound)
+		return nil, false
+	}
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil || !c.CanViewFact(f) {
+		writeJSONError(rw, http.StatusNotFound, apiFactNotFound)
+		return nil, false
+	}
+	return f, true
+}
+
+//Loads the fact in the URL to be edited by the signed in account
+func (c *ApiContext) loadFactToEdit(rw web.ResponseWriter, req *web.Request) (*fact.Fact, bool) {
+	if !c.requireAccount(rw, account.ScopeSubmit) {
+		return nil, false
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return nil, false
+	}
+	if f.AccountId != c.Account.Id && !c.Can(account.EditAnyFact) {
+		writeJSONError(rw, http.StatusForbidden, fact.NotAllowedToEdit)
+		return nil, false
+	}
+	return f, true
+}
+
+//Returns the index in f.References of the reference in the URL, writing a 404 and returning false if it isn't one of them
+func findApiReference(rw web.ResponseWriter, req *web.Request, f *fact.Fact) (int, bool) {
+	referenceId, err := strconv.ParseInt(req.PathParams["referenceId"], 10, 64)
+	if err == nil {
+		for i, r := range f.References {
+			if r.Id == referenceId {
+				return i, true
+			}
+		}
+	}
+	writeJSONError(rw, http.StatusNotFound, apiReferenceNotFound)
+	return 0, false
+}
+
+//Saves edited as the new version of f and writes the fact as it now is, or the error if it can't be saved
+func (c *ApiContext) saveEdit(rw web.ResponseWriter, req *web.Request, f *fact.Fact, edited fact.Fact, status int, respond func(f *fact.Fact) interface{}) {
+	if err := c.editFact(req, f, edited); err != nil {
+		writeJSONError(rw, apiStatus(err), err)
+		return
+	}
+	f, err := c.Storage.LoadFactFromId(f.Id)
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, status, respond(f))
+}
+
+//Lists facts, with the same query string as ListFactUrl
+func (c *ApiContext) ListFactsHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.allow(rw, account.ScopeRead) {
+		return
+	}
+	q, err := factQueryFromUrl(req.URL.Query())
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err)
+		return
+	}
+	page, err := c.Storage.ListFacts(c.visibleTo(q))
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, newApiFactPage(page))
+}
+
+//Submits a fact (an apiFactRequest) for the signed in account, responding with it as it was saved
+func (c *ApiContext) CreateFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.requireAccount(rw, account.ScopeSubmit) {
+		return
+	}
+	var request apiFactRequest
+	if !decodeApiRequest(rw, req, &request) {
+		return
+	}
+
+	f := fact.Fact{
+		Fact:           request.Fact,
+		Explain:        request.Explain,
+		ExplainFurther: request.ExplainFurther,
+		Tags:           apiTags(request.Tags),
+		References:     apiReferences(request.References),
+	}
+	if err := c.createFact(req, &f); err != nil {
+		writeJSONError(rw, apiStatus(err), err)
+		return
+	}
+
+	saved, err := c.Storage.LoadFactFromId(f.Id)
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set("Location", GetApiFactUrl(saved.Id))
+	writeJSON(rw, http.StatusCreated, newApiFact(saved, c.Account.Id))
+}
+
+func (c *ApiContext) ViewFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.allow(rw, account.ScopeRead) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, newApiFact(f, c.viewerId()))
+}
+
+//Changes the fields given in an apiFactPatch, the same way as editing the fact on the site
+func (c *ApiContext) EditFactHandler(rw web.ResponseWriter, req *web.Request) {
+	f, ok := c.loadFactToEdit(rw, req)
+	if !ok {
+		return
+	}
+	var patch apiFactPatch
+	if !decodeApiRequest(rw, req, &patch) {
+		return
+	}
+
+	edited := editableFact(f)
+	if patch.Fact != nil {
+		edited.Fact = *patch.Fact
+	}
+	if patch.Explain != nil {
+		edited.Explain = *patch.Explain
+	}
+	if patch.ExplainFurther != nil {
+		edited.ExplainFurther = *patch.ExplainFurther
+	}
+	if patch.Tags != nil {
+		edited.Tags = apiTags(*patch.Tags)
+	}
+	if patch.References != nil {
+		edited.References = apiReferences(*patch.References)
+	}
+
+	c.saveEdit(rw, req, f, edited, http.StatusOK, func(f *fact.Fact) interface{} {
+		return newApiFact(f, c.Account.Id)
+	})
+}
+
+func (c *ApiContext) DeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.requireAccount(rw, account.ScopeSubmit) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	if !c.CanDeleteFact(f) {
+		writeJSONError(rw, http.StatusForbidden, apiForbidden)
+		return
+	}
+	if err := c.deleteFact(req, f); err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ApiContext) ListReferencesHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.allow(rw, account.ScopeRead) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, newApiReferences(f.References))
+}
+
+//Adds a reference (an apiReferenceRequest) to the fact, responding with it
+func (c *ApiContext) CreateReferenceHandler(rw web.ResponseWriter, req *web.Request) {
+	f, ok := c.loadFactToEdit(rw, req)
+	if !ok {
+		return
+	}
+	var request apiReferenceRequest
+	if !decodeApiRequest(rw, req, &request) {
+		return
+	}
+
+	edited := editableFact(f)
+	edited.References = append(edited.References, request.reference())
+	c.saveEdit(rw, req, f, edited, http.StatusCreated, func(f *fact.Fact) interface{} {
+		//references are saved in order, so the new one is last
+		return newApiReference(f.References[len(f.References)-1])
+	})
+}
+
+func (c *ApiContext) ViewReferenceHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.allow(rw, account.ScopeRead) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	i, ok := findApiReference(rw, req, f)
+	if !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, newApiReference(f.References[i]))
+}
+
+//Changes the fields given in an apiReferencePatch, responding with the reference (which has a new Id)
+func (c *ApiContext) EditReferenceHandler(rw web.ResponseWriter, req *web.Request) {
+	f, ok := c.loadFactToEdit(rw, req)
+	if !ok {
+		return
+	}
+	i, ok := findApiReference(rw, req, f)
+	if !ok {
+		return
+	}
+	var patch apiReferencePatch
+	if !decodeApiRequest(rw, req, &patch) {
+		return
+	}
+
+	edited := editableFact(f)
+	r := &edited.References[i]
+	if patch.Url != nil {
+		r.Url = *patch.Url
+	}
+	if patch.Publisher != nil {
+		r.Publisher = *patch.Publisher
+	}
+	if patch.Title != nil {
+		r.Title = *patch.Title
+	}
+	c.saveEdit(rw, req, f, edited, http.StatusOK, func(f *fact.Fact) interface{} {
+		return newApiReference(f.References[i])
+	})
+}
+
+//Removes a reference from the fact, which has to keep at least two
+func (c *ApiContext) DeleteReferenceHandler(rw web.ResponseWriter, req *web.Request) {
+	f, ok := c.loadFactToEdit(rw, req)
+	if !ok {
+		return
+	}
+	i, ok := findApiReference(rw, req, f)
+	if !ok {
+		return
+	}
+
+	edited := editableFact(f)
+	edited.References = append(edited.References[:i], edited.References[i+1:]...)
+	if err := c.editFact(req, f, edited); err != nil {
+		writeJSONError(rw, apiStatus(err), err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+//Responds with the fact's votes, and the signed in account's vote on it
+func (c *ApiContext) ViewVotesHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.allow(rw, account.ScopeRead) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	response := apiVotes{FactId: f.Id, Score: f.GetScore(c.viewerId())}
+	if c.Account != nil {
+		response.VoteBank = c.Account.VoteBank
+	}
+	writeJSON(rw, http.StatusOK, response)
+}
+
+//Votes the fact up or down by one (an apiVoteRequest), the same way as the buttons on the site
+func (c *ApiContext) VoteHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.requireAccount(rw, account.ScopeVote) {
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	var request apiVoteRequest
+	if !decodeApiRequest(rw, req, &request) {
+		return
+	}
+
+	if err := c.castVote(req, f, request.Up); err != nil {
+		writeJSONError(rw, apiStatus(err), err)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(f.Id)
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, apiVotes{FactId: f.Id, Score: f.GetScore(c.Account.Id), VoteBank: c.Account.VoteBank})
+}
+
+//Approves, rejects or asks for changes to the fact (an apiModerationRequest), the same way as the moderation queue
+func (c *ApiContext) ModerateFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.requireAccount(rw, account.ScopeModerate) {
+		return
+	}
+	if !c.Can(account.ModerateFact) {
+		writeJSONError(rw, http.StatusForbidden, apiForbidden)
+		return
+	}
+	f, ok := c.loadFact(rw, req)
+	if !ok {
+		return
+	}
+	var request apiModerationRequest
+	if !decodeApiRequest(rw, req, &request) {
+		return
+	}
+
+	if err := c.moderate(req, f, request.Decision, request.Reason); err != nil {
+		writeJSONError(rw, apiStatus(err), err)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(f.Id)
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, newApiFact(f, c.Account.Id))
+}
+
+//Responds with the signed in account
+func (c *ApiContext) AccountHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.requireAccount(rw, account.ScopeRead) {
+		return
+	}
+	response := newApiAccount(c.Account)
+	if c.ApiToken != nil {
+		response.Scopes = c.ApiToken.ScopeList()
+	}
+	writeJSON(rw, http.StatusOK, response)
+}
@@ -0,0 +1,255 @@
+//Package audit records who changed what on hey.fyi, so that moderation, account management and everything else that
+//changes state can be looked back on. Events are only ever added, never changed or deleted.
+package audit
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiwih/nullables"
+)
+
+//What was done
+type Action string
+
+const (
+	SignUp                  Action = "account.signup"
+	Verify                  Action = "account.verify"
+	ResendVerification      Action = "account.resend_verification"
+	RequestPasswordReset    Action = "account.request_password_reset"
+	ResetPassword           Action = "account.reset_password"
+	SignIn                  Action = "account.signin"
+	SignOut                 Action = "account.signout"
+	ExternalSignIn          Action = "account.external_signin" //signing in with an identity provider, which can link it to an account or make one
+	EnableTwoFactor         Action = "account.enable_two_factor"
+	DisableTwoFactor        Action = "account.disable_two_factor"
+	RegenerateRecoveryCodes Action = "account.regenerate_recovery_codes"
+	RevokeSession           Action = "account.revoke_session"
+	RevokeAllSessions       Action = "account.revoke_all_sessions"
+	CreateApiToken          Action = "account.create_api_token"
+	RevokeApiToken          Action = "account.revoke_api_token"
+	UnlockLogin             Action = "account.unlock_login"
+	SetRole                 Action = "account.set_role"
+	VerifyFor               Action = "account.admin_verify"
+	Suspend                 Action = "account.suspend"
+	Ban                     Action = "account.ban"
+	Reinstate               Action = "account.reinstate"
+	ResetVoteBank           Action = "account.reset_vote_bank"
+	ForcePasswordReset      Action = "account.force_password_reset"
+	ExpireSessions          Action = "account.expire_sessions"
+	GiveVotes               Action = "account.give_votes" //the daily vote given to every account
+
+	CreateFact     Action = "fact.create"
+	EditFact       Action = "fact.edit"
+	RollbackFact   Action = "fact.rollback"
+	DeleteFact     Action = "fact.delete"
+	ModerateFact   Action = "fact.moderate"
+	ModerationNote Action = "fact.moderation_note"
+	Vote           Action = "fact.vote"
+
+	CreateComment Action = "comment.create"
+	EditComment   Action = "comment.edit"
+	DeleteComment Action = "comment.delete"
+	HideComment   Action = "comment.hide"
+
+	RenameTag Action = "tag.rename"
+	MergeTag  Action = "tag.merge"
+)
+
+//Every action, in the order they are offered when filtering the audit log
+var Actions = []Action{
+	SignUp, Verify, ResendVerification, RequestPasswordReset, ResetPassword, SignIn, SignOut, ExternalSignIn,
+	EnableTwoFactor, DisableTwoFactor, RegenerateRecoveryCodes, RevokeSession, RevokeAllSessions, CreateApiToken, RevokeApiToken,
+	UnlockLogin, SetRole, VerifyFor, Suspend, Ban, Reinstate, ResetVoteBank, ForcePasswordReset, ExpireSessions, GiveVotes,
+	CreateFact, EditFact, RollbackFact, DeleteFact, ModerateFact, ModerationNote, Vote,
+	CreateComment, EditComment, DeleteComment, HideComment,
+	RenameTag, MergeTag,
+}
+
+//What kind of thing an action was done to
+type TargetType string
+
+const (
+	NoTarget      TargetType = ""
+	TargetAccount TargetType = "account"
+	TargetSession TargetType = "session"
+	TargetToken   TargetType = "api_token"
+	TargetFact    TargetType = "fact"
+	TargetComment TargetType = "comment"
+	TargetTag     TargetType = "tag"
+	TargetLogin   TargetType = "login" //a locked sign in, which is described by Before as it doesn't have an id
+)
+
+var TargetTypes = []TargetType{TargetAccount, TargetSession, TargetToken, TargetFact, TargetComment, TargetTag, TargetLogin}
+
+//The longest Before or After is allowed to be. Longer summaries are cut short
+const MaxSummaryLength = 1000
+
+//An AuditEvent records one change: who made it (ActorId, or 0 if nobody was signed in or the server did it itself),
+//what they did, what they did it to, and a summary of what it was like before and after
+type AuditEvent struct {
+	Id         int64
+	ActorId    int64
+	Action     Action     `sql:"type:varchar(40)"`
+	TargetType TargetType `sql:"type:varchar(20)"`
+	TargetId   int64
+	Before     string `sql:"type:text"`
+	After      string `sql:"type:text"`
+	Ip         string `sql:"type:varchar(45)"`
+	CreatedAt  nullables.NullTime
+}
+
+//AuditStorer saves and lists audit events. There is deliberately no way to change or delete them
+type AuditStorer interface {
+	//Runs change and then saves e, both in one transaction, so that there is never a change without its event or an event
+	//without its change. change is given the storage to make the change with, which is the same kind of storage as the
+	//AuditStorer but may only be used until change returns. If change returns an error, nothing is saved
+	Audited(e *AuditEvent, change func(tx interface{}) error) error
+	ListAuditEvents(q AuditQuery) (*AuditPage, error)
+}
+
+//Returns s cut short to MaxSummaryLength bytes (without splitting a character), for an event's Before or After
+func Summarise(s string) string {
+	if len(s) <= MaxSummaryLength {
+		return s
+	}
+	s = s[:MaxSummaryLength]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "…"
+}
+
+const (
+	DefaultAuditPageSize = 50
+	MaxAuditPageSize     = 500
+)
+
+//AuditQuery describes one page of the audit log, which is listed newest first
+type AuditQuery struct {
+	ActorId       int64      //0 for anyone
+	Action        Action     //"" for any action
+	TargetType    TargetType //"" for any type
+	TargetId      int64      //0 for any target
+	CreatedAfter  time.Time  //zero for no limit
+	CreatedBefore time.Time  //zero for no limit
+
+	Page     int //starting from 1
+	PageSize int
+}
+
+//AuditPage is one page of events returned by ListAuditEvents, along with how many matched in total
+type AuditPage struct {
+	Query  AuditQuery
+	Events []AuditEvent
+	Total  int64
+}
+
+//Returns the query with the page and page size set to sensible values if they were missing or out of range
+func (q AuditQuery) Normalised() AuditQuery {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = DefaultAuditPageSize
+	}
+	if q.PageSize > MaxAuditPageSize {
+		q.PageSize = MaxAuditPageSize
+	}
+	return q
+}
+
+//The number of events to skip before this page starts
+func (q AuditQuery) Offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+//Returns true if e is one of the events the query asks for (ignoring its page)
+func (q AuditQuery) Matches(e *AuditEvent) bool {
+	if q.ActorId != 0 && e.ActorId != q.ActorId {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action {
+		return false
+	}
+	if q.TargetType != NoTarget && e.TargetType != q.TargetType {
+		return false
+	}
+	if q.TargetId != 0 && e.TargetId != q.TargetId {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && e.CreatedAt.Time.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !e.CreatedAt.Time.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+//The number of pages needed for every matching event
+func (p AuditPage) Pages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.Query.PageSize) - 1) / int64(p.Query.PageSize))
+}
+
+func (p AuditPage) HasPrevious() bool {
+	return p.Query.Page > 1
+}
+
+func (p AuditPage) HasNext() bool {
+	return p.Query.Page < p.Pages()
+}
+
+func (p AuditPage) PreviousPage() int {
+	return p.Query.Page - 1
+}
+
+func (p AuditPage) NextPage() int {
+	return p.Query.Page + 1
+}
+
+//The columns written by WriteCSV
+var CSVHeader = []string{"id", "time", "actor_id", "action", "target_type", "target_id", "before", "after", "ip"}
+
+//Stops spreadsheets from treating a summary (which can be anything someone typed) as a formula when the CSV is opened
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+//Writes the events to w as CSV, after a header row if header is true
+func WriteCSV(w io.Writer, events []AuditEvent, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write(CSVHeader); err != nil {
+			return err
+		}
+	}
+	for _, e := range events {
+		row := []string{
+			strconv.FormatInt(e.Id, 10),
+			e.CreatedAt.Time.UTC().Format(time.RFC3339),
+			strconv.FormatInt(e.ActorId, 10),
+			string(e.Action),
+			string(e.TargetType),
+			strconv.FormatInt(e.TargetId, 10),
+			csvSafe(e.Before),
+			csvSafe(e.After),
+			e.Ip,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
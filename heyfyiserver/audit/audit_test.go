@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiwih/nullables"
+)
+
+func TestSummarise(t *testing.T) {
+	if s := Summarise("short"); s != "short" {
+		t.Error("Summarise changed a short summary to ", s)
+	}
+
+	long := strings.Repeat("a", MaxSummaryLength-1) + "é" //é is two bytes, so it would be split at MaxSummaryLength
+	s := Summarise(long)
+	if !utf8.ValidString(s) {
+		t.Error("Summarise split a character")
+	}
+	if s != strings.Repeat("a", MaxSummaryLength-1)+"…" {
+		t.Error("Summarise didn't cut the summary short, got ", len(s), " bytes")
+	}
+}
+
+func TestNormalised(t *testing.T) {
+	tests := []struct {
+		in       AuditQuery
+		page     int
+		pageSize int
+	}{
+		{AuditQuery{}, 1, DefaultAuditPageSize},
+		{AuditQuery{Page: -2, PageSize: -5}, 1, DefaultAuditPageSize},
+		{AuditQuery{Page: 3, PageSize: 10}, 3, 10},
+		{AuditQuery{PageSize: MaxAuditPageSize + 1}, 1, MaxAuditPageSize},
+	}
+	for _, test := range tests {
+		q := test.in.Normalised()
+		if q.Page != test.page || q.PageSize != test.pageSize {
+			t.Errorf("%+v normalised to page %d of size %d", test.in, q.Page, q.PageSize)
+		}
+	}
+	if offset := (AuditQuery{Page: 3, PageSize: 10}).Offset(); offset != 20 {
+		t.Error("Offset returned ", offset)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	now := time.Now()
+	e := &AuditEvent{ActorId: 2, Action: EditFact, TargetType: TargetFact, TargetId: 5, CreatedAt: nullables.NullTime{Time: now, Valid: true}}
+
+	tests := []struct {
+		q       AuditQuery
+		matches bool
+	}{
+		{AuditQuery{}, true},
+		{AuditQuery{ActorId: 2, Action: EditFact, TargetType: TargetFact, TargetId: 5}, true},
+		{AuditQuery{ActorId: 3}, false},
+		{AuditQuery{Action: DeleteFact}, false},
+		{AuditQuery{TargetType: TargetComment}, false},
+		{AuditQuery{TargetId: 6}, false},
+		{AuditQuery{CreatedAfter: now, CreatedBefore: now.Add(time.Second)}, true},
+		{AuditQuery{CreatedAfter: now.Add(time.Second)}, false},
+		{AuditQuery{CreatedBefore: now}, false},
+	}
+	for _, test := range tests {
+		if test.q.Matches(e) != test.matches {
+			t.Errorf("%+v Matches returned %v", test.q, !test.matches)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	created := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+	events := []AuditEvent{
+		{Id: 1, ActorId: 2, Action: EditFact, TargetType: TargetFact, TargetId: 3, Before: "old, \"quoted\"", After: "=HYPERLINK(\"x\")", Ip: "203.0.113.1", CreatedAt: nullables.NullTime{Time: created, Valid: true}},
+		{Id: 2, Action: GiveVotes, TargetType: TargetAccount, After: "-1", CreatedAt: nullables.NullTime{Time: created, Valid: true}},
+	}
+
+	var b bytes.Buffer
+	if err := WriteCSV(&b, events, true); err != nil {
+		t.Fatal("WriteCSV failed: ", err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal("WriteCSV wrote bad CSV: ", err)
+	}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(CSVHeader, ",") {
+		t.Fatal("WriteCSV wrote ", rows)
+	}
+	expected := []string{"1", "2016-03-04T05:06:07Z", "2", "fact.edit", "fact", "3", "old, \"quoted\"", "'=HYPERLINK(\"x\")", "203.0.113.1"}
+	if strings.Join(rows[1], "|") != strings.Join(expected, "|") {
+		t.Error("WriteCSV wrote ", rows[1])
+	}
+	if rows[2][6] != "" || rows[2][7] != "'-1" {
+		t.Error("WriteCSV wrote ", rows[2])
+	}
+
+	b.Reset()
+	if err := WriteCSV(&b, events[:1], false); err != nil {
+		t.Fatal("WriteCSV failed: ", err)
+	}
+	if rows, _ := csv.NewReader(&b).ReadAll(); len(rows) != 1 {
+		t.Error("WriteCSV wrote a header when it wasn't asked to: ", rows)
+	}
+}
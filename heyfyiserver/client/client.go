@@ -0,0 +1,567 @@
+//Package client is a Go client for the hey.fyi JSON API, so that services that submit and read facts don't have to make
+//the HTTP requests themselves. Facts, references and votes are given as the same fact.Fact, fact.Reference and
+//fact.VoteScore types that the server uses
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/nullables"
+)
+
+//A Client makes requests to one hey.fyi server, either as nobody, as the account an API token belongs to, or as the
+//account that SignIn started a session for
+//Requests that fail because the server couldn't be reached or was unavailable are retried, waiting longer each time
+type Client struct {
+	HttpClient *http.Client //its cookie jar keeps the session that SignIn starts
+
+	MaxRetries    int           //how many times a failed request is tried again
+	RetryDelay    time.Duration //how long to wait before the first retry, which doubles for each retry after it
+	MaxRetryDelay time.Duration //the longest to wait before any retry
+
+	baseUrl string
+	token   string
+
+	mu        sync.Mutex
+	csrfToken string //the latest CSRF token the server gave, which requests made with a session have to send back
+}
+
+//The server's error responses
+type Error struct {
+	Status    int    //the HTTP status code
+	Code      string //the status as a word, eg "not_found" (only the /api/v1 endpoints give this)
+	Message   string //a sentence that can be shown to people
+	Reference *int   //the index of the reference that caused the error, if one did
+}
+
+var (
+	SignInFailed      error = errors.New("The email address or password was wrong, or the account can't sign in right now.")
+	TwoFactorRequired error = errors.New("The account needs a code from an authenticator app to sign in. Please use an API token instead.")
+)
+
+const (
+	DefaultMaxRetries    = 3
+	DefaultRetryDelay    = 500 * time.Millisecond
+	DefaultMaxRetryDelay = 30 * time.Second
+
+	maxResponseSize = 10 << 20
+
+	dateFormat = "2006-01-02" //how the from and to dates of a fact list are given
+
+	//the server's URLs that the client uses
+	apiFactsUrl      = "/api/v1/facts"
+	apiAccountUrl    = "/api/v1/account"
+	searchFactApiUrl = "/api/search"
+	signInUrl        = "/signin"
+	signInTwoFactor  = "/signin/twofactor"
+
+	csrfFormField = "CsrfToken"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+//A fact as the API gives it, which is a fact.Fact (without its Votes) along with its score
+type Fact struct {
+	fact.Fact
+	Score fact.VoteScore //AccountVote is the vote of the account the client is using
+	Url   string         //the fact's page on the site
+}
+
+//One page of facts, as given by ListFacts. Listed facts don't have their explanations, references, tags or score, so
+//use GetFact for those
+type FactPage struct {
+	Page     int
+	PageSize int
+	Pages    int
+	Total    int64
+	Facts    []Fact
+}
+
+//One search result, as given by SearchFacts. Fact and Snippet are HTML, with the search terms highlighted
+type SearchResult struct {
+	fact.SearchResult
+	Url string
+}
+
+//One page of search results, as given by SearchFacts
+type SearchPage struct {
+	Terms    string
+	Page     int
+	PageSize int
+	Pages    int
+	Total    int64
+	Results  []SearchResult
+}
+
+//The votes on a fact
+type Votes struct {
+	FactId   int64
+	Score    fact.VoteScore
+	VoteBank int64 //the vote bank of the account the client is using, or 0 if it isn't using one
+}
+
+//The account that the client is using
+type Account struct {
+	Id               int64
+	Email            string
+	Nickname         string
+	Role             account.Role
+	Permissions      []account.Permission
+	VoteBank         int64
+	TwoFactorEnabled bool
+	CreatedAt        *time.Time
+	Scopes           []account.Scope //what the client's API token can do, if it is using one
+}
+
+//Returns a client for the server at baseUrl (eg "https://hey.fyi"), which isn't signed in to any account
+func New(baseUrl string) *Client {
+	jar, _ := cookiejar.New(nil) //only fails if given options
+	return &Client{
+		HttpClient:    &http.Client{Jar: jar},
+		MaxRetries:    DefaultMaxRetries,
+		RetryDelay:    DefaultRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+		baseUrl:       strings.TrimRight(baseUrl, "/"),
+	}
+}
+
+//Returns a client for the server at baseUrl that uses an API token, which can be made on the site's API tokens page
+func NewWithToken(baseUrl string, token string) *Client {
+	c := New(baseUrl)
+	c.token = token
+	return c
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+//SESSIONS
+
+//Signs in with an email address and password, so that the client uses the account's session (kept in the client's
+//cookie jar) from now on. Accounts that need a code from an authenticator app can't sign in this way, and should use an
+//API token instead
+func (c *Client) SignIn(ctx context.Context, email string, password string) error {
+	//the sign in form needs a CSRF token like any other, which comes with every response
+	if c.getCsrfToken() == "" {
+		if _, err := c.Account(ctx); err != nil {
+			if e, ok := err.(*Error); !ok || e.Status != http.StatusUnauthorized {
+				return err
+			}
+		}
+	}
+	form := url.Values{"Email": {email}, "Password": {password}, csrfFormField: {c.getCsrfToken()}}
+
+	//the server redirects after signing in, and where to tells us whether it needs a second factor
+	hc := *c.HttpClient
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := c.send(ctx, &hc, http.MethodPost, c.baseUrl+signInUrl, "application/x-www-form-urlencoded", []byte(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+	if strings.HasPrefix(resp.Header.Get("Location"), signInTwoFactor) {
+		return TwoFactorRequired
+	}
+
+	//signing in redirects to the home page whether it worked or not, so check that there is a session now
+	if _, err := c.Account(ctx); err != nil {
+		if e, ok := err.(*Error); ok && e.Status == http.StatusUnauthorized {
+			return SignInFailed
+		}
+		return err
+	}
+	return nil
+}
+
+//Returns the account that the client is using
+func (c *Client) Account(ctx context.Context) (*Account, error) {
+	var a Account
+	if err := c.do(ctx, http.MethodGet, apiAccountUrl, nil, nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+//FACTS
+
+//Returns one page of the facts that q lists. ViewerId and ViewUnmoderated are ignored, as the server works them out
+//from the account the client is using, and only the dates of CreatedAfter and CreatedBefore are used
+func (c *Client) ListFacts(ctx context.Context, q fact.FactQuery) (*FactPage, error) {
+	values := url.Values{}
+	if q.Page != 0 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PageSize != 0 {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	if q.AuthorId != 0 {
+		values.Set("author", strconv.FormatInt(q.AuthorId, 10))
+	}
+	if q.Tag != "" {
+		values.Set("tag", q.Tag)
+	}
+	if q.Moderation != fact.AnyModeration {
+		values.Set("state", string(q.Moderation))
+	}
+	if !q.CreatedAfter.IsZero() {
+		values.Set("from", q.CreatedAfter.Format(dateFormat))
+	}
+	if !q.CreatedBefore.IsZero() {
+		//the server's to date is inclusive, but CreatedBefore isn't
+		values.Set("to", q.CreatedBefore.AddDate(0, 0, -1).Format(dateFormat))
+	}
+	if q.Sort != "" {
+		values.Set("sort", string(q.Sort))
+	}
+
+	var page struct {
+		Page     int
+		PageSize int
+		Pages    int
+		Total    int64
+		Facts    []apiFact
+	}
+	if err := c.do(ctx, http.MethodGet, apiFactsUrl, values, nil, &page); err != nil {
+		return nil, err
+	}
+	response := &FactPage{
+		Page:     page.Page,
+		PageSize: page.PageSize,
+		Pages:    page.Pages,
+		Total:    page.Total,
+		Facts:    []Fact{},
+	}
+	for _, f := range page.Facts {
+		response.Facts = append(response.Facts, f.fact())
+	}
+	return response, nil
+}
+
+//Returns one page of the facts that match a search. ViewerId and ViewUnmoderated are ignored. Search doesn't accept
+//API tokens, so a client using one only finds facts that anybody can see
+func (c *Client) SearchFacts(ctx context.Context, q fact.SearchQuery) (*SearchPage, error) {
+	values := url.Values{"q": {q.Terms}}
+	if q.Page != 0 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PageSize != 0 {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	var page SearchPage
+	if err := c.do(ctx, http.MethodGet, searchFactApiUrl, values, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) GetFact(ctx context.Context, factId int64) (*Fact, error) {
+	var f apiFact
+	if err := c.do(ctx, http.MethodGet, factUrl(factId, ""), nil, nil, &f); err != nil {
+		return nil, err
+	}
+	result := f.fact()
+	return &result, nil
+}
+
+//Submits a fact (its Fact, Explain, ExplainFurther, Tags and References) and returns it as it was saved
+//If one of the references is the problem, the *Error's Reference is its index
+func (c *Client) CreateFact(ctx context.Context, f fact.Fact) (*Fact, error) {
+	request := apiFactRequest{
+		Fact:           f.Fact,
+		Explain:        f.Explain,
+		ExplainFurther: f.ExplainFurther,
+		Tags:           []string{},
+		References:     []apiReferenceRequest{},
+	}
+	for _, t := range f.Tags {
+		request.Tags = append(request.Tags, t.Name)
+	}
+	for _, r := range f.References {
+		request.References = append(request.References, apiReferenceRequest{Url: r.Url, Publisher: r.Publisher, Title: r.Title})
+	}
+
+	var saved apiFact
+	if err := c.do(ctx, http.MethodPost, apiFactsUrl, nil, request, &saved); err != nil {
+		return nil, err
+	}
+	result := saved.fact()
+	return &result, nil
+}
+
+//VOTES AND MODERATION
+
+func (c *Client) GetVotes(ctx context.Context, factId int64) (*Votes, error) {
+	var v Votes
+	if err := c.do(ctx, http.MethodGet, factUrl(factId, "/votes"), nil, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+//Votes a fact up or down, which costs a vote from the account's vote bank, and returns its votes afterwards
+func (c *Client) Vote(ctx context.Context, factId int64, up bool) (*Votes, error) {
+	var v Votes
+	if err := c.do(ctx, http.MethodPost, factUrl(factId, "/votes"), nil, struct{ Up bool }{up}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+//Approves or rejects a fact, or asks its author to change it, and returns it afterwards. The reason is shown to its
+//author, and is needed for anything but approving
+func (c *Client) Moderate(ctx context.Context, factId int64, decision fact.ModerationDecision, reason string) (*Fact, error) {
+	request := struct {
+		Decision fact.ModerationDecision
+		Reason   string
+	}{decision, reason}
+	var f apiFact
+	if err := c.do(ctx, http.MethodPost, factUrl(factId, "/moderation"), nil, request, &f); err != nil {
+		return nil, err
+	}
+	result := f.fact()
+	return &result, nil
+}
+
+//REQUESTS
+
+//How the API gives facts, which is turned into a Fact
+type apiFact struct {
+	Id              int64
+	Fact            string
+	State           fact.ModerationState
+	AwaitModeration bool
+	AuthorId        int64
+	CreatedAt       *time.Time
+	EditedAt        *time.Time
+	Url             string
+	Explain         string
+	ExplainFurther  string
+	Tags            []string
+	References      []apiReference
+	Score           fact.VoteScore
+}
+
+type apiReference struct {
+	Id            int64
+	Url           string
+	Publisher     string
+	Title         string
+	LinkBroken    bool
+	LinkCheckedAt *time.Time
+}
+
+type apiReferenceRequest struct {
+	Url       string
+	Publisher string
+	Title     string
+}
+
+type apiFactRequest struct {
+	Fact           string
+	Explain        string
+	ExplainFurther string
+	Tags           []string
+	References     []apiReferenceRequest
+}
+
+//The body of the /api/v1 endpoints' error responses
+type apiErrorResponse struct {
+	Error *Error
+}
+
+func (f apiFact) fact() Fact {
+	result := Fact{
+		Fact: fact.Fact{
+			Id:              f.Id,
+			Fact:            f.Fact,
+			Explain:         f.Explain,
+			ExplainFurther:  f.ExplainFurther,
+			AwaitModeration: f.AwaitModeration,
+			ModerationState: f.State,
+			AccountId:       f.AuthorId,
+			CreatedAt:       nullTime(f.CreatedAt),
+			EditedAt:        nullTime(f.EditedAt),
+		},
+		Score: f.Score,
+		Url:   f.Url,
+	}
+	for _, name := range f.Tags {
+		result.Tags = append(result.Tags, fact.Tag{Name: name})
+	}
+	for _, r := range f.References {
+		reference := fact.Reference{
+			Id:            r.Id,
+			FactId:        f.Id,
+			Url:           r.Url,
+			Publisher:     r.Publisher,
+			Title:         r.Title,
+			LinkCheckedAt: nullTime(r.LinkCheckedAt),
+		}
+		//the API only says whether the link was broken, so a working link is given a 200 status, and a broken one none
+		//(as if there was no response), which is enough for LinkBroken to give the same answer
+		if reference.LinkCheckedAt.Valid && !r.LinkBroken {
+			reference.LinkStatus = http.StatusOK
+		}
+		result.References = append(result.References, reference)
+	}
+	return result
+}
+
+func nullTime(t *time.Time) nullables.NullTime {
+	if t == nil {
+		return nullables.NullTime{}
+	}
+	return nullables.NullTime{Time: *t, Valid: true}
+}
+
+func factUrl(factId int64, suffix string) string {
+	return apiFactsUrl + "/" + strconv.FormatInt(factId, 10) + suffix
+}
+
+//Makes a request to the API, with body (if not nil) sent as JSON, and decodes the JSON response into result
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, result interface{}) error {
+	u := c.baseUrl + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var payload []byte
+	contentType := ""
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	resp, err := c.send(ctx, c.HttpClient, method, u, contentType, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(result)
+}
+
+//Sends a request, trying it again if it fails in a way that retrying could help with
+//Requests that could change something are only retried when the server says it didn't do anything (429 and 503), as
+//otherwise retrying could (for example) submit a fact twice
+func (c *Client) send(ctx context.Context, hc *http.Client, method string, u string, contentType string, payload []byte) (*http.Response, error) {
+	idempotent := method == http.MethodGet || method == http.MethodHead || method == http.MethodPut || method == http.MethodDelete
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		} else if token := c.getCsrfToken(); token != "" {
+			req.Header.Set(csrfHeader, token)
+		}
+
+		resp, err := hc.Do(req)
+		if err == nil && resp.Header.Get(csrfHeader) != "" {
+			//it changes when signing in or out
+			c.mu.Lock()
+			c.csrfToken = resp.Header.Get(csrfHeader)
+			c.mu.Unlock()
+		}
+		retry := false
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			retry = idempotent
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			retry = true
+		case resp.StatusCode >= 500:
+			retry = idempotent
+		}
+		if !retry || attempt >= c.MaxRetries {
+			return resp, err
+		}
+
+		delay := c.retryDelay(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize)) //so that the connection can be reused
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) getCsrfToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.csrfToken
+}
+
+//Returns how long to wait before retrying after attempt (starting from 0) failed, which is as long as the server's
+//Retry-After header asks for, or otherwise doubles each time, with some jitter so that clients don't all retry at once
+func (c *Client) retryDelay(attempt int, resp *http.Response) time.Duration {
+	var delay time.Duration
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+	if delay == 0 {
+		delay = c.RetryDelay << uint(attempt)
+		if delay > 0 {
+			delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+	}
+	if c.MaxRetryDelay > 0 && delay > c.MaxRetryDelay {
+		delay = c.MaxRetryDelay
+	}
+	return delay
+}
+
+//Returns the error that an error response is. The /api/v1 endpoints give their errors as JSON, but the older ones
+//(eg search) give them as text, starting with the status code
+func responseError(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	var response apiErrorResponse
+	if json.Unmarshal(body, &response) == nil && response.Error != nil && response.Error.Status != 0 {
+		return response.Error
+	}
+	message := strings.TrimSpace(string(body))
+	message = strings.TrimPrefix(message, strconv.Itoa(resp.StatusCode)+": ")
+	return &Error{Status: resp.StatusCode, Message: message}
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/heyfyi/heyfyiserver/memdb"
+)
+
+//A server running the real router with a fresh memory storage, which has a moderator (whose password is "test@test")
+//and the test fact (1), which is awaiting moderation
+type testServer struct {
+	*httptest.Server
+	storage *memdb.MemoryStorage
+	account account.Account
+}
+
+func newTestServer(t *testing.T, wrap func(http.Handler) http.Handler) *testServer {
+	s := memdb.NewMemoryStorage()
+	a := fyidb.TestAccount()
+	a.Role = account.RoleModerator
+	if err := s.CreateAccount(&a); err != nil {
+		t.Fatal("CreateAccount failed: ", err)
+	}
+	f := fyidb.TestFact(a.Id)
+	if err := s.CreateFact(&f); err != nil {
+		t.Fatal("CreateFact failed: ", err)
+	}
+
+	var handler http.Handler = heyfyiserver.NewRouter(s, "client test")
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &testServer{Server: server, storage: s, account: a}
+}
+
+//Returns a client using a new token for the server's moderator, which can do what scopes allow
+func (s *testServer) tokenClient(t *testing.T, scopes ...account.Scope) *Client {
+	token, _, err := s.account.CreateApiToken(s.storage, "Client test", scopes, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal("CreateApiToken failed: ", err)
+	}
+	c := NewWithToken(s.URL, token)
+	c.RetryDelay = time.Millisecond
+	return c
+}
+
+func testSubmission() fact.Fact {
+	return fact.Fact{
+		Fact:           "Goldfish can remember things for months",
+		Explain:        "Experiments have trained goldfish to respond to sounds and lights, and they remembered months later.",
+		ExplainFurther: "The three second memory is a myth.",
+		Tags:           []fact.Tag{{Name: "animals"}},
+		References: []fact.Reference{
+			{Url: "https://www.bbc.co.uk/news/goldfish", Publisher: "BBC", Title: "Goldfish memory"},
+			{Url: "https://en.wikipedia.org/wiki/Goldfish", Publisher: "Wikipedia", Title: "Goldfish"},
+		},
+	}
+}
+
+func TestTokenClient(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.tokenClient(t, account.Scopes...)
+	ctx := context.Background()
+
+	a, err := c.Account(ctx)
+	if err != nil {
+		t.Fatal("Account failed: ", err)
+	}
+	if a.Id != s.account.Id || a.Email != "test@test" || a.Role != account.RoleModerator || len(a.Scopes) != len(account.Scopes) {
+		t.Fatalf("Account gave the wrong account, got %+v", a)
+	}
+
+	f, err := c.GetFact(ctx, 1)
+	if err != nil {
+		t.Fatal("GetFact failed: ", err)
+	}
+	if f.Fact.Fact != fyidb.TestFact(0).Fact || f.AccountId != s.account.Id || len(f.References) != 2 || f.Score.Ups != 1 || f.Score.AccountVote != 1 {
+		t.Fatalf("GetFact gave the wrong fact, got %+v", f)
+	}
+	if f.References[0].FactId != 1 || f.References[0].Publisher != "Scientific American" || f.References[0].LinkBroken() {
+		t.Errorf("GetFact gave the wrong references, got %+v", f.References)
+	}
+	if f.State() != fact.StatePending || !f.CreatedAt.Valid || f.Url == "" {
+		t.Errorf("GetFact gave the wrong state, creation time or URL, got %+v", f)
+	}
+
+	created, err := c.CreateFact(ctx, testSubmission())
+	if err != nil {
+		t.Fatal("CreateFact failed: ", err)
+	}
+	if created.Id == 0 || created.State() != fact.StatePending || len(created.References) != 2 || len(created.Tags) != 1 || created.Tags[0].Name != "animals" {
+		t.Fatalf("CreateFact didn't give the fact as it was saved, got %+v", created)
+	}
+
+	page, err := c.ListFacts(ctx, fact.FactQuery{Moderation: fact.OnlyPending, CreatedAfter: time.Now().AddDate(0, 0, -1), CreatedBefore: time.Now().AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatal("ListFacts failed: ", err)
+	}
+	if page.Total != 2 || len(page.Facts) != 2 || page.Facts[0].Id != created.Id || page.Page != 1 {
+		t.Fatalf("ListFacts didn't list the pending facts, newest first, got %+v", page)
+	}
+	if page, err = c.ListFacts(ctx, fact.FactQuery{Tag: "animals", Sort: fact.SortOldest, PageSize: 5}); err != nil || page.Total != 1 || page.PageSize != 5 {
+		t.Fatalf("ListFacts didn't list the tagged fact, got %+v, %v", page, err)
+	}
+
+	moderated, err := c.Moderate(ctx, created.Id, fact.DecisionApprove, "Well referenced.")
+	if err != nil {
+		t.Fatal("Moderate failed: ", err)
+	}
+	if moderated.State() != fact.StateApproved {
+		t.Fatalf("Moderate didn't approve the fact, got %+v", moderated)
+	}
+
+	votes, err := c.Vote(ctx, created.Id, false)
+	if err != nil {
+		t.Fatal("Vote failed: ", err)
+	}
+	if votes.FactId != created.Id || votes.Score.Downs != 1 || votes.Score.AccountVote != -1 || votes.VoteBank != 99 {
+		t.Fatalf("Vote didn't vote the fact down, got %+v", votes)
+	}
+	if votes, err = c.GetVotes(ctx, created.Id); err != nil || votes.Score.Downs != 1 {
+		t.Fatalf("GetVotes didn't give the vote, got %+v, %v", votes, err)
+	}
+
+	results, err := c.SearchFacts(ctx, fact.SearchQuery{Terms: "goldfish"})
+	if err != nil {
+		t.Fatal("SearchFacts failed: ", err)
+	}
+	if results.Terms != "goldfish" || results.Total != 1 || len(results.Results) != 1 || results.Results[0].FactId != created.Id || results.Results[0].Url == "" {
+		t.Fatalf("SearchFacts didn't find the fact, got %+v", results)
+	}
+}
+
+func TestSignIn(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	c := New(s.URL)
+
+	if _, err := c.Account(ctx); err == nil || err.(*Error).Status != http.StatusUnauthorized {
+		t.Fatal("Account didn't fail before signing in, got ", err)
+	}
+	if err := c.SignIn(ctx, "test@test", "wrong"); err != SignInFailed {
+		t.Fatal("SignIn didn't fail with the wrong password, got ", err)
+	}
+	if err := c.SignIn(ctx, "test@test", "test@test"); err != nil {
+		t.Fatal("SignIn failed: ", err)
+	}
+
+	a, err := c.Account(ctx)
+	if err != nil {
+		t.Fatal("Account failed after signing in: ", err)
+	}
+	if a.Id != s.account.Id || a.Scopes != nil {
+		t.Fatalf("Account gave the wrong account after signing in, got %+v", a)
+	}
+	if _, err := c.CreateFact(ctx, testSubmission()); err != nil {
+		t.Fatal("CreateFact failed with a session: ", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	c := s.tokenClient(t, account.ScopeRead)
+
+	_, err := c.GetFact(ctx, 999)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusNotFound || e.Code != "not_found" || e.Message == "" {
+		t.Fatalf("GetFact didn't give a not found error, got %#v", err)
+	}
+	_, err = c.CreateFact(ctx, testSubmission())
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusForbidden {
+		t.Fatalf("CreateFact didn't give a forbidden error without the submit scope, got %#v", err)
+	}
+
+	c = s.tokenClient(t, account.ScopeSubmit)
+	f := testSubmission()
+	f.References[1].Url = f.References[0].Url
+	_, err = c.CreateFact(ctx, f)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusUnprocessableEntity || e.Reference == nil || *e.Reference != 1 {
+		t.Fatalf("CreateFact didn't say which reference was the problem, got %#v", err)
+	}
+
+	_, err = NewWithToken(s.URL, "hfy_nope").Account(ctx)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusUnauthorized {
+		t.Fatalf("Account didn't give an unauthorized error with a bad token, got %#v", err)
+	}
+}
+
+//Wraps the router so that the first failures requests get status instead
+func failFirst(failures int32, status int, calls *int32) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(calls, 1) <= failures {
+				http.Error(rw, http.StatusText(status), status)
+				return
+			}
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int32
+	s := newTestServer(t, failFirst(2, http.StatusBadGateway, &calls))
+	c := s.tokenClient(t, account.Scopes...)
+	if _, err := c.GetFact(ctx, 1); err != nil || calls != 3 {
+		t.Fatalf("GetFact wasn't retried until it worked, got %v after %d calls", err, calls)
+	}
+
+	//submitting a fact could have worked despite the error, so it isn't retried
+	calls = 0
+	s = newTestServer(t, failFirst(2, http.StatusBadGateway, &calls))
+	c = s.tokenClient(t, account.Scopes...)
+	if _, err := c.CreateFact(ctx, testSubmission()); err == nil || err.(*Error).Status != http.StatusBadGateway || calls != 1 {
+		t.Fatalf("CreateFact was retried after a bad gateway, got %v after %d calls", err, calls)
+	}
+
+	//but it is when the server says it didn't do anything
+	calls = 0
+	s = newTestServer(t, failFirst(1, http.StatusServiceUnavailable, &calls))
+	c = s.tokenClient(t, account.Scopes...)
+	if _, err := c.CreateFact(ctx, testSubmission()); err != nil || calls != 2 {
+		t.Fatalf("CreateFact wasn't retried after the service was unavailable, got %v after %d calls", err, calls)
+	}
+
+	//giving up after MaxRetries
+	calls = 0
+	s = newTestServer(t, failFirst(10, http.StatusServiceUnavailable, &calls))
+	c = s.tokenClient(t, account.Scopes...)
+	c.MaxRetries = 2
+	if _, err := c.GetFact(ctx, 1); err == nil || err.(*Error).Status != http.StatusServiceUnavailable || calls != 3 {
+		t.Fatalf("GetFact didn't give up after MaxRetries, got %v after %d calls", err, calls)
+	}
+
+	//and when the context is done
+	calls = 0
+	c.RetryDelay = time.Hour
+	c.MaxRetryDelay = time.Hour
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetFact(cancelled, 1); err != context.DeadlineExceeded || calls != 1 {
+		t.Fatalf("GetFact didn't stop retrying when its context was done, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := New("http://localhost")
+	c.RetryDelay = time.Second
+	c.MaxRetryDelay = 10 * time.Second
+
+	for attempt := 0; attempt < 3; attempt++ {
+		full := time.Second << uint(attempt)
+		if d := c.retryDelay(attempt, nil); d < full/2 || d > full {
+			t.Errorf("Attempt %d waited %v, instead of between %v and %v", attempt, d, full/2, full)
+		}
+	}
+	if d := c.retryDelay(10, nil); d != c.MaxRetryDelay {
+		t.Error("The delay wasn't limited to MaxRetryDelay, got ", d)
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": {"3"}}}
+	if d := c.retryDelay(0, resp); d != 3*time.Second {
+		t.Error("Retry-After wasn't waited for, got ", d)
+	}
+}
@@ -1,20 +1,34 @@
 package heyfyiserver
 
 import (
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gocraft/web"
 	"github.com/gorilla/sessions"
 	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
 	"github.com/kiwih/heyfyi/heyfyiserver/fact"
-	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/heyfyi/heyfyiserver/linkcheck"
+	"github.com/kiwih/heyfyi/heyfyiserver/oidc"
 )
 
 type AnyStorer interface {
 	account.AccountStorer
+	account.LoginThrottleStorer
+	account.ExternalIdentityStorer
+	account.ApiTokenStorer
 	fact.FactStorer
+	linkcheck.LinkStorer
+	audit.AuditStorer
+	GiveOneVoteToAllAccounts() error
+	CastVote(accountId int64, factId int64, up bool) (*fact.Vote, *account.Account, error)
 }
 
 //Used in all requests
@@ -24,6 +38,9 @@ type Context struct {
 	Data                 interface{}
 	Store                *sessions.CookieStore
 	Account              *account.Account
+	Session              *account.Session  //the session that Account is signed in with
+	ApiToken             *account.ApiToken //the API token that Account is using instead, if the request has one
+	CsrfToken            string            //what forms and scripts have to send back to make changes (see CsrfMiddleware)
 	Storage              AnyStorer
 }
 
@@ -67,18 +84,85 @@ func (c *Context) CheckFailedRequestObject(rw web.ResponseWriter, req *web.Reque
 	return nil
 }
 
+//Returns the IP address that a request came from. If TrustProxyHeaders is set, this is the address that the
+//proxy in front of the server says it forwarded the request for
+func clientIp(req *web.Request) string {
+	if TrustProxyHeaders {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			//the proxy adds the address it saw to the end, and anything before that could have come from the client
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 //MIDDLEWARE
 
 func (c *Context) AssignStorageMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
-	c.Storage = &fyidb.DbStorage
+	c.Storage = storage
 	next(rw, req)
 }
 
 func (c *Context) LoadUserMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
 	session, _ := c.Store.Get(req.Request, "session-security")
 
-	if session.Values["sessionId"] != nil {
-		c.Account, _ = c.Storage.LoadAccountFromSession(session.Values["sessionId"].(string))
+	if token, ok := session.Values["sessionId"].(string); ok {
+		var err error
+		c.Account, c.Session, err = account.LoadSession(c.Storage, token, clientIp(req), time.Now())
+		if _, suspended := err.(*account.AccountSuspendedError); suspended {
+			//sign them out of this browser, and tell them why
+			delete(session.Values, "sessionId")
+			session.Save(req.Request, rw)
+			c.SetErrorMessage(rw, req, err.Error())
+		}
+	}
+	next(rw, req)
+}
+
+//Lets scripts use the API as an account by sending one of its API tokens in an "Authorization: Bearer" header, instead
+//of signing in. The token replaces any session, so that a request can only ever do what its token allows. Tokens are
+//only accepted by the API, and a bad one is always an error rather than being ignored, so that scripts find out
+func (c *Context) ApiTokenMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" || !isApiRequest(req) {
+		next(rw, req)
+		return
+	}
+
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(rw, http.StatusUnauthorized, account.BadApiToken)
+		return
+	}
+	a, t, err := account.LoadApiToken(c.Storage, c.Storage, strings.TrimSpace(parts[1]), clientIp(req), time.Now())
+	if err != nil {
+		rw.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		writeJSONError(rw, http.StatusUnauthorized, err)
+		return
+	}
+	c.Account, c.Session, c.ApiToken = a, nil, t
+	next(rw, req)
+}
+
+//Admins have to set up two factor authentication before they can do anything else (if account.RequireTwoFactorForAdmins is set)
+func (c *Context) TwoFactorPolicyMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if c.Account != nil && c.Account.MustSetUpTwoFactor() {
+		path := req.URL.Path
+		if path != SignOutUrl.String() && !strings.HasPrefix(path, TwoFactorUrl.String()) {
+			if isApiRequest(req) {
+				writeJSONError(rw, http.StatusForbidden, errors.New("Admin accounts need two-factor authentication. Please set it up on the site before using the API."))
+				return
+			}
+			c.SetErrorMessage(rw, req, "Admin accounts need two-factor authentication. Please set it up before continuing.")
+			http.Redirect(rw, req.Request, TwoFactorUrl.Make(), http.StatusSeeOther)
+			return
+		}
 	}
 	next(rw, req)
 }
@@ -143,41 +227,89 @@ func (c *Context) HomeHandler(rw web.ResponseWriter, req *web.Request) {
 	}
 }
 
+//Shows a fact's page, or the fact as the API gives it (see ApiFactUrl) if the request wants JSON
 func (c *Context) ViewFactHandler(rw web.ResponseWriter, req *web.Request) {
 	factIdStr, ok := req.PathParams["factId"]
 	if !ok {
-		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		writeError(rw, req, http.StatusBadRequest, "Bad fact ID")
 		return
 	}
 
 	//get the fact ID from the URL
 	factId, err := strconv.ParseInt(factIdStr, 10, 64)
 	if err != nil {
-		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		writeError(rw, req, http.StatusBadRequest, "Bad fact ID")
 		return
 	}
 
 	f, err := c.Storage.LoadFactFromId(factId)
 	if err != nil {
-		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		writeError(rw, req, http.StatusNotFound, "Fact not found")
 		return
 	}
 
-	if f.AwaitModeration {
-		if c.Account == nil {
-			http.Error(rw, "404: Fact not found", http.StatusNotFound)
-			return
+	if !c.CanViewFact(f) {
+		writeError(rw, req, http.StatusNotFound, "Fact not found")
+		return
+	}
+
+	if wantsJSON(req) {
+		writeJSON(rw, http.StatusOK, newApiFact(f, c.viewerId()))
+		return
+	}
+
+	comments, err := c.Storage.ListComments(f.Id)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nickname := c.nicknames()
+	var threaded []factComment
+	for _, comment := range fact.ThreadComments(comments, c.CanViewComment) {
+		threaded = append(threaded, factComment{ThreadedComment: comment, Author: nickname(comment.AccountId)})
+	}
+
+	//if their last comment failed, show them what they wrote so they can fix it
+	var failed fact.Comment
+	if badC := c.CheckFailedRequestObject(rw, req); badC != nil {
+		if comment, ok := badC.(fact.Comment); ok && comment.FactId == f.Id {
+			failed = comment
 		}
-		if f.AccountId != c.Account.Id && !c.Account.Admin {
-			http.Error(rw, "404: Fact not found", http.StatusNotFound)
+	}
+
+	//moderators see every decision and note, and the author sees the decisions about their fact
+	var moderation []factModerationNote
+	var latest *factModerationNote
+	if c.Can(account.ModerateFact) || (c.Account != nil && c.Account.Id == f.AccountId) {
+		notes, err := c.Storage.ListModerationNotes(f.Id)
+		if err != nil {
+			http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !c.Can(account.ModerateFact) {
+			notes = fact.Decisions(notes)
+		}
+		for _, n := range notes {
+			moderation = append(moderation, factModerationNote{ModerationNote: n, Moderator: nickname(n.AccountId)})
+		}
+		if decision := fact.LatestDecision(notes); decision != nil {
+			latest = &factModerationNote{ModerationNote: *decision, Moderator: nickname(decision.AccountId)}
+		}
 	}
 
 	data := struct {
-		Fact *fact.Fact
+		Fact            *fact.Fact
+		Comments        []factComment
+		FailedComment   fact.Comment
+		ModerationNotes []factModerationNote
+		LatestDecision  *factModerationNote
 	}{
-		Fact: f,
+		Fact:            f,
+		Comments:        threaded,
+		FailedComment:   failed,
+		ModerationNotes: moderation,
+		LatestDecision:  latest,
 	}
 	c.Data = data
 	if err := templates.ExecuteTemplate(rw, "factPage", c); err != nil {
@@ -185,6 +317,160 @@ func (c *Context) ViewFactHandler(rw web.ResponseWriter, req *web.Request) {
 	}
 }
 
+//Can is the check that every handler and template uses to decide whether the signed in account is allowed to do something
+//In templates the permission is given by name, eg {{if .Can "moderate_fact"}}
+func (c *Context) Can(p account.Permission) bool {
+	return c.Account.Can(p)
+}
+
+//Writes a 403 and returns false if the signed in account doesn't have the permission
+func (c *Context) Permit(rw web.ResponseWriter, p account.Permission) bool {
+	if c.Can(p) {
+		return true
+	}
+	http.Error(rw, "403: You don't have permission to make this request", http.StatusForbidden)
+	return false
+}
+
+//Facts that are awaiting moderation can only be seen by the account that submitted them and accounts allowed to ViewUnmoderated
+func (c *Context) CanViewFact(f *fact.Fact) bool {
+	if !f.AwaitModeration {
+		return true
+	}
+	if c.Account == nil {
+		return false
+	}
+	return f.AccountId == c.Account.Id || c.Can(account.ViewUnmoderated)
+}
+
+//Facts can be deleted by the account that submitted them and accounts allowed to DeleteAnyFact
+func (c *Context) CanDeleteFact(f *fact.Fact) bool {
+	return c.Account != nil && (f.AccountId == c.Account.Id || c.Can(account.DeleteAnyFact))
+}
+
+//Hidden comments can only be seen by the account that wrote them and moderators
+func (c *Context) CanViewComment(comment *fact.Comment) bool {
+	if !comment.Hidden {
+		return true
+	}
+	if c.Account == nil {
+		return false
+	}
+	return comment.AccountId == c.Account.Id || c.Can(account.ModerateFact)
+}
+
+//A comment as shown on a fact's page
+type factComment struct {
+	fact.ThreadedComment
+	Author string
+}
+
+//A moderator's decision or note about a fact, as shown on the fact's page
+type factModerationNote struct {
+	fact.ModerationNote
+	Moderator string
+}
+
+//Makes a change with the storage given to change, and saves e (as done by the signed in account from the request's IP
+//address) in the same transaction, so that the change is only made if it is audited. change can fill in e, eg with the
+//Id of something it made. Nothing else should be written to c.Storage until change returns
+func (c *Context) audited(req *web.Request, e *audit.AuditEvent, change func(s AnyStorer) error) error {
+	if e.ActorId == 0 && c.Account != nil {
+		e.ActorId = c.Account.Id
+	}
+	e.Ip = clientIp(req)
+	e.Before = audit.Summarise(e.Before)
+	return c.Storage.Audited(e, func(tx interface{}) error {
+		if err := change(tx.(AnyStorer)); err != nil {
+			return err
+		}
+		e.After = audit.Summarise(e.After)
+		return nil
+	})
+}
+
+//Returns a function that looks up the nicknames of accounts, loading each account only once
+func (c *Context) nicknames() func(accountId int64) string {
+	nicknames := make(map[int64]string)
+	return func(accountId int64) string {
+		if _, ok := nicknames[accountId]; !ok {
+			nicknames[accountId] = "Unknown"
+			if a, err := c.Storage.LoadAccountFromId(accountId); err == nil {
+				nicknames[accountId] = a.Nickname
+			}
+		}
+		return nicknames[accountId]
+	}
+}
+
+//One revision of a fact, as shown on the history page
+type factHistoryEntry struct {
+	Number   int
+	Revision fact.FactRevision
+	Editor   string
+	Diff     fact.RevisionDiff //the changes from the previous revision
+	Current  bool
+}
+
+func (c *Context) FactHistoryHandler(rw web.ResponseWriter, req *web.Request) {
+	factIdStr, ok := req.PathParams["factId"]
+	if !ok {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	//get the fact ID from the URL
+	factId, err := strconv.ParseInt(factIdStr, 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil || !c.CanViewFact(f) {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := c.Storage.ListFactRevisions(f.Id)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	editor := c.nicknames()
+	var entries []factHistoryEntry
+	for i := range revisions {
+		r := revisions[i]
+
+		var previous *fact.FactRevision
+		if i > 0 {
+			previous = &revisions[i-1]
+		}
+
+		//newest first
+		entries = append([]factHistoryEntry{{
+			Number:   i + 1,
+			Revision: r,
+			Editor:   editor(r.AccountId),
+			Diff:     fact.DiffRevisions(previous, &r),
+			Current:  i == len(revisions)-1,
+		}}, entries...)
+	}
+
+	data := struct {
+		Fact    *fact.Fact
+		History []factHistoryEntry
+	}{
+		Fact:    f,
+		History: entries,
+	}
+	c.Data = data
+	if err := templates.ExecuteTemplate(rw, "factHistoryPage", c); err != nil {
+		log.Println("Error:", err.Error())
+	}
+}
+
 type LoginRequestForm struct {
 	Email    string
 	Password string
@@ -201,41 +487,366 @@ func (c *Context) DoSignInRequestHandler(rw web.ResponseWriter, req *web.Request
 		return
 	}
 
-	propUser, err := account.AttemptLogin(c.Storage, prop.Email, prop.Password, prop.Remember)
+	propUser, err := account.AttemptThrottledLogin(c.Storage, c.Storage, prop.Email, prop.Password, clientIp(req), time.Now())
 
-	if propUser != nil {
-		//they have passed the login check. Save them to the session and redirect to management portal
-		session, _ := c.Store.Get(req.Request, "session-security")
-		session.Values["sessionId"] = propUser.CurrentSession.String
-		c.SetNotificationMessage(rw, req, "Hi, "+propUser.Nickname+".")
-		session.Save(req.Request, rw)
-		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
+	if err == account.SecondFactorRequired {
+		//their password was right, but they need to enter a code from their authenticator app before they get a session
+		c.beginSecondFactor(rw, req, propUser, prop.Remember)
+		return
+	}
+
+	if err == nil {
+		c.signIn(rw, req, propUser, prop.Remember)
 		return
 	}
 	c.SetErrorMessage(rw, req, err.Error())
+	if err == account.AccountNotYetVerified {
+		//their verification link may have expired or gone missing, so offer to send another
+		http.Redirect(rw, req.Request, ResendVerificationUrl.Make(), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
 }
 
+//Starts a new session for the account on this browser and redirects to the home page
+func (c *Context) signIn(rw web.ResponseWriter, req *web.Request, a *account.Account, willExpire bool) {
+	var token string
+	e := &audit.AuditEvent{ActorId: a.Id, Action: audit.SignIn, TargetType: audit.TargetSession}
+	err := c.audited(req, e, func(s AnyStorer) error {
+		var session *account.Session
+		var err error
+		token, session, err = a.StartSession(s, willExpire, req.UserAgent(), clientIp(req), time.Now())
+		if err != nil {
+			return err
+		}
+		e.TargetId = session.Id
+		e.After = req.UserAgent()
+		return nil
+	})
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//they have passed the login check. Save them to the session and redirect to management portal
+	session, _ := c.Store.Get(req.Request, "session-security")
+	session.Values["sessionId"] = token
+	clearPendingSecondFactor(session)
+	if err := c.newCsrfToken(rw, session); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.SetNotificationMessage(rw, req, "Hi, "+a.Nickname+".")
+	session.Save(req.Request, rw)
+	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
+}
+
+const (
+	pendingSecondFactorTime     = 5 * time.Minute //how long someone has to enter their code after entering their password
+	pendingSecondFactorAttempts = 5               //how many codes they can try before they have to enter their password again
+	//(the cookie can be replayed, so failed codes are also counted for the account; see account.SecondFactorThrottlePolicy)
+)
+
+//Remembers that the account needs to enter a second factor code in this session, and redirects to where they enter it
+func (c *Context) beginSecondFactor(rw web.ResponseWriter, req *web.Request, a *account.Account, remember bool) {
+	session, _ := c.Store.Get(req.Request, "session-security")
+	session.Values["pendingAccountId"] = a.Id
+	session.Values["pendingRemember"] = remember
+	session.Values["pendingUntil"] = time.Now().Add(pendingSecondFactorTime).Unix()
+	session.Values["pendingAttempts"] = 0
+	session.Save(req.Request, rw)
+	http.Redirect(rw, req.Request, SignInTwoFactorUrl.Make(), http.StatusSeeOther)
+}
+
+func clearPendingSecondFactor(session *sessions.Session) {
+	delete(session.Values, "pendingAccountId")
+	delete(session.Values, "pendingRemember")
+	delete(session.Values, "pendingUntil")
+	delete(session.Values, "pendingAttempts")
+}
+
+//Returns the account waiting to enter a second factor code in this session, if it hasn't run out of time or attempts
+func pendingSecondFactor(session *sessions.Session) (accountId int64, remember bool, ok bool) {
+	accountId, ok = session.Values["pendingAccountId"].(int64)
+	until, _ := session.Values["pendingUntil"].(int64)
+	attempts, _ := session.Values["pendingAttempts"].(int)
+	if !ok || time.Now().Unix() > until || attempts >= pendingSecondFactorAttempts {
+		return 0, false, false
+	}
+	remember, _ = session.Values["pendingRemember"].(bool)
+	return accountId, remember, true
+}
+
+func (c *Context) SignInTwoFactorHandler(rw web.ResponseWriter, req *web.Request) {
+	session, _ := c.Store.Get(req.Request, "session-security")
+	if _, _, ok := pendingSecondFactor(session); !ok {
+		c.SetErrorMessage(rw, req, "Please sign in again.")
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(rw, "signInTwoFactorPage", c); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *Context) DoSignInTwoFactorHandler(rw web.ResponseWriter, req *web.Request) {
+	session, _ := c.Store.Get(req.Request, "session-security")
+	accountId, remember, ok := pendingSecondFactor(session)
+	if !ok {
+		clearPendingSecondFactor(session)
+		session.Save(req.Request, rw)
+		c.SetErrorMessage(rw, req, "Please sign in again.")
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	req.ParseForm()
+
+	a, err := account.AttemptSecondFactorLogin(c.Storage, c.Storage, accountId, req.PostForm.Get("Code"), time.Now())
+	if throttled, ok := err.(*account.LoginThrottledError); ok {
+		if throttled.LockedOut {
+			clearPendingSecondFactor(session)
+			session.Save(req.Request, rw)
+			c.SetErrorMessage(rw, req, err.Error())
+			http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+			return
+		}
+		//waiting doesn't use up an attempt
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, SignInTwoFactorUrl.Make(), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		attempts, _ := session.Values["pendingAttempts"].(int)
+		session.Values["pendingAttempts"] = attempts + 1
+		session.Save(req.Request, rw)
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, SignInTwoFactorUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.signIn(rw, req, a, remember)
+}
+
+//how long someone has to sign in at the identity provider before they have to start again
+const oidcSignInTime = 10 * time.Minute
+
+//Sends the browser to the identity provider to sign in. What is needed to finish the sign in is kept in the cookie session
+func (c *Context) OidcSignInHandler(rw web.ResponseWriter, req *web.Request) {
+	if oidcProvider == nil {
+		http.Error(rw, "404: Signing in with an identity provider is not set up", http.StatusNotFound)
+		return
+	}
+
+	r, err := oidcProvider.NewAuthRequest()
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := c.Store.Get(req.Request, "session-security")
+	session.Values["oidcState"] = r.State
+	session.Values["oidcNonce"] = r.Nonce
+	session.Values["oidcVerifier"] = r.CodeVerifier
+	session.Values["oidcUntil"] = time.Now().Add(oidcSignInTime).Unix()
+	session.Save(req.Request, rw)
+	http.Redirect(rw, req.Request, r.Url, http.StatusFound)
+}
+
+func clearOidcSignIn(session *sessions.Session) {
+	delete(session.Values, "oidcState")
+	delete(session.Values, "oidcNonce")
+	delete(session.Values, "oidcVerifier")
+	delete(session.Values, "oidcUntil")
+}
+
+//The identity provider redirects back here once they have signed in. Their identity is checked and linked to an account
+//(which is made for them if they don't have one), and they are signed in to it
+func (c *Context) OidcCallbackHandler(rw web.ResponseWriter, req *web.Request) {
+	if oidcProvider == nil {
+		http.Error(rw, "404: Signing in with an identity provider is not set up", http.StatusNotFound)
+		return
+	}
+
+	//each sign in can only be finished once
+	session, _ := c.Store.Get(req.Request, "session-security")
+	state, _ := session.Values["oidcState"].(string)
+	nonce, _ := session.Values["oidcNonce"].(string)
+	verifier, _ := session.Values["oidcVerifier"].(string)
+	until, _ := session.Values["oidcUntil"].(int64)
+	clearOidcSignIn(session)
+	session.Save(req.Request, rw)
+
+	query := req.URL.Query()
+	if !oidc.StateMatches(state, query.Get("state")) || time.Now().Unix() > until {
+		c.SetErrorMessage(rw, req, "That sign in has expired. Please try again.")
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		c.SetErrorMessage(rw, req, "Signing in with "+OidcProviderName+" failed: "+providerError+" "+query.Get("error_description"))
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	claims, err := oidcProvider.SignIn(query.Get("code"), verifier, nonce, now)
+	if err != nil {
+		log.Println("Error signing in with OpenID Connect:", err.Error())
+		c.SetErrorMessage(rw, req, "Signing in with "+OidcProviderName+" failed: "+err.Error())
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	var a *account.Account
+	var created bool
+	var loginErr error
+	e := &audit.AuditEvent{Action: audit.ExternalSignIn, TargetType: audit.TargetAccount, Before: oidcProvider.Issuer + " " + claims.Subject}
+	err = c.audited(req, e, func(s AnyStorer) error {
+		a, created, loginErr = account.AttemptExternalLogin(s, s, account.ExternalLogin{
+			Issuer:        oidcProvider.Issuer,
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: claims.EmailVerified,
+			Name:          claims.Name,
+		}, now)
+		if a == nil {
+			return loginErr
+		}
+		//the identity was linked (or the account made) even if they can't be signed in yet, so that is kept
+		e.ActorId, e.TargetId = a.Id, a.Id
+		e.After = a.Email
+		if created {
+			e.After = "new account " + a.Email
+		}
+		return nil
+	})
+	if err == nil {
+		err = loginErr
+	}
+	if err == account.SecondFactorRequired {
+		c.beginSecondFactor(rw, req, a, true)
+		return
+	}
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusSeeOther)
+		return
+	}
+	if created {
+		log.Printf("Made an account for %s, who signed in with %s\n", a.Email, oidcProvider.Issuer)
+	}
+
+	c.signIn(rw, req, a, true)
+}
+
+//The format of the from and to dates in the fact listing URL
+const listFactsDateFormat = "2006-01-02"
+
+//Reads a fact listing query from the query string of ListFactUrl
+//page, size, sort, author, tag, state (moderated or awaiting), from and to (both dates, and both inclusive)
+func factQueryFromUrl(values url.Values) (fact.FactQuery, error) {
+	var q fact.FactQuery
+	var err error
+
+	if page := values.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			return q, errors.New("Bad page")
+		}
+	}
+	if size := values.Get("size"); size != "" {
+		if q.PageSize, err = strconv.Atoi(size); err != nil {
+			return q, errors.New("Bad page size")
+		}
+	}
+	if author := values.Get("author"); author != "" {
+		if q.AuthorId, err = strconv.ParseInt(author, 10, 64); err != nil {
+			return q, errors.New("Bad author ID")
+		}
+	}
+	if from := values.Get("from"); from != "" {
+		if q.CreatedAfter, err = time.ParseInLocation(listFactsDateFormat, from, time.Local); err != nil {
+			return q, errors.New("Bad from date")
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.CreatedBefore, err = time.ParseInLocation(listFactsDateFormat, to, time.Local); err != nil {
+			return q, errors.New("Bad to date")
+		}
+		//the to date is inclusive, so list everything before the start of the next day
+		q.CreatedBefore = q.CreatedBefore.AddDate(0, 0, 1)
+	}
+	q.Tag = values.Get("tag")
+	q.Sort = fact.FactSort(values.Get("sort"))
+	q.Moderation = fact.ModerationFilter(values.Get("state"))
+
+	return q.Normalised(), nil
+}
+
 func (c *Context) ListFactsHandler(rw web.ResponseWriter, req *web.Request) {
+	q, err := factQueryFromUrl(req.URL.Query())
+	if err != nil {
+		writeError(rw, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.listFacts(rw, req, q)
+}
+
+//Lists the facts with a tag, using the same query string as ListFactsHandler
+func (c *Context) ViewTagHandler(rw web.ResponseWriter, req *web.Request) {
+	t, err := c.Storage.LoadTagFromName(req.PathParams["tagName"])
+	if err != nil {
+		writeError(rw, req, http.StatusNotFound, "Tag not found")
+		return
+	}
+
+	q, err := factQueryFromUrl(req.URL.Query())
+	if err != nil {
+		writeError(rw, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Tag = t.Name
+
+	c.listFacts(rw, req, q)
+}
+
+//Returns q limited to the facts that the signed in account can see
+func (c *Context) visibleTo(q fact.FactQuery) fact.FactQuery {
 	//TODO: not signed in can view all posts?
-	var accountId int64 = 0
-	listFacts := false
 	//if logged in, set to view facts that are theirs
 	if c.Account != nil {
-		accountId = c.Account.Id
-		//only show all facts if they are an admin
-		listFacts = c.Account.Admin
+		q.ViewerId = c.Account.Id
+		//only show all facts if they are allowed to see ones awaiting moderation
+		q.ViewUnmoderated = c.Can(account.ViewUnmoderated)
 	}
-	facts, err := c.Storage.ListFacts(accountId, listFacts)
+	return q
+}
+
+//shows the listFactsPage for q, or the facts as the API lists them (see ApiFactsUrl) if the request wants JSON
+func (c *Context) listFacts(rw web.ResponseWriter, req *web.Request, q fact.FactQuery) {
+	page, err := c.Storage.ListFacts(c.visibleTo(q))
 	if err != nil {
-		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		writeError(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if wantsJSON(req) {
+		writeJSON(rw, http.StatusOK, newApiFactPage(page))
 		return
 	}
 
 	data := struct {
-		Facts []fact.Fact
+		Page     *fact.FactPage
+		Sorts    []fact.FactSort
+		From, To string
 	}{
-		Facts: facts,
+		Page:  page,
+		Sorts: []fact.FactSort{fact.SortNewest, fact.SortTop, fact.SortControversial},
+		From:  req.URL.Query().Get("from"),
+		To:    req.URL.Query().Get("to"),
 	}
 
 	c.Data = data
@@ -245,6 +856,140 @@ func (c *Context) ListFactsHandler(rw web.ResponseWriter, req *web.Request) {
 	}
 }
 
+//Lists every tag along with how many moderated facts have it. Tags without any are only listed for accounts that can edit any fact, so that they can be tidied up
+func (c *Context) ListTagsHandler(rw web.ResponseWriter, req *web.Request) {
+	tags, err := c.Storage.ListTags()
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !c.Can(account.EditAnyFact) {
+		var used []fact.TagCount
+		for _, t := range tags {
+			if t.Facts > 0 {
+				used = append(used, t)
+			}
+		}
+		tags = used
+	}
+
+	data := struct {
+		Tags []fact.TagCount
+	}{
+		Tags: tags,
+	}
+	c.Data = data
+
+	if err := templates.ExecuteTemplate(rw, "listTagsPage", c); err != nil {
+		log.Println("Error:", err.Error())
+	}
+}
+
+//Reads a search from the query string of SearchFactUrl or SearchFactApiUrl (q, page and size), for the current account
+func (c *Context) searchQueryFromUrl(values url.Values) (fact.SearchQuery, error) {
+	q := fact.SearchQuery{Terms: values.Get("q")}
+	var err error
+
+	if page := values.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			return q, errors.New("Bad page")
+		}
+	}
+	if size := values.Get("size"); size != "" {
+		if q.PageSize, err = strconv.Atoi(size); err != nil {
+			return q, errors.New("Bad page size")
+		}
+	}
+
+	//search results are visible to the same people as ListFactsHandler shows them to
+	if c.Account != nil {
+		q.ViewerId = c.Account.Id
+		q.ViewUnmoderated = c.Can(account.ViewUnmoderated)
+	}
+	return q.Normalised(), nil
+}
+
+//Shows the search results page, or the results as SearchFactsApiHandler gives them if the request wants JSON
+func (c *Context) SearchFactsHandler(rw web.ResponseWriter, req *web.Request) {
+	q, err := c.searchQueryFromUrl(req.URL.Query())
+	if err != nil {
+		writeError(rw, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := c.Storage.SearchFacts(q)
+	if err != nil {
+		writeError(rw, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if wantsJSON(req) {
+		writeJSON(rw, http.StatusOK, newSearchResponse(page))
+		return
+	}
+
+	data := struct {
+		Page *fact.SearchPage
+	}{
+		Page: page,
+	}
+	c.Data = data
+
+	if err := templates.ExecuteTemplate(rw, "searchFactsPage", c); err != nil {
+		log.Println("Error:", err.Error())
+	}
+}
+
+//Returns the same search results as SearchFactsHandler as JSON. Fact and Snippet in each result are HTML
+func (c *Context) SearchFactsApiHandler(rw web.ResponseWriter, req *web.Request) {
+	q, err := c.searchQueryFromUrl(req.URL.Query())
+	if err != nil {
+		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := c.Storage.SearchFacts(q)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	ReturnJSON(rw, newSearchResponse(page))
+}
+
+//One search result, as given by SearchFactsApiHandler
+type searchResult struct {
+	fact.SearchResult
+	Url string
+}
+
+//Search results, as given by SearchFactsApiHandler
+type searchResponse struct {
+	Terms    string
+	Page     int
+	PageSize int
+	Pages    int
+	Total    int64
+	Results  []searchResult
+}
+
+func newSearchResponse(page *fact.SearchPage) searchResponse {
+	response := searchResponse{
+		Terms:    page.Query.Terms,
+		Page:     page.Query.Page,
+		PageSize: page.Query.PageSize,
+		Pages:    page.Pages(),
+		Total:    page.Total,
+		Results:  []searchResult{},
+	}
+	for _, r := range page.Results {
+		response.Results = append(response.Results, searchResult{SearchResult: r, Url: GetViewFactUrl(r.FactId)})
+	}
+	return response
+}
+
 type CreateAccount struct {
 	Email           string
 	Password        string
@@ -304,7 +1049,19 @@ func (c *Context) DoSignUpHandler(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	if err := account.CheckAndCreateAccount(c.Storage, u.Email, u.Password, u.Nickname); err != nil {
+	e := &audit.AuditEvent{Action: audit.SignUp, TargetType: audit.TargetAccount}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := account.CheckAndCreateAccount(s, u.Email, u.Password, u.Nickname); err != nil {
+			return err
+		}
+		a, err := s.LoadAccountFromEmail(u.Email)
+		if err != nil {
+			return err
+		}
+		e.ActorId, e.TargetId = a.Id, a.Id
+		e.After = a.Email + " (" + a.Nickname + ")"
+		return nil
+	}); err != nil {
 		c.SetFailedRequestObject(rw, req, u)
 		c.SetErrorMessage(rw, req, err.Error())
 		http.Redirect(rw, req.Request, SignUpUrl.Make(), http.StatusSeeOther)
@@ -342,7 +1099,14 @@ func (c *Context) DoVerificationRequestHandler(rw web.ResponseWriter, req *web.R
 		return
 	}
 
-	if err := a.ApplyVerificationCode(c.Storage, verificationCode); err != nil {
+	if err := c.audited(req, &audit.AuditEvent{ActorId: a.Id, Action: audit.Verify, TargetType: audit.TargetAccount, TargetId: a.Id}, func(s AnyStorer) error {
+		return a.ApplyVerificationCode(s, verificationCode, time.Now())
+	}); err != nil {
+		if err == account.VerificationCodeExpired {
+			c.SetErrorMessage(rw, req, err.Error())
+			http.Redirect(rw, req.Request, ResendVerificationUrl.Make(), http.StatusSeeOther)
+			return
+		}
 		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -351,6 +1115,46 @@ func (c *Context) DoVerificationRequestHandler(rw web.ResponseWriter, req *web.R
 	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
 }
 
+func (c *Context) ResendVerificationHandler(rw web.ResponseWriter, req *web.Request) {
+	err := templates.ExecuteTemplate(rw, "resendVerificationPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type ResendVerificationForm struct {
+	Email string
+}
+
+func (c *Context) DoResendVerificationHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var p ResendVerificationForm
+
+	if err := decoder.Decode(&p, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, ResendVerificationUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	//the same message is shown whatever happened, so that this can't be used to find out who has an account
+	e := &audit.AuditEvent{Action: audit.ResendVerification, TargetType: audit.TargetAccount}
+	c.audited(req, e, func(s AnyStorer) error {
+		if err := account.ResendVerificationCode(s, p.Email, time.Now()); err != nil {
+			return err
+		}
+		a, err := s.LoadAccountFromEmail(p.Email)
+		if err == nil {
+			e.TargetId = a.Id
+		}
+		return err
+	})
+
+	c.SetNotificationMessage(rw, req, "If that account is waiting to be verified, a new verification link has been sent to it. Links can only be sent once every few minutes.")
+	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
+}
+
 func (c *Context) BeginPasswordResetRequestHandler(rw web.ResponseWriter, req *web.Request) {
 	err := templates.ExecuteTemplate(rw, "beginResetPasswordPage", c)
 	if err != nil {
@@ -374,7 +1178,17 @@ func (c *Context) DoBeginPasswordResetRequestHandler(rw web.ResponseWriter, req
 		return
 	}
 
-	account.DoPasswordResetRequestIfPossible(c.Storage, p.Email)
+	e := &audit.AuditEvent{Action: audit.RequestPasswordReset, TargetType: audit.TargetAccount}
+	c.audited(req, e, func(s AnyStorer) error {
+		if err := account.DoPasswordResetRequestIfPossible(s, p.Email, time.Now()); err != nil {
+			return err
+		}
+		a, err := s.LoadAccountFromEmail(p.Email)
+		if err == nil {
+			e.TargetId = a.Id
+		}
+		return err
+	})
 
 	c.SetNotificationMessage(rw, req, "Password reset requested.")
 	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
@@ -406,12 +1220,18 @@ func (c *Context) PasswordResetRequestHandler(rw web.ResponseWriter, req *web.Re
 		return
 	}
 
-	_, ok = req.PathParams["resetVerificationCode"]
+	resetVerificationCode, ok := req.PathParams["resetVerificationCode"]
 	if !ok {
 		http.Error(rw, "400: Bad reset verification code", http.StatusBadRequest)
 		return
 	}
 
+	if err := a.CheckPasswordResetCode(resetVerificationCode, time.Now()); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, RequestPasswordResetUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
 	err = templates.ExecuteTemplate(rw, "resetPasswordPage", c)
 	if err != nil {
 		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
@@ -468,7 +1288,9 @@ func (c *Context) DoPasswordResetRequestHandler(rw web.ResponseWriter, req *web.
 		return
 	}
 
-	if err := a.ApplyPasswordResetVerificationCode(c.Storage, resetVerificationCode, p.Password); err != nil {
+	if err := c.audited(req, &audit.AuditEvent{ActorId: a.Id, Action: audit.ResetPassword, TargetType: audit.TargetAccount, TargetId: a.Id}, func(s AnyStorer) error {
+		return a.ApplyPasswordResetVerificationCode(s, resetVerificationCode, p.Password, time.Now())
+	}); err != nil {
 		c.SetErrorMessage(rw, req, err.Error())
 		http.Redirect(rw, req.Request, ResetPasswordUrl.Make("accountId", accountIdStr, "resetVerificationCode", resetVerificationCode), http.StatusSeeOther)
 		return
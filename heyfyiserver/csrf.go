@@ -0,0 +1,92 @@
+package heyfyiserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/sessions"
+)
+
+//Other sites can make a browser send its cookies along with a form or script of theirs, so a signed in account's cookie
+//isn't enough to show that they meant to do something. Every browser is given a random token, kept in its session
+//cookie, which has to be sent back with every request that could change something: in a CsrfToken field by forms
+//(see CsrfField), or in an X-CSRF-Token header by scripts. Other sites can't read it, so they can't send it
+//Requests made with an API token don't need one, as browsers never send those by themselves
+
+const (
+	csrfFormField  = "CsrfToken"
+	csrfHeader     = "X-CSRF-Token" //also given on every response, for clients that don't read the pages
+	csrfSessionKey = "csrfToken"
+)
+
+var BadCsrfToken error = errors.New("This form has expired or didn't come from this site. Please go back, reload the page and try again.")
+
+//Makes sure the browser has a CSRF token, and rejects requests that could change something unless they send it back
+func (c *Context) CsrfMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if c.ApiToken != nil {
+		next(rw, req)
+		return
+	}
+
+	session, _ := c.Store.Get(req.Request, "session-security")
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		c.CsrfToken = token
+		rw.Header().Set(csrfHeader, token)
+	} else {
+		if err := c.newCsrfToken(rw, session); err != nil {
+			http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		session.Save(req.Request, rw)
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		next(rw, req)
+		return
+	}
+
+	sent := req.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = req.PostFormValue(csrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(c.CsrfToken)) != 1 {
+		if isApiRequest(req) {
+			writeJSONError(rw, http.StatusForbidden, BadCsrfToken)
+			return
+		}
+		writeError(rw, req, http.StatusForbidden, BadCsrfToken.Error())
+		return
+	}
+
+	//handlers decode forms into structs that don't have the token, and parsing them again does nothing
+	req.ParseForm()
+	req.PostForm.Del(csrfFormField)
+	req.Form.Del(csrfFormField)
+	next(rw, req)
+}
+
+//Gives the browser a new CSRF token in its session, which the caller has to save. This is also done when someone signs
+//in or out, so that a token learnt before then is no use afterwards
+func (c *Context) newCsrfToken(rw web.ResponseWriter, session *sessions.Session) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	session.Values[csrfSessionKey] = token
+	c.CsrfToken = token
+	rw.Header().Set(csrfHeader, token)
+	return nil
+}
+
+//Returns the hidden field that every form that is POSTed needs, with the browser's CSRF token in it
+//Used in templates as {{CsrfField $.CsrfToken}}
+func CsrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,207 @@
+package heyfyiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+)
+
+//The CSRF token in the session cookie of newOpenApiFixture
+const fixtureCsrfToken = "openapi-test-csrf-token"
+
+//Requests that a signed in browser could be made to send by another site, none of which should work without the token
+var forgeableRequests = []struct {
+	method string
+	url    string
+	form   url.Values //sent as a form, if not nil
+	json   string     //otherwise sent as JSON, if not ""
+}{
+	{"POST", SignOutUrl.Make(), url.Values{}, ""},
+	{"POST", DeleteFactUrl.Make("factId", "1"), url.Values{}, ""},
+	{"POST", RequestPasswordResetUrl.Make(), url.Values{"Email": {"test@test"}}, ""},
+	{"POST", DoModerateFactUrl.Make("factId", "1"), url.Values{"Decision": {"reject"}, "Reason": {"Forged."}}, ""},
+	{"POST", VoteOnFactUrl.Make(), nil, `{"FactId": 1, "Up": false}`},
+	{"POST", ModerateFactUrl.Make(), nil, `{"FactId": 1, "Decision": "reject", "Reason": "Forged."}`},
+	{"POST", ApiVotesUrl.Make("factId", "1"), nil, `{"Up": false}`},
+	{"DELETE", ApiFactUrl.Make("factId", "1"), nil, ""},
+}
+
+//Makes a request as the fixture's signed in account from another site, with the token in the header (if it isn't "")
+//and in the form (if the request is one)
+func (fixture *openApiFixture) forge(method string, u string, form url.Values, body string, header string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, u, strings.NewReader(body))
+	if form != nil {
+		req = httptest.NewRequest(method, u, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Cookie", fixture.cookie)
+	req.Header.Set("Origin", "https://evil.example")
+	if header != "" {
+		req.Header.Set(csrfHeader, header)
+	}
+	rw := httptest.NewRecorder()
+	fixture.router.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCsrfRejectsForgedRequests(t *testing.T) {
+	fixture := newOpenApiFixture(t)
+
+	for _, r := range forgeableRequests {
+		for _, token := range []string{"", "wrong"} {
+			form := r.form
+			if form != nil {
+				form = url.Values{csrfFormField: {token}}
+				for k, v := range r.form {
+					form[k] = v
+				}
+			}
+			rw := fixture.forge(r.method, r.url, form, r.json, token)
+			if rw.Code != http.StatusForbidden {
+				t.Errorf("%s %s with the token %q wasn't forbidden, got %d: %s", r.method, r.url, token, rw.Code, rw.Body.String())
+			}
+			if strings.HasPrefix(r.url, ApiUrl.String()+"/") && !strings.Contains(rw.Body.String(), `"forbidden"`) {
+				t.Errorf("%s %s didn't give a JSON error, got %s", r.method, r.url, rw.Body.String())
+			}
+		}
+	}
+
+	//nothing should have changed
+	f, err := storage.LoadFactFromId(1)
+	if err != nil {
+		t.Fatal("The fact was deleted: ", err)
+	}
+	if f.State() != fact.StatePending || f.GetScore(1) != (fact.VoteScore{Ups: 1, AccountVote: 1}) {
+		t.Errorf("The fact was moderated or voted on, got %v and %+v", f.State(), f.GetScore(1))
+	}
+	if a, err := storage.LoadAccountFromId(1); err != nil || a.ResetPasswordVerificationCode.Valid {
+		t.Error("A password reset was requested, got ", err)
+	}
+	req := httptest.NewRequest("GET", ApiAccountUrl.Make(), nil)
+	req.Header.Set("Cookie", fixture.cookie)
+	rw := httptest.NewRecorder()
+	fixture.router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Error("The session was signed out, got ", rw.Code)
+	}
+}
+
+func TestCsrfAcceptsToken(t *testing.T) {
+	for _, r := range forgeableRequests {
+		//each request gets a fresh fixture, as some of them sign out or delete the fact
+		fixture := newOpenApiFixture(t)
+		if rw := fixture.forge(r.method, r.url, r.form, r.json, fixtureCsrfToken); rw.Code == http.StatusForbidden {
+			t.Errorf("%s %s with the token in its header was forbidden: %s", r.method, r.url, rw.Body.String())
+		}
+	}
+
+	//forms send it as a field instead, which the handlers don't see
+	fixture := newOpenApiFixture(t)
+	rw := fixture.forge("POST", DeleteFactUrl.Make("factId", "1"), url.Values{csrfFormField: {fixtureCsrfToken}}, "", "")
+	if rw.Code != http.StatusSeeOther && rw.Code != http.StatusFound {
+		t.Fatalf("Deleting a fact with the token in the form didn't work, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if _, err := storage.LoadFactFromId(1); err == nil {
+		t.Error("The fact wasn't deleted")
+	}
+}
+
+func TestCsrfNotNeededWithApiToken(t *testing.T) {
+	fixture := newOpenApiFixture(t)
+	req := httptest.NewRequest("POST", ApiVotesUrl.Make("factId", "1"), strings.NewReader(`{"Up": false}`))
+	req.Header.Set("Authorization", "Bearer "+fixture.token)
+	rw := httptest.NewRecorder()
+	fixture.router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Voting with an API token needed a CSRF token, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get(csrfHeader) != "" || sessionCookie(rw) != "" {
+		t.Error("A request with an API token was given a CSRF token")
+	}
+}
+
+//Returns the session cookie that a response sets, or "" if it doesn't
+func sessionCookie(rw *httptest.ResponseRecorder) string {
+	cookie := ""
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == "session-security" {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	return cookie
+}
+
+func TestCsrfTokenChangesOnSignIn(t *testing.T) {
+	fixture := newOpenApiFixture(t)
+
+	rw := httptest.NewRecorder()
+	fixture.router.ServeHTTP(rw, httptest.NewRequest("GET", ApiFactsUrl.Make(), nil))
+	before, cookie := rw.Header().Get(csrfHeader), sessionCookie(rw)
+	if len(before) != 64 || cookie == "" {
+		t.Fatalf("A new browser wasn't given a CSRF token, got %q and %q", before, cookie)
+	}
+
+	signIn := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"Email": {"test@test"}, "Password": {"test@test"}, csrfFormField: {token}}
+		req := httptest.NewRequest("POST", SignInUrl.Make(), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+		rw := httptest.NewRecorder()
+		fixture.router.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := signIn("wrong"); rw.Code != http.StatusForbidden {
+		t.Fatal("Signing in without the CSRF token wasn't forbidden, got ", rw.Code)
+	}
+	rw = signIn(before)
+	after := rw.Header().Get(csrfHeader)
+	if rw.Code != http.StatusFound || after == "" || after == before {
+		t.Fatalf("Signing in didn't give a new CSRF token, got %d and %q", rw.Code, after)
+	}
+	cookie = sessionCookie(rw)
+
+	vote := func(token string) int {
+		req := httptest.NewRequest("POST", ApiVotesUrl.Make("factId", "1"), strings.NewReader(`{"Up": false}`))
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set(csrfHeader, token)
+		rw := httptest.NewRecorder()
+		fixture.router.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := vote(before); code != http.StatusForbidden {
+		t.Error("The CSRF token from before signing in still worked, got ", code)
+	}
+	if code := vote(after); code != http.StatusOK {
+		t.Error("The CSRF token from signing in didn't work, got ", code)
+	}
+}
+
+//Every form that is POSTed has to include the CSRF token, or it won't work
+func TestEveryFormHasCsrfField(t *testing.T) {
+	files, err := filepath.Glob("../media/templates/*.html")
+	if err != nil || len(files) == 0 {
+		t.Fatal("Could not find the templates: ", err)
+	}
+	forms := regexp.MustCompile(`(?is)<form\b([^>]*)>(.*?)</form>`)
+	post := regexp.MustCompile(`(?i)method=["']?post`)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal("Could not read a template: ", err)
+		}
+		for _, form := range forms.FindAllStringSubmatch(string(b), -1) {
+			if post.MatchString(form[1]) && !strings.Contains(form[2], "{{CsrfField $.CsrfToken}}") {
+				t.Errorf("A form in %s doesn't have {{CsrfField $.CsrfToken}}: <form%s>", filepath.Base(file), form[1])
+			}
+		}
+	}
+}
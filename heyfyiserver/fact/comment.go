@@ -0,0 +1,142 @@
+package fact
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/kiwih/nullables"
+)
+
+//A Comment is part of the discussion of a fact. Comments can reply to other comments on the same fact, making threads
+//Comments are soft deleted, so that the replies to a deleted comment can still be shown in their thread
+type Comment struct {
+	Id        int64
+	FactId    int64
+	AccountId int64
+	ParentId  int64  //the comment this replies to, or 0 for a new thread
+	Text      string `sql:"type:text"`
+	Hidden    bool   //hidden by an admin. Hidden comments can only be seen by admins and the account that wrote them
+	CreatedAt nullables.NullTime
+	EditedAt  nullables.NullTime
+	DeletedAt nullables.NullTime
+}
+
+const MaxCommentLength = 2000
+
+var (
+	CommentIsEmpty          = errors.New("Your comment is empty!")
+	CommentTooLong          = errors.New("Comments must be 2000 characters or less.")
+	ReplyToMissingComment   = errors.New("The comment you replied to has been deleted.")
+	NotAllowedToEditComment = errors.New("You can only change your own comments!")
+)
+
+func validateCommentText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", CommentIsEmpty
+	}
+	if len(text) > MaxCommentLength {
+		return "", CommentTooLong
+	}
+	return text, nil
+}
+
+//Saves a new comment after checking it. If it is a reply, the comment it replies to must be on the same fact
+func CreateComment(fs FactStorer, c *Comment) error {
+	text, err := validateCommentText(c.Text)
+	if err != nil {
+		return err
+	}
+	c.Text = text
+
+	if c.AccountId == 0 {
+		return NoAccountSpecified
+	}
+
+	if c.ParentId != 0 {
+		parent, err := fs.LoadCommentFromId(c.ParentId)
+		if err != nil || parent.FactId != c.FactId {
+			return ReplyToMissingComment
+		}
+	}
+
+	return fs.CreateComment(c)
+}
+
+//Changes the text of a comment. Only the account that wrote it can edit it
+func EditComment(fs FactStorer, c *Comment, text string, editorId int64) error {
+	if c.AccountId != editorId {
+		return NotAllowedToEditComment
+	}
+
+	text, err := validateCommentText(text)
+	if err != nil {
+		return err
+	}
+	c.Text = text
+
+	return fs.EditComment(c)
+}
+
+//Deletes a comment. Admins can delete anyone's comments
+func DeleteComment(fs FactStorer, c *Comment, accountId int64, admin bool) error {
+	if c.AccountId != accountId && !admin {
+		return NotAllowedToEditComment
+	}
+	return fs.DeleteComment(c)
+}
+
+//ThreadedComment is a comment in the order it is shown on a fact's page, along with how deeply it is nested in its thread
+type ThreadedComment struct {
+	Comment
+	Depth   int  //0 for the start of a thread
+	Removed bool //the comment was deleted or can't be seen, but is still shown (without its text) because it has replies that can be
+}
+
+//Puts the comments on a fact into threads, with each comment followed by its replies (oldest first)
+//visible should return whether the viewer can see a comment. Deleted comments, and comments that can't be seen, are
+//left out unless they have replies that are shown, in which case they are marked Removed and their text is left out
+func ThreadComments(comments []Comment, visible func(c *Comment) bool) []ThreadedComment {
+	replies := make(map[int64][]Comment)
+	ids := make(map[int64]bool)
+	for _, c := range comments {
+		ids[c.Id] = true
+	}
+	for _, c := range comments {
+		parentId := c.ParentId
+		if !ids[parentId] {
+			//a reply to a comment that is missing altogether starts a new thread
+			parentId = 0
+		}
+		replies[parentId] = append(replies[parentId], c)
+	}
+	for _, r := range replies {
+		sort.Sort(commentsById(r))
+	}
+
+	var thread func(parentId int64, depth int) []ThreadedComment
+	thread = func(parentId int64, depth int) []ThreadedComment {
+		var threaded []ThreadedComment
+		for _, c := range replies[parentId] {
+			below := thread(c.Id, depth+1)
+			removed := c.DeletedAt.Valid || !visible(&c)
+			if removed && len(below) == 0 {
+				continue
+			}
+			if removed {
+				c.Text = ""
+			}
+			threaded = append(threaded, ThreadedComment{Comment: c, Depth: depth, Removed: removed})
+			threaded = append(threaded, below...)
+		}
+		return threaded
+	}
+	return thread(0, 0)
+}
+
+type commentsById []Comment
+
+func (c commentsById) Len() int           { return len(c) }
+func (c commentsById) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c commentsById) Less(i, j int) bool { return c[i].Id < c[j].Id }
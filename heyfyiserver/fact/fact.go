@@ -2,7 +2,6 @@ package fact
 
 import (
 	"errors"
-	"strings"
 
 	"github.com/kiwih/nullables"
 )
@@ -13,8 +12,10 @@ type Fact struct {
 	Explain         string
 	ExplainFurther  string
 	AwaitModeration bool
+	ModerationState ModerationState `sql:"type:varchar(20)"`
 	References      []Reference
 	Votes           []Vote
+	Tags            []Tag `sql:"-"` //saved in the fact_tags table by the storage backend
 	AccountId       int64
 	CreatedAt       nullables.NullTime
 	EditedAt        nullables.NullTime
@@ -30,6 +31,34 @@ type Reference struct {
 	CreatedAt nullables.NullTime
 	EditedAt  nullables.NullTime
 	DeletedAt nullables.NullTime
+
+	//the result of the last time the link checker fetched Url
+	LinkStatus    int    //the HTTP status code, or 0 if there was no response
+	LinkFinalUrl  string `sql:"type:text"` //where Url ended up after redirects
+	LinkError     string `sql:"type:text"`
+	LinkCheckedAt nullables.NullTime
+	LinkFailures  int //how many checks in a row have found the link broken
+}
+
+//A link that has been broken for this many checks in a row is treated as gone for good, rather than temporarily down
+const LinkRottedAfterFailures = 3
+
+//Returns true if the last check of the reference's link didn't get a successful response
+func (r Reference) LinkBroken() bool {
+	return r.LinkCheckedAt.Valid && (r.LinkStatus == 0 || r.LinkStatus >= 400)
+}
+
+//Returns true if the reference's link has been broken for LinkRottedAfterFailures checks in a row
+func (r Reference) LinkRotted() bool {
+	return r.LinkBroken() && r.LinkFailures >= LinkRottedAfterFailures
+}
+
+func (r *Reference) clearLinkCheck() {
+	r.LinkStatus = 0
+	r.LinkFinalUrl = ""
+	r.LinkError = ""
+	r.LinkCheckedAt = nullables.NullTime{}
+	r.LinkFailures = 0
 }
 
 type Vote struct {
@@ -42,13 +71,30 @@ type Vote struct {
 }
 
 type FactStorer interface {
-	ListFacts(accountId int64, awaitModeration bool) ([]Fact, error)
+	ListFacts(q FactQuery) (*FactPage, error)
+	SearchFacts(q SearchQuery) (*SearchPage, error)
 	LoadFactFromId(id int64) (*Fact, error)
 	DeleteFact(*Fact) error
 	CreateFact(*Fact) error
 	GetVoteForFact(accountId int64, factId int64) (*Vote, error)
 	SaveVote(*Vote) error
 	ModerateFact(f *Fact, enable bool) error
+	SaveModerationDecision(f *Fact, n *ModerationNote) error //saves the fact's moderation state along with the decision
+	CreateModerationNote(n *ModerationNote) error
+	ListModerationNotes(factId int64) ([]ModerationNote, error) //oldest first
+	EditFact(f *Fact, editorId int64, comment string) error
+	ListFactRevisions(factId int64) ([]FactRevision, error)
+	LoadFactRevision(id int64) (*FactRevision, error)
+	ListTags() ([]TagCount, error)
+	LoadTagFromName(name string) (*Tag, error)
+	RenameTag(t *Tag, name string) error
+	MergeTags(from *Tag, into *Tag) error
+	ListComments(factId int64) ([]Comment, error)
+	LoadCommentFromId(id int64) (*Comment, error)
+	CreateComment(c *Comment) error
+	EditComment(c *Comment) error
+	DeleteComment(c *Comment) error
+	HideComment(c *Comment, hidden bool) error
 }
 
 type VoteScore struct {
@@ -61,6 +107,8 @@ var (
 	NotEnoughReferences    = errors.New("You need at least 2 references!")
 	NoAccountSpecified     = errors.New("No account ID was specified!")
 	AllFieldsAreCompulsory = errors.New("All fields are compulsory.")
+	NotAllowedToEdit       = errors.New("You can only edit your own facts!")
+	RevisionNotForFact     = errors.New("That revision is not of this fact!")
 )
 
 func VoteForFact(fs FactStorer, accountId int64, factId int64, up bool) (*Vote, error) {
@@ -91,6 +139,10 @@ func CreateFact(fs FactStorer, f *Fact) error {
 		return err
 	}
 
+	if err := f.ValidateTags(); err != nil {
+		return err
+	}
+
 	if f.AccountId == 0 {
 		return NoAccountSpecified
 	}
@@ -114,27 +166,31 @@ func (f *Fact) GetScore(currentAccountId int64) VoteScore {
 	return v
 }
 
-//if the references are fine, no error will be returned
-//this will also add "http://" to the urls if they do not begin with it or https:// or ftp://
+//if the references are fine, no error will be returned. If one of them isn't, the error is a *ReferenceError saying which
+//this will also put the urls in their canonical form (see CanonicalReferenceUrl), adding "http://" if they have no scheme,
+//and clear any link check results, as only the link checker should set them
 func (f *Fact) ValidateReferences() error {
 	if len(f.References) < 2 {
 		return NotEnoughReferences
 	}
 
+	pages := make(map[string]bool)
 	for i := 0; i < len(f.References); i++ {
+		f.References[i].clearLinkCheck()
+
 		if f.References[i].Url == "" || f.References[i].Title == "" || f.References[i].Publisher == "" {
 			return AllFieldsAreCompulsory
 		}
-		if strings.Contains(f.References[i].Url, "https://") {
-			continue
-		}
-		if strings.Contains(f.References[i].Url, "http://") {
-			continue
+
+		canonical, err := CanonicalReferenceUrl(f.References[i].Url)
+		if err != nil {
+			return &ReferenceError{Reference: i, Err: err}
 		}
-		if strings.Contains(f.References[i].Url, "ftp://") {
-			continue
+		if pages[samePageKey(canonical)] {
+			return &ReferenceError{Reference: i, Err: DuplicateReferenceUrl}
 		}
-		f.References[i].Url = "http://" + f.References[i].Url
+		pages[samePageKey(canonical)] = true
+		f.References[i].Url = canonical
 	}
 	return nil
 }
@@ -0,0 +1,176 @@
+package fact
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kiwih/nullables"
+)
+
+//Where a fact is in moderation. AwaitModeration is true for every state except StateApproved, and is what decides who can see it
+type ModerationState string
+
+const (
+	StatePending          ModerationState = "pending"           //waiting in the moderation queue
+	StateChangesRequested ModerationState = "changes_requested" //its author has been asked to change it, and it goes back in the queue when they do
+	StateRejected         ModerationState = "rejected"          //it won't be approved, so it isn't in the queue and can't be edited by its author
+	StateApproved         ModerationState = "approved"          //everyone can see it
+)
+
+//What a moderator decided about a fact
+type ModerationDecision string
+
+const (
+	DecisionNone           ModerationDecision = ""                //a note, which only moderators can see
+	DecisionApprove        ModerationDecision = "approve"         //the fact becomes StateApproved
+	DecisionReject         ModerationDecision = "reject"          //the fact becomes StateRejected
+	DecisionRequestChanges ModerationDecision = "request_changes" //the fact becomes StateChangesRequested
+)
+
+//A ModerationNote records a moderator's decision about a fact and why they made it, or just a note for other moderators
+//Decisions are shown to the fact's author, but notes (with DecisionNone) are only shown to moderators
+type ModerationNote struct {
+	Id        int64
+	FactId    int64
+	AccountId int64              //the moderator
+	Decision  ModerationDecision `sql:"type:varchar(20)"`
+	Text      string             `sql:"type:text"` //the reason for the decision, or the note
+	CreatedAt nullables.NullTime
+}
+
+const MaxModerationNoteLength = 1000
+
+var (
+	ModerationReasonMissing = errors.New("Please give a reason, as it is sent to the fact's author.")
+	ModerationNoteIsEmpty   = errors.New("Your note is empty!")
+	ModerationNoteTooLong   = errors.New("Moderation reasons and notes must be 1000 characters or less.")
+	BadModerationDecision   = errors.New("That isn't a moderation decision.")
+	FactWasRejected         = errors.New("This fact was rejected by a moderator, so it can't be changed.")
+)
+
+var decisionStates = map[ModerationDecision]ModerationState{
+	DecisionApprove:        StateApproved,
+	DecisionReject:         StateRejected,
+	DecisionRequestChanges: StateChangesRequested,
+}
+
+//Returns the state that a fact is put in by the decision, and false if it isn't a decision
+func (d ModerationDecision) State() (ModerationState, bool) {
+	state, ok := decisionStates[d]
+	return state, ok
+}
+
+var stateDescriptions = map[ModerationState]string{
+	StatePending:          "Awaiting Moderation",
+	StateChangesRequested: "Changes Requested",
+	StateRejected:         "Rejected",
+	StateApproved:         "Approved",
+}
+
+//Describes the state for people, eg in the badge on a fact
+func (s ModerationState) Description() string {
+	return stateDescriptions[s]
+}
+
+var decisionDescriptions = map[ModerationDecision]string{
+	DecisionNone:           "Note",
+	DecisionApprove:        "Approved",
+	DecisionReject:         "Rejected",
+	DecisionRequestChanges: "Changes requested",
+}
+
+//Describes the decision for people, eg in the list of decisions about a fact
+func (d ModerationDecision) Description() string {
+	return decisionDescriptions[d]
+}
+
+//Sets the fact's moderation state, along with AwaitModeration
+func (f *Fact) SetModerationState(state ModerationState) {
+	f.ModerationState = state
+	f.AwaitModeration = state != StateApproved
+}
+
+//Returns the fact's moderation state. Facts saved before there were states are approved or pending depending on AwaitModeration
+func (f *Fact) State() ModerationState {
+	if f.ModerationState != "" {
+		return f.ModerationState
+	}
+	if f.AwaitModeration {
+		return StatePending
+	}
+	return StateApproved
+}
+
+func validateModerationText(text string, empty error) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", empty
+	}
+	if len(text) > MaxModerationNoteLength {
+		return "", ModerationNoteTooLong
+	}
+	return text, nil
+}
+
+//Approves, rejects or requests changes to the fact on behalf of the moderator moderatorId, who has to give a reason
+//The decision is saved along with the fact's new state, and returned so that the author can be told about it
+func Moderate(fs FactStorer, f *Fact, moderatorId int64, decision ModerationDecision, reason string) (*ModerationNote, error) {
+	state, ok := decision.State()
+	if !ok {
+		return nil, BadModerationDecision
+	}
+	reason, err := validateModerationText(reason, ModerationReasonMissing)
+	if err != nil {
+		return nil, err
+	}
+
+	note := &ModerationNote{
+		FactId:    f.Id,
+		AccountId: moderatorId,
+		Decision:  decision,
+		Text:      reason,
+	}
+	f.SetModerationState(state)
+	if err := fs.SaveModerationDecision(f, note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+//Saves a note about the fact that only moderators can see
+func AddModerationNote(fs FactStorer, f *Fact, moderatorId int64, text string) (*ModerationNote, error) {
+	text, err := validateModerationText(text, ModerationNoteIsEmpty)
+	if err != nil {
+		return nil, err
+	}
+	note := &ModerationNote{
+		FactId:    f.Id,
+		AccountId: moderatorId,
+		Text:      text,
+	}
+	if err := fs.CreateModerationNote(note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+//Returns the most recent decision in notes (which are oldest first, as ListModerationNotes returns them), or nil if there isn't one
+func LatestDecision(notes []ModerationNote) *ModerationNote {
+	for i := len(notes) - 1; i >= 0; i-- {
+		if notes[i].Decision != DecisionNone {
+			return &notes[i]
+		}
+	}
+	return nil
+}
+
+//Returns only the decisions in notes, which is what a fact's author can see
+func Decisions(notes []ModerationNote) []ModerationNote {
+	var decisions []ModerationNote
+	for _, n := range notes {
+		if n.Decision != DecisionNone {
+			decisions = append(decisions, n)
+		}
+	}
+	return decisions
+}
@@ -0,0 +1,118 @@
+package fact
+
+import (
+	"time"
+)
+
+//The orders that facts can be listed in
+type FactSort string
+
+const (
+	SortNewest        FactSort = "newest"        //most recently created first
+	SortTop           FactSort = "top"           //highest score (ups minus downs) first
+	SortControversial FactSort = "controversial" //most votes on the losing side first
+	SortOldest        FactSort = "oldest"        //least recently created first, which is the order of the moderation queue
+)
+
+//Which facts to list, based on whether they have been moderated
+type ModerationFilter string
+
+const (
+	AnyModeration       ModerationFilter = ""
+	OnlyModerated       ModerationFilter = "moderated"
+	OnlyAwaitModeration ModerationFilter = "awaiting"
+	OnlyPending         ModerationFilter = "pending"  //only facts in the moderation queue (see StatePending)
+	OnlyRejected        ModerationFilter = "rejected" //only facts that were rejected (see StateRejected)
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+//FactQuery describes one page of a fact listing
+//ViewerId and ViewUnmoderated control what can be seen (the same way as ListFacts always has: facts awaiting moderation
+//are only listed for admins, or for the account that submitted them), and the rest filter and order what is listed
+type FactQuery struct {
+	ViewerId        int64
+	ViewUnmoderated bool
+
+	AuthorId      int64  //0 for any author
+	Tag           string //the name of a tag, or "" for facts with any (or no) tags
+	Moderation    ModerationFilter
+	CreatedAfter  time.Time //zero for no limit
+	CreatedBefore time.Time //zero for no limit
+
+	Sort     FactSort
+	Page     int //starting from 1
+	PageSize int
+}
+
+//FactPage is one page of facts returned by ListFacts, along with how many facts matched the query in total
+type FactPage struct {
+	Query FactQuery
+	Facts []Fact
+	Total int64
+}
+
+//Returns the query with the page, page size and sort set to sensible values if they were missing or out of range
+func (q FactQuery) Normalised() FactQuery {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = DefaultPageSize
+	}
+	if q.PageSize > MaxPageSize {
+		q.PageSize = MaxPageSize
+	}
+	switch q.Sort {
+	case SortNewest, SortTop, SortControversial, SortOldest:
+	default:
+		q.Sort = SortNewest
+	}
+	switch q.Moderation {
+	case AnyModeration, OnlyModerated, OnlyAwaitModeration, OnlyPending, OnlyRejected:
+	default:
+		q.Moderation = AnyModeration
+	}
+	return q
+}
+
+//The number of facts to skip before this page starts
+func (q FactQuery) Offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+//The number of pages needed for every matching fact
+func (p FactPage) Pages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.Query.PageSize) - 1) / int64(p.Query.PageSize))
+}
+
+func (p FactPage) HasPrevious() bool {
+	return p.Query.Page > 1
+}
+
+func (p FactPage) HasNext() bool {
+	return p.Query.Page < p.Pages()
+}
+
+func (p FactPage) PreviousPage() int {
+	return p.Query.Page - 1
+}
+
+func (p FactPage) NextPage() int {
+	return p.Query.Page + 1
+}
+
+//Returns the controversy of a fact with these votes, which is the number of votes on the losing side
+//A fact with 10 ups and 9 downs is more controversial than one with 100 ups and 1 down
+func (v VoteScore) Controversy() int64 {
+	if v.Ups < v.Downs {
+		return v.Ups
+	}
+	return v.Downs
+}
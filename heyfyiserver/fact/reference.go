@@ -0,0 +1,169 @@
+package fact
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	BadReferenceUrl       = errors.New("That isn't a valid web address.")
+	ReferenceNotWebPage   = errors.New("References must be web pages, with addresses starting with http:// or https://.")
+	ReferenceHasLogin     = errors.New("Reference addresses can't contain a username or password.")
+	ReferenceNotPublic    = errors.New("References must be on the public internet, not a local or private network.")
+	DuplicateReferenceUrl = errors.New("This is the same page as another of your references.")
+)
+
+//ReferenceError is returned when one of a fact's references is invalid. Err is the reason, eg ReferenceNotWebPage
+type ReferenceError struct {
+	Reference int //the index of the bad reference in Fact.References
+	Err       error
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("Reference %d: %s", e.Reference+1, e.Err.Error())
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return e.Err
+}
+
+//Returns the index of the reference that caused err, if it is a ReferenceError
+func BadReferenceIndex(err error) (int, bool) {
+	var refErr *ReferenceError
+	if errors.As(err, &refErr) {
+		return refErr.Reference, true
+	}
+	return 0, false
+}
+
+//query parameters that only track where a visitor came from, which are removed from reference URLs
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
+
+//host names that are only used on local networks
+var privateHostSuffixes = []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"}
+
+//Checks that rawUrl is a link to a public web page and returns it in its canonical form:
+//http:// is added if there is no scheme, the host is lower cased, default ports and tracking parameters (eg utm_source) are removed
+func CanonicalReferenceUrl(rawUrl string) (string, error) {
+	rawUrl = strings.TrimSpace(rawUrl)
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", BadReferenceUrl
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ReferenceNotWebPage
+	}
+	if u.User != nil {
+		return "", ReferenceHasLogin
+	}
+	if u.Opaque != "" {
+		return "", BadReferenceUrl
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", BadReferenceUrl
+	}
+	if !publicHost(host) {
+		return "", ReferenceNotPublic
+	}
+
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if u.RawQuery != "" {
+		var kept []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			name := param
+			if i := strings.Index(param, "="); i >= 0 {
+				name = param[:i]
+			}
+			if param != "" && !isTrackingParam(name) {
+				kept = append(kept, param)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+//Returns true if host is an IP address on the public internet, or a domain name that could be
+func publicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return IsPublicIP(ip)
+	}
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return false
+	}
+	for _, suffix := range privateHostSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return false
+		}
+	}
+	//top level domains are letters (or punycode). Anything else is probably an IP address written another way, eg 127.1 or 0x7f.0.0.1
+	tld := host[strings.LastIndex(host, ".")+1:]
+	if strings.HasPrefix(tld, "xn--") {
+		return true
+	}
+	for _, r := range tld {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return tld != ""
+}
+
+//Returns true if ip is an address on the public internet (not loopback, private, link local, multicast or unspecified)
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	//carrier grade NAT (100.64.0.0/10) isn't covered by IsPrivate
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+//two references are to the same page if their canonical URLs only differ by http/https, a trailing slash or the #fragment
+func samePageKey(canonicalUrl string) string {
+	u, err := url.Parse(canonicalUrl)
+	if err != nil {
+		return canonicalUrl
+	}
+	u.Scheme = "http"
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
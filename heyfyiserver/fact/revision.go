@@ -0,0 +1,234 @@
+package fact
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/kiwih/nullables"
+)
+
+//A FactRevision is one version of a fact's text and references
+//A revision is saved when a fact is created and every time it is edited, so the latest revision is always the current version
+type FactRevision struct {
+	Id             int64
+	FactId         int64
+	AccountId      int64 //the account that made this version
+	Fact           string
+	Explain        string
+	ExplainFurther string
+	ReferenceList  string `sql:"type:text"` //the references, as JSON
+	Comment        string //why the fact was changed (eg it was rolled back), if there is a reason
+	CreatedAt      nullables.NullTime
+}
+
+//Returns a revision holding the current version of f
+func NewRevision(f *Fact, accountId int64, comment string) FactRevision {
+	references := make([]Reference, len(f.References))
+	for i, r := range f.References {
+		references[i] = Reference{Url: r.Url, Publisher: r.Publisher, Title: r.Title}
+	}
+	list, _ := json.Marshal(references)
+
+	return FactRevision{
+		FactId:         f.Id,
+		AccountId:      accountId,
+		Fact:           f.Fact,
+		Explain:        f.Explain,
+		ExplainFurther: f.ExplainFurther,
+		ReferenceList:  string(list),
+		Comment:        comment,
+	}
+}
+
+//Returns the references saved in the revision (without Ids, as they are copies)
+func (r *FactRevision) GetReferences() []Reference {
+	var references []Reference
+	json.Unmarshal([]byte(r.ReferenceList), &references)
+	return references
+}
+
+//Returns the references as text, one per line, so they can be compared
+func (r *FactRevision) ReferencesText() string {
+	var lines []string
+	for _, ref := range r.GetReferences() {
+		lines = append(lines, ref.Publisher+" - "+ref.Title+" ("+ref.Url+")")
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Saves a new version of a fact that has been edited by the account editorId, after checking it the same way as CreateFact
+//Facts edited by anyone but an admin have to be moderated again
+func EditFact(fs FactStorer, f *Fact, editorId int64, admin bool) error {
+	if f.AccountId != editorId && !admin {
+		return NotAllowedToEdit
+	}
+	if f.State() == StateRejected && !admin {
+		return FactWasRejected
+	}
+
+	if f.Fact == "" || f.Explain == "" || f.ExplainFurther == "" {
+		return AllFieldsAreCompulsory
+	}
+
+	if err := f.ValidateReferences(); err != nil {
+		return err
+	}
+
+	if err := f.ValidateTags(); err != nil {
+		return err
+	}
+
+	if !admin {
+		//this also puts facts that a moderator asked to be changed back in the queue
+		f.SetModerationState(StatePending)
+	}
+
+	return fs.EditFact(f, editorId, "")
+}
+
+//Returns f to the version in the revision r, by saving it as a new version (so the rollback is also in the history)
+func RollbackFact(fs FactStorer, f *Fact, r *FactRevision, editorId int64, comment string) error {
+	if r.FactId != f.Id {
+		return RevisionNotForFact
+	}
+
+	f.Fact = r.Fact
+	f.Explain = r.Explain
+	f.ExplainFurther = r.ExplainFurther
+	f.References = r.GetReferences()
+
+	return fs.EditFact(f, editorId, comment)
+}
+
+//How a DiffChunk has changed between two versions of some text
+const (
+	DiffRemoved = -1
+	DiffSame    = 0
+	DiffAdded   = 1
+)
+
+//A DiffChunk is a piece of text that was removed, added or unchanged
+type DiffChunk struct {
+	Text   string
+	Change int
+}
+
+//RevisionDiff is what changed in each part of a fact between two revisions
+type RevisionDiff struct {
+	Fact           []DiffChunk
+	Explain        []DiffChunk
+	ExplainFurther []DiffChunk
+	References     []DiffChunk
+}
+
+//Compares two revisions. If from is nil, everything in to is shown as added
+func DiffRevisions(from *FactRevision, to *FactRevision) RevisionDiff {
+	if from == nil {
+		from = &FactRevision{}
+	}
+	return RevisionDiff{
+		Fact:           DiffWords(from.Fact, to.Fact),
+		Explain:        DiffWords(from.Explain, to.Explain),
+		ExplainFurther: DiffWords(from.ExplainFurther, to.ExplainFurther),
+		References:     DiffWords(from.ReferencesText(), to.ReferencesText()),
+	}
+}
+
+//Returns true if anything was added or removed
+func (d RevisionDiff) Changed() bool {
+	for _, chunks := range [][]DiffChunk{d.Fact, d.Explain, d.ExplainFurther, d.References} {
+		for _, c := range chunks {
+			if c.Change != DiffSame {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//splits text into words and the whitespace between them, so that joining the tokens gives back the text
+func diffTokens(text string) []string {
+	var tokens []string
+	start := 0
+	wasSpace := false
+	for i, r := range text {
+		if i > 0 && unicode.IsSpace(r) != wasSpace {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		wasSpace = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+//the largest number of token comparisons DiffWords will make before giving up and showing the whole text as replaced
+const maxDiffComparisons = 4000000
+
+//Returns the word level differences between two versions of some text, using the longest common subsequence of their words
+func DiffWords(from string, to string) []DiffChunk {
+	a := diffTokens(from)
+	b := diffTokens(to)
+
+	if len(a)*len(b) > maxDiffComparisons {
+		var chunks []DiffChunk
+		if from != "" {
+			chunks = append(chunks, DiffChunk{Text: from, Change: DiffRemoved})
+		}
+		if to != "" {
+			chunks = append(chunks, DiffChunk{Text: to, Change: DiffAdded})
+		}
+		return chunks
+	}
+
+	//lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var chunks []DiffChunk
+	add := func(text string, change int) {
+		if len(chunks) > 0 && chunks[len(chunks)-1].Change == change {
+			chunks[len(chunks)-1].Text += text
+			return
+		}
+		chunks = append(chunks, DiffChunk{Text: text, Change: change})
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			add(a[i], DiffSame)
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			add(a[i], DiffRemoved)
+			i++
+		} else {
+			add(b[j], DiffAdded)
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(a[i], DiffRemoved)
+	}
+	for ; j < len(b); j++ {
+		add(b[j], DiffAdded)
+	}
+	return chunks
+}
@@ -0,0 +1,263 @@
+package fact
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+//The most words that a search will look for. Any others are ignored
+const MaxSearchTerms = 10
+
+//The length (in characters) of the snippets shown with search results
+const SnippetLength = 160
+
+//SearchQuery is one page of a full text search
+//ViewerId and ViewUnmoderated control which facts can be found, the same way as they do for FactQuery
+type SearchQuery struct {
+	ViewerId        int64
+	ViewUnmoderated bool
+
+	Terms    string //what was typed into the search box
+	Page     int    //starting from 1
+	PageSize int
+}
+
+//SearchResult is one fact found by a search. Fact and Snippet are HTML, with the words that matched the search in <mark> tags
+type SearchResult struct {
+	FactId  int64
+	Fact    template.HTML
+	Snippet template.HTML
+	Rank    float64 //higher is better, but is only comparable to other ranks from the same search
+}
+
+//SearchPage is one page of results returned by SearchFacts, along with how many facts matched the search in total
+type SearchPage struct {
+	Query   SearchQuery
+	Results []SearchResult
+	Total   int64
+}
+
+//Returns the query with the page and page size set to sensible values if they were missing or out of range
+func (q SearchQuery) Normalised() SearchQuery {
+	list := FactQuery{Page: q.Page, PageSize: q.PageSize}.Normalised()
+	q.Page = list.Page
+	q.PageSize = list.PageSize
+	return q
+}
+
+//The number of results to skip before this page starts
+func (q SearchQuery) Offset() int {
+	return (q.Page - 1) * q.PageSize
+}
+
+func (p SearchPage) Pages() int {
+	return FactPage{Query: FactQuery{PageSize: p.Query.PageSize}, Total: p.Total}.Pages()
+}
+
+func (p SearchPage) HasPrevious() bool {
+	return p.Query.Page > 1
+}
+
+func (p SearchPage) HasNext() bool {
+	return p.Query.Page < p.Pages()
+}
+
+func (p SearchPage) PreviousPage() int {
+	return p.Query.Page - 1
+}
+
+func (p SearchPage) NextPage() int {
+	return p.Query.Page + 1
+}
+
+//Splits text into lower case words, dropping punctuation
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+//Returns the words to search for in what was typed into a search box, without duplicates
+//Every backend only finds facts containing every term (as the start of a word)
+func SearchTerms(terms string) []string {
+	var unique []string
+	for _, word := range searchWords(terms) {
+		duplicate := false
+		for _, u := range unique {
+			if u == word {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			unique = append(unique, word)
+		}
+		if len(unique) == MaxSearchTerms {
+			break
+		}
+	}
+	return unique
+}
+
+func matchesTerm(word string, terms []string) bool {
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
+
+//How much a match in each part of a fact counts towards its rank
+var searchWeights = struct {
+	Fact, Explain, ExplainFurther, References float64
+}{10, 5, 2, 1}
+
+//Returns the text of the fact's references that is searched (their titles and publishers)
+func (f *Fact) ReferenceSearchText() string {
+	var text []string
+	for _, r := range f.References {
+		text = append(text, r.Title, r.Publisher)
+	}
+	return strings.Join(text, " ")
+}
+
+//Returns how well the fact matches the search terms, or 0 if it doesn't contain every term
+//This is used by the backends that can't rank results themselves
+func (f *Fact) SearchRank(terms []string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+
+	fields := []struct {
+		Text   string
+		Weight float64
+	}{
+		{f.Fact, searchWeights.Fact},
+		{f.Explain, searchWeights.Explain},
+		{f.ExplainFurther, searchWeights.ExplainFurther},
+		{f.ReferenceSearchText(), searchWeights.References},
+	}
+
+	var rank float64
+	for _, term := range terms {
+		found := false
+		for _, field := range fields {
+			for _, word := range searchWords(field.Text) {
+				if strings.HasPrefix(word, term) {
+					rank += field.Weight
+					found = true
+				}
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return rank
+}
+
+//Returns the fact as a search result, with its best matching text as the snippet
+func (f *Fact) SearchResult(terms []string, rank float64) SearchResult {
+	snippet := f.Explain
+	for _, text := range []string{f.Explain, f.ExplainFurther, f.ReferenceSearchText()} {
+		if highlightStart(text, terms) >= 0 {
+			snippet = text
+			break
+		}
+	}
+
+	return SearchResult{
+		FactId:  f.Id,
+		Fact:    Highlight(f.Fact, terms, 0),
+		Snippet: Highlight(snippet, terms, SnippetLength),
+		Rank:    rank,
+	}
+}
+
+//returns the byte offset of the first word in text that matches a term, or -1
+func highlightStart(text string, terms []string) int {
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && matchesTerm(strings.ToLower(text[start:i]), terms) {
+			return start
+		}
+		start = -1
+	}
+	if start >= 0 && matchesTerm(strings.ToLower(text[start:]), terms) {
+		return start
+	}
+	return -1
+}
+
+//Returns text as HTML with every word that matches a term wrapped in <mark> tags
+//If length is more than 0, the text is cut down to about that many characters around the first match
+func Highlight(text string, terms []string, length int) template.HTML {
+	if length > 0 && len(text) > length {
+		start := highlightStart(text, terms)
+		if start < 0 {
+			start = 0
+		}
+		//show a little of what comes before the first match
+		start -= length / 4
+		if start < 0 {
+			start = 0
+		}
+		//don't cut words (or runes) in half
+		for start > 0 && !unicode.IsSpace(rune(text[start-1])) {
+			start--
+		}
+		end := start + length
+		if end > len(text) {
+			end = len(text)
+		}
+		for end < len(text) && !unicode.IsSpace(rune(text[end])) {
+			end++
+		}
+
+		cut := text[start:end]
+		if start > 0 {
+			cut = "..." + cut
+		}
+		if end < len(text) {
+			cut = cut + "..."
+		}
+		text = cut
+	}
+
+	var out bytes.Buffer
+	wordStart := -1
+	flush := func(end int) {
+		word := text[wordStart:end]
+		if matchesTerm(strings.ToLower(word), terms) {
+			out.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+		} else {
+			out.WriteString(html.EscapeString(word))
+		}
+		wordStart = -1
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if wordStart < 0 {
+				wordStart = i
+			}
+			continue
+		}
+		if wordStart >= 0 {
+			flush(i)
+		}
+		out.WriteString(html.EscapeString(string(r)))
+	}
+	if wordStart >= 0 {
+		flush(len(text))
+	}
+	return template.HTML(out.String())
+}
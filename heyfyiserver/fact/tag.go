@@ -0,0 +1,110 @@
+package fact
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kiwih/nullables"
+)
+
+//A Tag groups facts by topic (eg health, animals, history). Facts can have several tags, and tags can be on many facts
+//Tag names are lower case letters, numbers and hyphens, so they can be used in URLs as they are
+type Tag struct {
+	Id        int64
+	Name      string `sql:"unique;type:varchar(30)"`
+	CreatedAt nullables.NullTime
+}
+
+//TagCount is a tag along with the number of moderated facts that have it
+type TagCount struct {
+	Tag
+	Facts int64
+}
+
+const (
+	MaxTagsPerFact = 5
+	MaxTagLength   = 30
+)
+
+var (
+	BadTagName    = errors.New("Tags can only contain letters, numbers and hyphens, and must be 30 characters or less.")
+	TooManyTags   = errors.New("Facts can have at most 5 tags.")
+	TagNameTaken  = errors.New("There is already a tag with that name (merge the tags instead).")
+	TagMergedSelf = errors.New("A tag can't be merged into itself!")
+)
+
+//Returns a tag name in the form that it is saved in: lower case, with spaces and underscores replaced by hyphens
+func NormaliseTagName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '_' || r == '-'
+	})
+	return strings.Join(words, "-")
+}
+
+//Returns true if name is a normalised tag name
+func ValidTagName(name string) bool {
+	if name == "" || len(name) > MaxTagLength {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+//Splits a comma separated list of tag names (as typed into the fact form) into tags
+//The names are checked by ValidateTags when the fact is saved
+func TagsFromText(text string) []Tag {
+	var tags []Tag
+	for _, name := range strings.Split(text, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			tags = append(tags, Tag{Name: name})
+		}
+	}
+	return tags
+}
+
+//if the tags are fine, no error will be returned
+//this will also normalise their names and remove any duplicates
+func (f *Fact) ValidateTags() error {
+	var tags []Tag
+	for _, t := range f.Tags {
+		t.Name = NormaliseTagName(t.Name)
+		if !ValidTagName(t.Name) {
+			return BadTagName
+		}
+		duplicate := false
+		for _, existing := range tags {
+			if existing.Name == t.Name {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) > MaxTagsPerFact {
+		return TooManyTags
+	}
+	f.Tags = tags
+	return nil
+}
+
+//Renames a tag, after normalising and checking the new name
+func RenameTag(fs FactStorer, t *Tag, name string) error {
+	name = NormaliseTagName(name)
+	if !ValidTagName(name) {
+		return BadTagName
+	}
+	return fs.RenameTag(t, name)
+}
+
+//Moves every fact tagged with from to into, and then deletes from
+func MergeTags(fs FactStorer, from *Tag, into *Tag) error {
+	if from.Id == into.Id {
+		return TagMergedSelf
+	}
+	return fs.MergeTags(from, into)
+}
@@ -0,0 +1,50 @@
+package fyidb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+)
+
+func (s *DatabaseStorage) CreateApiToken(t *account.ApiToken) error {
+	return s.dbGorm.Create(t).Error
+}
+
+//Loads the API token with the given token hash. Expired tokens are returned too (account.LoadApiToken checks them)
+func (s *DatabaseStorage) LoadApiToken(tokenHash string) (*account.ApiToken, error) {
+	var t account.ApiToken
+	if err := s.dbGorm.Where("token_hash = ?", tokenHash).Find(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+//Returns the account's API tokens, newest first
+func (s *DatabaseStorage) ListApiTokens(accountId int64) ([]account.ApiToken, error) {
+	var tokens []account.ApiToken
+	if err := s.dbGorm.Where("account_id = ?", accountId).Order("created_at desc, id desc").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+//Saves when and where the token was last used, and adds one to how many times it has been used (in the database,
+//so that uses at the same time aren't lost)
+func (s *DatabaseStorage) RecordApiTokenUse(t *account.ApiToken) error {
+	return s.dbGorm.Model(t).UpdateColumns(map[string]interface{}{
+		"last_used_at": t.LastUsedAt,
+		"last_used_ip": t.LastUsedIp,
+		"uses":         gorm.Expr("uses + ?", 1),
+	}).Error
+}
+
+//Deletes one of the account's API tokens, returning account.ApiTokenNotFound if it doesn't have one with that Id
+func (s *DatabaseStorage) DeleteApiToken(accountId int64, tokenId int64) error {
+	db := s.dbGorm.Where("id = ? AND account_id = ?", tokenId, accountId).Delete(account.ApiToken{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return account.ApiTokenNotFound
+	}
+	return nil
+}
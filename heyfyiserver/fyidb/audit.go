@@ -0,0 +1,49 @@
+package fyidb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
+)
+
+//Runs change with a copy of this storage that uses a new transaction, and saves e in the same transaction if change succeeds
+func (s *DatabaseStorage) Audited(e *audit.AuditEvent, change func(tx interface{}) error) error {
+	return s.inTransaction(func(tx *gorm.DB) error {
+		if err := change(&DatabaseStorage{dbGorm: tx, dialect: s.dialect, inTx: true}); err != nil {
+			return err
+		}
+		return tx.Create(e).Error
+	})
+}
+
+//Lists one page of audit events, newest first
+func (s *DatabaseStorage) ListAuditEvents(q audit.AuditQuery) (*audit.AuditPage, error) {
+	q = q.Normalised()
+	query := s.dbGorm.Model(&audit.AuditEvent{})
+	if q.ActorId != 0 {
+		query = query.Where("actor_id = ?", q.ActorId)
+	}
+	if q.Action != "" {
+		query = query.Where("action = ?", q.Action)
+	}
+	if q.TargetType != audit.NoTarget {
+		query = query.Where("target_type = ?", q.TargetType)
+	}
+	if q.TargetId != 0 {
+		query = query.Where("target_id = ?", q.TargetId)
+	}
+	if !q.CreatedAfter.IsZero() {
+		query = query.Where("created_at >= ?", q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", q.CreatedBefore)
+	}
+
+	page := audit.AuditPage{Query: q}
+	if err := query.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := query.Order("id desc").Offset(q.Offset()).Limit(q.PageSize).Find(&page.Events).Error; err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
@@ -0,0 +1,60 @@
+package fyidb
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/nullables"
+)
+
+//Returns every comment on a fact in the order they were made, including deleted ones (which fact.ThreadComments needs to keep threads together)
+func (s *DatabaseStorage) ListComments(factId int64) ([]fact.Comment, error) {
+	var comments []fact.Comment
+	if err := s.dbGorm.Unscoped().Where("fact_id = ?", factId).Order("id").Find(&comments).Error; err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (s *DatabaseStorage) LoadCommentFromId(id int64) (*fact.Comment, error) {
+	var c fact.Comment
+	if err := s.dbGorm.Find(&c, id).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *DatabaseStorage) CreateComment(c *fact.Comment) error {
+	return s.dbGorm.Create(c).Error
+}
+
+//Saves a comment's new text
+func (s *DatabaseStorage) EditComment(c *fact.Comment) error {
+	c.EditedAt = nullables.NullTime{Time: time.Now(), Valid: true}
+	return s.updateComment(c, map[string]interface{}{"text": c.Text, "edited_at": c.EditedAt})
+}
+
+func (s *DatabaseStorage) DeleteComment(c *fact.Comment) error {
+	return s.dbGorm.Delete(c).Error
+}
+
+func (s *DatabaseStorage) HideComment(c *fact.Comment, hidden bool) error {
+	if err := s.updateComment(c, map[string]interface{}{"hidden": hidden}); err != nil {
+		return err
+	}
+	c.Hidden = hidden
+	return nil
+}
+
+//updates the columns of a comment that hasn't been deleted
+func (s *DatabaseStorage) updateComment(c *fact.Comment, columns map[string]interface{}) error {
+	update := s.dbGorm.Model(&fact.Comment{}).Where("id = ? AND deleted_at IS NULL", c.Id).UpdateColumns(columns)
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
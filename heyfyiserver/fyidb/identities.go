@@ -0,0 +1,22 @@
+package fyidb
+
+import (
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+)
+
+func (s *DatabaseStorage) LoadExternalIdentity(issuer string, subject string) (*account.ExternalIdentity, error) {
+	var identity account.ExternalIdentity
+	if err := s.dbGorm.Where("issuer = ? AND subject = ?", issuer, subject).Find(&identity).Error; err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (s *DatabaseStorage) CreateExternalIdentity(identity *account.ExternalIdentity) error {
+	return s.dbGorm.Create(identity).Error
+}
+
+//Saves when the identity was last used to sign in
+func (s *DatabaseStorage) SaveExternalIdentity(identity *account.ExternalIdentity) error {
+	return s.dbGorm.Model(identity).UpdateColumn("last_used_at", identity.LastUsedAt).Error
+}
@@ -0,0 +1,54 @@
+package fyidb
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+)
+
+//references on facts that haven't been deleted
+func (s *DatabaseStorage) liveReferences() *gorm.DB {
+	return s.dbGorm.Where("fact_id IN (SELECT id FROM facts WHERE deleted_at IS NULL)")
+}
+
+//Returns up to limit references whose links haven't been checked since checkedBefore. Those that have never been checked come first,
+//then those that were checked longest ago
+func (s *DatabaseStorage) ListReferencesToCheck(checkedBefore time.Time, limit int) ([]fact.Reference, error) {
+	var references []fact.Reference
+	err := s.liveReferences().Where("link_checked_at IS NULL OR link_checked_at < ?", checkedBefore).
+		Order("CASE WHEN link_checked_at IS NULL THEN 0 ELSE 1 END, link_checked_at, id").Limit(limit).Find(&references).Error
+	if err != nil {
+		return nil, err
+	}
+	return references, nil
+}
+
+//Saves the result of checking a reference's link
+func (s *DatabaseStorage) SaveLinkCheck(r *fact.Reference) error {
+	update := s.dbGorm.Model(&fact.Reference{}).Where("id = ?", r.Id).UpdateColumns(map[string]interface{}{
+		"link_status":     r.LinkStatus,
+		"link_final_url":  r.LinkFinalUrl,
+		"link_error":      r.LinkError,
+		"link_checked_at": r.LinkCheckedAt,
+		"link_failures":   r.LinkFailures,
+	})
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+//Returns the references whose links were broken when they were last checked, grouped by fact
+func (s *DatabaseStorage) ListBrokenReferences() ([]fact.Reference, error) {
+	var references []fact.Reference
+	err := s.liveReferences().Where("link_checked_at IS NOT NULL AND (link_status = 0 OR link_status >= 400)").
+		Order("fact_id, id").Find(&references).Error
+	if err != nil {
+		return nil, err
+	}
+	return references, nil
+}
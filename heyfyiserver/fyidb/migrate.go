@@ -0,0 +1,215 @@
+package fyidb
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//A Migration is one numbered, reversible change to the database schema
+//Up and Down are each run inside a transaction (although mysql can't roll back schema changes)
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *gorm.DB, dialect string) error
+	Down        func(tx *gorm.DB, dialect string) error
+}
+
+//Each applied migration is recorded as a row in the schema_version table
+//The version of the database is the highest Version in it (or 0 if it is empty)
+type SchemaVersion struct {
+	Id          int64
+	Version     int
+	Description string
+	AppliedAt   time.Time
+}
+
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+//MigrationState is a Migration along with when (if ever) it was applied to the database
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var (
+	UnknownSchemaVersion    error = errors.New("There is no migration with that version")
+	DatabaseSchemaOutOfDate error = errors.New("The database schema is out of date. Run \"heyfyi migrate up\" to upgrade it.")
+	DatabaseSchemaTooNew    error = errors.New("The database schema is newer than this version of heyfyi supports.")
+)
+
+//Returns the version that the database will be at after all migrations are applied
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+//Makes sure the schema_version table exists. If it doesn't, but the accounts table does, the database was made by
+//CreateDatabaseTables before migrations existed and is stamped with the baseline version (1) without running anything
+func (s *DatabaseStorage) ensureSchemaVersionTable() error {
+	if s.dbGorm.HasTable(&SchemaVersion{}) {
+		return nil
+	}
+
+	if err := s.dbGorm.CreateTable(&SchemaVersion{}).Error; err != nil {
+		return err
+	}
+
+	if s.dbGorm.HasTable("accounts") {
+		log.Println("Existing database found, stamping it with the baseline schema version.")
+		baseline := Migrations[0]
+		return s.dbGorm.Create(&SchemaVersion{Version: baseline.Version, Description: baseline.Description, AppliedAt: time.Now()}).Error
+	}
+	return nil
+}
+
+//Returns the current version of the database schema
+func (s *DatabaseStorage) SchemaVersion() (int, error) {
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+
+	var versions []SchemaVersion
+	if err := s.dbGorm.Order("version desc").Limit(1).Find(&versions).Error; err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[0].Version, nil
+}
+
+//Returns every known migration and whether it has been applied
+func (s *DatabaseStorage) MigrationStatus() ([]MigrationState, error) {
+	if err := s.ensureSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaVersion
+	if err := s.dbGorm.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(Migrations))
+	for i, m := range Migrations {
+		states[i].Migration = m
+		for _, a := range applied {
+			if a.Version == m.Version {
+				states[i].Applied = true
+				states[i].AppliedAt = a.AppliedAt
+			}
+		}
+	}
+	return states, nil
+}
+
+//Applies or reverts migrations, one transaction each, until the database is at the given version
+//Version 0 is an empty database
+func (s *DatabaseStorage) MigrateTo(version int) error {
+	if version < 0 || version > LatestSchemaVersion() {
+		return UnknownSchemaVersion
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return DatabaseSchemaTooNew
+	}
+
+	for _, m := range Migrations {
+		if m.Version > current && m.Version <= version {
+			if err := s.runMigration(m, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m := Migrations[i]
+		if m.Version <= current && m.Version > version {
+			if err := s.runMigration(m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Applies every migration that hasn't been applied yet
+func (s *DatabaseStorage) MigrateUp() error {
+	return s.MigrateTo(LatestSchemaVersion())
+}
+
+//Reverts the most recently applied migration
+func (s *DatabaseStorage) MigrateDown() error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	previous := 0
+	for _, m := range Migrations {
+		if m.Version < current {
+			previous = m.Version
+		}
+	}
+	return s.MigrateTo(previous)
+}
+
+func (s *DatabaseStorage) runMigration(m Migration, up bool) error {
+	tx := s.dbGorm.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var err error
+	if up {
+		log.Printf("Applying migration %d: %s\n", m.Version, m.Description)
+		if err = m.Up(tx, s.dialect); err == nil {
+			err = tx.Create(&SchemaVersion{Version: m.Version, Description: m.Description, AppliedAt: time.Now()}).Error
+		}
+	} else {
+		log.Printf("Reverting migration %d: %s\n", m.Version, m.Description)
+		if err = m.Down(tx, s.dialect); err == nil {
+			err = tx.Where("version = ?", m.Version).Delete(&SchemaVersion{}).Error
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+//Called when the server starts. A new (empty) database is migrated to the latest version and given the test user and fact,
+//but any other database must already be at the latest version - upgrades are done with "heyfyi migrate"
+func (s *DatabaseStorage) CheckDatabaseSchema() error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		if err := s.MigrateUp(); err != nil {
+			return err
+		}
+		AddTestFact(AddTestUser())
+		return nil
+	}
+
+	if current < LatestSchemaVersion() {
+		log.Printf("The database schema is at version %d, but this version of heyfyi needs version %d.\n", current, LatestSchemaVersion())
+		return DatabaseSchemaOutOfDate
+	}
+	if current > LatestSchemaVersion() {
+		log.Printf("The database schema is at version %d, but this version of heyfyi only knows up to version %d.\n", current, LatestSchemaVersion())
+		return DatabaseSchemaTooNew
+	}
+	return nil
+}
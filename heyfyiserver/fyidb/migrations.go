@@ -0,0 +1,732 @@
+package fyidb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/nullables"
+)
+
+//Migrations is the ordered list of every schema change. Add new migrations to the end with the next version number,
+//and never edit one that has been released - write another migration instead.
+//Migrations use their own copies of the tables (eg accountV1) rather than account.Account etc, so that they keep
+//doing the same thing as the models change.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "baseline: accounts, facts, references and votes tables",
+		Up: func(tx *gorm.DB, dialect string) error {
+			return tx.CreateTable(&accountV1{}, &factV1{}, &referenceV1{}, &voteV1{}).Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&voteV1{}, &referenceV1{}, &factV1{}, &accountV1{}).Error
+		},
+	},
+	{
+		Version:     2,
+		Description: "index fact, reference and vote lookups and account sessions",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.Model(&factV1{}).AddIndex("idx_facts_account_id", "account_id").Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&referenceV1{}).AddIndex("idx_references_fact_id", "fact_id").Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&voteV1{}).AddIndex("idx_votes_fact_id_account_id", "fact_id", "account_id").Error; err != nil {
+				return err
+			}
+			return tx.Model(&accountV1{}).AddIndex("idx_accounts_current_session", "current_session").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			if err := dropIndex(tx, dialect, "accounts", "idx_accounts_current_session"); err != nil {
+				return err
+			}
+			if err := dropIndex(tx, dialect, "votes", "idx_votes_fact_id_account_id"); err != nil {
+				return err
+			}
+			if err := dropIndex(tx, dialect, "references", "idx_references_fact_id"); err != nil {
+				return err
+			}
+			return dropIndex(tx, dialect, "facts", "idx_facts_account_id")
+		},
+	},
+	{
+		Version:     3,
+		Description: "index facts by creation time for paginated listing",
+		Up: func(tx *gorm.DB, dialect string) error {
+			return tx.Model(&factV1{}).AddIndex("idx_facts_created_at", "created_at").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return dropIndex(tx, dialect, "facts", "idx_facts_created_at")
+		},
+	},
+	{
+		Version:     4,
+		Description: "full text search table for facts and their references",
+		Up: func(tx *gorm.DB, dialect string) error {
+			var err error
+			switch dialect {
+			case "postgres":
+				err = tx.Exec(`CREATE TABLE fact_search (fact_id bigint PRIMARY KEY, fact text, explanation text, explain_further text, reference_text text)`).Error
+				if err == nil {
+					err = tx.Exec(`CREATE INDEX idx_fact_search_document ON fact_search USING gin ((` + searchDocumentPostgres + `))`).Error
+				}
+			case "mysql":
+				err = tx.Exec(`CREATE TABLE fact_search (fact_id bigint PRIMARY KEY, fact text, explanation text, explain_further text, reference_text text,
+					FULLTEXT idx_fact_search_document (fact, explanation, explain_further, reference_text)) ENGINE=InnoDB`).Error
+			default:
+				err = tx.Exec(`CREATE VIRTUAL TABLE fact_search USING fts5(fact_id UNINDEXED, fact, explanation, explain_further, reference_text)`).Error
+				if err != nil && strings.Contains(err.Error(), "no such module") {
+					log.Println("This build of sqlite3 doesn't have FTS5 (build with -tags sqlite_fts5), so searches will be slower and unranked by the database.")
+					err = tx.Exec(`CREATE TABLE fact_search (fact_id integer PRIMARY KEY, fact text, explanation text, explain_further text, reference_text text)`).Error
+				}
+			}
+			if err != nil {
+				return err
+			}
+			return indexAllFacts(tx)
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.Exec("DROP TABLE fact_search").Error
+		},
+	},
+	{
+		Version:     5,
+		Description: "fact revisions, starting with the current version of every fact",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&factRevisionV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&factRevisionV1{}).AddIndex("idx_fact_revisions_fact_id", "fact_id").Error; err != nil {
+				return err
+			}
+
+			var facts []factV1
+			if err := tx.Where("deleted_at IS NULL").Find(&facts).Error; err != nil {
+				return err
+			}
+			for _, f := range facts {
+				var references []referenceV1
+				if err := tx.Where("fact_id = ? AND deleted_at IS NULL", f.Id).Order("id").Find(&references).Error; err != nil {
+					return err
+				}
+				list := make([]map[string]string, len(references))
+				for i, r := range references {
+					list[i] = map[string]string{"Url": r.Url, "Publisher": r.Publisher, "Title": r.Title}
+				}
+				referenceList, _ := json.Marshal(list)
+
+				revision := factRevisionV1{
+					FactId:         f.Id,
+					AccountId:      f.AccountId,
+					Fact:           f.Fact,
+					Explain:        f.Explain,
+					ExplainFurther: f.ExplainFurther,
+					ReferenceList:  string(referenceList),
+					CreatedAt:      f.CreatedAt,
+				}
+				if err := tx.Create(&revision).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&factRevisionV1{}).Error
+		},
+	},
+	{
+		Version:     6,
+		Description: "tags, and the fact_tags table linking them to facts",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&tagV1{}, &factTagV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&factTagV1{}).AddUniqueIndex("idx_fact_tags_fact_id_tag_id", "fact_id", "tag_id").Error; err != nil {
+				return err
+			}
+			return tx.Model(&factTagV1{}).AddIndex("idx_fact_tags_tag_id", "tag_id").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&factTagV1{}, &tagV1{}).Error
+		},
+	},
+	{
+		Version:     7,
+		Description: "threaded comments on facts",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&commentV1{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&commentV1{}).AddIndex("idx_comments_fact_id", "fact_id").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&commentV1{}).Error
+		},
+	},
+	{
+		Version:     8,
+		Description: "record the results of checking reference links",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.AutoMigrate(&referenceV2{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&referenceV2{}).AddIndex("idx_references_link_checked_at", "link_checked_at").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			if err := dropIndex(tx, dialect, "references", "idx_references_link_checked_at"); err != nil {
+				return err
+			}
+			for _, column := range []string{"link_status", "link_final_url", "link_error", "link_checked_at", "link_failures"} {
+				if err := tx.Model(&referenceV2{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "two factor authentication secrets and recovery codes for accounts",
+		Up: func(tx *gorm.DB, dialect string) error {
+			return tx.AutoMigrate(&accountV2{}).Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			for _, column := range []string{"totp_secret", "totp_enabled", "totp_last_step", "recovery_codes"} {
+				if err := tx.Model(&accountV2{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     10,
+		Description: "sessions table, so that accounts can be signed in on more than one device, with the session tokens hashed",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&sessionV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&sessionV1{}).AddIndex("idx_sessions_account_id", "account_id").Error; err != nil {
+				return err
+			}
+
+			//keep everyone signed in by moving their current sessions across
+			var accounts []accountV2
+			if err := tx.Where("current_session IS NOT NULL AND current_session <> ''").Find(&accounts).Error; err != nil {
+				return err
+			}
+			for _, a := range accounts {
+				session := sessionV1{
+					AccountId:  a.Id,
+					TokenHash:  hashSessionTokenV1(a.CurrentSession.String),
+					CreatedAt:  a.UpdatedAt,
+					LastSeenAt: a.UpdatedAt,
+					ExpiresAt:  a.SessionExpires,
+				}
+				if err := tx.Create(&session).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := dropIndex(tx, dialect, "accounts", "idx_accounts_current_session"); err != nil {
+				return err
+			}
+			for _, column := range []string{"current_session", "session_expires"} {
+				if err := tx.Model(&accountV2{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			//only hashes of the session tokens are kept, so everyone has to sign in again
+			if err := tx.AutoMigrate(&accountV2{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&accountV2{}).AddIndex("idx_accounts_current_session", "current_session").Error; err != nil {
+				return err
+			}
+			return tx.DropTable(&sessionV1{}).Error
+		},
+	},
+	{
+		Version:     11,
+		Description: "record when verification and password reset codes were sent, so that they can expire",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.AutoMigrate(&accountV3{}).Error; err != nil {
+				return err
+			}
+			//codes that have already been sent are treated as if they were sent now, so that they don't all expire at once
+			now := time.Now()
+			if err := tx.Model(&accountV3{}).Where("verification_code IS NOT NULL").UpdateColumn("verification_code_issued_at", now).Error; err != nil {
+				return err
+			}
+			return tx.Model(&accountV3{}).Where("reset_password_verification_code IS NOT NULL").UpdateColumn("reset_password_code_issued_at", now).Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			for _, column := range []string{"verification_code_issued_at", "reset_password_code_issued_at"} {
+				if err := tx.Model(&accountV3{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     12,
+		Description: "count failed sign ins for each email and IP address, so that password guessing can be slowed down",
+		Up: func(tx *gorm.DB, dialect string) error {
+			return tx.CreateTable(&loginThrottleV1{}).Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&loginThrottleV1{}).Error
+		},
+	},
+	{
+		Version:     13,
+		Description: "identities at OpenID Connect providers, linked to the accounts they sign in to",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&externalIdentityV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&externalIdentityV1{}).AddUniqueIndex("idx_external_identities_issuer_subject", "issuer", "subject").Error; err != nil {
+				return err
+			}
+			return tx.Model(&externalIdentityV1{}).AddIndex("idx_external_identities_account_id", "account_id").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&externalIdentityV1{}).Error
+		},
+	},
+	{
+		Version:     14,
+		Description: "replace the admin flag on accounts with roles",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.AutoMigrate(&accountV4{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&accountV4{}).Where("admin = ?", true).UpdateColumn("role", "admin").Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&accountV4{}).Where("role IS NULL OR role = ''").UpdateColumn("role", "member").Error; err != nil {
+				return err
+			}
+			return tx.Model(&accountV4{}).DropColumn("admin").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			//only admins had any special permissions before roles, so trusted members and moderators become plain members
+			if err := tx.AutoMigrate(&accountV3{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&accountV3{}).UpdateColumn("admin", false).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&accountV3{}).Where("role = ?", "admin").UpdateColumn("admin", true).Error; err != nil {
+				return err
+			}
+			return tx.Model(&accountV3{}).DropColumn("role").Error
+		},
+	},
+	{
+		Version:     15,
+		Description: "let admins suspend and ban accounts, and make them choose a new password",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.AutoMigrate(&accountV5{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&accountV5{}).UpdateColumns(map[string]interface{}{"password_reset_required": false, "banned": false}).Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			for _, column := range []string{"password_reset_required", "suspended_until", "banned", "suspension_reason"} {
+				if err := tx.Model(&accountV5{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     16,
+		Description: "give facts a moderation state, so that rejected facts aren't just awaiting moderation, and keep moderators' decisions and notes",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.AutoMigrate(&factV2{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&factV2{}).Where("await_moderation = ?", true).UpdateColumn("moderation_state", "pending").Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&factV2{}).Where("await_moderation = ?", false).UpdateColumn("moderation_state", "approved").Error; err != nil {
+				return err
+			}
+			if err := tx.CreateTable(&moderationNoteV1{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&moderationNoteV1{}).AddIndex("idx_moderation_notes_fact_id", "fact_id").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			//rejected facts and facts waiting for changes were awaiting moderation before there were states, which they still are
+			if err := tx.DropTable(&moderationNoteV1{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&factV2{}).DropColumn("moderation_state").Error
+		},
+	},
+	{
+		Version:     17,
+		Description: "keep an append-only audit log of everything that changes state",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&auditEventV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&auditEventV1{}).AddIndex("idx_audit_events_actor_id", "actor_id").Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&auditEventV1{}).AddIndex("idx_audit_events_target", "target_type", "target_id").Error; err != nil {
+				return err
+			}
+			return tx.Model(&auditEventV1{}).AddIndex("idx_audit_events_action", "action").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&auditEventV1{}).Error
+		},
+	},
+	{
+		Version:     18,
+		Description: "add personal API tokens",
+		Up: func(tx *gorm.DB, dialect string) error {
+			if err := tx.CreateTable(&apiTokenV1{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&apiTokenV1{}).AddIndex("idx_api_tokens_account_id", "account_id").Error
+		},
+		Down: func(tx *gorm.DB, dialect string) error {
+			return tx.DropTable(&apiTokenV1{}).Error
+		},
+	},
+}
+
+//Drops an index inside the migration's transaction. gorm's RemoveIndex doesn't use the transaction (and doesn't return
+//its error), so it can't be used after a migration has written anything
+func dropIndex(tx *gorm.DB, dialect string, table string, index string) error {
+	if dialect == "mysql" {
+		return tx.Exec("DROP INDEX " + index + " ON `" + table + "`").Error //quoted, as references is a reserved word
+	}
+	return tx.Exec("DROP INDEX " + index).Error
+}
+
+//the tables as they were made by CreateDatabaseTables before migrations existed
+
+type accountV1 struct {
+	Id                            int64
+	Email                         string               `sql:"unique; type:varchar(60);"`
+	Nickname                      string               `sql:"type:varchar(15);"`
+	Password                      string               `sql:"type:varchar(60);"`
+	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
+	CurrentSession                nullables.NullString `sql:"type:varchar(32)"`
+	SessionExpires                nullables.NullTime
+	VoteBank                      int64
+	Admin                         bool
+	CreatedAt                     nullables.NullTime
+	UpdatedAt                     nullables.NullTime
+	DeletedAt                     nullables.NullTime
+}
+
+func (accountV1) TableName() string { return "accounts" }
+
+type factV1 struct {
+	Id              int64
+	Fact            string
+	Explain         string
+	ExplainFurther  string
+	AwaitModeration bool
+	AccountId       int64
+	CreatedAt       nullables.NullTime
+	EditedAt        nullables.NullTime
+	DeletedAt       nullables.NullTime
+}
+
+func (factV1) TableName() string { return "facts" }
+
+type referenceV1 struct {
+	Id        int64
+	FactId    int64
+	Url       string
+	Publisher string
+	Title     string
+	CreatedAt nullables.NullTime
+	EditedAt  nullables.NullTime
+	DeletedAt nullables.NullTime
+}
+
+func (referenceV1) TableName() string { return "references" }
+
+type voteV1 struct {
+	Id        int64
+	FactId    int64
+	AccountId int64
+	Score     int64
+	CreatedAt nullables.NullTime
+	DeletedAt nullables.NullTime
+}
+
+func (voteV1) TableName() string { return "votes" }
+
+//tables added by later migrations
+
+type factRevisionV1 struct {
+	Id             int64
+	FactId         int64
+	AccountId      int64
+	Fact           string
+	Explain        string
+	ExplainFurther string
+	ReferenceList  string `sql:"type:text"`
+	Comment        string
+	CreatedAt      nullables.NullTime
+}
+
+func (factRevisionV1) TableName() string { return "fact_revisions" }
+
+type tagV1 struct {
+	Id        int64
+	Name      string `sql:"unique;type:varchar(30)"`
+	CreatedAt nullables.NullTime
+}
+
+func (tagV1) TableName() string { return "tags" }
+
+type factTagV1 struct {
+	FactId int64
+	TagId  int64
+}
+
+func (factTagV1) TableName() string { return "fact_tags" }
+
+type commentV1 struct {
+	Id        int64
+	FactId    int64
+	AccountId int64
+	ParentId  int64
+	Text      string `sql:"type:text"`
+	Hidden    bool
+	CreatedAt nullables.NullTime
+	EditedAt  nullables.NullTime
+	DeletedAt nullables.NullTime
+}
+
+func (commentV1) TableName() string { return "comments" }
+
+type referenceV2 struct {
+	Id            int64
+	FactId        int64
+	Url           string
+	Publisher     string
+	Title         string
+	CreatedAt     nullables.NullTime
+	EditedAt      nullables.NullTime
+	DeletedAt     nullables.NullTime
+	LinkStatus    int
+	LinkFinalUrl  string `sql:"type:text"`
+	LinkError     string `sql:"type:text"`
+	LinkCheckedAt nullables.NullTime
+	LinkFailures  int
+}
+
+func (referenceV2) TableName() string { return "references" }
+
+type accountV2 struct {
+	Id                            int64
+	Email                         string               `sql:"unique; type:varchar(60);"`
+	Nickname                      string               `sql:"type:varchar(15);"`
+	Password                      string               `sql:"type:varchar(60);"`
+	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
+	CurrentSession                nullables.NullString `sql:"type:varchar(32)"`
+	SessionExpires                nullables.NullTime
+	VoteBank                      int64
+	Admin                         bool
+	TotpSecret                    nullables.NullString `sql:"type:varchar(32)"`
+	TotpEnabled                   bool
+	TotpLastStep                  int64
+	RecoveryCodes                 string `sql:"type:text"`
+	CreatedAt                     nullables.NullTime
+	UpdatedAt                     nullables.NullTime
+	DeletedAt                     nullables.NullTime
+}
+
+func (accountV2) TableName() string { return "accounts" }
+
+type accountV3 struct {
+	Id                            int64
+	Email                         string               `sql:"unique; type:varchar(60);"`
+	Nickname                      string               `sql:"type:varchar(15);"`
+	Password                      string               `sql:"type:varchar(60);"`
+	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	VerificationCodeIssuedAt      nullables.NullTime
+	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
+	ResetPasswordCodeIssuedAt     nullables.NullTime
+	VoteBank                      int64
+	Admin                         bool
+	TotpSecret                    nullables.NullString `sql:"type:varchar(32)"`
+	TotpEnabled                   bool
+	TotpLastStep                  int64
+	RecoveryCodes                 string `sql:"type:text"`
+	CreatedAt                     nullables.NullTime
+	UpdatedAt                     nullables.NullTime
+	DeletedAt                     nullables.NullTime
+}
+
+func (accountV3) TableName() string { return "accounts" }
+
+type accountV4 struct {
+	Id                            int64
+	Email                         string               `sql:"unique; type:varchar(60);"`
+	Nickname                      string               `sql:"type:varchar(15);"`
+	Password                      string               `sql:"type:varchar(60);"`
+	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	VerificationCodeIssuedAt      nullables.NullTime
+	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
+	ResetPasswordCodeIssuedAt     nullables.NullTime
+	VoteBank                      int64
+	Role                          string               `sql:"type:varchar(20)"`
+	TotpSecret                    nullables.NullString `sql:"type:varchar(32)"`
+	TotpEnabled                   bool
+	TotpLastStep                  int64
+	RecoveryCodes                 string `sql:"type:text"`
+	CreatedAt                     nullables.NullTime
+	UpdatedAt                     nullables.NullTime
+	DeletedAt                     nullables.NullTime
+}
+
+func (accountV4) TableName() string { return "accounts" }
+
+type accountV5 struct {
+	Id                            int64
+	Email                         string               `sql:"unique; type:varchar(60);"`
+	Nickname                      string               `sql:"type:varchar(15);"`
+	Password                      string               `sql:"type:varchar(60);"`
+	VerificationCode              nullables.NullString `sql:"type:varchar(32)"`
+	VerificationCodeIssuedAt      nullables.NullTime
+	ResetPasswordVerificationCode nullables.NullString `sql:"type:varchar(32)"`
+	ResetPasswordCodeIssuedAt     nullables.NullTime
+	VoteBank                      int64
+	Role                          string               `sql:"type:varchar(20)"`
+	TotpSecret                    nullables.NullString `sql:"type:varchar(32)"`
+	TotpEnabled                   bool
+	TotpLastStep                  int64
+	RecoveryCodes                 string `sql:"type:text"`
+	PasswordResetRequired         bool
+	SuspendedUntil                nullables.NullTime
+	Banned                        bool
+	SuspensionReason              string `sql:"type:varchar(255)"`
+	CreatedAt                     nullables.NullTime
+	UpdatedAt                     nullables.NullTime
+	DeletedAt                     nullables.NullTime
+}
+
+func (accountV5) TableName() string { return "accounts" }
+
+type sessionV1 struct {
+	Id         int64
+	AccountId  int64
+	TokenHash  string `sql:"unique;type:varchar(64)"`
+	UserAgent  string `sql:"type:varchar(255)"`
+	Ip         string `sql:"type:varchar(45)"`
+	CreatedAt  nullables.NullTime
+	LastSeenAt nullables.NullTime
+	ExpiresAt  nullables.NullTime
+}
+
+func (sessionV1) TableName() string { return "sessions" }
+
+type loginThrottleV1 struct {
+	Id            int64
+	ThrottleKey   string `sql:"unique;type:varchar(80)"`
+	Failures      int
+	LastFailureAt nullables.NullTime
+	BlockedUntil  nullables.NullTime
+	LockedOut     bool
+}
+
+func (loginThrottleV1) TableName() string { return "login_throttles" }
+
+type externalIdentityV1 struct {
+	Id         int64
+	AccountId  int64
+	Issuer     string `sql:"type:varchar(255)"`
+	Subject    string `sql:"type:varchar(255)"`
+	Email      string `sql:"type:varchar(60)"`
+	CreatedAt  nullables.NullTime
+	LastUsedAt nullables.NullTime
+}
+
+func (externalIdentityV1) TableName() string { return "external_identities" }
+
+type factV2 struct {
+	Id              int64
+	Fact            string
+	Explain         string
+	ExplainFurther  string
+	AwaitModeration bool
+	ModerationState string `sql:"type:varchar(20)"`
+	AccountId       int64
+	CreatedAt       nullables.NullTime
+	EditedAt        nullables.NullTime
+	DeletedAt       nullables.NullTime
+}
+
+func (factV2) TableName() string { return "facts" }
+
+type moderationNoteV1 struct {
+	Id        int64
+	FactId    int64
+	AccountId int64
+	Decision  string `sql:"type:varchar(20)"`
+	Text      string `sql:"type:text"`
+	CreatedAt nullables.NullTime
+}
+
+func (moderationNoteV1) TableName() string { return "moderation_notes" }
+
+type auditEventV1 struct {
+	Id         int64
+	ActorId    int64
+	Action     string `sql:"type:varchar(40)"`
+	TargetType string `sql:"type:varchar(20)"`
+	TargetId   int64
+	Before     string `sql:"type:text"`
+	After      string `sql:"type:text"`
+	Ip         string `sql:"type:varchar(45)"`
+	CreatedAt  nullables.NullTime
+}
+
+func (auditEventV1) TableName() string { return "audit_events" }
+
+type apiTokenV1 struct {
+	Id         int64
+	AccountId  int64
+	Name       string `sql:"type:varchar(60)"`
+	TokenHash  string `sql:"unique;type:varchar(64)"`
+	Prefix     string `sql:"type:varchar(12)"`
+	Scopes     string `sql:"type:varchar(100)"`
+	CreatedAt  nullables.NullTime
+	ExpiresAt  nullables.NullTime
+	LastUsedAt nullables.NullTime
+	LastUsedIp string `sql:"type:varchar(45)"`
+	Uses       int64
+}
+
+func (apiTokenV1) TableName() string { return "api_tokens" }
+
+//the same as account.HashSessionToken when migration 10 was written
+func hashSessionTokenV1(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,39 @@
+package fyidb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+)
+
+//Saves the fact's moderation state and the decision in one transaction, so that every change of state has a decision
+func (s *DatabaseStorage) SaveModerationDecision(f *fact.Fact, n *fact.ModerationNote) error {
+	return s.inTransaction(func(tx *gorm.DB) error {
+		update := tx.Model(&fact.Fact{}).Where("id = ?", f.Id).UpdateColumns(map[string]interface{}{
+			"await_moderation": f.AwaitModeration,
+			"moderation_state": f.ModerationState,
+		})
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Create(n).Error
+	})
+}
+
+func (s *DatabaseStorage) CreateModerationNote(n *fact.ModerationNote) error {
+	if _, err := s.LoadFactFromId(n.FactId); err != nil {
+		return err
+	}
+	return s.dbGorm.Create(n).Error
+}
+
+//Returns the decisions and notes about a fact, oldest first
+func (s *DatabaseStorage) ListModerationNotes(factId int64) ([]fact.ModerationNote, error) {
+	var notes []fact.ModerationNote
+	if err := s.dbGorm.Where("fact_id = ?", factId).Order("id").Find(&notes).Error; err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
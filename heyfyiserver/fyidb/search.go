@@ -0,0 +1,185 @@
+package fyidb
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+)
+
+//Facts are searched using the fact_search table, which holds a copy of each fact's searchable text
+//It is made by migration 4, differently for each dialect:
+//sqlite3 - an FTS5 virtual table (if go-sqlite3 was built with the sqlite_fts5 tag, otherwise a plain table which is searched with LIKE)
+//postgres - a plain table with a GIN index on searchDocumentPostgres
+//mysql - a plain table with a FULLTEXT index
+
+//the weighted text search document used by postgres. The index in migration 4 is on this exact expression
+const searchDocumentPostgres = `setweight(to_tsvector('english', fact_search.fact), 'A') ||
+	setweight(to_tsvector('english', fact_search.explanation), 'B') ||
+	setweight(to_tsvector('english', fact_search.explain_further), 'C') ||
+	setweight(to_tsvector('english', fact_search.reference_text), 'D')`
+
+const searchColumnsMysql = "fact_search.fact, fact_search.explanation, fact_search.explain_further, fact_search.reference_text"
+
+//Replaces a fact's row in the search table. This should be called in the same transaction as the fact is saved in
+func indexFact(tx *gorm.DB, f *fact.Fact) error {
+	if err := tx.Exec("DELETE FROM fact_search WHERE fact_id = ?", f.Id).Error; err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO fact_search (fact_id, fact, explanation, explain_further, reference_text) VALUES (?, ?, ?, ?, ?)",
+		f.Id, f.Fact, f.Explain, f.ExplainFurther, f.ReferenceSearchText()).Error
+}
+
+//Returns true if fact_search is an FTS5 table. It won't be if go-sqlite3 was built without FTS5 when it was made
+func (s *DatabaseStorage) hasFts5() bool {
+	var tables []struct {
+		Sql string
+	}
+	if err := s.dbGorm.Raw("SELECT sql FROM sqlite_master WHERE name = ?", "fact_search").Scan(&tables).Error; err != nil || len(tables) == 0 {
+		return false
+	}
+	return strings.Contains(strings.ToLower(tables[0].Sql), "fts5")
+}
+
+//Returns the condition that finds facts containing every term, and the expression that ranks them (higher is better)
+func (s *DatabaseStorage) searchMatch(terms []string) (match string, matchArg string, rank string, rankArgs []interface{}) {
+	switch s.dialect {
+	case "postgres":
+		var query []string
+		for _, term := range terms {
+			query = append(query, term+":*")
+		}
+		q := strings.Join(query, " & ")
+		return "(" + searchDocumentPostgres + ") @@ to_tsquery('english', ?)", q,
+			"ts_rank(" + searchDocumentPostgres + ", to_tsquery('english', ?))", []interface{}{q}
+	case "mysql":
+		var query []string
+		for _, term := range terms {
+			query = append(query, "+"+term+"*")
+		}
+		q := strings.Join(query, " ")
+		return "MATCH(" + searchColumnsMysql + ") AGAINST (? IN BOOLEAN MODE)", q,
+			"MATCH(" + searchColumnsMysql + ") AGAINST (? IN BOOLEAN MODE)", []interface{}{q}
+	default:
+		var query []string
+		for _, term := range terms {
+			query = append(query, `"`+term+`"*`)
+		}
+		//bm25 is better when it is lower, and takes a weight for each column (starting with the unindexed fact_id)
+		return "fact_search MATCH ?", strings.Join(query, " "), "-bm25(fact_search, 0, 10, 5, 2, 1)", nil
+	}
+}
+
+//Finds facts that contain every search term, ranked by how well they match
+func (s *DatabaseStorage) SearchFacts(q fact.SearchQuery) (*fact.SearchPage, error) {
+	q = q.Normalised()
+	page := fact.SearchPage{Query: q}
+
+	terms := fact.SearchTerms(q.Terms)
+	if len(terms) == 0 {
+		return &page, nil
+	}
+
+	if s.dialect == "sqlite3" && !s.hasFts5() {
+		return s.searchFactsWithoutIndex(q, terms)
+	}
+
+	match, matchArg, rank, rankArgs := s.searchMatch(terms)
+	query := visibleFacts(s.dbGorm.Table("fact_search").Joins("JOIN facts ON facts.id = fact_search.fact_id"), q.ViewerId, q.ViewUnmoderated).
+		Where("facts.deleted_at IS NULL").
+		Where(match, matchArg)
+
+	if err := query.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+
+	//(rank is a column of FTS5 tables, so it can't be used as the name here)
+	var ranked []struct {
+		FactId     int64
+		SearchRank float64
+	}
+	if err := query.Select("fact_search.fact_id, "+rank+" AS search_rank", rankArgs...).Order("search_rank desc, fact_search.fact_id desc").Offset(q.Offset()).Limit(q.PageSize).Scan(&ranked).Error; err != nil {
+		return nil, err
+	}
+
+	for _, r := range ranked {
+		f, err := s.LoadFactFromId(r.FactId)
+		if err != nil {
+			return nil, err
+		}
+		page.Results = append(page.Results, f.SearchResult(terms, r.SearchRank))
+	}
+	return &page, nil
+}
+
+//Used when sqlite3 doesn't have FTS5. The facts that might match are found with LIKE, and then checked and ranked by fact.SearchRank
+func (s *DatabaseStorage) searchFactsWithoutIndex(q fact.SearchQuery, terms []string) (*fact.SearchPage, error) {
+	query := visibleFacts(s.dbGorm.Table("fact_search").Joins("JOIN facts ON facts.id = fact_search.fact_id"), q.ViewerId, q.ViewUnmoderated).
+		Where("facts.deleted_at IS NULL")
+	for _, term := range terms {
+		query = query.Where("lower(fact_search.fact || ' ' || fact_search.explanation || ' ' || fact_search.explain_further || ' ' || fact_search.reference_text) LIKE ?", "%"+term+"%")
+	}
+
+	var candidates []int64
+	if err := query.Pluck("fact_search.fact_id", &candidates).Error; err != nil {
+		return nil, err
+	}
+
+	var results []fact.SearchResult
+	for _, id := range candidates {
+		f, err := s.LoadFactFromId(id)
+		if err != nil {
+			return nil, err
+		}
+		if rank := f.SearchRank(terms); rank > 0 {
+			results = append(results, f.SearchResult(terms, rank))
+		}
+	}
+	sort.Sort(searchResultsByRank(results))
+
+	page := fact.SearchPage{Query: q, Total: int64(len(results))}
+	if offset := q.Offset(); offset < len(results) {
+		results = results[offset:]
+		if len(results) > q.PageSize {
+			results = results[:q.PageSize]
+		}
+		page.Results = results
+	}
+	return &page, nil
+}
+
+//Fills the search table from the facts table, for migration 4
+func indexAllFacts(tx *gorm.DB) error {
+	var facts []factV1
+	if err := tx.Where("deleted_at IS NULL").Find(&facts).Error; err != nil {
+		return err
+	}
+	for _, fv := range facts {
+		var references []referenceV1
+		if err := tx.Where("fact_id = ?", fv.Id).Order("id").Find(&references).Error; err != nil {
+			return err
+		}
+		f := fact.Fact{Id: fv.Id, Fact: fv.Fact, Explain: fv.Explain, ExplainFurther: fv.ExplainFurther}
+		for _, r := range references {
+			f.References = append(f.References, fact.Reference{Title: r.Title, Publisher: r.Publisher})
+		}
+		if err := indexFact(tx, &f); err != nil {
+			return err
+		}
+	}
+	log.Printf("Indexed %d facts for searching.\n", len(facts))
+	return nil
+}
+
+type searchResultsByRank []fact.SearchResult
+
+func (r searchResultsByRank) Len() int      { return len(r) }
+func (r searchResultsByRank) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResultsByRank) Less(i, j int) bool {
+	if r[i].Rank != r[j].Rank {
+		return r[i].Rank > r[j].Rank
+	}
+	return r[i].FactId > r[j].FactId
+}
@@ -0,0 +1,61 @@
+package fyidb
+
+import (
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+)
+
+//Loads the session with the given token hash, and the account it belongs to. Expired sessions are returned too (account.LoadSession checks them)
+func (s *DatabaseStorage) LoadAccountFromSession(tokenHash string) (*account.Account, *account.Session, error) {
+	var session account.Session
+	if err := s.dbGorm.Where("token_hash = ?", tokenHash).Find(&session).Error; err != nil {
+		return nil, nil, err
+	}
+	a, err := s.LoadAccountFromId(session.AccountId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, &session, nil
+}
+
+func (s *DatabaseStorage) CreateSession(session *account.Session) error {
+	return s.dbGorm.Create(session).Error
+}
+
+//Saves when and where a session was last seen
+func (s *DatabaseStorage) SaveSession(session *account.Session) error {
+	return s.dbGorm.Model(session).UpdateColumns(map[string]interface{}{
+		"last_seen_at": session.LastSeenAt,
+		"ip":           session.Ip,
+	}).Error
+}
+
+//Returns the account's sessions, most recently seen first
+func (s *DatabaseStorage) ListSessions(accountId int64) ([]account.Session, error) {
+	var sessions []account.Session
+	if err := s.dbGorm.Where("account_id = ?", accountId).Order("last_seen_at desc, id desc").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+//Deletes one of the account's sessions, returning account.SessionNotFound if it doesn't have one with that Id
+func (s *DatabaseStorage) DeleteSession(accountId int64, sessionId int64) error {
+	db := s.dbGorm.Where("id = ? AND account_id = ?", sessionId, accountId).Delete(account.Session{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return account.SessionNotFound
+	}
+	return nil
+}
+
+func (s *DatabaseStorage) DeleteAllSessions(accountId int64) error {
+	return s.dbGorm.Where("account_id = ?", accountId).Delete(account.Session{}).Error
+}
+
+func (s *DatabaseStorage) DeleteExpiredSessions(accountId int64, now time.Time) error {
+	return s.dbGorm.Where("account_id = ? AND expires_at < ?", accountId, now).Delete(account.Session{}).Error
+}
@@ -0,0 +1,120 @@
+package fyidb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/nullables"
+)
+
+//Facts and tags are linked by the fact_tags table, which has a row for each tag on each fact
+
+//Replaces a fact's tags with f.Tags, creating any tags that don't exist yet. This should be called in the same transaction as the fact is saved in
+//The tags in f.Tags are updated with their Ids
+func saveFactTags(tx *gorm.DB, f *fact.Fact) error {
+	if err := tx.Exec("DELETE FROM fact_tags WHERE fact_id = ?", f.Id).Error; err != nil {
+		return err
+	}
+	for i := range f.Tags {
+		var t fact.Tag
+		err := tx.Where("name = ?", f.Tags[i].Name).First(&t).Error
+		if err == gorm.ErrRecordNotFound {
+			t = fact.Tag{Name: f.Tags[i].Name}
+			err = tx.Create(&t).Error
+		}
+		if err != nil {
+			return err
+		}
+		f.Tags[i] = t
+
+		if err := tx.Exec("INSERT INTO fact_tags (fact_id, tag_id) VALUES (?, ?)", f.Id, t.Id).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Returns a fact's tags, in order of their names
+func loadFactTags(db *gorm.DB, factId int64) ([]fact.Tag, error) {
+	var tags []fact.Tag
+	if err := db.Joins("JOIN fact_tags ON fact_tags.tag_id = tags.id").Where("fact_tags.fact_id = ?", factId).Order("tags.name").Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+//Returns every tag in order of their names, with the number of moderated facts that have each one
+func (s *DatabaseStorage) ListTags() ([]fact.TagCount, error) {
+	var rows []struct {
+		Id        int64
+		Name      string
+		CreatedAt nullables.NullTime
+		Facts     int64
+	}
+	err := s.dbGorm.Raw(`SELECT tags.id, tags.name, tags.created_at, COUNT(facts.id) AS facts FROM tags
+		LEFT JOIN fact_tags ON fact_tags.tag_id = tags.id
+		LEFT JOIN facts ON facts.id = fact_tags.fact_id AND facts.deleted_at IS NULL AND facts.await_moderation = ?
+		GROUP BY tags.id, tags.name, tags.created_at ORDER BY tags.name`, false).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]fact.TagCount, len(rows))
+	for i, r := range rows {
+		tags[i] = fact.TagCount{Tag: fact.Tag{Id: r.Id, Name: r.Name, CreatedAt: r.CreatedAt}, Facts: r.Facts}
+	}
+	return tags, nil
+}
+
+func (s *DatabaseStorage) LoadTagFromName(name string) (*fact.Tag, error) {
+	var t fact.Tag
+	if err := s.dbGorm.Where("name = ?", name).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+//Renames a tag. Returns fact.TagNameTaken if another tag already has the name
+func (s *DatabaseStorage) RenameTag(t *fact.Tag, name string) error {
+	return s.inTransaction(func(tx *gorm.DB) error {
+		var taken int64
+		if err := tx.Model(&fact.Tag{}).Where("name = ? AND id <> ?", name, t.Id).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fact.TagNameTaken
+		}
+
+		update := tx.Model(&fact.Tag{}).Where("id = ?", t.Id).UpdateColumn("name", name)
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		t.Name = name
+		return nil
+	})
+}
+
+//Moves every fact tagged with from to into (skipping facts that already have into), and then deletes from
+func (s *DatabaseStorage) MergeTags(from *fact.Tag, into *fact.Tag) error {
+	return s.inTransaction(func(tx *gorm.DB) error {
+		var found int64
+		if err := tx.Model(&fact.Tag{}).Where("id IN (?, ?)", from.Id, into.Id).Count(&found).Error; err != nil {
+			return err
+		}
+		if found != 2 {
+			return gorm.ErrRecordNotFound
+		}
+
+		err := tx.Exec(`INSERT INTO fact_tags (fact_id, tag_id) SELECT fact_id, ? FROM fact_tags
+			WHERE tag_id = ? AND fact_id NOT IN (SELECT fact_id FROM fact_tags WHERE tag_id = ?)`, into.Id, from.Id, into.Id).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM fact_tags WHERE tag_id = ?", from.Id).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM tags WHERE id = ?", from.Id).Error
+	})
+}
@@ -0,0 +1,78 @@
+package fyidb
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/nullables"
+)
+
+func (s *DatabaseStorage) LoadLoginThrottle(key string) (*account.LoginThrottle, error) {
+	var t account.LoginThrottle
+	if err := s.dbGorm.Where("throttle_key = ?", key).Find(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+//Adds a failure to the throttle with the given key. The count is incremented by the database (rather than loaded and
+//saved), so that failures recorded at the same time by different servers are all counted
+func (s *DatabaseStorage) RecordLoginFailure(key string, now time.Time, forgetBefore time.Time) (*account.LoginThrottle, error) {
+	var t account.LoginThrottle
+	err := s.inTransaction(func(tx *gorm.DB) error {
+		if err := recordLoginFailure(tx, key, now, forgetBefore); err != nil {
+			return err
+		}
+		return tx.Where("throttle_key = ?", key).Find(&t).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func recordLoginFailure(tx *gorm.DB, key string, now time.Time, forgetBefore time.Time) error {
+	lastFailure := nullables.NullTime{Time: now, Valid: true}
+	update := tx.Model(&account.LoginThrottle{}).Where("throttle_key = ? AND last_failure_at >= ?", key, forgetBefore).UpdateColumns(map[string]interface{}{
+		"failures":        gorm.Expr("failures + 1"),
+		"last_failure_at": lastFailure,
+	})
+	if update.Error != nil || update.RowsAffected > 0 {
+		return update.Error
+	}
+
+	//its failures are old enough to be forgotten, so start counting again
+	update = tx.Model(&account.LoginThrottle{}).Where("throttle_key = ?", key).UpdateColumns(map[string]interface{}{
+		"failures":        1,
+		"last_failure_at": lastFailure,
+		"blocked_until":   nullables.NullTime{},
+		"locked_out":      false,
+	})
+	if update.Error != nil || update.RowsAffected > 0 {
+		return update.Error
+	}
+
+	return tx.Create(&account.LoginThrottle{ThrottleKey: key, Failures: 1, LastFailureAt: lastFailure}).Error
+}
+
+//Saves when the throttle's sign ins are blocked until, and whether it is locked
+func (s *DatabaseStorage) SaveLoginThrottle(t *account.LoginThrottle) error {
+	return s.dbGorm.Model(t).UpdateColumns(map[string]interface{}{
+		"blocked_until": t.BlockedUntil,
+		"locked_out":    t.LockedOut,
+	}).Error
+}
+
+func (s *DatabaseStorage) DeleteLoginThrottle(key string) error {
+	return s.dbGorm.Where("throttle_key = ?", key).Delete(account.LoginThrottle{}).Error
+}
+
+//Returns the throttles that are locked at time now, those that will be unlocked soonest first
+func (s *DatabaseStorage) ListLockedLoginThrottles(now time.Time) ([]account.LoginThrottle, error) {
+	var throttles []account.LoginThrottle
+	if err := s.dbGorm.Where("locked_out = ? AND blocked_until > ?", true, now).Order("blocked_until, id").Find(&throttles).Error; err != nil {
+		return nil, err
+	}
+	return throttles, nil
+}
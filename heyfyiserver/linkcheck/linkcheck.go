@@ -0,0 +1,205 @@
+//Package linkcheck fetches the URLs of fact references to find the ones that no longer work
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/nullables"
+)
+
+//LinkStorer is what the checker needs from a storage backend
+type LinkStorer interface {
+	ListReferencesToCheck(checkedBefore time.Time, limit int) ([]fact.Reference, error)
+	SaveLinkCheck(r *fact.Reference) error
+	ListBrokenReferences() ([]fact.Reference, error)
+}
+
+const (
+	DefaultTimeout     = 15 * time.Second
+	DefaultConcurrency = 8
+	MaxRedirects       = 10
+	UserAgent          = "heyfyi-linkcheck/1.0 (+https://github.com/kiwih/heyfyi)"
+
+	//at most this much of each page is read, so that the connection can be reused
+	maxBodyRead = 64 * 1024
+)
+
+var (
+	TooManyRedirects = errors.New("stopped after 10 redirects")
+	NotPublicAddress = errors.New("the link is to a private or local network address")
+)
+
+//Checker fetches links, at most Concurrency at a time
+type Checker struct {
+	Client      *http.Client
+	Concurrency int
+	Now         func() time.Time //used for LinkCheckedAt, so tests can control the time
+}
+
+//Returns a Checker with a client that times out after DefaultTimeout, follows up to MaxRedirects redirects,
+//and refuses to connect to private and local network addresses (so that links can't be used to probe the server's network)
+//It never uses a proxy (even if HTTP_PROXY is set), as then it would be the proxy's address that was checked, not the link's
+func NewChecker() *Checker {
+	dialer := &net.Dialer{Timeout: DefaultTimeout}
+	transport := &http.Transport{
+		DialContext:           publicDialContext(dialer),
+		TLSHandshakeTimeout:   DefaultTimeout,
+		ResponseHeaderTimeout: DefaultTimeout,
+		MaxIdleConnsPerHost:   2,
+	}
+	return &Checker{
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   DefaultTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= MaxRedirects {
+					return TooManyRedirects
+				}
+				return nil
+			},
+		},
+		Concurrency: DefaultConcurrency,
+		Now:         time.Now,
+	}
+}
+
+//Result is what happened when a link was fetched
+type Result struct {
+	Status   int    //the HTTP status code of the final response, or 0 if there wasn't one
+	FinalUrl string //the URL after following any redirects
+	Err      error
+}
+
+//Fetches a link. A HEAD request is tried first, and if the server doesn't like it (some don't support HEAD properly), a GET
+func (c *Checker) Check(url string) Result {
+	result := c.fetch("HEAD", url)
+	if result.Err != nil || result.Status >= 400 {
+		if get := c.fetch("GET", url); get.Err == nil || result.Err != nil {
+			result = get
+		}
+	}
+	return result
+}
+
+func (c *Checker) fetch(method string, url string) Result {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return Result{Err: err}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodyRead))
+
+	return Result{Status: resp.StatusCode, FinalUrl: resp.Request.URL.String()}
+}
+
+//Checks each reference's link and records the result in it. Up to c.Concurrency links are fetched at once
+func (c *Checker) CheckReferences(references []fact.Reference) {
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, concurrency)
+	for i := range references {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(r *fact.Reference) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			c.record(r, c.Check(r.Url))
+		}(&references[i])
+	}
+	wg.Wait()
+}
+
+func (c *Checker) record(r *fact.Reference, result Result) {
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+
+	r.LinkStatus = result.Status
+	r.LinkFinalUrl = result.FinalUrl
+	r.LinkError = ""
+	if result.Err != nil {
+		r.LinkError = result.Err.Error()
+	}
+	r.LinkCheckedAt = nullables.NullTime{Time: now(), Valid: true}
+
+	if r.LinkBroken() {
+		r.LinkFailures++
+	} else {
+		r.LinkFailures = 0
+	}
+}
+
+//Checks up to limit references that haven't been checked since recheckAfter ago (those never checked go first), and saves the results
+//Returns how many results were saved. References deleted while they were being checked are skipped, and a result that
+//can't be saved doesn't stop the others being saved, so the error (if any) is every one that couldn't be
+func (c *Checker) Run(s LinkStorer, limit int, recheckAfter time.Duration) (int, error) {
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+
+	references, err := s.ListReferencesToCheck(now().Add(-recheckAfter), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	c.CheckReferences(references)
+
+	saved := 0
+	var errs []error
+	for i := range references {
+		err := s.SaveLinkCheck(&references[i])
+		switch {
+		case err == nil:
+			saved++
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			//the reference was deleted (eg by its fact being edited) since it was listed
+		default:
+			errs = append(errs, err)
+		}
+	}
+	return saved, errors.Join(errs...)
+}
+
+//Returns a DialContext function that only connects to public addresses
+func publicDialContext(dialer *net.Dialer) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addresses {
+			if !fact.IsPublicIP(a.IP) {
+				return nil, NotPublicAddress
+			}
+		}
+		if len(addresses) == 0 {
+			return nil, &net.DNSError{Err: "no addresses", Name: host}
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addresses[0].IP.String(), port))
+	}
+}
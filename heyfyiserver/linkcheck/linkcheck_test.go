@@ -0,0 +1,252 @@
+package linkcheck
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/memdb"
+)
+
+//returns a server with a page for each kind of link, and a Checker with a client for it
+func newTestServer(t *testing.T) (*httptest.Server, *Checker) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("a page"))
+	})
+	mux.HandleFunc("/missing", func(rw http.ResponseWriter, req *http.Request) {
+		http.NotFound(rw, req)
+	})
+	mux.HandleFunc("/moved", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/loop", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/nohead", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "HEAD" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Write([]byte("a page"))
+	})
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		close(release)
+		server.Close()
+	})
+
+	c := NewChecker()
+	c.Client = server.Client()
+	c.Client.Timeout = 200 * time.Millisecond
+	c.Client.CheckRedirect = NewChecker().Client.CheckRedirect
+	return server, c
+}
+
+func TestCheck(t *testing.T) {
+	server, c := newTestServer(t)
+
+	tests := []struct {
+		Path     string
+		Status   int
+		FinalUrl string
+		Err      bool
+	}{
+		{"/ok", 200, "/ok", false},
+		{"/missing", 404, "/missing", false},
+		{"/moved", 200, "/ok", false},
+		{"/nohead", 200, "/nohead", false},
+		{"/loop", 0, "", true},
+		{"/slow", 0, "", true},
+	}
+
+	for _, test := range tests {
+		result := c.Check(server.URL + test.Path)
+		if result.Status != test.Status || (result.Err != nil) != test.Err {
+			t.Errorf("Check(%s) returned %+v, expected status %d", test.Path, result, test.Status)
+		}
+		if test.FinalUrl != "" && result.FinalUrl != server.URL+test.FinalUrl {
+			t.Errorf("Check(%s) returned final URL %s, expected %s", test.Path, result.FinalUrl, server.URL+test.FinalUrl)
+		}
+	}
+
+	if result := c.Check("http://bad url"); result.Err == nil {
+		t.Error("Check of an invalid URL did not return an error")
+	}
+}
+
+func TestCheckReferencesConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	c := NewChecker()
+	c.Client = server.Client()
+	c.Concurrency = 3
+
+	references := make([]fact.Reference, 12)
+	for i := range references {
+		references[i].Url = server.URL
+	}
+	c.CheckReferences(references)
+
+	if most > 3 {
+		t.Errorf("%d links were checked at once, expected at most 3", most)
+	}
+	for _, r := range references {
+		if r.LinkStatus != 200 || !r.LinkCheckedAt.Valid || r.LinkBroken() {
+			t.Fatalf("CheckReferences did not record the result, got %+v", r)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	server, c := newTestServer(t)
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Now = func() time.Time { return now }
+
+	s := memdb.NewMemoryStorage()
+	f := &fact.Fact{
+		Fact:           "This is the fact string",
+		Explain:        "This is the explain string",
+		ExplainFurther: "This is the explain further string",
+		AccountId:      1,
+		References: []fact.Reference{
+			{Url: server.URL + "/moved", Publisher: "example publisher", Title: "example title 1"},
+			{Url: server.URL + "/missing", Publisher: "example publisher", Title: "example title 2"},
+		},
+	}
+	if err := s.CreateFact(f); err != nil {
+		t.Fatal("Could not create fact: ", err)
+	}
+
+	if checked, err := c.Run(s, 10, time.Hour); err != nil || checked != 2 {
+		t.Fatalf("Run checked %d references, %v", checked, err)
+	}
+	broken, err := s.ListBrokenReferences()
+	if err != nil || len(broken) != 1 || broken[0].Id != f.References[1].Id || broken[0].LinkStatus != 404 || broken[0].LinkFailures != 1 {
+		t.Fatalf("Run did not save the broken reference, got %+v, %v", broken, err)
+	}
+	loaded, _ := s.LoadFactFromId(f.Id)
+	if r := loaded.References[0]; r.LinkStatus != 200 || r.LinkFinalUrl != server.URL+"/ok" || !r.LinkCheckedAt.Time.Equal(now) {
+		t.Fatalf("Run did not save the working reference, got %+v", r)
+	}
+
+	//nothing is checked again until recheckAfter has passed
+	if checked, err := c.Run(s, 10, time.Hour); err != nil || checked != 0 {
+		t.Fatalf("Run checked %d references again straight away, %v", checked, err)
+	}
+	now = now.Add(2 * time.Hour)
+	if checked, err := c.Run(s, 10, time.Hour); err != nil || checked != 2 {
+		t.Fatalf("Run checked %d references after recheckAfter, %v", checked, err)
+	}
+	if broken, _ = s.ListBrokenReferences(); len(broken) != 1 || broken[0].LinkFailures != 2 {
+		t.Fatalf("Run did not count the failed checks, got %+v", broken)
+	}
+}
+
+func TestNewCheckerRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	result := NewChecker().Check(server.URL)
+	if !errors.Is(result.Err, NotPublicAddress) {
+		t.Fatalf("NewChecker's client fetched a local address, got %+v", result)
+	}
+}
+
+//A proxy would be dialled instead of the link's host, so the check of the address would be of the proxy
+func TestNewCheckerDoesNotUseProxy(t *testing.T) {
+	if NewChecker().Client.Transport.(*http.Transport).Proxy != nil {
+		t.Fatal("NewChecker's client uses a proxy, so it wouldn't check the addresses of links")
+	}
+}
+
+//A LinkStorer that edits a fact (which replaces its references) before saving the first result, as if someone edited
+//it during a run, and that can't save the result for one reference
+type editingStorer struct {
+	*memdb.MemoryStorage
+	edit   *fact.Fact
+	failId int64
+}
+
+var saveFailed = errors.New("could not save")
+
+func (s *editingStorer) SaveLinkCheck(r *fact.Reference) error {
+	if s.edit != nil {
+		if err := s.MemoryStorage.EditFact(s.edit, s.edit.AccountId, "Replaced the references"); err != nil {
+			return err
+		}
+		s.edit = nil
+	}
+	if r.Id == s.failId {
+		return saveFailed
+	}
+	return s.MemoryStorage.SaveLinkCheck(r)
+}
+
+func TestRunSkipsDeletedReferences(t *testing.T) {
+	server, c := newTestServer(t)
+	s := &editingStorer{MemoryStorage: memdb.NewMemoryStorage()}
+
+	var facts []*fact.Fact
+	for i, path := range []string{"/ok", "/missing", "/moved"} {
+		f := &fact.Fact{
+			Fact:           "This is the fact string",
+			Explain:        "This is the explain string",
+			ExplainFurther: "This is the explain further string",
+			AccountId:      1,
+			References: []fact.Reference{
+				{Url: server.URL + path, Publisher: "example publisher", Title: "example title 1"},
+				{Url: server.URL + path + "?" + string(rune('a'+i)), Publisher: "example publisher", Title: "example title 2"},
+			},
+		}
+		if err := s.CreateFact(f); err != nil {
+			t.Fatal("Could not create fact: ", err)
+		}
+		facts = append(facts, f)
+	}
+
+	//the second fact's references are deleted in the middle of the run, and one of the third's can't be saved
+	edited := *facts[1]
+	edited.References = []fact.Reference{
+		{Url: server.URL + "/ok?new1", Publisher: "example publisher", Title: "example title 1"},
+		{Url: server.URL + "/ok?new2", Publisher: "example publisher", Title: "example title 2"},
+	}
+	s.edit = &edited
+	s.failId = facts[2].References[1].Id
+
+	checked, err := c.Run(s, 10, time.Hour)
+	if checked != 3 || !errors.Is(err, saveFailed) {
+		t.Fatalf("Run didn't save the results for the references that were still there, got %d, %v", checked, err)
+	}
+	for _, f := range []*fact.Fact{facts[0], facts[2]} {
+		loaded, _ := s.LoadFactFromId(f.Id)
+		if !loaded.References[0].LinkCheckedAt.Valid {
+			t.Errorf("The result for %s wasn't saved", loaded.References[0].Url)
+		}
+	}
+	if loaded, _ := s.LoadFactFromId(facts[2].Id); loaded.References[1].LinkCheckedAt.Valid {
+		t.Error("The result that couldn't be saved was")
+	}
+}
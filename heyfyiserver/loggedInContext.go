@@ -2,11 +2,17 @@ package heyfyiserver
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gocraft/web"
 	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
 	"github.com/kiwih/heyfyi/heyfyiserver/fact"
 )
 
@@ -16,28 +22,293 @@ type LoggedInContext struct {
 
 //This handler performs the logout request
 func (c *LoggedInContext) DoSignOutRequestHandler(rw web.ResponseWriter, req *web.Request) {
+	c.audited(req, &audit.AuditEvent{Action: audit.SignOut, TargetType: audit.TargetSession, TargetId: c.Session.Id}, func(s AnyStorer) error {
+		return c.Account.EndSession(s, c.Session.Id)
+	})
+	c.signOut(rw, req, "Goodbye!")
+}
+
+//Forgets this browser's session and redirects to the home page
+func (c *LoggedInContext) signOut(rw web.ResponseWriter, req *web.Request, notification string) {
 	session, _ := c.Store.Get(req.Request, "session-security")
 	session.Values["sessionId"] = nil
-	c.SetNotificationMessage(rw, req, "Goodbye!")
-
-	c.Account.ExpireSession(c.Storage)
+	if err := c.newCsrfToken(rw, session); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.SetNotificationMessage(rw, req, notification)
 
 	session.Save(req.Request, rw)
 	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
 }
 
+//A session as shown on the sessions page
+type accountSession struct {
+	account.Session
+	Current bool //the session this page is being viewed with
+}
+
+//Lists the browsers and devices that the account is signed in on
+func (c *LoggedInContext) SessionsHandler(rw web.ResponseWriter, req *web.Request) {
+	sessions, err := c.Storage.ListSessions(c.Account.Id)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	var shown []accountSession
+	for _, s := range sessions {
+		if !s.Expired(now) {
+			shown = append(shown, accountSession{Session: s, Current: s.Id == c.Session.Id})
+		}
+	}
+	c.Data = shown
+
+	if err := templates.ExecuteTemplate(rw, "sessionsPage", c); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Signs the account out of one of its sessions. If it is this one, they are signed out here too
+func (c *LoggedInContext) DoRevokeSessionHandler(rw web.ResponseWriter, req *web.Request) {
+	sessionId, err := strconv.ParseInt(req.PathParams["sessionId"], 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad session ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.RevokeSession, TargetType: audit.TargetSession, TargetId: sessionId}, func(s AnyStorer) error {
+		return c.Account.EndSession(s, sessionId)
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, SessionsUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	if sessionId == c.Session.Id {
+		c.signOut(rw, req, "Goodbye!")
+		return
+	}
+	c.SetNotificationMessage(rw, req, "That session has been signed out.")
+	http.Redirect(rw, req.Request, SessionsUrl.Make(), http.StatusSeeOther)
+}
+
+//Signs the account out of every session, including this one
+func (c *LoggedInContext) DoRevokeAllSessionsHandler(rw web.ResponseWriter, req *web.Request) {
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.RevokeAllSessions, TargetType: audit.TargetAccount, TargetId: c.Account.Id}, func(s AnyStorer) error {
+		return c.Account.EndAllSessions(s)
+	}); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.signOut(rw, req, "You have been signed out everywhere.")
+}
+
+//An API token as it is shown on the tokens page
+type accountApiToken struct {
+	account.ApiToken
+	Expired bool
+}
+
+//How long new API tokens can last, in days, in the order they are offered
+var apiTokenLifetimes = []int{7, 30, 90, 365}
+
+//Lists the account's API tokens, and lets them make new ones
+func (c *LoggedInContext) ApiTokensHandler(rw web.ResponseWriter, req *web.Request) {
+	c.showApiTokensPage(rw, "")
+}
+
+//newToken is only shown once, straight after it is made
+func (c *LoggedInContext) showApiTokensPage(rw web.ResponseWriter, newToken string) {
+	tokens, err := c.Storage.ListApiTokens(c.Account.Id)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	shown := make([]accountApiToken, len(tokens))
+	for i, t := range tokens {
+		shown[i] = accountApiToken{ApiToken: t, Expired: t.Expired(now)}
+	}
+
+	var scopes []account.Scope
+	for _, s := range account.Scopes {
+		if s != account.ScopeModerate || c.Can(account.ModerateFact) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	c.Data = struct {
+		Tokens    []accountApiToken
+		NewToken  string
+		Scopes    []account.Scope
+		Lifetimes []int
+	}{
+		Tokens:    shown,
+		NewToken:  newToken,
+		Scopes:    scopes,
+		Lifetimes: apiTokenLifetimes,
+	}
+
+	if err := templates.ExecuteTemplate(rw, "apiTokensPage", c); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Makes an API token with the posted Name, Scopes and lifetime in Days, and shows it (this once)
+func (c *LoggedInContext) DoCreateApiTokenHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	days, err := strconv.Atoi(req.PostForm.Get("Days"))
+	if err != nil {
+		days = 0 //CreateApiToken will say why that isn't allowed
+	}
+	var scopes []account.Scope
+	for _, s := range req.PostForm["Scopes"] {
+		scopes = append(scopes, account.Scope(s))
+	}
+
+	var token string
+	e := &audit.AuditEvent{Action: audit.CreateApiToken, TargetType: audit.TargetToken}
+	err = c.audited(req, e, func(s AnyStorer) error {
+		var t *account.ApiToken
+		var err error
+		if token, t, err = c.Account.CreateApiToken(s, req.PostForm.Get("Name"), scopes, time.Duration(days)*24*time.Hour, time.Now()); err != nil {
+			return err
+		}
+		e.TargetId = t.Id
+		e.After = t.Name + " (" + t.Scopes + ", expires " + t.ExpiresAt.Time.Format(auditDateFormat) + ")"
+		return nil
+	})
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, ApiTokensUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.NotificationMessages = append(c.NotificationMessages, "Your token has been made. Please copy it now, as it won't be shown again.")
+	c.showApiTokensPage(rw, token)
+}
+
+//Revokes one of the account's API tokens, so that it stops working straight away
+func (c *LoggedInContext) DoRevokeApiTokenHandler(rw web.ResponseWriter, req *web.Request) {
+	tokenId, err := strconv.ParseInt(req.PathParams["tokenId"], 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad token ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.RevokeApiToken, TargetType: audit.TargetToken, TargetId: tokenId}, func(s AnyStorer) error {
+		return c.Account.RevokeApiToken(s, tokenId)
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, ApiTokensUrl.Make(), http.StatusSeeOther)
+		return
+	}
+	c.SetNotificationMessage(rw, req, "That token has been revoked.")
+	http.Redirect(rw, req.Request, ApiTokensUrl.Make(), http.StatusSeeOther)
+}
+
+//Shows whether two factor authentication is on, and starts setting it up if it isn't
+func (c *LoggedInContext) TwoFactorHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Account.TwoFactorEnabled() {
+		if err := c.Account.BeginTwoFactorSetup(c.Storage); err != nil {
+			http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	c.showTwoFactorPage(rw, nil)
+}
+
+//recoveryCodes are only shown once, straight after they are made
+func (c *LoggedInContext) showTwoFactorPage(rw web.ResponseWriter, recoveryCodes []string) {
+	c.Data = struct {
+		RecoveryCodes []string
+		Required      bool
+	}{
+		RecoveryCodes: recoveryCodes,
+		Required:      c.Account.IsAdmin() && account.RequireTwoFactorForAdmins,
+	}
+
+	if err := templates.ExecuteTemplate(rw, "twoFactorPage", c); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *LoggedInContext) DoEnableTwoFactorHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var codes []string
+	err := c.audited(req, &audit.AuditEvent{Action: audit.EnableTwoFactor, TargetType: audit.TargetAccount, TargetId: c.Account.Id}, func(s AnyStorer) error {
+		var err error
+		codes, err = c.Account.EnableTwoFactor(s, req.PostForm.Get("Code"), time.Now())
+		return err
+	})
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, TwoFactorUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.NotificationMessages = append(c.NotificationMessages, "Two-factor authentication is on! Save your recovery codes somewhere safe.")
+	c.showTwoFactorPage(rw, codes)
+}
+
+func (c *LoggedInContext) DoRegenerateRecoveryCodesHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	var codes []string
+	err := c.audited(req, &audit.AuditEvent{Action: audit.RegenerateRecoveryCodes, TargetType: audit.TargetAccount, TargetId: c.Account.Id}, func(s AnyStorer) error {
+		var err error
+		codes, err = c.Account.RegenerateRecoveryCodes(s, req.PostForm.Get("Code"), time.Now())
+		return err
+	})
+	if err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, TwoFactorUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.NotificationMessages = append(c.NotificationMessages, "Your old recovery codes no longer work. Save these new ones somewhere safe.")
+	c.showTwoFactorPage(rw, codes)
+}
+
+func (c *LoggedInContext) DoDisableTwoFactorHandler(rw web.ResponseWriter, req *web.Request) {
+	req.ParseForm()
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.DisableTwoFactor, TargetType: audit.TargetAccount, TargetId: c.Account.Id}, func(s AnyStorer) error {
+		return c.Account.DisableTwoFactor(s, req.PostForm.Get("Code"), time.Now())
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, TwoFactorUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Two-factor authentication is off.")
+	http.Redirect(rw, req.Request, HomeUrl.Make(), http.StatusFound)
+}
+
+//The body of a request to VoteOnFactUrl
+type voteOnFactRequest struct {
+	FactId int64
+	Up     bool
+}
+
+type voteOnFactResponse struct {
+	Response    string //always "ok"
+	FactId      int64
+	NewScore    fact.VoteScore
+	NewVoteBank int64
+}
+
 func (c *LoggedInContext) VoteOnFactHandler(rw web.ResponseWriter, req *web.Request) {
-	voteRequest := struct {
-		FactId int64
-		Up     bool
-	}{}
-
-	response := struct {
-		Response    string
-		FactId      int64
-		NewScore    fact.VoteScore
-		NewVoteBank int64
-	}{}
+	var voteRequest voteOnFactRequest
+	var response voteOnFactResponse
 
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&voteRequest); err != nil {
@@ -56,14 +327,14 @@ func (c *LoggedInContext) VoteOnFactHandler(rw web.ResponseWriter, req *web.Requ
 		return
 	}
 
-	if f.AwaitModeration && !c.Account.Admin {
+	if f.AwaitModeration && !c.Can(account.ViewUnmoderated) {
 		if f.AccountId != c.Account.Id {
 			http.Error(rw, "400: Bad FactID specified", http.StatusBadRequest)
 			return
 		}
 	}
 
-	if err := c.Account.UpdateVoteBank(c.Storage, voteRequest.Up, f.GetScore(c.Account.Id).AccountVote); err != nil {
+	if err := c.castVote(req, f, voteRequest.Up); err != nil {
 		if err == account.NoVotesLeft {
 			http.Error(rw, "You have no votes to cast!", http.StatusBadRequest)
 			return
@@ -73,11 +344,6 @@ func (c *LoggedInContext) VoteOnFactHandler(rw web.ResponseWriter, req *web.Requ
 		}
 	}
 
-	if _, err := fact.VoteForFact(c.Storage, c.Account.Id, f.Id, voteRequest.Up); err != nil {
-		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	f, _ = c.Storage.LoadFactFromId(f.Id)
 
 	response.FactId = f.Id
@@ -87,22 +353,54 @@ func (c *LoggedInContext) VoteOnFactHandler(rw web.ResponseWriter, req *web.Requ
 	ReturnJSON(rw, response)
 }
 
+//Changes the signed in account's vote on the fact by one, up or down, and takes or refunds the vote from their vote bank
+//c.Account is updated with their new vote bank
+func (c *Context) castVote(req *web.Request, f *fact.Fact, up bool) error {
+	//the vote and the vote bank are updated together, so concurrent votes can't overspend the bank
+	var a *account.Account
+	e := &audit.AuditEvent{Action: audit.Vote, TargetType: audit.TargetFact, TargetId: f.Id, Before: "vote bank " + strconv.FormatInt(c.Account.VoteBank, 10)}
+	err := c.audited(req, e, func(s AnyStorer) error {
+		v, voter, err := s.CastVote(c.Account.Id, f.Id, up)
+		if err != nil {
+			return err
+		}
+		a = voter
+		direction := "down"
+		if up {
+			direction = "up"
+		}
+		e.After = "voted " + direction + ", vote " + strconv.FormatInt(v.Score, 10) + ", vote bank " + strconv.FormatInt(a.VoteBank, 10)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Account = a
+	return nil
+}
+
+//Approves, rejects or requests changes to a fact, for scripts. The request gives the FactId, the Decision and the Reason for it
+//The body of a request to ModerateFactUrl
+type moderateFactRequest struct {
+	FactId   int64
+	Decision fact.ModerationDecision
+	Reason   string
+}
+
+type moderateFactResponse struct {
+	Response           string //always "ok"
+	FactId             int64
+	NewState           fact.ModerationState
+	NewAwaitModeration bool
+}
+
 func (c *LoggedInContext) ModerateFactHandler(rw web.ResponseWriter, req *web.Request) {
-	if !c.Account.Admin {
-		http.Error(rw, "400: Only admins can make this request", http.StatusBadRequest)
+	if !c.Permit(rw, account.ModerateFact) {
 		return
 	}
 
-	moderateRequest := struct {
-		FactId int64
-		Enable bool
-	}{}
-
-	response := struct {
-		Response           string
-		FactId             int64
-		NewAwaitModeration bool
-	}{}
+	var moderateRequest moderateFactRequest
+	var response moderateFactResponse
 
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&moderateRequest); err != nil {
@@ -121,27 +419,212 @@ func (c *LoggedInContext) ModerateFactHandler(rw web.ResponseWriter, req *web.Re
 		return
 	}
 
-	if err := c.Storage.ModerateFact(f, moderateRequest.Enable); err != nil {
-		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+	if err := c.moderate(req, f, moderateRequest.Decision, moderateRequest.Reason); err != nil {
+		switch err {
+		case fact.BadModerationDecision, fact.ModerationReasonMissing, fact.ModerationNoteTooLong:
+			http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
 	response.FactId = f.Id
+	response.NewState = f.State()
 	response.NewAwaitModeration = f.AwaitModeration
 	response.Response = "ok"
 	ReturnJSON(rw, response)
 }
 
+//Saves a moderator's decision about a fact, and emails the fact's author to tell them about it
+func (c *Context) moderate(req *web.Request, f *fact.Fact, decision fact.ModerationDecision, reason string) error {
+	var note *fact.ModerationNote
+	e := &audit.AuditEvent{Action: audit.ModerateFact, TargetType: audit.TargetFact, TargetId: f.Id, Before: string(f.State())}
+	err := c.audited(req, e, func(s AnyStorer) error {
+		var err error
+		if note, err = fact.Moderate(s, f, c.Account.Id, decision, reason); err != nil {
+			return err
+		}
+		e.After = string(f.State()) + ": " + note.Text
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	author, err := c.Storage.LoadAccountFromId(f.AccountId)
+	if err != nil {
+		log.Println("Could not load the author of fact", f.Id, "to tell them about a moderation decision:", err)
+		return nil
+	}
+
+	var subject, outcome string
+	switch decision {
+	case fact.DecisionApprove:
+		subject = "Your fact has been approved"
+		outcome = "has been approved by a moderator, so everyone can see it now."
+	case fact.DecisionReject:
+		subject = "Your fact has been rejected"
+		outcome = "has been rejected by a moderator, so it won't be shown to anyone else."
+	case fact.DecisionRequestChanges:
+		subject = "Please make changes to your fact"
+		outcome = "needs some changes before a moderator can approve it. Once you have edited it, it will be moderated again."
+	}
+	author.SendEmail(subject, "Hello!\r\n\r\nYour fact \""+f.Fact+"\" "+outcome+"\r\n\r\nThe moderator's reason was:\r\n"+note.Text+"\r\n\r\nYou can see it at http://hey.fyi"+GetViewFactUrl(f.Id)+"\r\n\r\nRegards,\r\nhey.fyi")
+	return nil
+}
+
+//Loads the fact in the URL for a moderator, who can see every fact
+func (c *LoggedInContext) loadFactToModerate(req *web.Request) (*fact.Fact, bool) {
+	factId, err := strconv.ParseInt(req.PathParams["factId"], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+//Shows the facts that are waiting to be moderated, oldest first
+func (c *LoggedInContext) ModerationQueueHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ModerateFact) {
+		return
+	}
+
+	q := fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyPending, Sort: fact.SortOldest}
+	if page := req.URL.Query().Get("page"); page != "" {
+		var err error
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			http.Error(rw, "400: Bad page", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := c.Storage.ListFacts(q)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nickname := c.nicknames()
+	var queued []queuedFact
+	for _, f := range page.Facts {
+		queued = append(queued, queuedFact{Fact: f, Author: nickname(f.AccountId)})
+	}
+
+	c.Data = struct {
+		Page  *fact.FactPage
+		Facts []queuedFact
+	}{
+		Page:  page,
+		Facts: queued,
+	}
+
+	err = templates.ExecuteTemplate(rw, "moderationPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//A fact in the moderation queue, along with who submitted it
+type queuedFact struct {
+	fact.Fact
+	Author string
+}
+
+//Approves, rejects or requests changes to a fact, given by the posted Decision and Reason
+//Goes back to the moderation queue if that's where it was done from (the posted From is "queue"), and to the fact otherwise
+func (c *LoggedInContext) DoModerateFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ModerateFact) {
+		return
+	}
+
+	f, ok := c.loadFactToModerate(req)
+	if !ok {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+	next := GetViewFactUrl(f.Id) + "#moderation"
+	if req.PostForm.Get("From") == "queue" {
+		next = GetModerationQueueUrl()
+	}
+
+	if err := c.moderate(req, f, fact.ModerationDecision(req.PostForm.Get("Decision")), req.PostForm.Get("Reason")); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, next, http.StatusSeeOther)
+		return
+	}
+
+	switch f.State() {
+	case fact.StateApproved:
+		c.SetNotificationMessage(rw, req, "Fact approved. Its author has been told.")
+	case fact.StateRejected:
+		c.SetNotificationMessage(rw, req, "Fact rejected. Its author has been told why.")
+	case fact.StateChangesRequested:
+		c.SetNotificationMessage(rw, req, "Its author has been asked to change the fact.")
+	}
+	http.Redirect(rw, req.Request, next, http.StatusFound)
+}
+
+//Saves a note about a fact that only moderators can see, given by the posted Text
+func (c *LoggedInContext) DoAddModerationNoteHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ModerateFact) {
+		return
+	}
+
+	f, ok := c.loadFactToModerate(req)
+	if !ok {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+	e := &audit.AuditEvent{Action: audit.ModerationNote, TargetType: audit.TargetFact, TargetId: f.Id}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		note, err := fact.AddModerationNote(s, f, c.Account.Id, req.PostForm.Get("Text"))
+		if err != nil {
+			return err
+		}
+		e.After = note.Text
+		return nil
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, GetViewFactUrl(f.Id)+"#moderation", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(rw, req.Request, GetViewFactUrl(f.Id)+"#moderation", http.StatusFound)
+}
+
+//FactForm is what the create and edit fact pages show. When saving a fact fails, it is kept so the form can be shown again
+type FactForm struct {
+	Fact         fact.Fact
+	BadReference int //the index of the reference that caused the error, or -1
+}
+
+func newFactForm(f fact.Fact, err error) FactForm {
+	form := FactForm{Fact: f, BadReference: -1}
+	if index, ok := fact.BadReferenceIndex(err); ok {
+		form.BadReference = index
+	}
+	return form
+}
+
 func (c *Context) CreateFactHandler(rw web.ResponseWriter, req *web.Request) {
 
-	var f fact.Fact
+	//a new fact starts with the two references it needs
+	form := newFactForm(fact.Fact{References: make([]fact.Reference, 2)}, nil)
 
-	badF := c.CheckFailedRequestObject(rw, req)
-	if badF != nil {
-		f = badF.(fact.Fact)
+	if badForm, ok := c.CheckFailedRequestObject(rw, req).(FactForm); ok {
+		form = badForm
 	}
 
-	c.Data = f
+	c.Data = form
 
 	err := templates.ExecuteTemplate(rw, "createFactPage", c)
 	if err != nil {
@@ -150,22 +633,47 @@ func (c *Context) CreateFactHandler(rw web.ResponseWriter, req *web.Request) {
 	}
 }
 
+//Decodes the fact form used to create and edit facts
+//The tags are typed into one box (separated by commas) rather than having a field for each one, so they are read separately
+func decodeFactForm(f *fact.Fact, form url.Values) error {
+	tags := form.Get("Tags")
+	form.Del("Tags")
+
+	if err := decoder.Decode(f, form); err != nil {
+		return err
+	}
+	f.Tags = fact.TagsFromText(tags)
+	return nil
+}
+
+//Submits f as a new fact by the signed in account
+func (c *Context) createFact(req *web.Request, f *fact.Fact) error {
+	f.AccountId = c.Account.Id
+
+	e := &audit.AuditEvent{Action: audit.CreateFact, TargetType: audit.TargetFact}
+	return c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.CreateFact(s, f); err != nil {
+			return err
+		}
+		e.TargetId, e.After = f.Id, f.Fact
+		return nil
+	})
+}
+
 func (c *Context) DoCreateFactHandler(rw web.ResponseWriter, req *web.Request) {
 
 	req.ParseForm()
 
 	var f fact.Fact
 
-	if err := decoder.Decode(&f, req.PostForm); err != nil {
+	if err := decodeFactForm(&f, req.PostForm); err != nil {
 		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
 		http.Redirect(rw, req.Request, CreateFactUrl.Make(), http.StatusSeeOther)
 		return
 	}
 
-	f.AccountId = c.Account.Id
-
-	if err := fact.CreateFact(c.Storage, &f); err != nil {
-		c.SetFailedRequestObject(rw, req, f)
+	if err := c.createFact(req, &f); err != nil {
+		c.SetFailedRequestObject(rw, req, newFactForm(f, err))
 		c.SetErrorMessage(rw, req, err.Error())
 		http.Redirect(rw, req.Request, CreateFactUrl.Make(), http.StatusSeeOther)
 		return
@@ -196,7 +704,7 @@ func (c *Context) DeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	if f.AccountId != c.Account.Id && !c.Account.Admin {
+	if !c.CanDeleteFact(f) {
 		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
 		return
 	}
@@ -210,6 +718,13 @@ func (c *Context) DeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
 	}
 }
 
+//Deletes the fact, which the signed in account must be allowed to do (see CanDeleteFact)
+func (c *Context) deleteFact(req *web.Request, f *fact.Fact) error {
+	return c.audited(req, &audit.AuditEvent{Action: audit.DeleteFact, TargetType: audit.TargetFact, TargetId: f.Id, Before: f.Fact}, func(s AnyStorer) error {
+		return s.DeleteFact(f)
+	})
+}
+
 func (c *Context) DoDeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
 
 	factIdStr, ok := req.PathParams["factId"]
@@ -231,12 +746,12 @@ func (c *Context) DoDeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
-	if f.AccountId != c.Account.Id && !c.Account.Admin {
+	if !c.CanDeleteFact(f) {
 		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
 		return
 	}
 
-	if err := c.Storage.DeleteFact(f); err != nil {
+	if err := c.deleteFact(req, f); err != nil {
 		http.Error(rw, "404: Fact not found", http.StatusNotFound)
 		return
 	}
@@ -244,3 +759,901 @@ func (c *Context) DoDeleteFactHandler(rw web.ResponseWriter, req *web.Request) {
 	c.SetNotificationMessage(rw, req, "Fact deleted!")
 	http.Redirect(rw, req.Request, ListFactUrl.Make(), http.StatusFound)
 }
+
+func (c *LoggedInContext) EditFactHandler(rw web.ResponseWriter, req *web.Request) {
+
+	factIdStr, ok := req.PathParams["factId"]
+	if !ok {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	//get the fact ID from the URL
+	factId, err := strconv.ParseInt(factIdStr, 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	if f.AccountId != c.Account.Id && !c.Can(account.EditAnyFact) {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	form := newFactForm(*f, nil)
+
+	//if their last edit failed, show them what they tried to save so they can fix it
+	if badForm, ok := c.CheckFailedRequestObject(rw, req).(FactForm); ok && badForm.Fact.Id == f.Id {
+		form = badForm
+	}
+
+	c.Data = form
+
+	err = templates.ExecuteTemplate(rw, "editFactPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Saves the text, references and tags of edited as a new version of f, by the signed in account
+//f is changed even if the edit fails, so that it can be shown to them to fix
+func (c *Context) editFact(req *web.Request, f *fact.Fact, edited fact.Fact) error {
+	e := &audit.AuditEvent{Action: audit.EditFact, TargetType: audit.TargetFact, TargetId: f.Id, Before: f.Fact}
+
+	//only the text, references and tags can be edited
+	f.Fact = edited.Fact
+	f.Explain = edited.Explain
+	f.ExplainFurther = edited.ExplainFurther
+	f.References = edited.References
+	f.Tags = edited.Tags
+
+	return c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.EditFact(s, f, c.Account.Id, c.Can(account.EditAnyFact)); err != nil {
+			return err
+		}
+		e.After = f.Fact
+		return nil
+	})
+}
+
+func (c *LoggedInContext) DoEditFactHandler(rw web.ResponseWriter, req *web.Request) {
+
+	factIdStr, ok := req.PathParams["factId"]
+	if !ok {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	//get the fact ID from the URL
+	factId, err := strconv.ParseInt(factIdStr, 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	req.ParseForm()
+
+	var edited fact.Fact
+
+	if err := decodeFactForm(&edited, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, EditFactUrl.Make("factId", factIdStr), http.StatusSeeOther)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	if err := c.editFact(req, f, edited); err != nil {
+		if err == fact.NotAllowedToEdit {
+			http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+			return
+		}
+		f.Votes = nil
+		c.SetFailedRequestObject(rw, req, newFactForm(*f, err))
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, EditFactUrl.Make("factId", factIdStr), http.StatusSeeOther)
+		return
+	}
+
+	if f.AwaitModeration {
+		c.SetNotificationMessage(rw, req, "Fact updated! It will be visible to everyone again once it has been moderated.")
+	} else {
+		c.SetNotificationMessage(rw, req, "Fact updated!")
+	}
+	http.Redirect(rw, req.Request, ViewFactUrl.Make("factId", factIdStr), http.StatusFound)
+}
+
+func (c *LoggedInContext) DoRollbackFactHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.EditAnyFact) {
+		return
+	}
+
+	factIdStr, ok := req.PathParams["factId"]
+	if !ok {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	//get the fact and revision IDs from the URL
+	factId, err := strconv.ParseInt(factIdStr, 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	revisionId, err := strconv.ParseInt(req.PathParams["revisionId"], 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad revision ID", http.StatusBadRequest)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := c.Storage.ListFactRevisions(f.Id)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//revisions are numbered from 1 on the history page
+	number := 0
+	for i, r := range revisions {
+		if r.Id == revisionId {
+			number = i + 1
+		}
+	}
+	if number == 0 {
+		http.Error(rw, "404: Revision not found", http.StatusNotFound)
+		return
+	}
+
+	e := &audit.AuditEvent{Action: audit.RollbackFact, TargetType: audit.TargetFact, TargetId: f.Id, Before: f.Fact}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.RollbackFact(s, f, &revisions[number-1], c.Account.Id, "Rolled back to revision "+strconv.Itoa(number)); err != nil {
+			return err
+		}
+		e.After = "revision " + strconv.Itoa(number) + ": " + f.Fact
+		return nil
+	}); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Fact rolled back to revision "+strconv.Itoa(number)+".")
+	http.Redirect(rw, req.Request, FactHistoryUrl.Make("factId", factIdStr), http.StatusFound)
+}
+
+func (c *LoggedInContext) DoRenameTagHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.EditAnyFact) {
+		return
+	}
+
+	t, err := c.Storage.LoadTagFromName(req.PathParams["tagName"])
+	if err != nil {
+		http.Error(rw, "404: Tag not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+
+	e := &audit.AuditEvent{Action: audit.RenameTag, TargetType: audit.TargetTag, TargetId: t.Id, Before: t.Name}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.RenameTag(s, t, req.PostForm.Get("Name")); err != nil {
+			return err
+		}
+		e.After = t.Name
+		return nil
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, ListTagsUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Tag renamed to "+t.Name+".")
+	http.Redirect(rw, req.Request, ListTagsUrl.Make(), http.StatusFound)
+}
+
+func (c *LoggedInContext) DoMergeTagHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.EditAnyFact) {
+		return
+	}
+
+	from, err := c.Storage.LoadTagFromName(req.PathParams["tagName"])
+	if err != nil {
+		http.Error(rw, "404: Tag not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+
+	into, err := c.Storage.LoadTagFromName(req.PostForm.Get("Into"))
+	if err != nil {
+		c.SetErrorMessage(rw, req, "There is no tag with that name to merge into.")
+		http.Redirect(rw, req.Request, ListTagsUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.MergeTag, TargetType: audit.TargetTag, TargetId: from.Id, Before: from.Name, After: "merged into " + into.Name}, func(s AnyStorer) error {
+		return fact.MergeTags(s, from, into)
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, ListTagsUrl.Make(), http.StatusSeeOther)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Tag "+from.Name+" merged into "+into.Name+".")
+	http.Redirect(rw, req.Request, ListTagsUrl.Make(), http.StatusFound)
+}
+
+//brokenLinkFact is a fact on the broken links report, with the references whose links are broken
+type brokenLinkFact struct {
+	*fact.Fact
+	Broken []fact.Reference
+	Rotted bool //at least one of the links has been broken for fact.LinkRottedAfterFailures checks
+}
+
+//Lists the facts with references whose links were broken when the link checker last tried them
+func (c *LoggedInContext) BrokenLinksHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.EditAnyFact) {
+		return
+	}
+
+	references, err := c.Storage.ListBrokenReferences()
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//the references are in order of their fact
+	var facts []brokenLinkFact
+	for _, r := range references {
+		if len(facts) == 0 || facts[len(facts)-1].Id != r.FactId {
+			f, err := c.Storage.LoadFactFromId(r.FactId)
+			if err != nil {
+				continue
+			}
+			facts = append(facts, brokenLinkFact{Fact: f})
+		}
+		last := &facts[len(facts)-1]
+		last.Broken = append(last.Broken, r)
+		last.Rotted = last.Rotted || r.LinkRotted()
+	}
+
+	c.Data = facts
+
+	err = templates.ExecuteTemplate(rw, "brokenLinksPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Lists the email and IP addresses that have been locked after too many failed sign ins
+func (c *LoggedInContext) LoginLockoutsHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	throttles, err := c.Storage.ListLockedLoginThrottles(time.Now())
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Data = throttles
+
+	err = templates.ExecuteTemplate(rw, "loginLockoutsPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Unlocks an email or IP address, forgetting its failed sign ins
+func (c *LoggedInContext) DoUnlockLoginHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	req.ParseForm()
+	key := req.PostForm.Get("Key")
+	if key == "" {
+		http.Error(rw, "400: Bad lockout", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.UnlockLogin, TargetType: audit.TargetLogin, Before: key}, func(s AnyStorer) error {
+		return s.DeleteLoginThrottle(key)
+	}); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Unlocked "+key+".")
+	http.Redirect(rw, req.Request, LoginLockoutsUrl.Make(), http.StatusFound)
+}
+
+//A role, and the accounts that have it, as shown on the roles page
+type RoleAccounts struct {
+	Role        account.Role
+	Permissions []account.Permission
+	Accounts    []account.Account
+}
+
+//Lists the accounts that have a role other than member, and lets the role of any account be changed
+func (c *LoggedInContext) RolesHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	var roles []RoleAccounts
+	for _, role := range account.Roles {
+		if role == account.RoleMember {
+			continue
+		}
+		accounts, err := c.Storage.ListAccountsWithRole(role)
+		if err != nil {
+			http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, RoleAccounts{Role: role, Permissions: role.Permissions(), Accounts: accounts})
+	}
+
+	c.Data = struct {
+		Roles    []RoleAccounts
+		AllRoles []account.Role
+	}{
+		Roles:    roles,
+		AllRoles: account.Roles,
+	}
+
+	err := templates.ExecuteTemplate(rw, "rolesPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Gives the account with the posted email address the posted role
+func (c *LoggedInContext) DoSetRoleHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	req.ParseForm()
+	email := strings.TrimSpace(req.PostForm.Get("Email"))
+	role := account.Role(req.PostForm.Get("Role"))
+
+	a, err := c.Storage.LoadAccountFromEmail(email)
+	if err != nil {
+		c.SetErrorMessage(rw, req, "There is no account with the email address "+email+".")
+		http.Redirect(rw, req.Request, RolesUrl.Make(), http.StatusFound)
+		return
+	}
+
+	e := &audit.AuditEvent{Action: audit.SetRole, TargetType: audit.TargetAccount, TargetId: a.Id, Before: string(a.Role), After: string(role)}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		return a.SetRole(s, role, c.Account)
+	}); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, RolesUrl.Make(), http.StatusFound)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, a.Nickname+" ("+a.Email+") is now a "+string(role)+".")
+	http.Redirect(rw, req.Request, RolesUrl.Make(), http.StatusFound)
+}
+
+//Lists accounts for admins, searching their email addresses and nicknames with ?q=
+func (c *LoggedInContext) AccountsHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	values := req.URL.Query()
+	q := account.AccountQuery{Search: values.Get("q")}
+	var err error
+	if page := values.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			http.Error(rw, "400: Bad page", http.StatusBadRequest)
+			return
+		}
+	}
+	if size := values.Get("size"); size != "" {
+		if q.PageSize, err = strconv.Atoi(size); err != nil {
+			http.Error(rw, "400: Bad page size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := c.Storage.ListAccounts(q)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.Data = struct {
+		Page *account.AccountPage
+		Now  time.Time
+	}{
+		Page: page,
+		Now:  time.Now(),
+	}
+
+	err = templates.ExecuteTemplate(rw, "accountsPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Does one of the admin actions on the accounts page to an account, given by the posted Action:
+//verify, suspend (for Days days), ban, reinstate, resetvotes, resetpassword or expiresessions
+//Suspending and banning need a Reason
+func (c *LoggedInContext) DoManageAccountHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ManageUsers) {
+		return
+	}
+
+	accountId, err := strconv.ParseInt(req.PathParams["accountId"], 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad account ID", http.StatusBadRequest)
+		return
+	}
+	a, err := c.Storage.LoadAccountFromId(accountId)
+	if err != nil {
+		http.Error(rw, "404: Account not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+	reason := strings.TrimSpace(req.PostForm.Get("Reason"))
+	now := time.Now()
+
+	var done string
+	var change func(s AnyStorer) error
+	e := &audit.AuditEvent{TargetType: audit.TargetAccount, TargetId: a.Id}
+	switch req.PostForm.Get("Action") {
+	case "verify":
+		e.Action = audit.VerifyFor
+		change = func(s AnyStorer) error { return a.VerifyFor(s, c.Account) }
+		done = "verified"
+	case "suspend":
+		days, convErr := strconv.Atoi(req.PostForm.Get("Days"))
+		if convErr != nil || days < 1 {
+			http.Error(rw, "400: Bad number of days", http.StatusBadRequest)
+			return
+		}
+		until := now.AddDate(0, 0, days)
+		e.Action, e.After = audit.Suspend, "until "+until.UTC().Format(time.RFC3339)+": "+reason
+		change = func(s AnyStorer) error { return a.Suspend(s, until, reason, c.Account, now) }
+		done = "suspended for " + strconv.Itoa(days) + " days"
+	case "ban":
+		e.Action, e.After = audit.Ban, reason
+		change = func(s AnyStorer) error { return a.Ban(s, reason, c.Account) }
+		done = "banned"
+	case "reinstate":
+		e.Action, e.Before = audit.Reinstate, a.SuspensionReason
+		change = func(s AnyStorer) error { return a.Reinstate(s, c.Account) }
+		done = "reinstated"
+	case "resetvotes":
+		e.Action, e.Before = audit.ResetVoteBank, "vote bank "+strconv.FormatInt(a.VoteBank, 10)
+		e.After = "vote bank " + strconv.Itoa(account.NewAccountVoteBank)
+		change = func(s AnyStorer) error { return a.ResetVoteBank(s, c.Account) }
+		done = "given a vote bank of " + strconv.Itoa(account.NewAccountVoteBank)
+	case "resetpassword":
+		e.Action = audit.ForcePasswordReset
+		change = func(s AnyStorer) error { return a.ForcePasswordReset(s, c.Account, now) }
+		done = "signed out and sent a link to choose a new password"
+	case "expiresessions":
+		e.Action = audit.ExpireSessions
+		change = func(s AnyStorer) error { return a.ExpireSessions(s, c.Account) }
+		done = "signed out everywhere"
+	default:
+		http.Error(rw, "400: Bad action", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.audited(req, e, change); err != nil {
+		c.SetErrorMessage(rw, req, err.Error())
+	} else {
+		c.SetNotificationMessage(rw, req, a.Nickname+" ("+a.Email+") has been "+done+".")
+	}
+	http.Redirect(rw, req.Request, GetAccountsUrl(req.PostForm.Get("q")), http.StatusFound)
+}
+
+//The format of the audit log's from and to dates
+const auditDateFormat = "2006-01-02"
+
+//Reads the audit log's filters from the query string: actor (an account's ID or email address), action, type, target,
+//from and to (dates, which are both included), page and size
+func (c *LoggedInContext) parseAuditQuery(values url.Values) (audit.AuditQuery, error) {
+	var q audit.AuditQuery
+	var err error
+	if actor := strings.TrimSpace(values.Get("actor")); actor != "" {
+		if q.ActorId, err = strconv.ParseInt(actor, 10, 64); err != nil {
+			a, err := c.Storage.LoadAccountFromEmail(actor)
+			if err != nil {
+				return q, errors.New("There is no account with the email address " + actor + ".")
+			}
+			q.ActorId = a.Id
+		}
+	}
+	q.Action = audit.Action(values.Get("action"))
+	q.TargetType = audit.TargetType(values.Get("type"))
+	if target := strings.TrimSpace(values.Get("target")); target != "" {
+		if q.TargetId, err = strconv.ParseInt(target, 10, 64); err != nil {
+			return q, errors.New("Bad target ID")
+		}
+	}
+	if from := values.Get("from"); from != "" {
+		if q.CreatedAfter, err = time.Parse(auditDateFormat, from); err != nil {
+			return q, errors.New("Bad from date")
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.CreatedBefore, err = time.Parse(auditDateFormat, to); err != nil {
+			return q, errors.New("Bad to date")
+		}
+		q.CreatedBefore = q.CreatedBefore.AddDate(0, 0, 1)
+	}
+	if page := values.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			return q, errors.New("Bad page")
+		}
+	}
+	if size := values.Get("size"); size != "" {
+		if q.PageSize, err = strconv.Atoi(size); err != nil {
+			return q, errors.New("Bad page size")
+		}
+	}
+	return q, nil
+}
+
+//One event in the audit log, as shown on the audit log page
+type auditLogEntry struct {
+	audit.AuditEvent
+	Actor string
+}
+
+//Lists the audit log for admins, newest first, filtered by the query string (see parseAuditQuery)
+//With format=csv, every matching event is downloaded as CSV instead
+func (c *LoggedInContext) AuditLogHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ViewAuditLog) {
+		return
+	}
+
+	values := req.URL.Query()
+	q, err := c.parseAuditQuery(values)
+	if err != nil {
+		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if values.Get("format") == "csv" {
+		c.writeAuditLogCSV(rw, q)
+		return
+	}
+
+	page, err := c.Storage.ListAuditEvents(q)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nickname := c.nicknames()
+	entries := make([]auditLogEntry, len(page.Events))
+	for i, e := range page.Events {
+		entries[i] = auditLogEntry{AuditEvent: e, Actor: "Nobody"}
+		if e.ActorId != 0 {
+			entries[i].Actor = nickname(e.ActorId)
+		}
+	}
+
+	c.Data = struct {
+		Page        *audit.AuditPage
+		Events      []auditLogEntry
+		Actions     []audit.Action
+		TargetTypes []audit.TargetType
+		Actor       string
+		From        string
+		To          string
+	}{
+		Page:        page,
+		Events:      entries,
+		Actions:     audit.Actions,
+		TargetTypes: audit.TargetTypes,
+		Actor:       values.Get("actor"),
+		From:        values.Get("from"),
+		To:          values.Get("to"),
+	}
+
+	err = templates.ExecuteTemplate(rw, "auditLogPage", c)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Writes every event matching q (whatever its page) as a CSV download, a page at a time
+func (c *LoggedInContext) writeAuditLogCSV(rw web.ResponseWriter, q audit.AuditQuery) {
+	q.Page, q.PageSize = 1, audit.MaxAuditPageSize
+	page, err := c.Storage.ListAuditEvents(q)
+	if err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	rw.Header().Set("Content-Disposition", "attachment; filename=\"audit-"+time.Now().UTC().Format(auditDateFormat)+".csv\"")
+	if err := audit.WriteCSV(rw, page.Events, true); err != nil {
+		log.Println("Error writing audit log CSV:", err.Error())
+		return
+	}
+	for page.HasNext() {
+		q.Page = page.NextPage()
+		if page, err = c.Storage.ListAuditEvents(q); err != nil {
+			//the download has already started, so all that can be done is to stop it short
+			log.Println("Error listing audit log for CSV:", err.Error())
+			return
+		}
+		if err := audit.WriteCSV(rw, page.Events, false); err != nil {
+			log.Println("Error writing audit log CSV:", err.Error())
+			return
+		}
+	}
+}
+
+type CommentForm struct {
+	Text     string
+	ParentId int64
+}
+
+func (c *LoggedInContext) DoCreateCommentHandler(rw web.ResponseWriter, req *web.Request) {
+
+	factIdStr, ok := req.PathParams["factId"]
+	if !ok {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	//get the fact ID from the URL
+	factId, err := strconv.ParseInt(factIdStr, 10, 64)
+	if err != nil {
+		http.Error(rw, "400: Bad fact ID", http.StatusBadRequest)
+		return
+	}
+
+	f, err := c.Storage.LoadFactFromId(factId)
+	if err != nil || !c.CanViewFact(f) {
+		http.Error(rw, "404: Fact not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+
+	var form CommentForm
+
+	if err := decoder.Decode(&form, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, ViewFactUrl.Make("factId", factIdStr), http.StatusSeeOther)
+		return
+	}
+
+	comment := fact.Comment{
+		FactId:    f.Id,
+		AccountId: c.Account.Id,
+		ParentId:  form.ParentId,
+		Text:      form.Text,
+	}
+
+	e := &audit.AuditEvent{Action: audit.CreateComment, TargetType: audit.TargetComment}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.CreateComment(s, &comment); err != nil {
+			return err
+		}
+		e.TargetId, e.After = comment.Id, comment.Text
+		return nil
+	}); err != nil {
+		c.SetFailedRequestObject(rw, req, comment)
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, ViewFactUrl.Make("factId", factIdStr)+"#comments", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(rw, req.Request, ViewFactUrl.Make("factId", factIdStr)+"#comment-"+strconv.FormatInt(comment.Id, 10), http.StatusFound)
+}
+
+//Loads the comment in the URL, and the fact it is on. The comment can only be loaded if the current account can see it
+func (c *LoggedInContext) loadCommentFromUrl(req *web.Request) (*fact.Comment, *fact.Fact, bool) {
+	commentId, err := strconv.ParseInt(req.PathParams["commentId"], 10, 64)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	comment, err := c.Storage.LoadCommentFromId(commentId)
+	if err != nil || !c.CanViewComment(comment) {
+		return nil, nil, false
+	}
+
+	f, err := c.Storage.LoadFactFromId(comment.FactId)
+	if err != nil || !c.CanViewFact(f) {
+		return nil, nil, false
+	}
+	return comment, f, true
+}
+
+func (c *LoggedInContext) EditCommentHandler(rw web.ResponseWriter, req *web.Request) {
+	comment, f, ok := c.loadCommentFromUrl(req)
+	if !ok {
+		http.Error(rw, "404: Comment not found", http.StatusNotFound)
+		return
+	}
+
+	if comment.AccountId != c.Account.Id {
+		http.Error(rw, "400: Bad comment ID", http.StatusBadRequest)
+		return
+	}
+
+	//if their last edit failed, show them what they tried to save so they can fix it
+	badC := c.CheckFailedRequestObject(rw, req)
+	if badC != nil {
+		if edited, ok := badC.(fact.Comment); ok && edited.Id == comment.Id {
+			comment = &edited
+		}
+	}
+
+	data := struct {
+		Fact    *fact.Fact
+		Comment *fact.Comment
+	}{
+		Fact:    f,
+		Comment: comment,
+	}
+	c.Data = data
+
+	if err := templates.ExecuteTemplate(rw, "editCommentPage", c); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *LoggedInContext) DoEditCommentHandler(rw web.ResponseWriter, req *web.Request) {
+	comment, f, ok := c.loadCommentFromUrl(req)
+	if !ok {
+		http.Error(rw, "404: Comment not found", http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+
+	var form CommentForm
+
+	if err := decoder.Decode(&form, req.PostForm); err != nil {
+		c.SetErrorMessage(rw, req, "Decoding error: "+err.Error())
+		http.Redirect(rw, req.Request, EditCommentUrl.Make("commentId", req.PathParams["commentId"]), http.StatusSeeOther)
+		return
+	}
+
+	e := &audit.AuditEvent{Action: audit.EditComment, TargetType: audit.TargetComment, TargetId: comment.Id, Before: comment.Text}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := fact.EditComment(s, comment, form.Text, c.Account.Id); err != nil {
+			return err
+		}
+		e.After = comment.Text
+		return nil
+	}); err != nil {
+		if err == fact.NotAllowedToEditComment {
+			http.Error(rw, "400: Bad comment ID", http.StatusBadRequest)
+			return
+		}
+		comment.Text = form.Text
+		c.SetFailedRequestObject(rw, req, *comment)
+		c.SetErrorMessage(rw, req, err.Error())
+		http.Redirect(rw, req.Request, EditCommentUrl.Make("commentId", req.PathParams["commentId"]), http.StatusSeeOther)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Comment updated!")
+	http.Redirect(rw, req.Request, GetViewFactUrl(f.Id)+"#comment-"+strconv.FormatInt(comment.Id, 10), http.StatusFound)
+}
+
+func (c *LoggedInContext) DoDeleteCommentHandler(rw web.ResponseWriter, req *web.Request) {
+	comment, f, ok := c.loadCommentFromUrl(req)
+	if !ok {
+		http.Error(rw, "404: Comment not found", http.StatusNotFound)
+		return
+	}
+
+	if err := c.audited(req, &audit.AuditEvent{Action: audit.DeleteComment, TargetType: audit.TargetComment, TargetId: comment.Id, Before: comment.Text}, func(s AnyStorer) error {
+		return fact.DeleteComment(s, comment, c.Account.Id, c.Can(account.ModerateFact))
+	}); err != nil {
+		if err == fact.NotAllowedToEditComment {
+			http.Error(rw, "400: Bad comment ID", http.StatusBadRequest)
+			return
+		}
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.SetNotificationMessage(rw, req, "Comment deleted!")
+	http.Redirect(rw, req.Request, GetViewFactUrl(f.Id)+"#comments", http.StatusFound)
+}
+
+//The body of a request to HideCommentUrl
+type hideCommentRequest struct {
+	CommentId int64
+	Hide      bool
+}
+
+type hideCommentResponse struct {
+	Response  string //always "ok"
+	CommentId int64
+	NewHidden bool
+}
+
+func (c *LoggedInContext) HideCommentHandler(rw web.ResponseWriter, req *web.Request) {
+	if !c.Permit(rw, account.ModerateFact) {
+		return
+	}
+
+	var hideRequest hideCommentRequest
+	var response hideCommentResponse
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&hideRequest); err != nil {
+		http.Error(rw, "400: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if hideRequest.CommentId == 0 {
+		http.Error(rw, "400: No CommentID specified", http.StatusBadRequest)
+		return
+	}
+
+	comment, err := c.Storage.LoadCommentFromId(hideRequest.CommentId)
+	if err != nil {
+		http.Error(rw, "400: Bad CommentID specified", http.StatusBadRequest)
+		return
+	}
+
+	e := &audit.AuditEvent{Action: audit.HideComment, TargetType: audit.TargetComment, TargetId: comment.Id, Before: hiddenSummary(comment.Hidden)}
+	if err := c.audited(req, e, func(s AnyStorer) error {
+		if err := s.HideComment(comment, hideRequest.Hide); err != nil {
+			return err
+		}
+		e.After = hiddenSummary(comment.Hidden)
+		return nil
+	}); err != nil {
+		http.Error(rw, "500: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.CommentId = comment.Id
+	response.NewHidden = comment.Hidden
+	response.Response = "ok"
+	ReturnJSON(rw, response)
+}
+
+//Describes whether a comment is hidden, for the audit log
+func hiddenSummary(hidden bool) string {
+	if hidden {
+		return "hidden"
+	}
+	return "shown"
+}
@@ -0,0 +1,1380 @@
+package memdb
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/nullables"
+)
+
+//MemoryStorage keeps accounts, facts, references and votes in maps instead of a database.
+//It behaves the same way as fyidb.DatabaseStorage (including returning gorm.ErrRecordNotFound and soft deleting facts)
+//so it can be used for tests and for running the server without writing anything to disk.
+//It is safe for concurrent use.
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	accounts   map[int64]account.Account
+	facts      map[int64]fact.Fact //stored without their References and Votes
+	references map[int64]fact.Reference
+	votes      map[int64]fact.Vote
+	revisions  map[int64]fact.FactRevision
+	tags       map[int64]fact.Tag
+	factTags   map[int64][]int64 //the Ids of each fact's tags
+	comments   map[int64]fact.Comment
+	sessions   map[int64]account.Session
+	throttles  map[string]account.LoginThrottle //by ThrottleKey
+	identities map[int64]account.ExternalIdentity
+
+	moderationNotes map[int64]fact.ModerationNote
+
+	auditEvents map[int64]audit.AuditEvent
+
+	apiTokens map[int64]account.ApiToken
+
+	lastAccountId   int64
+	lastFactId      int64
+	lastReferenceId int64
+	lastVoteId      int64
+	lastRevisionId  int64
+	lastTagId       int64
+	lastCommentId   int64
+	lastSessionId   int64
+	lastThrottleId  int64
+	lastIdentityId  int64
+
+	lastModerationNoteId int64
+
+	lastAuditEventId int64
+
+	lastApiTokenId int64
+}
+
+var (
+	EmailAddressNotUnique     error = errors.New("UNIQUE constraint failed: accounts.email")
+	ExternalIdentityNotUnique error = errors.New("UNIQUE constraint failed: external_identities.issuer, external_identities.subject")
+	ApiTokenNotUnique         error = errors.New("UNIQUE constraint failed: api_tokens.token_hash")
+)
+
+//Returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		accounts:   make(map[int64]account.Account),
+		facts:      make(map[int64]fact.Fact),
+		references: make(map[int64]fact.Reference),
+		votes:      make(map[int64]fact.Vote),
+		revisions:  make(map[int64]fact.FactRevision),
+		tags:       make(map[int64]fact.Tag),
+		factTags:   make(map[int64][]int64),
+		comments:   make(map[int64]fact.Comment),
+		sessions:   make(map[int64]account.Session),
+		throttles:  make(map[string]account.LoginThrottle),
+		identities: make(map[int64]account.ExternalIdentity),
+
+		moderationNotes: make(map[int64]fact.ModerationNote),
+
+		auditEvents: make(map[int64]audit.AuditEvent),
+
+		apiTokens: make(map[int64]account.ApiToken),
+	}
+}
+
+//Returns a MemoryStorage containing the same default admin account and fact that fyidb puts in a new database
+func NewDemoStorage() *MemoryStorage {
+	s := NewMemoryStorage()
+
+	log.Printf("Inserting \"test@test / test@test\" as an admin Account...\n")
+	a := fyidb.TestAccount()
+	s.CreateAccount(&a)
+
+	f := fyidb.TestFact(a.Id)
+	s.CreateFact(&f)
+	s.ModerateFact(&f, false)
+
+	return s
+}
+
+func now() nullables.NullTime {
+	return nullables.NullTime{Time: time.Now(), Valid: true}
+}
+
+//Loads an account given a username
+func (s *MemoryStorage) LoadAccountFromEmail(email string) (*account.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, a := range s.accounts {
+		if a.Email == email {
+			return &a, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+//Loads an account given an ID
+func (s *MemoryStorage) LoadAccountFromId(id int64) (*account.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a, ok := s.accounts[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &a, nil
+}
+
+//Loads the session with the given token hash, and the account it belongs to. Expired sessions are returned too, the same as fyidb
+func (s *MemoryStorage) LoadAccountFromSession(tokenHash string) (*account.Account, *account.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, session := range s.sessions {
+		if session.TokenHash == tokenHash {
+			a, ok := s.accounts[session.AccountId]
+			if !ok {
+				return nil, nil, gorm.ErrRecordNotFound
+			}
+			return &a, &session, nil
+		}
+	}
+	return nil, nil, gorm.ErrRecordNotFound
+}
+
+func (s *MemoryStorage) CreateAccount(a *account.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertAccount(a)
+}
+
+//insertAccount must be called with the lock held
+func (s *MemoryStorage) insertAccount(a *account.Account) error {
+	for _, existing := range s.accounts {
+		if existing.Email == a.Email {
+			return EmailAddressNotUnique
+		}
+	}
+
+	if a.Id == 0 {
+		s.lastAccountId++
+		a.Id = s.lastAccountId
+	} else if a.Id > s.lastAccountId {
+		s.lastAccountId = a.Id
+	}
+	a.CreatedAt = now()
+	a.UpdatedAt = a.CreatedAt
+	s.accounts[a.Id] = *a
+	return nil
+}
+
+func (s *MemoryStorage) SaveAccount(a *account.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[a.Id]; !ok {
+		return s.insertAccount(a)
+	}
+	for _, existing := range s.accounts {
+		if existing.Email == a.Email && existing.Id != a.Id {
+			return EmailAddressNotUnique
+		}
+	}
+	a.UpdatedAt = now()
+	s.accounts[a.Id] = *a
+	return nil
+}
+
+//Returns the accounts with the given role, in order of email address
+func (s *MemoryStorage) ListAccountsWithRole(role account.Role) ([]account.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accounts []account.Account
+	for _, a := range s.accounts {
+		if a.Role == role {
+			accounts = append(accounts, a)
+		}
+	}
+	sort.Sort(accountsByEmail(accounts))
+	return accounts, nil
+}
+
+//Lists one page of accounts in order of email address, along with how many facts each has submitted and votes each has cast
+func (s *MemoryStorage) ListAccounts(q account.AccountQuery) (*account.AccountPage, error) {
+	q = q.Normalised()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	search := strings.ToLower(strings.TrimSpace(q.Search))
+	var accounts []account.Account
+	for _, a := range s.accounts {
+		if search == "" || strings.Contains(strings.ToLower(a.Email), search) || strings.Contains(strings.ToLower(a.Nickname), search) {
+			accounts = append(accounts, a)
+		}
+	}
+	sort.Sort(accountsByEmail(accounts))
+
+	page := account.AccountPage{Query: q, Total: int64(len(accounts))}
+	for i := q.Offset(); i < len(accounts) && i < q.Offset()+q.PageSize; i++ {
+		summary := account.AccountSummary{Account: accounts[i]}
+		for _, f := range s.facts {
+			if f.AccountId == summary.Id && !f.DeletedAt.Valid {
+				summary.FactsSubmitted++
+			}
+		}
+		for _, v := range s.votes {
+			if v.AccountId == summary.Id && !v.DeletedAt.Valid {
+				if v.Score < 0 {
+					summary.VotesCast -= v.Score
+				} else {
+					summary.VotesCast += v.Score
+				}
+			}
+		}
+		page.Accounts = append(page.Accounts, summary)
+	}
+	return &page, nil
+}
+
+func (s *MemoryStorage) CreateSession(session *account.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSessionId++
+	session.Id = s.lastSessionId
+	s.sessions[session.Id] = *session
+	return nil
+}
+
+//Saves when and where a session was last seen
+func (s *MemoryStorage) SaveSession(session *account.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.sessions[session.Id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	existing.LastSeenAt = session.LastSeenAt
+	existing.Ip = session.Ip
+	s.sessions[session.Id] = existing
+	return nil
+}
+
+//Returns the account's sessions, most recently seen first
+func (s *MemoryStorage) ListSessions(accountId int64) ([]account.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []account.Session
+	for _, session := range s.sessions {
+		if session.AccountId == accountId {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Sort(sessionsByLastSeen(sessions))
+	return sessions, nil
+}
+
+//Deletes one of the account's sessions, returning account.SessionNotFound if it doesn't have one with that Id
+func (s *MemoryStorage) DeleteSession(accountId int64, sessionId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[sessionId]; !ok || session.AccountId != accountId {
+		return account.SessionNotFound
+	}
+	delete(s.sessions, sessionId)
+	return nil
+}
+
+func (s *MemoryStorage) DeleteAllSessions(accountId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.AccountId == accountId {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeleteExpiredSessions(accountId int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.AccountId == accountId && session.Expired(now) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) CreateApiToken(t *account.ApiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.apiTokens {
+		if existing.TokenHash == t.TokenHash {
+			return ApiTokenNotUnique
+		}
+	}
+	s.lastApiTokenId++
+	t.Id = s.lastApiTokenId
+	s.apiTokens[t.Id] = *t
+	return nil
+}
+
+//Loads the API token with the given token hash. Expired tokens are returned too (account.LoadApiToken checks them)
+func (s *MemoryStorage) LoadApiToken(tokenHash string) (*account.ApiToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.apiTokens {
+		if t.TokenHash == tokenHash {
+			return &t, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+//Returns the account's API tokens, newest first
+func (s *MemoryStorage) ListApiTokens(accountId int64) ([]account.ApiToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens []account.ApiToken
+	for _, t := range s.apiTokens {
+		if t.AccountId == accountId {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Sort(apiTokensByCreated(tokens))
+	return tokens, nil
+}
+
+//Saves when and where the token was last used, and adds one to how many times it has been used
+func (s *MemoryStorage) RecordApiTokenUse(t *account.ApiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.apiTokens[t.Id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	existing.LastUsedAt = t.LastUsedAt
+	existing.LastUsedIp = t.LastUsedIp
+	existing.Uses++
+	s.apiTokens[t.Id] = existing
+	return nil
+}
+
+//Deletes one of the account's API tokens, returning account.ApiTokenNotFound if it doesn't have one with that Id
+func (s *MemoryStorage) DeleteApiToken(accountId int64, tokenId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.apiTokens[tokenId]; !ok || t.AccountId != accountId {
+		return account.ApiTokenNotFound
+	}
+	delete(s.apiTokens, tokenId)
+	return nil
+}
+
+func (s *MemoryStorage) LoadLoginThrottle(key string) (*account.LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.throttles[key]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &t, nil
+}
+
+func (s *MemoryStorage) RecordLoginFailure(key string, now time.Time, forgetBefore time.Time) (*account.LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.throttles[key]
+	if !ok {
+		s.lastThrottleId++
+		t = account.LoginThrottle{Id: s.lastThrottleId, ThrottleKey: key}
+	} else if t.LastFailureAt.Time.Before(forgetBefore) {
+		t = account.LoginThrottle{Id: t.Id, ThrottleKey: key}
+	}
+	t.Failures++
+	t.LastFailureAt = nullables.NullTime{Time: now, Valid: true}
+	s.throttles[key] = t
+	return &t, nil
+}
+
+//Saves when the throttle's sign ins are blocked until, and whether it is locked
+func (s *MemoryStorage) SaveLoginThrottle(t *account.LoginThrottle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.throttles[t.ThrottleKey]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	existing.BlockedUntil = t.BlockedUntil
+	existing.LockedOut = t.LockedOut
+	s.throttles[t.ThrottleKey] = existing
+	return nil
+}
+
+func (s *MemoryStorage) DeleteLoginThrottle(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.throttles, key)
+	return nil
+}
+
+//Returns the throttles that are locked at time now, those that will be unlocked soonest first
+func (s *MemoryStorage) ListLockedLoginThrottles(now time.Time) ([]account.LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var throttles []account.LoginThrottle
+	for _, t := range s.throttles {
+		if t.LockedOut && t.BlockedUntil.Valid && t.BlockedUntil.Time.After(now) {
+			throttles = append(throttles, t)
+		}
+	}
+	sort.Sort(throttlesByBlockedUntil(throttles))
+	return throttles, nil
+}
+
+func (s *MemoryStorage) LoadExternalIdentity(issuer string, subject string) (*account.ExternalIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, identity := range s.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *MemoryStorage) CreateExternalIdentity(identity *account.ExternalIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.identities {
+		if existing.Issuer == identity.Issuer && existing.Subject == identity.Subject {
+			return ExternalIdentityNotUnique
+		}
+	}
+	s.lastIdentityId++
+	identity.Id = s.lastIdentityId
+	s.identities[identity.Id] = *identity
+	return nil
+}
+
+//Saves when the identity was last used to sign in
+func (s *MemoryStorage) SaveExternalIdentity(identity *account.ExternalIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.identities[identity.Id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	existing.LastUsedAt = identity.LastUsedAt
+	s.identities[identity.Id] = existing
+	return nil
+}
+
+//loadFact must be called with the lock held
+func (s *MemoryStorage) loadFact(id int64) (*fact.Fact, bool) {
+	f, ok := s.facts[id]
+	if !ok || f.DeletedAt.Valid {
+		return nil, false
+	}
+
+	f.References = nil
+	for _, r := range s.references {
+		if r.FactId == id && !r.DeletedAt.Valid {
+			f.References = append(f.References, r)
+		}
+	}
+	sort.Sort(referencesById(f.References))
+
+	f.Votes = nil
+	for _, v := range s.votes {
+		if v.FactId == id {
+			f.Votes = append(f.Votes, v)
+		}
+	}
+	sort.Sort(votesById(f.Votes))
+
+	f.Tags = nil
+	for _, id := range s.factTags[f.Id] {
+		f.Tags = append(f.Tags, s.tags[id])
+	}
+	sort.Sort(tagsByName(f.Tags))
+
+	return &f, true
+}
+
+func (s *MemoryStorage) LoadFactFromId(id int64) (*fact.Fact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.loadFact(id)
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return f, nil
+}
+
+func (s *MemoryStorage) CreateFact(f *fact.Fact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.SetModerationState(fact.StatePending)
+	s.lastFactId++
+	f.Id = s.lastFactId
+	f.CreatedAt = now()
+
+	s.insertReferences(f)
+	for i := range f.Votes {
+		s.lastVoteId++
+		f.Votes[i].Id = s.lastVoteId
+		f.Votes[i].FactId = f.Id
+		f.Votes[i].CreatedAt = f.CreatedAt
+		s.votes[f.Votes[i].Id] = f.Votes[i]
+	}
+
+	s.setFactTags(f)
+
+	stored := *f
+	stored.References = nil
+	stored.Votes = nil
+	stored.Tags = nil
+	s.facts[f.Id] = stored
+
+	s.insertRevision(f, f.AccountId, "")
+	return nil
+}
+
+//insertReferences must be called with the lock held
+func (s *MemoryStorage) insertReferences(f *fact.Fact) {
+	for i := range f.References {
+		s.lastReferenceId++
+		f.References[i].Id = s.lastReferenceId
+		f.References[i].FactId = f.Id
+		f.References[i].CreatedAt = now()
+		s.references[f.References[i].Id] = f.References[i]
+	}
+}
+
+//setFactTags replaces a fact's tags with f.Tags, creating any tags that don't exist yet, and must be called with the lock held
+func (s *MemoryStorage) setFactTags(f *fact.Fact) {
+	s.factTags[f.Id] = nil
+	for i := range f.Tags {
+		t, ok := s.tagFromName(f.Tags[i].Name)
+		if !ok {
+			s.lastTagId++
+			t = fact.Tag{Id: s.lastTagId, Name: f.Tags[i].Name, CreatedAt: now()}
+			s.tags[t.Id] = t
+		}
+		f.Tags[i] = t
+		s.factTags[f.Id] = append(s.factTags[f.Id], t.Id)
+	}
+}
+
+//tagFromName must be called with the lock held
+func (s *MemoryStorage) tagFromName(name string) (fact.Tag, bool) {
+	for _, t := range s.tags {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return fact.Tag{}, false
+}
+
+//hasTag must be called with the lock held
+func (s *MemoryStorage) hasTag(factId int64, tagId int64) bool {
+	for _, id := range s.factTags[factId] {
+		if id == tagId {
+			return true
+		}
+	}
+	return false
+}
+
+//insertRevision must be called with the lock held
+func (s *MemoryStorage) insertRevision(f *fact.Fact, accountId int64, comment string) {
+	r := fact.NewRevision(f, accountId, comment)
+	s.lastRevisionId++
+	r.Id = s.lastRevisionId
+	r.CreatedAt = now()
+	s.revisions[r.Id] = r
+}
+
+//Like the database, the old references are soft deleted and replaced, and the old tags are replaced
+func (s *MemoryStorage) EditFact(f *fact.Fact, editorId int64, comment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.facts[f.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+
+	f.EditedAt = now()
+	stored.Fact = f.Fact
+	stored.Explain = f.Explain
+	stored.ExplainFurther = f.ExplainFurther
+	stored.AwaitModeration = f.AwaitModeration
+	stored.ModerationState = f.ModerationState
+	stored.EditedAt = f.EditedAt
+	s.facts[f.Id] = stored
+
+	for id, r := range s.references {
+		if r.FactId == f.Id && !r.DeletedAt.Valid {
+			r.DeletedAt = f.EditedAt
+			s.references[id] = r
+		}
+	}
+	s.insertReferences(f)
+	s.setFactTags(f)
+
+	s.insertRevision(f, editorId, comment)
+	return nil
+}
+
+//Returns every revision of a fact, oldest first
+func (s *MemoryStorage) ListFactRevisions(factId int64) ([]fact.FactRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var revisions []fact.FactRevision
+	for _, r := range s.revisions {
+		if r.FactId == factId {
+			revisions = append(revisions, r)
+		}
+	}
+	sort.Sort(revisionsById(revisions))
+	return revisions, nil
+}
+
+func (s *MemoryStorage) LoadFactRevision(id int64) (*fact.FactRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.revisions[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &r, nil
+}
+
+//Facts are soft deleted, the same as they are in the database. Deleting a missing fact is not an error.
+func (s *MemoryStorage) DeleteFact(f *fact.Fact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.facts[f.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return nil
+	}
+	stored.DeletedAt = now()
+	s.facts[f.Id] = stored
+	f.DeletedAt = stored.DeletedAt
+	return nil
+}
+
+//Record a vote against a fact. Return the vote, and any applicable error.
+func (s *MemoryStorage) GetVoteForFact(accountId int64, factId int64) (*fact.Vote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.votes {
+		if v.AccountId == accountId && v.FactId == factId {
+			return &v, nil
+		}
+	}
+
+	s.lastVoteId++
+	v := fact.Vote{
+		Id:        s.lastVoteId,
+		AccountId: accountId,
+		FactId:    factId,
+		CreatedAt: now(),
+	}
+	s.votes[v.Id] = v
+	return &v, nil
+}
+
+func (s *MemoryStorage) SaveVote(v *fact.Vote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v.Id == 0 {
+		s.lastVoteId++
+		v.Id = s.lastVoteId
+		v.CreatedAt = now()
+	}
+	s.votes[v.Id] = *v
+	return nil
+}
+
+//Changes an account's vote on a fact by one (up or down) and takes or refunds the vote from their vote bank, atomically
+//Returns the new vote and the updated account, or account.NoVotesLeft if they can't afford the vote
+func (s *MemoryStorage) CastVote(accountId int64, factId int64, up bool) (*fact.Vote, *account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[accountId]
+	if !ok {
+		return nil, nil, gorm.ErrRecordNotFound
+	}
+
+	v := fact.Vote{AccountId: accountId, FactId: factId}
+	for _, existing := range s.votes {
+		if existing.AccountId == accountId && existing.FactId == factId {
+			v = existing
+		}
+	}
+
+	if account.IsCastingVote(up, v.Score) {
+		if a.VoteBank <= 0 {
+			return nil, nil, account.NoVotesLeft
+		}
+		a.VoteBank--
+	} else {
+		a.VoteBank++
+	}
+
+	if up {
+		v.Score++
+	} else {
+		v.Score--
+	}
+
+	if v.Id == 0 {
+		s.lastVoteId++
+		v.Id = s.lastVoteId
+		v.CreatedAt = now()
+	}
+	s.votes[v.Id] = v
+	s.accounts[a.Id] = a
+	return &v, &a, nil
+}
+
+func (s *MemoryStorage) ModerateFact(f *fact.Fact, enable bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.facts[f.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	state := fact.StatePending
+	if !enable {
+		state = fact.StateApproved
+	}
+	stored.SetModerationState(state)
+	s.facts[f.Id] = stored
+	f.SetModerationState(state)
+	return nil
+}
+
+//Saves the fact's moderation state and the decision, at the same time
+func (s *MemoryStorage) SaveModerationDecision(f *fact.Fact, n *fact.ModerationNote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.facts[f.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	stored.SetModerationState(f.State())
+	s.facts[f.Id] = stored
+	s.insertModerationNote(n)
+	return nil
+}
+
+func (s *MemoryStorage) CreateModerationNote(n *fact.ModerationNote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.facts[n.FactId]; !ok || f.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	s.insertModerationNote(n)
+	return nil
+}
+
+//insertModerationNote must be called with the lock held
+func (s *MemoryStorage) insertModerationNote(n *fact.ModerationNote) {
+	s.lastModerationNoteId++
+	n.Id = s.lastModerationNoteId
+	n.CreatedAt = now()
+	s.moderationNotes[n.Id] = *n
+}
+
+//Returns the decisions and notes about a fact, oldest first
+func (s *MemoryStorage) ListModerationNotes(factId int64) ([]fact.ModerationNote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var notes []fact.ModerationNote
+	for _, n := range s.moderationNotes {
+		if n.FactId == factId {
+			notes = append(notes, n)
+		}
+	}
+	sort.Sort(moderationNotesById(notes))
+	return notes, nil
+}
+
+//Like the database, the listed facts do not have their References or Votes loaded
+func (s *MemoryStorage) ListFacts(q fact.FactQuery) (*fact.FactPage, error) {
+	q = q.Normalised()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var facts []fact.Fact
+	for _, f := range s.facts {
+		if f.DeletedAt.Valid {
+			continue
+		}
+		//if not viewing unmoderated, only show facts that are awaiting moderation that are yours
+		if !q.ViewUnmoderated && f.AwaitModeration && (q.ViewerId == 0 || f.AccountId != q.ViewerId) {
+			continue
+		}
+		if q.AuthorId > 0 && f.AccountId != q.AuthorId {
+			continue
+		}
+		if q.Tag != "" {
+			if t, ok := s.tagFromName(q.Tag); !ok || !s.hasTag(f.Id, t.Id) {
+				continue
+			}
+		}
+		if (q.Moderation == fact.OnlyModerated && f.AwaitModeration) || (q.Moderation == fact.OnlyAwaitModeration && !f.AwaitModeration) {
+			continue
+		}
+		if (q.Moderation == fact.OnlyPending && f.State() != fact.StatePending) || (q.Moderation == fact.OnlyRejected && f.State() != fact.StateRejected) {
+			continue
+		}
+		if !q.CreatedAfter.IsZero() && f.CreatedAt.Time.Before(q.CreatedAfter) {
+			continue
+		}
+		if !q.CreatedBefore.IsZero() && !f.CreatedAt.Time.Before(q.CreatedBefore) {
+			continue
+		}
+		facts = append(facts, f)
+	}
+
+	scores := make(map[int64]fact.VoteScore)
+	for _, v := range s.votes {
+		if v.DeletedAt.Valid {
+			continue
+		}
+		score := scores[v.FactId]
+		if v.Score > 0 {
+			score.Ups += v.Score
+		} else {
+			score.Downs -= v.Score
+		}
+		scores[v.FactId] = score
+	}
+	sort.Sort(factsByQuery{facts: facts, scores: scores, sort: q.Sort})
+
+	page := fact.FactPage{Query: q, Total: int64(len(facts))}
+	if offset := q.Offset(); offset < len(facts) {
+		facts = facts[offset:]
+		if len(facts) > q.PageSize {
+			facts = facts[:q.PageSize]
+		}
+		page.Facts = facts
+	}
+	return &page, nil
+}
+
+//Every visible fact is checked and ranked by fact.SearchRank, as there is no index
+func (s *MemoryStorage) SearchFacts(q fact.SearchQuery) (*fact.SearchPage, error) {
+	q = q.Normalised()
+	terms := fact.SearchTerms(q.Terms)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []fact.SearchResult
+	for id, stored := range s.facts {
+		if len(terms) == 0 || stored.DeletedAt.Valid {
+			continue
+		}
+		if !q.ViewUnmoderated && stored.AwaitModeration && (q.ViewerId == 0 || stored.AccountId != q.ViewerId) {
+			continue
+		}
+		f, _ := s.loadFact(id)
+		if rank := f.SearchRank(terms); rank > 0 {
+			results = append(results, f.SearchResult(terms, rank))
+		}
+	}
+	sort.Sort(searchResultsByRank(results))
+
+	page := fact.SearchPage{Query: q, Total: int64(len(results))}
+	if offset := q.Offset(); offset < len(results) {
+		results = results[offset:]
+		if len(results) > q.PageSize {
+			results = results[:q.PageSize]
+		}
+		page.Results = results
+	}
+	return &page, nil
+}
+
+//Returns every tag in order of their names, with the number of moderated facts that have each one
+func (s *MemoryStorage) ListTags() ([]fact.TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[int64]int64)
+	for factId, tagIds := range s.factTags {
+		if f, ok := s.facts[factId]; !ok || f.DeletedAt.Valid || f.AwaitModeration {
+			continue
+		}
+		for _, id := range tagIds {
+			counts[id]++
+		}
+	}
+
+	var tags []fact.Tag
+	for _, t := range s.tags {
+		tags = append(tags, t)
+	}
+	sort.Sort(tagsByName(tags))
+
+	counted := make([]fact.TagCount, len(tags))
+	for i, t := range tags {
+		counted[i] = fact.TagCount{Tag: t, Facts: counts[t.Id]}
+	}
+	return counted, nil
+}
+
+func (s *MemoryStorage) LoadTagFromName(name string) (*fact.Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tagFromName(name)
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &t, nil
+}
+
+//Renames a tag. Returns fact.TagNameTaken if another tag already has the name
+func (s *MemoryStorage) RenameTag(t *fact.Tag, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tags[t.Id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if existing, ok := s.tagFromName(name); ok && existing.Id != t.Id {
+		return fact.TagNameTaken
+	}
+	stored.Name = name
+	s.tags[t.Id] = stored
+	t.Name = name
+	return nil
+}
+
+//Moves every fact tagged with from to into (skipping facts that already have into), and then deletes from
+func (s *MemoryStorage) MergeTags(from *fact.Tag, into *fact.Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, fromOk := s.tags[from.Id]
+	_, intoOk := s.tags[into.Id]
+	if !fromOk || !intoOk {
+		return gorm.ErrRecordNotFound
+	}
+
+	for factId, tagIds := range s.factTags {
+		if !s.hasTag(factId, from.Id) {
+			continue
+		}
+		var merged []int64
+		for _, id := range tagIds {
+			if id != from.Id {
+				merged = append(merged, id)
+			}
+		}
+		if !s.hasTag(factId, into.Id) {
+			merged = append(merged, into.Id)
+		}
+		s.factTags[factId] = merged
+	}
+	delete(s.tags, from.Id)
+	return nil
+}
+
+//Returns every comment on a fact in the order they were made, including deleted ones (the same as the database)
+func (s *MemoryStorage) ListComments(factId int64) ([]fact.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var comments []fact.Comment
+	for _, c := range s.comments {
+		if c.FactId == factId {
+			comments = append(comments, c)
+		}
+	}
+	sort.Sort(commentsById(comments))
+	return comments, nil
+}
+
+func (s *MemoryStorage) LoadCommentFromId(id int64) (*fact.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.comments[id]
+	if !ok || c.DeletedAt.Valid {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &c, nil
+}
+
+func (s *MemoryStorage) CreateComment(c *fact.Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastCommentId++
+	c.Id = s.lastCommentId
+	c.CreatedAt = now()
+	s.comments[c.Id] = *c
+	return nil
+}
+
+//Saves a comment's new text
+func (s *MemoryStorage) EditComment(c *fact.Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[c.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	c.EditedAt = now()
+	stored.Text = c.Text
+	stored.EditedAt = c.EditedAt
+	s.comments[c.Id] = stored
+	return nil
+}
+
+//Comments are soft deleted, the same as facts. Deleting a missing comment is not an error.
+func (s *MemoryStorage) DeleteComment(c *fact.Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[c.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return nil
+	}
+	stored.DeletedAt = now()
+	s.comments[c.Id] = stored
+	c.DeletedAt = stored.DeletedAt
+	return nil
+}
+
+func (s *MemoryStorage) HideComment(c *fact.Comment, hidden bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[c.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	stored.Hidden = hidden
+	s.comments[c.Id] = stored
+	c.Hidden = hidden
+	return nil
+}
+
+//liveReference must be called with the lock held. It returns true if the reference and its fact haven't been deleted
+func (s *MemoryStorage) liveReference(r fact.Reference) bool {
+	f, ok := s.facts[r.FactId]
+	return !r.DeletedAt.Valid && ok && !f.DeletedAt.Valid
+}
+
+//Returns up to limit references whose links haven't been checked since checkedBefore, in the same order as the database
+func (s *MemoryStorage) ListReferencesToCheck(checkedBefore time.Time, limit int) ([]fact.Reference, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var references []fact.Reference
+	for _, r := range s.references {
+		if s.liveReference(r) && (!r.LinkCheckedAt.Valid || r.LinkCheckedAt.Time.Before(checkedBefore)) {
+			references = append(references, r)
+		}
+	}
+	sort.Sort(referencesByLinkCheck(references))
+	if len(references) > limit {
+		references = references[:limit]
+	}
+	return references, nil
+}
+
+func (s *MemoryStorage) SaveLinkCheck(r *fact.Reference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.references[r.Id]
+	if !ok || stored.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	stored.LinkStatus = r.LinkStatus
+	stored.LinkFinalUrl = r.LinkFinalUrl
+	stored.LinkError = r.LinkError
+	stored.LinkCheckedAt = r.LinkCheckedAt
+	stored.LinkFailures = r.LinkFailures
+	s.references[r.Id] = stored
+	return nil
+}
+
+//Returns the references whose links were broken when they were last checked, ordered by fact and then Id
+func (s *MemoryStorage) ListBrokenReferences() ([]fact.Reference, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var references []fact.Reference
+	for _, r := range s.references {
+		if s.liveReference(r) && r.LinkBroken() {
+			references = append(references, r)
+		}
+	}
+	sort.Sort(referencesByFact(references))
+	return references, nil
+}
+
+func (s *MemoryStorage) GiveOneVoteToAllAccounts() error {
+	log.Println("Giving vote to all accounts.")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, a := range s.accounts {
+		a.VoteBank++
+		s.accounts[id] = a
+	}
+	return nil
+}
+
+//Runs change with this storage and then saves e if it succeeded. There are no transactions in memory, but as with the
+//database, an event is only saved along with its change and a failed change saves no event
+func (s *MemoryStorage) Audited(e *audit.AuditEvent, change func(tx interface{}) error) error {
+	if err := change(s); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAuditEventId++
+	e.Id = s.lastAuditEventId
+	e.CreatedAt = now()
+	s.auditEvents[e.Id] = *e
+	return nil
+}
+
+//Lists one page of audit events, newest first
+func (s *MemoryStorage) ListAuditEvents(q audit.AuditQuery) (*audit.AuditPage, error) {
+	q = q.Normalised()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []audit.AuditEvent
+	for _, e := range s.auditEvents {
+		if q.Matches(&e) {
+			events = append(events, e)
+		}
+	}
+	sort.Sort(auditEventsByNewest(events))
+
+	page := audit.AuditPage{Query: q, Total: int64(len(events))}
+	for i := q.Offset(); i < len(events) && i < q.Offset()+q.PageSize; i++ {
+		page.Events = append(page.Events, events[i])
+	}
+	return &page, nil
+}
+
+//sorts facts the same way as the ORDER BY clauses used by fyidb.ListFacts
+type factsByQuery struct {
+	facts  []fact.Fact
+	scores map[int64]fact.VoteScore
+	sort   fact.FactSort
+}
+
+func (f factsByQuery) Len() int      { return len(f.facts) }
+func (f factsByQuery) Swap(i, j int) { f.facts[i], f.facts[j] = f.facts[j], f.facts[i] }
+func (f factsByQuery) Less(i, j int) bool {
+	a, b := f.facts[i], f.facts[j]
+	sa, sb := f.scores[a.Id], f.scores[b.Id]
+
+	switch f.sort {
+	case fact.SortTop:
+		if sa.Ups-sa.Downs != sb.Ups-sb.Downs {
+			return sa.Ups-sa.Downs > sb.Ups-sb.Downs
+		}
+	case fact.SortControversial:
+		if sa.Controversy() != sb.Controversy() {
+			return sa.Controversy() > sb.Controversy()
+		}
+		if sa.Ups+sa.Downs != sb.Ups+sb.Downs {
+			return sa.Ups+sa.Downs > sb.Ups+sb.Downs
+		}
+	case fact.SortOldest:
+		if !a.CreatedAt.Time.Equal(b.CreatedAt.Time) {
+			return a.CreatedAt.Time.Before(b.CreatedAt.Time)
+		}
+		return a.Id < b.Id
+	default:
+		if !a.CreatedAt.Time.Equal(b.CreatedAt.Time) {
+			return a.CreatedAt.Time.After(b.CreatedAt.Time)
+		}
+	}
+	return a.Id > b.Id
+}
+
+type searchResultsByRank []fact.SearchResult
+
+func (r searchResultsByRank) Len() int      { return len(r) }
+func (r searchResultsByRank) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResultsByRank) Less(i, j int) bool {
+	if r[i].Rank != r[j].Rank {
+		return r[i].Rank > r[j].Rank
+	}
+	return r[i].FactId > r[j].FactId
+}
+
+type accountsByEmail []account.Account
+
+func (l accountsByEmail) Len() int           { return len(l) }
+func (l accountsByEmail) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l accountsByEmail) Less(i, j int) bool { return l[i].Email < l[j].Email }
+
+//newest first, the same as fyidb.ListApiTokens
+type apiTokensByCreated []account.ApiToken
+
+func (l apiTokensByCreated) Len() int      { return len(l) }
+func (l apiTokensByCreated) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l apiTokensByCreated) Less(i, j int) bool {
+	if !l[i].CreatedAt.Time.Equal(l[j].CreatedAt.Time) {
+		return l[i].CreatedAt.Time.After(l[j].CreatedAt.Time)
+	}
+	return l[i].Id > l[j].Id
+}
+
+//most recently seen first, the same as fyidb.ListSessions
+type sessionsByLastSeen []account.Session
+
+func (l sessionsByLastSeen) Len() int      { return len(l) }
+func (l sessionsByLastSeen) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l sessionsByLastSeen) Less(i, j int) bool {
+	if !l[i].LastSeenAt.Time.Equal(l[j].LastSeenAt.Time) {
+		return l[i].LastSeenAt.Time.After(l[j].LastSeenAt.Time)
+	}
+	return l[i].Id > l[j].Id
+}
+
+//soonest unlocked first, the same as fyidb.ListLockedLoginThrottles
+type throttlesByBlockedUntil []account.LoginThrottle
+
+func (l throttlesByBlockedUntil) Len() int      { return len(l) }
+func (l throttlesByBlockedUntil) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l throttlesByBlockedUntil) Less(i, j int) bool {
+	if !l[i].BlockedUntil.Time.Equal(l[j].BlockedUntil.Time) {
+		return l[i].BlockedUntil.Time.Before(l[j].BlockedUntil.Time)
+	}
+	return l[i].Id < l[j].Id
+}
+
+type moderationNotesById []fact.ModerationNote
+
+func (n moderationNotesById) Len() int           { return len(n) }
+func (n moderationNotesById) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n moderationNotesById) Less(i, j int) bool { return n[i].Id < n[j].Id }
+
+type commentsById []fact.Comment
+
+func (c commentsById) Len() int           { return len(c) }
+func (c commentsById) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c commentsById) Less(i, j int) bool { return c[i].Id < c[j].Id }
+
+type referencesById []fact.Reference
+
+func (r referencesById) Len() int           { return len(r) }
+func (r referencesById) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r referencesById) Less(i, j int) bool { return r[i].Id < r[j].Id }
+
+type referencesByFact []fact.Reference
+
+func (r referencesByFact) Len() int      { return len(r) }
+func (r referencesByFact) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r referencesByFact) Less(i, j int) bool {
+	if r[i].FactId != r[j].FactId {
+		return r[i].FactId < r[j].FactId
+	}
+	return r[i].Id < r[j].Id
+}
+
+//never checked first, then the oldest checks, the same as fyidb.ListReferencesToCheck
+type referencesByLinkCheck []fact.Reference
+
+func (r referencesByLinkCheck) Len() int      { return len(r) }
+func (r referencesByLinkCheck) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r referencesByLinkCheck) Less(i, j int) bool {
+	if r[i].LinkCheckedAt.Valid != r[j].LinkCheckedAt.Valid {
+		return !r[i].LinkCheckedAt.Valid
+	}
+	if !r[i].LinkCheckedAt.Time.Equal(r[j].LinkCheckedAt.Time) {
+		return r[i].LinkCheckedAt.Time.Before(r[j].LinkCheckedAt.Time)
+	}
+	return r[i].Id < r[j].Id
+}
+
+type revisionsById []fact.FactRevision
+
+func (r revisionsById) Len() int           { return len(r) }
+func (r revisionsById) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r revisionsById) Less(i, j int) bool { return r[i].Id < r[j].Id }
+
+type tagsByName []fact.Tag
+
+func (t tagsByName) Len() int           { return len(t) }
+func (t tagsByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t tagsByName) Less(i, j int) bool { return t[i].Name < t[j].Name }
+
+type votesById []fact.Vote
+
+func (v votesById) Len() int           { return len(v) }
+func (v votesById) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v votesById) Less(i, j int) bool { return v[i].Id < v[j].Id }
+
+type auditEventsByNewest []audit.AuditEvent
+
+func (e auditEventsByNewest) Len() int           { return len(e) }
+func (e auditEventsByNewest) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e auditEventsByNewest) Less(i, j int) bool { return e[i].Id > e[j].Id }
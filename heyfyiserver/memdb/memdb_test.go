@@ -0,0 +1,28 @@
+package memdb
+
+import (
+	"testing"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.TestStorer(t, func(t *testing.T) storagetest.Storer {
+		return NewMemoryStorage()
+	})
+}
+
+func TestNewDemoStorage(t *testing.T) {
+	s := NewDemoStorage()
+
+	a, err := s.LoadAccountFromEmail("test@test")
+	if err != nil || !a.IsAdmin() {
+		t.Fatalf("Demo storage did not contain the test admin account, got %+v, %v", a, err)
+	}
+
+	page, err := s.ListFacts(fact.FactQuery{})
+	if err != nil || page.Total != 1 || len(page.Facts) != 1 || page.Facts[0].AccountId != a.Id {
+		t.Fatalf("Demo storage did not contain the moderated test fact, got %+v, %v", page, err)
+	}
+}
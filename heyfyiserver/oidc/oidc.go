@@ -0,0 +1,377 @@
+//Package oidc signs people in with an OpenID Connect identity provider, using the authorization code flow with PKCE.
+//Only what hey.fyi needs is implemented: discovery, the code exchange, and checking RS256 signed ID tokens.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Config is how hey.fyi is registered with the identity provider
+type Config struct {
+	Issuer       string //eg https://login.example.com. The discovery document is fetched from Issuer + "/.well-known/openid-configuration"
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string   //the full URL of OidcCallbackUrl, eg https://hey.fyi/signin/oidc/callback
+	Scopes       []string //"openid" is always asked for. Defaults to "openid email profile"
+}
+
+//Provider is an identity provider that has been discovered, and is ready to sign people in
+type Provider struct {
+	Config
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JwksUri               string
+
+	client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey //the provider's signing keys, by key id
+}
+
+//Claims are the parts of an ID token that hey.fyi uses
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+//AuthRequest is a sign in that has been started. State, Nonce and CodeVerifier must be kept (eg in the cookie session)
+//until the provider redirects back to the RedirectUrl
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Url          string //where to send the browser
+}
+
+var (
+	NotConfigured         error = errors.New("Signing in with an identity provider hasn't been set up.")
+	IssuerMismatch        error = errors.New("The identity provider's discovery document is for a different issuer.")
+	NoIdToken             error = errors.New("The identity provider did not return an ID token.")
+	MalformedIdToken      error = errors.New("The ID token is malformed.")
+	UnsupportedAlgorithm  error = errors.New("The ID token is not signed with RS256.")
+	UnknownSigningKey     error = errors.New("The ID token is signed with a key the identity provider doesn't publish.")
+	BadIdTokenSignature   error = errors.New("The ID token's signature is wrong.")
+	IdTokenWrongIssuer    error = errors.New("The ID token is from the wrong issuer.")
+	IdTokenWrongAudience  error = errors.New("The ID token is for a different client.")
+	IdTokenExpired        error = errors.New("The ID token has expired.")
+	IdTokenNonceMismatch  error = errors.New("The ID token is not for this sign in.")
+	IdTokenMissingSubject error = errors.New("The ID token doesn't say who signed in.")
+)
+
+//How far the provider's clock is allowed to be from ours when checking ID tokens
+const clockSkew = time.Minute
+
+//Fetches the provider's discovery document and returns it ready to use
+func NewProvider(config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientId == "" || config.RedirectUrl == "" {
+		return nil, NotConfigured
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	p := &Provider{
+		Config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+	}
+	if err := p.getJson(config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != config.Issuer {
+		return nil, IssuerMismatch
+	}
+	p.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+	p.TokenEndpoint = discovery.TokenEndpoint
+	p.JwksUri = discovery.JwksUri
+	return p, nil
+}
+
+//Starts a sign in, returning where to send the browser and what needs to be kept to finish it
+func (p *Provider) NewAuthRequest() (*AuthRequest, error) {
+	r := &AuthRequest{}
+	for _, value := range []*string{&r.State, &r.Nonce, &r.CodeVerifier} {
+		random, err := randomString()
+		if err != nil {
+			return nil, err
+		}
+		*value = random
+	}
+
+	scopes := p.Scopes
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientId},
+		"redirect_uri":          {p.RedirectUrl},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {r.State},
+		"nonce":                 {r.Nonce},
+		"code_challenge":        {CodeChallenge(r.CodeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	r.Url = p.AuthorizationEndpoint + separator + params.Encode()
+	return r, nil
+}
+
+//Returns the PKCE S256 code challenge for a code verifier
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//Returns true if the state the provider sent back is the one that the sign in was started with
+func StateMatches(expected string, state string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(state)) == 1
+}
+
+//Finishes a sign in: swaps the code the provider sent back for an ID token, checks it, and returns its claims
+func (p *Provider) SignIn(code string, codeVerifier string, nonce string, now time.Time) (*Claims, error) {
+	idToken, err := p.Exchange(code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return p.Verify(idToken, nonce, now)
+}
+
+//Swaps an authorization code for an ID token at the provider's token endpoint
+func (p *Provider) Exchange(code string, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectUrl},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("The identity provider's token response could not be read: %v", err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("The identity provider refused the sign in: %s %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("The identity provider's token endpoint returned HTTP %d", resp.StatusCode)
+	}
+	if token.IdToken == "" {
+		return "", NoIdToken
+	}
+	return token.IdToken, nil
+}
+
+//Checks an ID token's signature and claims, and returns the claims
+func (p *Provider) Verify(idToken string, nonce string, now time.Time) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, MalformedIdToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, MalformedIdToken
+	}
+	if header.Alg != "RS256" {
+		return nil, UnsupportedAlgorithm
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, MalformedIdToken
+	}
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, signed[:], signature); err != nil {
+		return nil, BadIdTokenSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, MalformedIdToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer {
+		return nil, IdTokenWrongIssuer
+	}
+	if !contains(claims.Audience, p.ClientId) {
+		return nil, IdTokenWrongAudience
+	}
+	if !now.Before(time.Unix(claims.Expiry, 0).Add(clockSkew)) {
+		return nil, IdTokenExpired
+	}
+	if !StateMatches(nonce, claims.Nonce) {
+		return nil, IdTokenNonceMismatch
+	}
+	if claims.Subject == "" {
+		return nil, IdTokenMissingSubject
+	}
+	return &claims, nil
+}
+
+//Returns the provider's key with the given id, fetching its keys again if it isn't known (as the provider may have rotated them)
+func (p *Provider) signingKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+	keys, err := p.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, UnknownSigningKey
+}
+
+//findKey must be called with the lock held. Tokens without a key id can only use a provider's only key
+func (p *Provider) findKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+func (p *Provider) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJson(p.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJson(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+//Returns 32 random bytes, base64url encoded (which is also a valid PKCE code verifier)
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+//the "aud" claim can be a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = audience(list)
+	return nil
+}
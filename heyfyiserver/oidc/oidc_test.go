@@ -0,0 +1,155 @@
+package oidc
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/oidc/oidctest"
+)
+
+const testRedirectUrl = "http://hey.fyi.test/signin/oidc/callback"
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Provider) {
+	mock := oidctest.NewProvider("heyfyi", "client secret")
+	p, err := NewProvider(Config{Issuer: mock.URL, ClientId: "heyfyi", ClientSecret: "client secret", RedirectUrl: testRedirectUrl})
+	if err != nil {
+		mock.Close()
+		t.Fatal("NewProvider failed: ", err)
+	}
+	return p, mock
+}
+
+//Follows the auth request's URL to the mock provider, and returns the code and state it redirects back with
+func authorize(t *testing.T, r *AuthRequest) (code string, state string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(r.Url)
+	if err != nil {
+		t.Fatal("Authorizing failed: ", err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound || !strings.HasPrefix(location.String(), testRedirectUrl) {
+		t.Fatalf("The provider did not redirect back, got %d %s", resp.StatusCode, location)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestNewProvider(t *testing.T) {
+	p, mock := newTestProvider(t)
+	defer mock.Close()
+
+	if p.AuthorizationEndpoint != mock.URL+"/authorize" || p.TokenEndpoint != mock.URL+"/token" || p.JwksUri != mock.URL+"/jwks" {
+		t.Fatalf("NewProvider did not discover the endpoints: %+v", p)
+	}
+	if _, err := NewProvider(Config{Issuer: mock.URL + "/other", ClientId: "heyfyi", RedirectUrl: testRedirectUrl}); err == nil {
+		t.Fatal("NewProvider accepted a provider without a discovery document")
+	}
+	if _, err := NewProvider(Config{}); err != NotConfigured {
+		t.Fatal("NewProvider did not return NotConfigured, got ", err)
+	}
+}
+
+func TestSignIn(t *testing.T) {
+	p, mock := newTestProvider(t)
+	defer mock.Close()
+
+	r, err := p.NewAuthRequest()
+	if err != nil {
+		t.Fatal("NewAuthRequest failed: ", err)
+	}
+	params, _ := url.ParseQuery(r.Url[strings.Index(r.Url, "?")+1:])
+	if params.Get("code_challenge") != CodeChallenge(r.CodeVerifier) || params.Get("code_challenge_method") != "S256" || params.Get("scope") != "openid email profile" {
+		t.Fatalf("The auth request is missing PKCE or scopes: %s", r.Url)
+	}
+
+	code, state := authorize(t, r)
+	if !StateMatches(r.State, state) || StateMatches("", "") {
+		t.Fatal("StateMatches did not match the state the provider sent back")
+	}
+	claims, err := p.SignIn(code, r.CodeVerifier, r.Nonce, time.Now())
+	if err != nil {
+		t.Fatal("SignIn failed: ", err)
+	}
+	if claims.Subject != "1234" || claims.Email != "oidc@test" || !claims.EmailVerified || claims.Name != "Oidc Test" {
+		t.Fatalf("SignIn returned the wrong claims: %+v", claims)
+	}
+
+	//codes can only be used once
+	if _, err := p.SignIn(code, r.CodeVerifier, r.Nonce, time.Now()); err == nil {
+		t.Fatal("A code was exchanged twice")
+	}
+}
+
+func TestSignInChecksPkceAndNonce(t *testing.T) {
+	p, mock := newTestProvider(t)
+	defer mock.Close()
+
+	r, _ := p.NewAuthRequest()
+	code, _ := authorize(t, r)
+	if _, err := p.SignIn(code, "not the verifier", r.Nonce, time.Now()); err == nil {
+		t.Fatal("A code was exchanged without the right code verifier")
+	}
+
+	r, _ = p.NewAuthRequest()
+	code, _ = authorize(t, r)
+	if _, err := p.SignIn(code, r.CodeVerifier, "another sign in's nonce", time.Now()); err != IdTokenNonceMismatch {
+		t.Fatal("SignIn accepted an ID token for another sign in, got ", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p, mock := newTestProvider(t)
+	defer mock.Close()
+	now := time.Now()
+
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   mock.URL,
+			"sub":   "1234",
+			"aud":   []string{"other", "heyfyi"},
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "nonce",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	if _, err := p.Verify(mock.SignIdToken(claims(nil)), "nonce", now); err != nil {
+		t.Fatal("Verify rejected a good ID token: ", err)
+	}
+
+	tests := map[error]map[string]interface{}{
+		IdTokenWrongIssuer:    claims(func(c map[string]interface{}) { c["iss"] = "https://evil.test" }),
+		IdTokenWrongAudience:  claims(func(c map[string]interface{}) { c["aud"] = "other" }),
+		IdTokenExpired:        claims(func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() }),
+		IdTokenNonceMismatch:  claims(func(c map[string]interface{}) { delete(c, "nonce") }),
+		IdTokenMissingSubject: claims(func(c map[string]interface{}) { c["sub"] = "" }),
+	}
+	for expected, c := range tests {
+		if _, err := p.Verify(mock.SignIdToken(c), "nonce", now); err != expected {
+			t.Errorf("Verify returned %v, expected %v", err, expected)
+		}
+	}
+
+	token := mock.SignIdToken(claims(nil))
+	parts := strings.Split(token, ".")
+	admin := strings.Split(mock.SignIdToken(claims(func(c map[string]interface{}) { c["sub"] = "admin" })), ".")
+	if _, err := p.Verify(admin[0]+"."+admin[1]+"."+parts[2], "nonce", now); err != BadIdTokenSignature {
+		t.Fatal("Verify accepted a tampered ID token, got ", err)
+	}
+	if _, err := p.Verify("eyJhbGciOiJub25lIn0."+parts[1]+".", "nonce", now); err != UnsupportedAlgorithm {
+		t.Fatal("Verify accepted an unsigned ID token, got ", err)
+	}
+
+	//when the provider rotates its key, the new one is fetched
+	mock.KeyId = "rotated"
+	if _, err := p.Verify(mock.SignIdToken(claims(nil)), "nonce", now); err != nil {
+		t.Fatal("Verify did not fetch the provider's new key: ", err)
+	}
+}
@@ -0,0 +1,210 @@
+//Package oidctest runs a mock OpenID Connect identity provider, so that signing in with oidc can be tested without a real one.
+//It signs in whoever Identity says straight away, without showing a login page.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//Identity is who the mock provider says has signed in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+//authorization is a code that has been handed out by the authorize endpoint, waiting to be exchanged
+type authorization struct {
+	Identity
+	ClientId      string
+	RedirectUri   string
+	Nonce         string
+	CodeChallenge string
+}
+
+//Provider is a running mock identity provider. Close it when the test is finished
+type Provider struct {
+	*httptest.Server
+	ClientId     string
+	ClientSecret string
+	KeyId        string
+	Key          *rsa.PrivateKey
+
+	mu       sync.Mutex
+	Identity Identity                 //who will be signed in by the next authorization
+	Now      func() time.Time         //the time ID tokens are issued at
+	codes    map[string]authorization //by code
+}
+
+//Starts a mock provider that will accept the given client
+func NewProvider(clientId string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &Provider{
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		KeyId:        "test-key",
+		Key:          key,
+		Identity:     Identity{Subject: "1234", Email: "oidc@test", EmailVerified: true, Name: "Oidc Test"},
+		Now:          time.Now,
+		codes:        make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+//Changes who will be signed in by the next authorization
+func (p *Provider) SetIdentity(identity Identity) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Identity = identity
+}
+
+//Signs the claims as an ID token with the provider's key
+func (p *Provider) SignIdToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.KeyId})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *Provider) discovery(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+//Signs in Identity straight away, and redirects back to the client with a code
+func (p *Provider) authorize(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != p.ClientId || q.Get("response_type") != "code" {
+		http.Error(rw, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(rw, "PKCE is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		Identity:      p.Identity,
+		ClientId:      q.Get("client_id"),
+		RedirectUri:   q.Get("redirect_uri"),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(rw, req, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(rw http.ResponseWriter, req *http.Request) {
+	clientId, clientSecret, ok := req.BasicAuth()
+	clientId, _ = url.QueryUnescape(clientId)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if !ok || clientId != p.ClientId || clientSecret != p.ClientSecret {
+		writeJson(rw, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	req.ParseForm()
+	p.mu.Lock()
+	auth, found := p.codes[req.PostForm.Get("code")]
+	delete(p.codes, req.PostForm.Get("code")) //codes can only be used once
+	p.mu.Unlock()
+
+	if !found || req.PostForm.Get("grant_type") != "authorization_code" || req.PostForm.Get("redirect_uri") != auth.RedirectUri {
+		writeJson(rw, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	verifier := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.CodeChallenge {
+		writeJson(rw, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := p.Now()
+	idToken := p.SignIdToken(map[string]interface{}{
+		"iss":            p.URL,
+		"sub":            auth.Subject,
+		"aud":            auth.ClientId,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          auth.Nonce,
+		"email":          auth.Email,
+		"email_verified": auth.EmailVerified,
+		"name":           auth.Name,
+	})
+	writeJson(rw, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) jwks(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.KeyId,
+			"n":   base64.RawURLEncoding.EncodeToString(p.Key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.Key.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJson(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,452 @@
+package heyfyiserver
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gocraft/web"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+)
+
+//The OpenAPI document served at OpenApiUrl is made from apiOperations, with the schemas of the request and response
+//bodies read (by reflection) from the types that the handlers actually decode and write. openapi_test.go checks that
+//every JSON route is in apiOperations, and that each handler accepts and responds with what the document says
+
+//Who can make a request
+type apiAuth int
+
+const (
+	authNone     apiAuth = iota //anyone, signed in or not
+	authOptional                //anyone, but what is shown depends on who is signed in (eg facts awaiting moderation)
+	authRequired                //only someone signed in (or using an API token, for the versioned API)
+)
+
+//A query string parameter
+type apiParameter struct {
+	Name        string
+	Type        interface{} //a value of the parameter's type, eg 0 for an integer
+	Format      string      //eg "date", if it is a string in a particular format
+	Description string
+}
+
+//One operation (a method on a URL) of the API
+type apiOperation struct {
+	Id       string //the operationId, which generated clients name their functions after
+	Method   string
+	Url      URL
+	Summary  string
+	Tag      string
+	Auth     apiAuth
+	Scope    account.Scope //the scope an API token needs, if the operation can be used with one
+	Query    []apiParameter
+	Request  interface{} //an example request body, of the type the handler decodes it into, or nil if there isn't one
+	Status   int         //the status of a successful response
+	Response interface{} //a value of the type the handler responds with, or nil if there is no body
+	Legacy   bool        //one of the endpoints used by the site's scripts, whose errors are text rather than apiErrorResponse
+}
+
+var listFactsParameters = []apiParameter{
+	{Name: "page", Type: 0, Description: "The page to list, starting from 1."},
+	{Name: "size", Type: 0, Description: "How many facts to list on each page."},
+	{Name: "sort", Type: fact.FactSort(""), Description: "The order to list them in."},
+	{Name: "author", Type: int64(0), Description: "Only list facts submitted by this account."},
+	{Name: "tag", Type: "", Description: "Only list facts with this tag."},
+	{Name: "state", Type: fact.ModerationFilter(""), Description: "Only list facts in this moderation state. Facts awaiting moderation are only listed for accounts that can see them."},
+	{Name: "from", Type: "", Format: "date", Description: "Only list facts submitted on or after this date."},
+	{Name: "to", Type: "", Format: "date", Description: "Only list facts submitted on or before this date."},
+}
+
+var searchFactsParameters = []apiParameter{
+	{Name: "q", Type: "", Description: "The words to search for."},
+	{Name: "page", Type: 0, Description: "The page of results, starting from 1."},
+	{Name: "size", Type: 0, Description: "How many results to give on each page."},
+}
+
+//Returns a pointer to s, for the optional fields of example requests
+func apiString(s string) *string {
+	return &s
+}
+
+var exampleReferences = []apiReferenceRequest{
+	{Url: "https://www.snopes.com/fact-check/swallow-spiders/", Publisher: "Snopes", Title: "Do People Swallow Eight Spiders Per Year?"},
+	{Url: "https://www.scientificamerican.com/article/fact-or-fiction-we-swallow-spiders-in-our-sleep/", Publisher: "Scientific American", Title: "Fact or Fiction?: We Swallow Spiders in Our Sleep"},
+}
+
+//Every JSON endpoint, in the order they are listed in the document
+var apiOperations = []apiOperation{
+	{Id: "listFacts", Method: "GET", Url: ApiFactsUrl, Summary: "List facts", Tag: "facts", Auth: authOptional, Scope: account.ScopeRead,
+		Query: listFactsParameters, Status: http.StatusOK, Response: apiFactPage{}},
+	{Id: "createFact", Method: "POST", Url: ApiFactsUrl, Summary: "Submit a fact, which awaits moderation", Tag: "facts", Auth: authRequired, Scope: account.ScopeSubmit,
+		Request: apiFactRequest{
+			Fact:           "People almost never swallow spiders in their sleep",
+			Explain:        "Spiders avoid sleeping people, who breathe, snore and have heartbeats.",
+			ExplainFurther: "The claim that we swallow eight spiders a year was never based on any study.",
+			Tags:           []string{"spiders", "myths"},
+			References:     exampleReferences,
+		},
+		Status: http.StatusCreated, Response: apiFact{}},
+	{Id: "getFact", Method: "GET", Url: ApiFactUrl, Summary: "Get a fact, with its references, tags and votes", Tag: "facts", Auth: authOptional, Scope: account.ScopeRead,
+		Status: http.StatusOK, Response: apiFact{}},
+	{Id: "editFact", Method: "PATCH", Url: ApiFactUrl, Summary: "Change some of a fact's fields. Giving References replaces all of them", Tag: "facts", Auth: authRequired, Scope: account.ScopeSubmit,
+		Request: apiFactPatch{
+			Fact:           apiString("People very rarely swallow spiders in their sleep"),
+			Explain:        apiString("Spiders avoid sleeping people, who breathe, snore and have heartbeats."),
+			ExplainFurther: apiString("The claim that we swallow eight spiders a year was never based on any study."),
+			Tags:           &[]string{"spiders"},
+			References:     &exampleReferences,
+		},
+		Status: http.StatusOK, Response: apiFact{}},
+	{Id: "deleteFact", Method: "DELETE", Url: ApiFactUrl, Summary: "Delete a fact", Tag: "facts", Auth: authRequired, Scope: account.ScopeSubmit,
+		Status: http.StatusNoContent},
+	{Id: "listReferences", Method: "GET", Url: ApiReferencesUrl, Summary: "List a fact's references", Tag: "references", Auth: authOptional, Scope: account.ScopeRead,
+		Status: http.StatusOK, Response: []apiReference{}},
+	{Id: "createReference", Method: "POST", Url: ApiReferencesUrl, Summary: "Add a reference to a fact", Tag: "references", Auth: authRequired, Scope: account.ScopeSubmit,
+		Request: apiReferenceRequest{Url: "https://www.bbc.com/future/article/20141031-do-we-swallow-spiders-in-our-sleep", Publisher: "BBC", Title: "Do we swallow spiders in our sleep?"},
+		Status:  http.StatusCreated, Response: apiReference{}},
+	{Id: "getReference", Method: "GET", Url: ApiReferenceUrl, Summary: "Get one of a fact's references", Tag: "references", Auth: authOptional, Scope: account.ScopeRead,
+		Status: http.StatusOK, Response: apiReference{}},
+	{Id: "editReference", Method: "PATCH", Url: ApiReferenceUrl, Summary: "Change some of a reference's fields, which gives every reference of the fact a new Id", Tag: "references", Auth: authRequired, Scope: account.ScopeSubmit,
+		Request: apiReferencePatch{Url: apiString("https://www.snopes.com/fact-check/swallow-spiders/"), Publisher: apiString("Snopes.com"), Title: apiString("Do People Swallow Spiders?")},
+		Status:  http.StatusOK, Response: apiReference{}},
+	{Id: "deleteReference", Method: "DELETE", Url: ApiReferenceUrl, Summary: "Remove a reference from a fact, which has to keep at least two", Tag: "references", Auth: authRequired, Scope: account.ScopeSubmit,
+		Status: http.StatusNoContent},
+	{Id: "getVotes", Method: "GET", Url: ApiVotesUrl, Summary: "Get a fact's votes", Tag: "votes", Auth: authOptional, Scope: account.ScopeRead,
+		Status: http.StatusOK, Response: apiVotes{}},
+	{Id: "vote", Method: "POST", Url: ApiVotesUrl, Summary: "Vote a fact up or down by one, from the account's vote bank", Tag: "votes", Auth: authRequired, Scope: account.ScopeVote,
+		Request: apiVoteRequest{Up: true},
+		Status:  http.StatusOK, Response: apiVotes{}},
+	{Id: "moderateFact", Method: "POST", Url: ApiModerationUrl, Summary: "Approve, reject or ask for changes to a fact", Tag: "moderation", Auth: authRequired, Scope: account.ScopeModerate,
+		Request: apiModerationRequest{Decision: fact.DecisionRequestChanges, Reason: "Please add a more recent reference."},
+		Status:  http.StatusOK, Response: apiFact{}},
+	{Id: "getAccount", Method: "GET", Url: ApiAccountUrl, Summary: "Get the signed in account", Tag: "account", Auth: authRequired, Scope: account.ScopeRead,
+		Status: http.StatusOK, Response: apiAccount{}},
+
+	{Id: "searchFacts", Method: "GET", Url: SearchFactApiUrl, Summary: "Search facts", Tag: "legacy", Auth: authOptional, Legacy: true,
+		Query: searchFactsParameters, Status: http.StatusOK, Response: searchResponse{}},
+	{Id: "voteOnFact", Method: "POST", Url: VoteOnFactUrl, Summary: "Vote a fact up or down, as the buttons on the site do", Tag: "legacy", Auth: authRequired, Legacy: true,
+		Request: voteOnFactRequest{FactId: 1, Up: true},
+		Status:  http.StatusOK, Response: voteOnFactResponse{}},
+	{Id: "moderateFactFromSite", Method: "POST", Url: ModerateFactUrl, Summary: "Moderate a fact, as the buttons on the site do", Tag: "legacy", Auth: authRequired, Legacy: true,
+		Request: moderateFactRequest{FactId: 1, Decision: fact.DecisionApprove, Reason: "Well referenced."},
+		Status:  http.StatusOK, Response: moderateFactResponse{}},
+	{Id: "hideComment", Method: "POST", Url: HideCommentUrl, Summary: "Hide or show a comment", Tag: "legacy", Auth: authRequired, Legacy: true,
+		Request: hideCommentRequest{CommentId: 1, Hide: true},
+		Status:  http.StatusOK, Response: hideCommentResponse{}},
+	{Id: "getOpenApiDocument", Method: "GET", Url: OpenApiUrl, Summary: "Get this document", Tag: "legacy", Auth: authNone, Legacy: true,
+		Status: http.StatusOK, Response: map[string]interface{}{}},
+}
+
+//Returns the values that a string type can have, or nil if it can be any string
+func apiEnum(t reflect.Type) []string {
+	var values []string
+	switch t {
+	case reflect.TypeOf(fact.ModerationState("")):
+		for _, s := range []fact.ModerationState{fact.StatePending, fact.StateChangesRequested, fact.StateRejected, fact.StateApproved} {
+			values = append(values, string(s))
+		}
+	case reflect.TypeOf(fact.ModerationDecision("")):
+		for _, d := range []fact.ModerationDecision{fact.DecisionApprove, fact.DecisionReject, fact.DecisionRequestChanges} {
+			values = append(values, string(d))
+		}
+	case reflect.TypeOf(fact.FactSort("")):
+		for _, s := range []fact.FactSort{fact.SortNewest, fact.SortTop, fact.SortControversial, fact.SortOldest} {
+			values = append(values, string(s))
+		}
+	case reflect.TypeOf(fact.ModerationFilter("")):
+		for _, f := range []fact.ModerationFilter{fact.OnlyModerated, fact.OnlyAwaitModeration, fact.OnlyPending, fact.OnlyRejected} {
+			values = append(values, string(f))
+		}
+	case reflect.TypeOf(account.Role("")):
+		for _, r := range account.Roles {
+			values = append(values, string(r))
+		}
+	case reflect.TypeOf(account.Permission("")):
+		for _, p := range account.RoleAdmin.Permissions() { //admins can do everything
+			values = append(values, string(p))
+		}
+	case reflect.TypeOf(account.Scope("")):
+		for _, s := range account.Scopes {
+			values = append(values, string(s))
+		}
+	}
+	return values
+}
+
+//THE DOCUMENT
+
+type openApiDocument struct {
+	OpenApi    string                                  `json:"openapi"`
+	Info       openApiInfo                             `json:"info"`
+	Paths      map[string]map[string]*openApiOperation `json:"paths"`
+	Components openApiComponents                       `json:"components"`
+
+	types map[string]reflect.Type //the type each schema was made from
+}
+
+type openApiInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type openApiComponents struct {
+	Schemas         map[string]*openApiSchema         `json:"schemas"`
+	SecuritySchemes map[string]*openApiSecurityScheme `json:"securitySchemes"`
+}
+
+type openApiSecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description"`
+}
+
+type openApiOperation struct {
+	OperationId string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []openApiParameter          `json:"parameters,omitempty"`
+	RequestBody *openApiRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openApiResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+	TokenScope  account.Scope               `json:"x-token-scope,omitempty"` //bearer schemes can't have scopes, so they are given here
+}
+
+type openApiParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      *openApiSchema `json:"schema"`
+}
+
+type openApiRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openApiMediaType `json:"content"`
+}
+
+type openApiResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openApiMediaType `json:"content,omitempty"`
+}
+
+type openApiMediaType struct {
+	Schema  *openApiSchema `json:"schema"`
+	Example interface{}    `json:"example,omitempty"`
+}
+
+type openApiSchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	AllOf                []*openApiSchema          `json:"allOf,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *openApiSchema            `json:"items,omitempty"`
+	Properties           map[string]*openApiSchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *bool                     `json:"additionalProperties,omitempty"`
+}
+
+const (
+	sessionSecurity = "session"
+	tokenSecurity   = "token"
+)
+
+//Returns the OpenAPI document describing apiOperations
+func newOpenApiDocument() *openApiDocument {
+	doc := &openApiDocument{
+		OpenApi: "3.0.3",
+		Info: openApiInfo{
+			Title:   "hey.fyi",
+			Version: "1",
+			Description: "The versioned API under " + ApiUrl.String() + " answers every request with JSON, including errors (an ErrorResponse). " +
+				"It can be used by signing in on the site, or with an API token (from " + ApiTokensUrl.String() + ") which can only do what its scopes allow (see x-token-scope). " +
+				"The legacy endpoints are the ones used by the site's own scripts, and only work for someone signed in on the site.",
+		},
+		Paths: make(map[string]map[string]*openApiOperation),
+		types: make(map[string]reflect.Type),
+		Components: openApiComponents{
+			Schemas: make(map[string]*openApiSchema),
+			SecuritySchemes: map[string]*openApiSecurityScheme{
+				sessionSecurity: {Type: "apiKey", In: "cookie", Name: "session-security", Description: "Signing in on the site. Requests other than GET also need the X-CSRF-Token header, which every response gives."},
+				tokenSecurity:   {Type: "http", Scheme: "bearer", Description: "An API token, which can only be used with the versioned API."},
+			},
+		},
+	}
+
+	for _, op := range apiOperations {
+		path, params := openApiPath(op.Url)
+		o := &openApiOperation{
+			OperationId: op.Id,
+			Summary:     op.Summary,
+			Tags:        []string{op.Tag},
+			Parameters:  params,
+			Responses:   make(map[string]*openApiResponse),
+			TokenScope:  op.Scope,
+		}
+		for _, q := range op.Query {
+			schema := doc.schema(reflect.TypeOf(q.Type))
+			schema.Format = q.Format
+			o.Parameters = append(o.Parameters, openApiParameter{Name: q.Name, In: "query", Description: q.Description, Schema: schema})
+		}
+
+		if op.Request != nil {
+			o.RequestBody = &openApiRequestBody{Required: true, Content: map[string]*openApiMediaType{
+				"application/json": {Schema: doc.schema(reflect.TypeOf(op.Request)), Example: op.Request},
+			}}
+		}
+
+		success := &openApiResponse{Description: http.StatusText(op.Status)}
+		if op.Response != nil {
+			success.Content = map[string]*openApiMediaType{"application/json": {Schema: doc.schema(reflect.TypeOf(op.Response))}}
+		}
+		o.Responses[strconv.Itoa(op.Status)] = success
+		if op.Legacy {
+			o.Responses["default"] = &openApiResponse{Description: "An error, as text (eg \"400: Bad FactID specified\")", Content: map[string]*openApiMediaType{
+				"text/plain": {Schema: &openApiSchema{Type: "string"}},
+			}}
+		} else {
+			o.Responses["default"] = &openApiResponse{Description: "An error", Content: map[string]*openApiMediaType{
+				"application/json": {Schema: doc.schema(reflect.TypeOf(apiErrorResponse{}))},
+			}}
+		}
+
+		var security []map[string][]string
+		if op.Auth != authNone {
+			security = append(security, map[string][]string{sessionSecurity: {}})
+			if !op.Legacy {
+				security = append(security, map[string][]string{tokenSecurity: {}})
+			}
+		}
+		if op.Auth == authOptional {
+			security = append([]map[string][]string{{}}, security...)
+		}
+		o.Security = security
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*openApiOperation)
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = o
+	}
+	return doc
+}
+
+//Returns the OpenAPI path of u (eg /api/v1/facts/{factId}), and its path parameters
+func openApiPath(u URL) (string, []openApiParameter) {
+	var params []openApiParameter
+	parts := strings.Split(u.String(), "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			name := part[1:]
+			parts[i] = "{" + name + "}"
+			params = append(params, openApiParameter{Name: name, In: "path", Required: true, Schema: &openApiSchema{Type: "integer", Format: "int64"}})
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+//Returns the schema of values of type t as they are written by encoding/json. Named structs are added to the document's
+//schemas and referred to, so that generated clients have a type for each of them
+func (doc *openApiDocument) schema(t reflect.Type) *openApiSchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &openApiSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := doc.schema(t.Elem())
+		if schema.Ref != "" {
+			//$ref can't have anything else beside it
+			schema = &openApiSchema{AllOf: []*openApiSchema{schema}}
+		}
+		schema.Nullable = true
+		return schema
+	case reflect.Slice, reflect.Array:
+		return &openApiSchema{Type: "array", Items: doc.schema(t.Elem())}
+	case reflect.Map:
+		return &openApiSchema{Type: "object"}
+	case reflect.Interface:
+		return &openApiSchema{}
+	case reflect.Bool:
+		return &openApiSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openApiSchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &openApiSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openApiSchema{Type: "number"}
+	case reflect.String:
+		return &openApiSchema{Type: "string", Enum: apiEnum(t)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return doc.objectSchema(t)
+		}
+		name := openApiSchemaName(t)
+		if existing, ok := doc.types[name]; !ok {
+			doc.types[name] = t //first, so that a struct that refers to itself doesn't loop forever
+			doc.Components.Schemas[name] = doc.objectSchema(t)
+		} else if existing != t {
+			panic("The OpenAPI document has two schemas called " + name + ": " + existing.String() + " and " + t.String())
+		}
+		return &openApiSchema{Ref: "#/components/schemas/" + name}
+	}
+	panic("The OpenAPI document can't describe values of type " + t.String())
+}
+
+//Returns the schema of a struct's fields. Fields with omitempty might not be there, so aren't required
+func (doc *openApiDocument) objectSchema(t reflect.Type) *openApiSchema {
+	noMore := false
+	schema := &openApiSchema{Type: "object", Properties: make(map[string]*openApiSchema), AdditionalProperties: &noMore}
+	doc.addFields(schema, t)
+	return schema
+}
+
+func (doc *openApiDocument) addFields(schema *openApiSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			//encoding/json writes the fields of embedded structs as if they were this struct's
+			doc.addFields(schema, field.Type)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue //unexported
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = doc.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+//Returns the name a struct is given in the document, which is its Go name without "api" (eg apiFact is "Fact")
+func openApiSchemaName(t reflect.Type) string {
+	name := strings.TrimPrefix(t.Name(), "api")
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+//Serves the OpenAPI document describing the API
+func (c *Context) OpenApiHandler(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, http.StatusOK, newOpenApiDocument())
+}
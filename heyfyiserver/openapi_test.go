@@ -0,0 +1,359 @@
+package heyfyiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/heyfyi/heyfyiserver/memdb"
+)
+
+//Returns every JSON route that initRouter registers (those whose URLs start with /api), as "METHOD /url", by reading urls.go
+func apiRoutes(t *testing.T) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "urls.go", nil, 0)
+	if err != nil {
+		t.Fatal("Could not read urls.go: ", err)
+	}
+
+	urls := make(map[string]string)
+	var routes []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ValueSpec:
+			if lit, ok := n.Values[0].(*ast.BasicLit); ok && len(n.Names) == 1 {
+				urls[n.Names[0].Name], _ = strconv.Unquote(lit.Value)
+			}
+		case *ast.CallExpr:
+			method, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok || len(n.Args) != 2 {
+				return true
+			}
+			switch method.Sel.Name {
+			case "Get", "Post", "Put", "Patch", "Delete":
+			default:
+				return true
+			}
+			//eg rootRouter.Get(SearchFactApiUrl.String(), ...)
+			if arg, ok := n.Args[0].(*ast.CallExpr); ok {
+				if s, ok := arg.Fun.(*ast.SelectorExpr); ok {
+					if u, ok := s.X.(*ast.Ident); ok {
+						routes = append(routes, strings.ToUpper(method.Sel.Name)+" "+u.Name)
+					}
+				}
+			}
+		}
+		return true
+	})
+
+	var apiRoutes []string
+	for _, route := range routes {
+		parts := strings.SplitN(route, " ", 2)
+		if u := urls[parts[1]]; strings.HasPrefix(u, "/api") {
+			apiRoutes = append(apiRoutes, parts[0]+" "+u)
+		}
+	}
+	sort.Strings(apiRoutes)
+	return apiRoutes
+}
+
+func TestOpenApiDescribesEveryRoute(t *testing.T) {
+	var described []string
+	for _, op := range apiOperations {
+		described = append(described, op.Method+" "+op.Url.String())
+	}
+	sort.Strings(described)
+
+	routes := apiRoutes(t)
+	if len(routes) < 10 {
+		t.Fatal("Only found these routes in urls.go: ", routes)
+	}
+	if strings.Join(routes, "\n") != strings.Join(described, "\n") {
+		t.Errorf("The OpenAPI document doesn't describe the same routes as urls.go registers.\nRoutes:\n%s\n\nDescribed:\n%s", strings.Join(routes, "\n"), strings.Join(described, "\n"))
+	}
+}
+
+//Everything an operation is tried out with: a router with a fresh memory storage, a fact (1) with three references
+//and a comment (1), and a moderator who is signed in with both a session and an API token with every scope
+type openApiFixture struct {
+	router      http.Handler
+	cookie      string
+	token       string
+	factId      int64
+	referenceId int64
+}
+
+func newOpenApiFixture(t *testing.T) *openApiFixture {
+	s := memdb.NewMemoryStorage()
+	router := NewRouter(s, "openapi test")
+
+	a := fyidb.TestAccount()
+	a.Role = account.RoleModerator
+	if err := s.CreateAccount(&a); err != nil {
+		t.Fatal("CreateAccount failed: ", err)
+	}
+
+	f := fyidb.TestFact(a.Id)
+	f.References = append(f.References, fact.Reference{Url: "https://en.wikipedia.org/wiki/Spider", Publisher: "Wikipedia", Title: "Spider"})
+	if err := s.CreateFact(&f); err != nil {
+		t.Fatal("CreateFact failed: ", err)
+	}
+	if err := s.CreateComment(&fact.Comment{FactId: f.Id, AccountId: a.Id, Text: "I didn't know that!"}); err != nil {
+		t.Fatal("CreateComment failed: ", err)
+	}
+	saved, err := s.LoadFactFromId(f.Id)
+	if err != nil || f.Id != 1 || len(saved.References) != 3 {
+		t.Fatalf("The fact wasn't saved as expected, got %+v, %v", saved, err)
+	}
+
+	now := time.Now()
+	token, _, err := a.CreateApiToken(s, "OpenAPI test", account.Scopes, time.Hour, now)
+	if err != nil {
+		t.Fatal("CreateApiToken failed: ", err)
+	}
+	sessionToken, _, err := a.StartSession(s, true, "OpenAPI test", "192.0.2.1", now)
+	if err != nil {
+		t.Fatal("StartSession failed: ", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	session, _ := store.Get(req, "session-security")
+	session.Values["sessionId"] = sessionToken
+	session.Values[csrfSessionKey] = "openapi-test-csrf-token"
+	if err := session.Save(req, rw); err != nil {
+		t.Fatal("Could not save the session cookie: ", err)
+	}
+
+	return &openApiFixture{
+		router:      router,
+		cookie:      strings.SplitN(rw.Header().Get("Set-Cookie"), ";", 2)[0],
+		token:       token,
+		factId:      f.Id,
+		referenceId: saved.References[0].Id,
+	}
+}
+
+//Makes the request described by op, with its example request body, and returns the response
+func (fixture *openApiFixture) do(t *testing.T, op apiOperation) *httptest.ResponseRecorder {
+	u := op.Url.Make("factId", strconv.FormatInt(fixture.factId, 10), "referenceId", strconv.FormatInt(fixture.referenceId, 10))
+	var body []byte
+	if op.Request != nil {
+		var err error
+		if body, err = json.Marshal(op.Request); err != nil {
+			t.Fatal("Could not marshal the example request: ", err)
+		}
+	}
+	req := httptest.NewRequest(op.Method, u, bytes.NewReader(body))
+	switch {
+	case op.Auth == authNone:
+	case op.Legacy:
+		req.Header.Set("Cookie", fixture.cookie)
+		req.Header.Set(csrfHeader, "openapi-test-csrf-token")
+	default:
+		req.Header.Set("Authorization", "Bearer "+fixture.token)
+	}
+	rw := httptest.NewRecorder()
+	fixture.router.ServeHTTP(rw, req)
+	return rw
+}
+
+//Checks that v (decoded from JSON) matches the schema in doc (also decoded from JSON). If complete is true, every
+//property of every object has to be given, not just the required ones
+func checkSchema(doc map[string]interface{}, schema map[string]interface{}, v interface{}, path string, complete bool) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return []string{path + ": there is no schema called " + name}
+		}
+		return checkSchema(doc, resolved, v, path, complete)
+	}
+	if v == nil {
+		if schema["nullable"] == true || len(schema) == 0 {
+			return nil
+		}
+		return []string{path + ": is null"}
+	}
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		var problems []string
+		for _, s := range allOf {
+			problems = append(problems, checkSchema(doc, s.(map[string]interface{}), v, path, complete)...)
+		}
+		return problems
+	}
+
+	wrongType := []string{path + ": isn't a " + schema["type"].(string) + ", got " + strconv.Quote(strings.TrimSpace(string(mustMarshal(v))))}
+	switch schema["type"] {
+	case "object":
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return wrongType
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		var problems []string
+		for name, value := range object {
+			property, ok := properties[name]
+			if !ok {
+				if schema["additionalProperties"] == false {
+					problems = append(problems, path+"."+name+": isn't in the schema")
+				}
+				continue
+			}
+			problems = append(problems, checkSchema(doc, property.(map[string]interface{}), value, path+"."+name, complete)...)
+		}
+		required, _ := schema["required"].([]interface{})
+		for name := range properties {
+			if _, given := object[name]; !given && complete {
+				problems = append(problems, path+"."+name+": isn't given")
+			}
+		}
+		for _, name := range required {
+			if _, given := object[name.(string)]; !given && !complete {
+				problems = append(problems, path+"."+name.(string)+": is required but isn't given")
+			}
+		}
+		return problems
+	case "array":
+		array, ok := v.([]interface{})
+		if !ok {
+			return wrongType
+		}
+		var problems []string
+		for i, item := range array {
+			problems = append(problems, checkSchema(doc, schema["items"].(map[string]interface{}), item, path+"["+strconv.Itoa(i)+"]", complete)...)
+		}
+		return problems
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return wrongType
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				return []string{path + ": " + strconv.Quote(s) + " isn't one of " + string(mustMarshal(enum))}
+			}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return []string{path + ": isn't a date-time: " + err.Error()}
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return wrongType
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return wrongType
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return wrongType
+		}
+	}
+	return nil
+}
+
+func mustMarshal(v interface{}) []byte {
+	j, _ := json.Marshal(v)
+	return j
+}
+
+//Returns the schema of op's request body or successful response in the served document
+func openApiSchemaOf(t *testing.T, doc map[string]interface{}, op apiOperation, request bool) map[string]interface{} {
+	path, _ := openApiPath(op.Url)
+	o := doc["paths"].(map[string]interface{})[path].(map[string]interface{})[strings.ToLower(op.Method)].(map[string]interface{})
+	var content interface{}
+	if request {
+		content = o["requestBody"].(map[string]interface{})["content"]
+	} else {
+		content = o["responses"].(map[string]interface{})[strconv.Itoa(op.Status)].(map[string]interface{})["content"]
+	}
+	return content.(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+}
+
+//Tries every operation with its example request, and checks that the handler accepts it and responds as the document says.
+//The versioned API rejects unknown fields, so a request struct that has drifted from the document fails too
+func TestOpenApiMatchesHandlers(t *testing.T) {
+	fixture := newOpenApiFixture(t)
+	rw := fixture.do(t, apiOperation{Method: "GET", Url: OpenApiUrl, Auth: authNone})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("%s returned %d: %s", OpenApiUrl, rw.Code, rw.Body.String())
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatal("The OpenAPI document isn't JSON: ", err)
+	}
+	if doc["openapi"] != "3.0.3" || len(doc["paths"].(map[string]interface{})) == 0 {
+		t.Fatal("The OpenAPI document is missing its version or paths")
+	}
+
+	for _, op := range apiOperations {
+		name := op.Method + " " + op.Url.String()
+		if op.Request != nil {
+			var example interface{}
+			json.Unmarshal(mustMarshal(op.Request), &example)
+			if problems := checkSchema(doc, openApiSchemaOf(t, doc, op, true), example, "request", true); len(problems) > 0 {
+				t.Errorf("%s: the example request doesn't match the document (every field should be given):\n%s", name, strings.Join(problems, "\n"))
+				continue
+			}
+		}
+
+		//each operation gets a fresh fixture, as some of them delete things the others use
+		rw := newOpenApiFixture(t).do(t, op)
+		if rw.Code != op.Status {
+			t.Errorf("%s returned %d, not %d: %s", name, rw.Code, op.Status, rw.Body.String())
+			continue
+		}
+		if op.Response == nil {
+			if rw.Body.Len() != 0 {
+				t.Errorf("%s has no response body in the document, but responded with %s", name, rw.Body.String())
+			}
+			continue
+		}
+		var response interface{}
+		if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s didn't respond with JSON: %v", name, err)
+			continue
+		}
+		if problems := checkSchema(doc, openApiSchemaOf(t, doc, op, false), response, "response", false); len(problems) > 0 {
+			t.Errorf("%s didn't respond as the document says:\n%s", name, strings.Join(problems, "\n"))
+		}
+	}
+}
+
+//Errors from the versioned API are described by the ErrorResponse schema
+func TestOpenApiErrorResponse(t *testing.T) {
+	fixture := newOpenApiFixture(t)
+	doc := newOpenApiDocument()
+	var decoded map[string]interface{}
+	json.Unmarshal(mustMarshal(doc), &decoded)
+
+	fixture.factId = 999 //which doesn't exist
+	rw := fixture.do(t, apiOperation{Method: "GET", Url: ApiFactUrl, Auth: authNone})
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("Getting a fact that doesn't exist returned %d: %s", rw.Code, rw.Body.String())
+	}
+	var response interface{}
+	json.Unmarshal(rw.Body.Bytes(), &response)
+	schema := map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}
+	if problems := checkSchema(decoded, schema, response, "response", false); len(problems) > 0 {
+		t.Errorf("The error didn't match the ErrorResponse schema:\n%s", strings.Join(problems, "\n"))
+	}
+}
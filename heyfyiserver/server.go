@@ -13,32 +13,79 @@ import (
 	"github.com/gocraft/web"
 	"github.com/gorilla/schema"
 	"github.com/gorilla/sessions"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
 	"github.com/kiwih/heyfyi/heyfyiserver/fact"
 	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/heyfyi/heyfyiserver/linkcheck"
+	"github.com/kiwih/heyfyi/heyfyiserver/memdb"
+	"github.com/kiwih/heyfyi/heyfyiserver/oidc"
 )
 
 var (
-	store *sessions.CookieStore
+	store        *sessions.CookieStore
+	storage      AnyStorer
+	oidcProvider *oidc.Provider
 
-	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("./media/templates/*")) //this initializes the template engine
-	decoder   = schema.NewDecoder()                                                       //this initializes the schema (HTML form decoding) engine
+	templates *template.Template    //parsed by StartServer, so that the package can be loaded (eg by tests) from anywhere
+	decoder   = schema.NewDecoder() //this initializes the schema (HTML form decoding) engine
+)
+
+//Passing this as the databaseUrl to StartServer runs the server without a database
+const MemoryDatabaseUrl = "memory://"
+
+//How often the background link checker runs. Setting it to 0 before calling StartServer turns it off
+var LinkCheckInterval = 10 * time.Minute
+
+//If true, the X-Forwarded-For header is trusted for the address that requests come from. Only set it when the server is
+//behind a proxy that sets that header, as otherwise anyone could pretend to come from any address
+var TrustProxyHeaders = false
+
+//Setting OidcConfig.Issuer before calling StartServer lets people sign in with that OpenID Connect identity provider
+var (
+	OidcConfig       oidc.Config
+	OidcProviderName = "your identity provider" //shown on the sign in button, eg "Sign in with Example Corp"
+)
+
+const (
+	linkCheckBatch   = 200            //the most references checked each time the link checker runs
+	linkRecheckAfter = 24 * time.Hour //how long a reference's link result is trusted for before it is checked again
 )
 
-func StartServer(serverAddress string, cookieStoreSalt string) {
+func StartServer(serverAddress string, cookieStoreSalt string, databaseUrl string) {
 
 	//gob is used when we save failed form structs to the session
 	gob.Register(CreateAccount{})
-	gob.Register(fact.Fact{})
+	gob.Register(FactForm{})
+	gob.Register(fact.Comment{})
 
 	decoder.RegisterConverter(false, ConvertBool)
 
-	fyidb.ConnectDatabase("heyfyi")
+	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("./media/templates/*")) //this initializes the template engine
 
-	store = sessions.NewCookieStore([]byte(cookieStoreSalt))
+	//the in-memory storage is seeded with the same test account and fact as a new database
+	if databaseUrl == MemoryDatabaseUrl {
+		log.Println("Using in-memory storage. Nothing will be saved when the server stops.")
+		storage = memdb.NewDemoStorage()
+	} else {
+		fyidb.ConnectDatabase(databaseUrl)
+		storage = &fyidb.DbStorage
+	}
 
-	router := initRouter()
+	if OidcConfig.Issuer != "" {
+		p, err := oidc.NewProvider(OidcConfig)
+		if err != nil {
+			log.Fatalln("Error setting up the OpenID Connect provider:", err.Error())
+		}
+		oidcProvider = p
+		log.Println("People can sign in with " + OidcProviderName + " (" + p.Issuer + ").")
+	}
+
+	router := NewRouter(storage, cookieStoreSalt)
 
 	go BackgroundVoteGiver()
+	if LinkCheckInterval > 0 {
+		go BackgroundLinkChecker(linkcheck.NewChecker())
+	}
 
 	log.Println("Server running at " + serverAddress)
 	if err := http.ListenAndServe(serverAddress, router); err != nil {
@@ -46,6 +93,15 @@ func StartServer(serverAddress string, cookieStoreSalt string) {
 	}
 }
 
+//Returns the server's router, which keeps its data in s and signs its cookies with cookieStoreSalt. It is what
+//StartServer serves, and can be served by itself (eg with httptest) to test against the real server, though pages can't
+//be shown unless StartServer has loaded the templates. There is only one storage, so only one router can be used at once
+func NewRouter(s AnyStorer, cookieStoreSalt string) http.Handler {
+	storage = s
+	store = sessions.NewCookieStore([]byte(cookieStoreSalt))
+	return initRouter()
+}
+
 func ConvertBool(value string) reflect.Value {
 	if value == "on" {
 		return reflect.ValueOf(true)
@@ -66,7 +122,26 @@ func ReturnJSON(rw web.ResponseWriter, object interface{}) {
 }
 
 func BackgroundVoteGiver() {
-	fyidb.DbStorage.GiveOneVoteToAllAccounts()
+	err := storage.Audited(&audit.AuditEvent{Action: audit.GiveVotes, TargetType: audit.TargetAccount}, func(tx interface{}) error {
+		return tx.(AnyStorer).GiveOneVoteToAllAccounts()
+	})
+	if err != nil {
+		log.Println("Error giving votes:", err.Error())
+	}
 	time.Sleep(3600 * time.Second)
 	BackgroundVoteGiver()
 }
+
+//Checks the links of the references that are due to be checked every LinkCheckInterval
+func BackgroundLinkChecker(checker *linkcheck.Checker) {
+	for {
+		checked, err := checker.Run(storage, linkCheckBatch, linkRecheckAfter)
+		if err != nil {
+			log.Println("Error checking reference links:", err.Error())
+		}
+		if checked > 0 {
+			log.Printf("Checked %d reference links.\n", checked)
+		}
+		time.Sleep(LinkCheckInterval)
+	}
+}
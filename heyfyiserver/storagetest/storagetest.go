@@ -0,0 +1,1552 @@
+//Package storagetest contains a conformance test suite shared by every storage backend (fyidb, memdb),
+//so that they can be shown to behave identically.
+package storagetest
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
+	"github.com/kiwih/heyfyi/heyfyiserver/linkcheck"
+	"github.com/kiwih/nullables"
+)
+
+//Storer is everything that the server needs from a storage backend (it matches heyfyiserver.AnyStorer,
+//which can't be imported here without an import cycle)
+type Storer interface {
+	account.AccountStorer
+	account.LoginThrottleStorer
+	account.ExternalIdentityStorer
+	account.ApiTokenStorer
+	fact.FactStorer
+	linkcheck.LinkStorer
+	audit.AuditStorer
+	GiveOneVoteToAllAccounts() error
+	CastVote(accountId int64, factId int64, up bool) (*fact.Vote, *account.Account, error)
+}
+
+//TestStorer runs every conformance test against a new, empty Storer made by newStorer
+func TestStorer(t *testing.T, newStorer func(t *testing.T) Storer) {
+	tests := []struct {
+		Name string
+		Test func(t *testing.T, s Storer)
+	}{
+		{"Accounts", testAccounts},
+		{"ListAccounts", testListAccounts},
+		{"Sessions", testSessions},
+		{"LoginThrottles", testLoginThrottles},
+		{"LoginThrottlesConcurrently", testLoginThrottlesConcurrently},
+		{"ExternalIdentities", testExternalIdentities},
+		{"ApiTokens", testApiTokens},
+		{"Facts", testFacts},
+		{"Votes", testVotes},
+		{"Moderation", testModeration},
+		{"ModerationDecisions", testModerationDecisions},
+		{"ListFacts", testListFacts},
+		{"ListFactsPages", testListFactsPages},
+		{"ListFactsSorts", testListFactsSorts},
+		{"ListFactsFilters", testListFactsFilters},
+		{"SearchFacts", testSearchFacts},
+		{"EditFact", testEditFact},
+		{"Tags", testTags},
+		{"MergeAndRenameTags", testMergeAndRenameTags},
+		{"Comments", testComments},
+		{"LinkChecks", testLinkChecks},
+		{"GiveOneVoteToAllAccounts", testGiveOneVoteToAllAccounts},
+		{"CastVote", testCastVote},
+		{"CastVoteConcurrently", testCastVoteConcurrently},
+		{"CastVoteCannotOverspend", testCastVoteCannotOverspend},
+		{"AuditEvents", testAuditEvents},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			test.Test(t, newStorer(t))
+		})
+	}
+}
+
+func makeAccount(t *testing.T, s Storer, email string) *account.Account {
+	a := &account.Account{
+		Email:    email,
+		Nickname: "Test account",
+		Password: "not a real hash",
+		VoteBank: 10,
+		Role:     account.RoleMember,
+	}
+	if err := s.CreateAccount(a); err != nil {
+		t.Fatal("Could not create account: ", err)
+	}
+	if a.Id == 0 {
+		t.Fatal("CreateAccount did not assign an Id")
+	}
+	return a
+}
+
+func makeFact(t *testing.T, s Storer, accountId int64) *fact.Fact {
+	f := &fact.Fact{
+		Fact:           "This is the fact string",
+		Explain:        "This is the explain string",
+		ExplainFurther: "This is the explain further string",
+		AccountId:      accountId,
+		References: []fact.Reference{
+			fact.Reference{Url: "http://example.com/1", Publisher: "example publisher", Title: "example title 1"},
+			fact.Reference{Url: "http://example.com/2", Publisher: "example publisher", Title: "example title 2"},
+		},
+	}
+	if err := s.CreateFact(f); err != nil {
+		t.Fatal("Could not create fact: ", err)
+	}
+	if f.Id == 0 {
+		t.Fatal("CreateFact did not assign an Id")
+	}
+	return f
+}
+
+func testAccounts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+	if a.Id == b.Id {
+		t.Fatal("Two accounts were given the same Id")
+	}
+
+	if err := s.CreateAccount(&account.Account{Email: "test@test", Nickname: "Duplicate"}); err == nil {
+		t.Fatal("Account with a duplicate email was created")
+	}
+
+	loaded, err := s.LoadAccountFromEmail("test@test")
+	if err != nil || loaded.Id != a.Id || loaded.Nickname != a.Nickname || loaded.VoteBank != 10 {
+		t.Fatalf("LoadAccountFromEmail did not return the account, got %+v, %v", loaded, err)
+	}
+
+	if _, err := s.LoadAccountFromEmail("not_test@test"); err == nil || err.Error() != gorm.ErrRecordNotFound.Error() {
+		t.Fatal("LoadAccountFromEmail of a missing account did not return ErrRecordNotFound, got ", err)
+	}
+
+	loaded, err = s.LoadAccountFromId(b.Id)
+	if err != nil || loaded.Email != "other@test" {
+		t.Fatalf("LoadAccountFromId did not return the account, got %+v, %v", loaded, err)
+	}
+
+	if _, err := s.LoadAccountFromId(b.Id + 100); err == nil {
+		t.Fatal("LoadAccountFromId of a missing account did not return an error")
+	}
+
+	loaded.VoteBank = 3
+	loaded.VerificationCode = nullables.NullString{String: "code", Valid: true}
+	issued := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	loaded.VerificationCodeIssuedAt = nullables.NullTime{Time: issued, Valid: true}
+	if err := s.SaveAccount(loaded); err != nil {
+		t.Fatal("SaveAccount failed: ", err)
+	}
+
+	//changes to the returned account must not be visible until they are saved
+	loaded.VoteBank = 5
+
+	reloaded, err := s.LoadAccountFromId(b.Id)
+	if err != nil || reloaded.VoteBank != 3 || reloaded.VerificationCode.String != "code" || !reloaded.VerificationCode.Valid || !reloaded.VerificationCodeIssuedAt.Time.Equal(issued) {
+		t.Fatalf("SaveAccount did not save the account, got %+v, %v", reloaded, err)
+	}
+
+	if err := reloaded.BeginTwoFactorSetup(s); err != nil {
+		t.Fatal("BeginTwoFactorSetup failed: ", err)
+	}
+	now := time.Now()
+	code, _ := account.TotpCode(reloaded.TotpSecret.String, now)
+	if _, err := reloaded.EnableTwoFactor(s, code, now); err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+	reloaded, err = s.LoadAccountFromId(b.Id)
+	if err != nil || !reloaded.TwoFactorEnabled() || reloaded.TotpLastStep == 0 || reloaded.RecoveryCodesLeft() != account.RecoveryCodeCount {
+		t.Fatalf("SaveAccount did not save two factor authentication, got %+v, %v", reloaded, err)
+	}
+
+	c := makeAccount(t, s, "another@test")
+	for _, changed := range []*account.Account{c, reloaded} {
+		changed.Role = account.RoleModerator
+		if err := s.SaveAccount(changed); err != nil {
+			t.Fatal("SaveAccount failed: ", err)
+		}
+	}
+	moderators, err := s.ListAccountsWithRole(account.RoleModerator)
+	if err != nil || len(moderators) != 2 || moderators[0].Id != c.Id || moderators[1].Id != b.Id || moderators[1].Role != account.RoleModerator {
+		t.Fatalf("ListAccountsWithRole did not return the moderators in order of email address, got %+v, %v", moderators, err)
+	}
+	if admins, err := s.ListAccountsWithRole(account.RoleAdmin); err != nil || len(admins) != 0 {
+		t.Fatalf("ListAccountsWithRole returned admins when there aren't any, got %+v, %v", admins, err)
+	}
+}
+
+func testListAccounts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "alice@test")
+	b := makeAccount(t, s, "bob@test")
+	b.Nickname = "Alicia"
+	b.Banned = true
+	b.SuspensionReason = "Spamming"
+	if err := s.SaveAccount(b); err != nil {
+		t.Fatal("SaveAccount failed: ", err)
+	}
+	makeAccount(t, s, "carol@test")
+
+	makeFact(t, s, a.Id)
+	f := makeFact(t, s, a.Id)
+	deleted := makeFact(t, s, a.Id)
+	if err := s.DeleteFact(deleted); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+	for _, up := range []bool{true, true, false} {
+		if _, _, err := s.CastVote(a.Id, f.Id, up); err != nil {
+			t.Fatal("CastVote failed: ", err)
+		}
+	}
+	if _, _, err := s.CastVote(a.Id, deleted.Id, false); err != nil {
+		t.Fatal("CastVote failed: ", err)
+	}
+
+	page, err := s.ListAccounts(account.AccountQuery{})
+	if err != nil || page.Total != 3 || len(page.Accounts) != 3 || page.Query.PageSize != account.DefaultAccountPageSize {
+		t.Fatalf("ListAccounts did not list every account, got %+v, %v", page, err)
+	}
+	alice := page.Accounts[0]
+	if alice.Id != a.Id || alice.FactsSubmitted != 2 || alice.VotesCast != 2 {
+		t.Fatalf("ListAccounts did not count the account's facts and votes, got %+v", alice)
+	}
+	if page.Accounts[1].Id != b.Id || !page.Accounts[1].Banned || page.Accounts[1].FactsSubmitted != 0 || page.Accounts[2].Email != "carol@test" {
+		t.Fatalf("ListAccounts did not list the accounts in order of email address, got %+v", page.Accounts)
+	}
+
+	//searches match either the email address or the nickname, ignoring case
+	page, err = s.ListAccounts(account.AccountQuery{Search: " ALI "})
+	if err != nil || page.Total != 2 || len(page.Accounts) != 2 || page.Accounts[0].Id != a.Id || page.Accounts[1].Id != b.Id {
+		t.Fatalf("ListAccounts did not search, got %+v, %v", page, err)
+	}
+
+	page, err = s.ListAccounts(account.AccountQuery{Page: 2, PageSize: 2})
+	if err != nil || page.Total != 3 || len(page.Accounts) != 1 || page.Accounts[0].Email != "carol@test" || page.HasNext() {
+		t.Fatalf("ListAccounts did not return the second page, got %+v, %v", page, err)
+	}
+}
+
+func testSessions(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	other := makeAccount(t, s, "other@test")
+	now := time.Now()
+
+	if _, _, err := s.LoadAccountFromSession(account.HashSessionToken("some_token")); err == nil {
+		t.Fatal("LoadAccountFromSession found an account without any sessions")
+	}
+
+	makeSession := func(a *account.Account, token string, lastSeen time.Time, expires time.Time) *account.Session {
+		session := &account.Session{
+			AccountId:  a.Id,
+			TokenHash:  account.HashSessionToken(token),
+			UserAgent:  "Test browser",
+			Ip:         "203.0.113.1",
+			CreatedAt:  nullables.NullTime{Time: lastSeen, Valid: true},
+			LastSeenAt: nullables.NullTime{Time: lastSeen, Valid: true},
+			ExpiresAt:  nullables.NullTime{Time: expires, Valid: true},
+		}
+		if err := s.CreateSession(session); err != nil || session.Id == 0 {
+			t.Fatal("CreateSession failed: ", err)
+		}
+		return session
+	}
+	laptop := makeSession(a, "laptop_token", now.Add(-time.Hour), now.Add(time.Hour))
+	phone := makeSession(a, "phone_token", now.Add(-time.Minute), now.Add(time.Hour))
+	expired := makeSession(a, "expired_token", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	otherSession := makeSession(other, "other_token", now, now.Add(time.Hour))
+
+	loaded, session, err := s.LoadAccountFromSession(account.HashSessionToken("laptop_token"))
+	if err != nil || loaded.Id != a.Id || session.Id != laptop.Id || session.UserAgent != "Test browser" {
+		t.Fatalf("LoadAccountFromSession did not return the account and session, got %+v, %+v, %v", loaded, session, err)
+	}
+
+	laptop.LastSeenAt = nullables.NullTime{Time: now, Valid: true}
+	laptop.Ip = "203.0.113.2"
+	if err := s.SaveSession(laptop); err != nil {
+		t.Fatal("SaveSession failed: ", err)
+	}
+	if _, session, _ := s.LoadAccountFromSession(laptop.TokenHash); session.Ip != "203.0.113.2" || !session.LastSeenAt.Time.Equal(laptop.LastSeenAt.Time) {
+		t.Fatalf("SaveSession did not save when and where the session was seen, got %+v", session)
+	}
+
+	sessions, err := s.ListSessions(a.Id)
+	if err != nil || len(sessions) != 3 || sessions[0].Id != laptop.Id || sessions[1].Id != phone.Id || sessions[2].Id != expired.Id {
+		t.Fatalf("ListSessions did not return the account's sessions most recently seen first, got %+v, %v", sessions, err)
+	}
+
+	if err := s.DeleteExpiredSessions(a.Id, now); err != nil {
+		t.Fatal("DeleteExpiredSessions failed: ", err)
+	}
+	if _, _, err := s.LoadAccountFromSession(expired.TokenHash); err == nil {
+		t.Fatal("DeleteExpiredSessions did not delete the expired session")
+	}
+
+	if err := s.DeleteSession(a.Id, otherSession.Id); err != account.SessionNotFound {
+		t.Fatal("DeleteSession deleted another account's session, got ", err)
+	}
+	if err := s.DeleteSession(a.Id, phone.Id); err != nil {
+		t.Fatal("DeleteSession failed: ", err)
+	}
+	if _, _, err := s.LoadAccountFromSession(phone.TokenHash); err == nil {
+		t.Fatal("DeleteSession did not delete the session")
+	}
+	if _, _, err := s.LoadAccountFromSession(laptop.TokenHash); err != nil {
+		t.Fatal("DeleteSession deleted the wrong session: ", err)
+	}
+
+	if err := s.DeleteAllSessions(a.Id); err != nil {
+		t.Fatal("DeleteAllSessions failed: ", err)
+	}
+	if sessions, err := s.ListSessions(a.Id); err != nil || len(sessions) != 0 {
+		t.Fatalf("DeleteAllSessions left %+v, %v", sessions, err)
+	}
+	if _, _, err := s.LoadAccountFromSession(otherSession.TokenHash); err != nil {
+		t.Fatal("DeleteAllSessions deleted another account's session: ", err)
+	}
+}
+
+func testLoginThrottles(t *testing.T, s Storer) {
+	now := time.Now()
+	key := account.EmailThrottleKey("test@test")
+
+	if _, err := s.LoadLoginThrottle(key); err == nil {
+		t.Fatal("LoadLoginThrottle found a throttle before any failures")
+	}
+	for i := 1; i <= 3; i++ {
+		throttle, err := s.RecordLoginFailure(key, now, now.Add(-time.Hour))
+		if err != nil || throttle.Failures != i || throttle.ThrottleKey != key || !throttle.LastFailureAt.Time.Equal(now) {
+			t.Fatalf("RecordLoginFailure did not count failure %d, got %+v, %v", i, throttle, err)
+		}
+	}
+	other, err := s.RecordLoginFailure(account.IpThrottleKey("203.0.113.1"), now, now.Add(-time.Hour))
+	if err != nil || other.Failures != 1 {
+		t.Fatalf("RecordLoginFailure counted failures for the wrong key, got %+v, %v", other, err)
+	}
+
+	throttle, _ := s.LoadLoginThrottle(key)
+	throttle.BlockedUntil = nullables.NullTime{Time: now.Add(time.Hour), Valid: true}
+	throttle.LockedOut = true
+	if err := s.SaveLoginThrottle(throttle); err != nil {
+		t.Fatal("SaveLoginThrottle failed: ", err)
+	}
+	if loaded, err := s.LoadLoginThrottle(key); err != nil || !loaded.LockedOut || !loaded.BlockedUntil.Time.Equal(throttle.BlockedUntil.Time) || loaded.Failures != 3 {
+		t.Fatalf("SaveLoginThrottle did not save the lock, got %+v, %v", loaded, err)
+	}
+
+	locked, err := s.ListLockedLoginThrottles(now)
+	if err != nil || len(locked) != 1 || locked[0].ThrottleKey != key {
+		t.Fatalf("ListLockedLoginThrottles did not return the locked throttle, got %+v, %v", locked, err)
+	}
+	if locked, err := s.ListLockedLoginThrottles(now.Add(2 * time.Hour)); err != nil || len(locked) != 0 {
+		t.Fatalf("ListLockedLoginThrottles returned a throttle that has been unlocked, got %+v, %v", locked, err)
+	}
+
+	//once the last failure is old enough, the failures (and the lock) are forgotten
+	later := now.Add(2 * time.Hour)
+	throttle, err = s.RecordLoginFailure(key, later, later.Add(-time.Hour))
+	if err != nil || throttle.Failures != 1 || throttle.LockedOut || throttle.BlockedUntil.Valid {
+		t.Fatalf("RecordLoginFailure did not forget the old failures, got %+v, %v", throttle, err)
+	}
+
+	if err := s.DeleteLoginThrottle(key); err != nil {
+		t.Fatal("DeleteLoginThrottle failed: ", err)
+	}
+	if _, err := s.LoadLoginThrottle(key); err == nil {
+		t.Fatal("DeleteLoginThrottle did not delete the throttle")
+	}
+	if _, err := s.LoadLoginThrottle(other.ThrottleKey); err != nil {
+		t.Fatal("DeleteLoginThrottle deleted the wrong throttle: ", err)
+	}
+}
+
+//failures recorded at the same time (as they could be by different servers) must all be counted
+func testLoginThrottlesConcurrently(t *testing.T, s Storer) {
+	now := time.Now()
+	key := account.EmailThrottleKey("test@test")
+	if _, err := s.RecordLoginFailure(key, now, now.Add(-time.Hour)); err != nil {
+		t.Fatal("RecordLoginFailure failed: ", err)
+	}
+
+	const failures = 10
+	var wg sync.WaitGroup
+	for i := 0; i < failures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.RecordLoginFailure(key, now, now.Add(-time.Hour)); err != nil {
+				t.Error("RecordLoginFailure failed: ", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if throttle, err := s.LoadLoginThrottle(key); err != nil || throttle.Failures != failures+1 {
+		t.Fatalf("Failures recorded at the same time were lost, got %+v, %v", throttle, err)
+	}
+}
+
+func testExternalIdentities(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	now := time.Now()
+
+	if _, err := s.LoadExternalIdentity("https://login.test", "abc"); err == nil {
+		t.Fatal("LoadExternalIdentity found an identity before any were made")
+	}
+	identity := &account.ExternalIdentity{
+		AccountId:  a.Id,
+		Issuer:     "https://login.test",
+		Subject:    "abc",
+		Email:      "test@test",
+		CreatedAt:  nullables.NullTime{Time: now, Valid: true},
+		LastUsedAt: nullables.NullTime{Time: now, Valid: true},
+	}
+	if err := s.CreateExternalIdentity(identity); err != nil || identity.Id == 0 {
+		t.Fatal("CreateExternalIdentity failed: ", err)
+	}
+	if err := s.CreateExternalIdentity(&account.ExternalIdentity{AccountId: a.Id, Issuer: "https://login.test", Subject: "abc"}); err == nil {
+		t.Fatal("CreateExternalIdentity made a second identity with the same issuer and subject")
+	}
+	//the same subject at another provider is someone else
+	if err := s.CreateExternalIdentity(&account.ExternalIdentity{AccountId: a.Id, Issuer: "https://other.test", Subject: "abc"}); err != nil {
+		t.Fatal("CreateExternalIdentity failed: ", err)
+	}
+
+	identity.LastUsedAt = nullables.NullTime{Time: now.Add(time.Hour), Valid: true}
+	if err := s.SaveExternalIdentity(identity); err != nil {
+		t.Fatal("SaveExternalIdentity failed: ", err)
+	}
+	loaded, err := s.LoadExternalIdentity("https://login.test", "abc")
+	if err != nil || loaded.Id != identity.Id || loaded.AccountId != a.Id || loaded.Email != "test@test" || !loaded.LastUsedAt.Time.Equal(identity.LastUsedAt.Time) {
+		t.Fatalf("LoadExternalIdentity did not return the saved identity, got %+v, %v", loaded, err)
+	}
+}
+
+func testApiTokens(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	other := makeAccount(t, s, "other@test")
+	now := time.Now()
+
+	if _, err := s.LoadApiToken(account.HashSessionToken("hfy_token")); err == nil {
+		t.Fatal("LoadApiToken found a token before any were made")
+	}
+
+	makeToken := func(a *account.Account, token string, created time.Time) *account.ApiToken {
+		apiToken := &account.ApiToken{
+			AccountId: a.Id,
+			Name:      "Test bot",
+			TokenHash: account.HashSessionToken(token),
+			Prefix:    token[:8],
+			Scopes:    "read,vote",
+			CreatedAt: nullables.NullTime{Time: created, Valid: true},
+			ExpiresAt: nullables.NullTime{Time: created.Add(time.Hour), Valid: true},
+		}
+		if err := s.CreateApiToken(apiToken); err != nil || apiToken.Id == 0 {
+			t.Fatal("CreateApiToken failed: ", err)
+		}
+		return apiToken
+	}
+	older := makeToken(a, "hfy_older_token", now.Add(-time.Hour))
+	newer := makeToken(a, "hfy_newer_token", now)
+	otherToken := makeToken(other, "hfy_other_token", now)
+
+	if err := s.CreateApiToken(&account.ApiToken{AccountId: a.Id, TokenHash: older.TokenHash}); err == nil {
+		t.Fatal("CreateApiToken made a second token with the same hash")
+	}
+
+	loaded, err := s.LoadApiToken(older.TokenHash)
+	if err != nil || loaded.Id != older.Id || loaded.AccountId != a.Id || loaded.Name != "Test bot" || loaded.Scopes != "read,vote" {
+		t.Fatalf("LoadApiToken did not return the token, got %+v, %v", loaded, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		older.LastUsedAt = nullables.NullTime{Time: now.Add(time.Duration(i) * time.Minute), Valid: true}
+		older.LastUsedIp = "203.0.113.2"
+		if err := s.RecordApiTokenUse(older); err != nil {
+			t.Fatal("RecordApiTokenUse failed: ", err)
+		}
+	}
+	loaded, _ = s.LoadApiToken(older.TokenHash)
+	if loaded.Uses != 2 || loaded.LastUsedIp != "203.0.113.2" || !loaded.LastUsedAt.Time.Equal(older.LastUsedAt.Time) {
+		t.Fatalf("RecordApiTokenUse did not record the uses, got %+v", loaded)
+	}
+
+	tokens, err := s.ListApiTokens(a.Id)
+	if err != nil || len(tokens) != 2 || tokens[0].Id != newer.Id || tokens[1].Id != older.Id {
+		t.Fatalf("ListApiTokens did not return the account's tokens newest first, got %+v, %v", tokens, err)
+	}
+
+	if err := s.DeleteApiToken(a.Id, otherToken.Id); err != account.ApiTokenNotFound {
+		t.Fatal("DeleteApiToken deleted another account's token, got ", err)
+	}
+	if err := s.DeleteApiToken(a.Id, older.Id); err != nil {
+		t.Fatal("DeleteApiToken failed: ", err)
+	}
+	if _, err := s.LoadApiToken(older.TokenHash); err == nil {
+		t.Fatal("DeleteApiToken did not delete the token")
+	}
+	if err := s.DeleteApiToken(a.Id, older.Id); err != account.ApiTokenNotFound {
+		t.Fatal("DeleteApiToken deleted a token twice, got ", err)
+	}
+	if _, err := s.LoadApiToken(otherToken.TokenHash); err != nil {
+		t.Fatal("DeleteApiToken deleted the wrong token: ", err)
+	}
+}
+
+func testFacts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+
+	if !f.AwaitModeration {
+		t.Fatal("CreateFact did not mark the fact as awaiting moderation")
+	}
+
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil {
+		t.Fatal("LoadFactFromId failed: ", err)
+	}
+	if loaded.Fact != f.Fact || loaded.Explain != f.Explain || loaded.ExplainFurther != f.ExplainFurther || loaded.AccountId != a.Id || !loaded.AwaitModeration {
+		t.Fatalf("LoadFactFromId did not return the fact, got %+v", loaded)
+	}
+	if len(loaded.References) != 2 {
+		t.Fatalf("LoadFactFromId did not load the references, got %+v", loaded.References)
+	}
+	for i, r := range loaded.References {
+		if r.Id == 0 || r.FactId != f.Id || r.Url != f.References[i].Url || r.Title != f.References[i].Title {
+			t.Fatalf("Reference %d was not stored correctly, got %+v", i, r)
+		}
+	}
+	if len(loaded.Votes) != 0 {
+		t.Fatalf("LoadFactFromId loaded votes that were never cast, got %+v", loaded.Votes)
+	}
+
+	if _, err := s.LoadFactFromId(f.Id + 100); err == nil {
+		t.Fatal("LoadFactFromId of a missing fact did not return an error")
+	}
+
+	if err := s.DeleteFact(loaded); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+
+	if _, err := s.LoadFactFromId(f.Id); err == nil {
+		t.Fatal("LoadFactFromId returned a deleted fact")
+	}
+}
+
+func testVotes(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+	f := makeFact(t, s, a.Id)
+
+	v, err := s.GetVoteForFact(a.Id, f.Id)
+	if err != nil || v.Id == 0 || v.AccountId != a.Id || v.FactId != f.Id || v.Score != 0 {
+		t.Fatalf("GetVoteForFact did not create an empty vote, got %+v, %v", v, err)
+	}
+
+	v.Score = 2
+	if err := s.SaveVote(v); err != nil {
+		t.Fatal("SaveVote failed: ", err)
+	}
+
+	again, err := s.GetVoteForFact(a.Id, f.Id)
+	if err != nil || again.Id != v.Id || again.Score != 2 {
+		t.Fatalf("GetVoteForFact did not return the saved vote, got %+v, %v", again, err)
+	}
+
+	if _, err := fact.VoteForFact(s, b.Id, f.Id, false); err != nil {
+		t.Fatal("VoteForFact failed: ", err)
+	}
+
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil {
+		t.Fatal("LoadFactFromId failed: ", err)
+	}
+	if len(loaded.Votes) != 2 {
+		t.Fatalf("LoadFactFromId did not load both votes, got %+v", loaded.Votes)
+	}
+	if score := loaded.GetScore(a.Id); score.Ups != 2 || score.Downs != 1 || score.AccountVote != 2 {
+		t.Fatalf("Votes were not stored correctly, score is %+v", score)
+	}
+}
+
+func testModeration(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+
+	if err := s.ModerateFact(f, false); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+	if f.AwaitModeration {
+		t.Fatal("ModerateFact did not update the fact it was given")
+	}
+
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil || loaded.AwaitModeration || loaded.State() != fact.StateApproved {
+		t.Fatalf("ModerateFact did not save the fact, got %+v, %v", loaded, err)
+	}
+
+	if err := s.ModerateFact(loaded, true); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+
+	loaded, err = s.LoadFactFromId(f.Id)
+	if err != nil || !loaded.AwaitModeration || loaded.State() != fact.StatePending {
+		t.Fatalf("ModerateFact did not save the fact, got %+v, %v", loaded, err)
+	}
+}
+
+func testModerationDecisions(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	moderator := makeAccount(t, s, "moderator@test")
+	old := makeFact(t, s, a.Id)
+	rejected := makeFact(t, s, a.Id)
+	approved := makeFact(t, s, a.Id)
+
+	if loaded, err := s.LoadFactFromId(old.Id); err != nil || loaded.ModerationState != fact.StatePending {
+		t.Fatalf("CreateFact did not make the fact pending, got %+v, %v", loaded, err)
+	}
+
+	if _, err := fact.Moderate(s, rejected, moderator.Id, fact.DecisionReject, "Not a fact"); err != nil {
+		t.Fatal("Moderate failed: ", err)
+	}
+	if _, err := fact.Moderate(s, approved, moderator.Id, fact.DecisionApprove, "Well referenced"); err != nil {
+		t.Fatal("Moderate failed: ", err)
+	}
+	if _, err := fact.AddModerationNote(s, rejected, moderator.Id, "Posted twice before"); err != nil {
+		t.Fatal("AddModerationNote failed: ", err)
+	}
+
+	loaded, err := s.LoadFactFromId(rejected.Id)
+	if err != nil || loaded.ModerationState != fact.StateRejected || !loaded.AwaitModeration {
+		t.Fatalf("Moderate did not save the fact's state, got %+v, %v", loaded, err)
+	}
+	notes, err := s.ListModerationNotes(rejected.Id)
+	if err != nil || len(notes) != 2 {
+		t.Fatalf("ListModerationNotes returned %+v, %v", notes, err)
+	}
+	if notes[0].Decision != fact.DecisionReject || notes[0].Text != "Not a fact" || notes[0].AccountId != moderator.Id || !notes[0].CreatedAt.Valid {
+		t.Fatalf("ListModerationNotes returned the decision wrong: %+v", notes[0])
+	}
+	if notes[1].Decision != fact.DecisionNone || notes[1].Text != "Posted twice before" {
+		t.Fatalf("ListModerationNotes returned the note wrong: %+v", notes[1])
+	}
+	if notes, err := s.ListModerationNotes(old.Id); err != nil || len(notes) != 0 {
+		t.Fatalf("ListModerationNotes returned another fact's notes, got %+v, %v", notes, err)
+	}
+
+	if err := s.SaveModerationDecision(&fact.Fact{Id: approved.Id + 100}, &fact.ModerationNote{FactId: approved.Id + 100, Decision: fact.DecisionApprove}); err == nil {
+		t.Fatal("SaveModerationDecision of a missing fact did not return an error")
+	}
+	if err := s.CreateModerationNote(&fact.ModerationNote{FactId: approved.Id + 100, Text: "Missing"}); err == nil {
+		t.Fatal("CreateModerationNote for a missing fact did not return an error")
+	}
+
+	tests := []struct {
+		Name  string
+		Query fact.FactQuery
+		Facts []int64
+	}{
+		{"the queue", fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyPending, Sort: fact.SortOldest}, []int64{old.Id}},
+		{"rejected", fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyRejected}, []int64{rejected.Id}},
+		{"awaiting moderation", fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyAwaitModeration}, []int64{rejected.Id, old.Id}},
+		{"moderated", fact.FactQuery{Moderation: fact.OnlyModerated}, []int64{approved.Id}},
+	}
+	for _, test := range tests {
+		page, err := s.ListFacts(test.Query)
+		if err != nil || !sameIds(factIds(page.Facts), test.Facts...) {
+			t.Fatalf("ListFacts of %s returned %v, %v, expected %v", test.Name, factIds(page.Facts), err, test.Facts)
+		}
+	}
+}
+
+func factIds(facts []fact.Fact) []int64 {
+	ids := make([]int64, len(facts))
+	for i := range facts {
+		ids[i] = facts[i].Id
+	}
+	return ids
+}
+
+func sameIds(a []int64, b ...int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testListFacts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+
+	moderated := makeFact(t, s, a.Id)
+	if err := s.ModerateFact(moderated, false); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+	unmoderatedA := makeFact(t, s, a.Id)
+	unmoderatedB := makeFact(t, s, b.Id)
+	deleted := makeFact(t, s, a.Id)
+	if err := s.ModerateFact(deleted, false); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+	if err := s.DeleteFact(deleted); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+
+	//facts are listed newest first by default
+	page, err := s.ListFacts(fact.FactQuery{})
+	if err != nil || !sameIds(factIds(page.Facts), moderated.Id) || page.Total != 1 {
+		t.Fatalf("ListFacts for nobody returned %v, %v", factIds(page.Facts), err)
+	}
+
+	page, err = s.ListFacts(fact.FactQuery{ViewerId: a.Id})
+	if err != nil || !sameIds(factIds(page.Facts), unmoderatedA.Id, moderated.Id) || page.Total != 2 {
+		t.Fatalf("ListFacts for account A returned %v, %v", factIds(page.Facts), err)
+	}
+
+	page, err = s.ListFacts(fact.FactQuery{ViewerId: b.Id})
+	if err != nil || !sameIds(factIds(page.Facts), unmoderatedB.Id, moderated.Id) || page.Total != 2 {
+		t.Fatalf("ListFacts for account B returned %v, %v", factIds(page.Facts), err)
+	}
+
+	page, err = s.ListFacts(fact.FactQuery{ViewerId: a.Id, ViewUnmoderated: true})
+	if err != nil || !sameIds(factIds(page.Facts), unmoderatedB.Id, unmoderatedA.Id, moderated.Id) || page.Total != 3 {
+		t.Fatalf("ListFacts of unmoderated facts returned %v, %v", factIds(page.Facts), err)
+	}
+}
+
+func testListFactsPages(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		f := makeFact(t, s, a.Id)
+		if err := s.ModerateFact(f, false); err != nil {
+			t.Fatal("ModerateFact failed: ", err)
+		}
+		ids = append([]int64{f.Id}, ids...)
+	}
+
+	tests := []struct {
+		Page  int
+		Facts []int64
+	}{
+		{1, ids[0:2]},
+		{2, ids[2:4]},
+		{3, ids[4:5]},
+		{4, nil},
+	}
+
+	for _, test := range tests {
+		page, err := s.ListFacts(fact.FactQuery{Page: test.Page, PageSize: 2})
+		if err != nil || !sameIds(factIds(page.Facts), test.Facts...) {
+			t.Fatalf("ListFacts page %d returned %v, %v, expected %v", test.Page, factIds(page.Facts), err, test.Facts)
+		}
+		if page.Total != 5 || page.Pages() != 3 || page.Query.Page != test.Page {
+			t.Fatalf("ListFacts page %d returned %d facts in %d pages, expected 5 facts in 3 pages", test.Page, page.Total, page.Pages())
+		}
+	}
+
+	//the page size and page are clamped to sensible values
+	page, err := s.ListFacts(fact.FactQuery{Page: -1, PageSize: fact.MaxPageSize + 1})
+	if err != nil || page.Query.Page != 1 || page.Query.PageSize != fact.MaxPageSize || len(page.Facts) != 5 {
+		t.Fatalf("ListFacts with a bad page returned %+v, %v", page, err)
+	}
+}
+
+func testListFactsSorts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+
+	top := makeFact(t, s, a.Id)
+	controversial := makeFact(t, s, a.Id)
+	disliked := makeFact(t, s, a.Id)
+
+	votes := []struct {
+		AccountId int64
+		Fact      *fact.Fact
+		Up        bool
+	}{
+		{a.Id, top, true}, {a.Id, top, true}, {a.Id, top, true},
+		{a.Id, controversial, true}, {a.Id, controversial, true},
+		{b.Id, controversial, false}, {b.Id, controversial, false},
+		{b.Id, disliked, false},
+	}
+	for _, v := range votes {
+		if _, _, err := s.CastVote(v.AccountId, v.Fact.Id, v.Up); err != nil {
+			t.Fatal("CastVote failed: ", err)
+		}
+	}
+
+	tests := []struct {
+		Sort  fact.FactSort
+		Facts []int64
+	}{
+		{fact.SortNewest, []int64{disliked.Id, controversial.Id, top.Id}},
+		{fact.SortTop, []int64{top.Id, controversial.Id, disliked.Id}},
+		{fact.SortControversial, []int64{controversial.Id, top.Id, disliked.Id}},
+		{fact.SortOldest, []int64{top.Id, controversial.Id, disliked.Id}},
+		{"", []int64{disliked.Id, controversial.Id, top.Id}},
+	}
+
+	for _, test := range tests {
+		page, err := s.ListFacts(fact.FactQuery{ViewUnmoderated: true, Sort: test.Sort})
+		if err != nil || !sameIds(factIds(page.Facts), test.Facts...) {
+			t.Fatalf("ListFacts sorted by %q returned %v, %v, expected %v", test.Sort, factIds(page.Facts), err, test.Facts)
+		}
+	}
+}
+
+func testListFactsFilters(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+
+	first := makeFact(t, s, a.Id)
+	if err := s.ModerateFact(first, false); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+	second := makeFact(t, s, b.Id)
+	third := makeFact(t, s, a.Id)
+
+	//use the times the storage gave the facts, so the date range test is exact
+	var created []time.Time
+	for _, f := range []*fact.Fact{first, second, third} {
+		loaded, err := s.LoadFactFromId(f.Id)
+		if err != nil {
+			t.Fatal("LoadFactFromId failed: ", err)
+		}
+		created = append(created, loaded.CreatedAt.Time)
+	}
+	if !created[0].Before(created[1]) || !created[1].Before(created[2]) {
+		t.Fatalf("Facts were not given increasing creation times, got %v", created)
+	}
+
+	tests := []struct {
+		Name  string
+		Query fact.FactQuery
+		Facts []int64
+	}{
+		{"author", fact.FactQuery{ViewUnmoderated: true, AuthorId: a.Id}, []int64{third.Id, first.Id}},
+		{"moderated", fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyModerated}, []int64{first.Id}},
+		{"awaiting moderation", fact.FactQuery{ViewUnmoderated: true, Moderation: fact.OnlyAwaitModeration}, []int64{third.Id, second.Id}},
+		{"awaiting moderation without permission", fact.FactQuery{ViewerId: b.Id, Moderation: fact.OnlyAwaitModeration}, []int64{second.Id}},
+		{"created after", fact.FactQuery{ViewUnmoderated: true, CreatedAfter: created[1]}, []int64{third.Id, second.Id}},
+		{"created before", fact.FactQuery{ViewUnmoderated: true, CreatedBefore: created[1]}, []int64{first.Id}},
+		{"created between", fact.FactQuery{ViewUnmoderated: true, CreatedAfter: created[1], CreatedBefore: created[2]}, []int64{second.Id}},
+		{"author and moderation", fact.FactQuery{ViewUnmoderated: true, AuthorId: b.Id, Moderation: fact.OnlyModerated}, nil},
+	}
+
+	for _, test := range tests {
+		page, err := s.ListFacts(test.Query)
+		if err != nil || !sameIds(factIds(page.Facts), test.Facts...) || page.Total != int64(len(test.Facts)) {
+			t.Fatalf("ListFacts filtered by %s returned %v, %v, expected %v", test.Name, factIds(page.Facts), err, test.Facts)
+		}
+	}
+}
+
+func makeSearchableFact(t *testing.T, s Storer, accountId int64, factText string, explain string, referenceTitle string) *fact.Fact {
+	f := &fact.Fact{
+		Fact:           factText,
+		Explain:        explain,
+		ExplainFurther: "Nothing more to say",
+		AccountId:      accountId,
+		References: []fact.Reference{
+			fact.Reference{Url: "http://example.com/1", Publisher: "Example Publisher", Title: referenceTitle},
+			fact.Reference{Url: "http://example.com/2", Publisher: "Example Publisher", Title: "Another article"},
+		},
+	}
+	if err := s.CreateFact(f); err != nil {
+		t.Fatal("Could not create fact: ", err)
+	}
+	return f
+}
+
+func testSearchFacts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+
+	inFact := makeSearchableFact(t, s, a.Id, "The platypus is venomous", "Males have a spur on their hind legs", "Monotremes of Australia")
+	inReference := makeSearchableFact(t, s, a.Id, "Echidnas lay eggs", "They are monotremes too", "The platypus and the echidna")
+	inExplain := makeSearchableFact(t, s, b.Id, "Some mammals lay eggs", "The platypus is one of them", "Egg laying mammals")
+	deleted := makeSearchableFact(t, s, a.Id, "A deleted platypus fact", "This should never be found", "Deleted article")
+	unrelated := makeSearchableFact(t, s, a.Id, "Spiders are not insects", "They have eight legs", "Arachnids")
+	for _, f := range []*fact.Fact{inFact, inReference, deleted, unrelated} {
+		if err := s.ModerateFact(f, false); err != nil {
+			t.Fatal("ModerateFact failed: ", err)
+		}
+	}
+	if err := s.DeleteFact(deleted); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+
+	tests := []struct {
+		Name  string
+		Query fact.SearchQuery
+		Facts []int64
+	}{
+		{"nobody", fact.SearchQuery{Terms: "platypus"}, []int64{inFact.Id, inReference.Id}},
+		{"the author of an unmoderated fact", fact.SearchQuery{Terms: "platypus", ViewerId: b.Id}, []int64{inFact.Id, inExplain.Id, inReference.Id}},
+		{"someone else", fact.SearchQuery{Terms: "platypus", ViewerId: a.Id}, []int64{inFact.Id, inReference.Id}},
+		{"an admin", fact.SearchQuery{Terms: "platypus", ViewerId: a.Id, ViewUnmoderated: true}, []int64{inFact.Id, inExplain.Id, inReference.Id}},
+		{"upper case", fact.SearchQuery{Terms: "PLATYPUS"}, []int64{inFact.Id, inReference.Id}},
+		{"the start of a word", fact.SearchQuery{Terms: "platy"}, []int64{inFact.Id, inReference.Id}},
+		{"every term", fact.SearchQuery{Terms: "platypus, venomous!"}, []int64{inFact.Id}},
+		{"reference publishers", fact.SearchQuery{Terms: "publisher arachnids"}, []int64{unrelated.Id}},
+		{"no matches", fact.SearchQuery{Terms: "platypus spiders"}, nil},
+		{"no terms", fact.SearchQuery{Terms: " ?! "}, nil},
+		{"the second page", fact.SearchQuery{Terms: "platypus", Page: 2, PageSize: 1}, []int64{inReference.Id}},
+	}
+
+	for _, test := range tests {
+		page, err := s.SearchFacts(test.Query)
+		if err != nil {
+			t.Fatalf("SearchFacts for %s failed: %v", test.Name, err)
+		}
+		var ids []int64
+		for _, r := range page.Results {
+			ids = append(ids, r.FactId)
+		}
+		if !sameIds(ids, test.Facts...) {
+			t.Fatalf("SearchFacts for %s returned %v, expected %v", test.Name, ids, test.Facts)
+		}
+		if test.Query.Page == 0 && page.Total != int64(len(test.Facts)) {
+			t.Fatalf("SearchFacts for %s returned a total of %d, expected %d", test.Name, page.Total, len(test.Facts))
+		}
+	}
+
+	page, err := s.SearchFacts(fact.SearchQuery{Terms: "platypus"})
+	if err != nil || len(page.Results) == 0 {
+		t.Fatalf("SearchFacts failed: %+v, %v", page, err)
+	}
+	if page.Results[0].Fact != "The <mark>platypus</mark> is venomous" {
+		t.Fatalf("SearchFacts did not highlight the fact, got %q", page.Results[0].Fact)
+	}
+	if page.Results[1].Snippet != "The <mark>platypus</mark> and the echidna Example Publisher Another article Example Publisher" {
+		t.Fatalf("SearchFacts did not highlight the snippet, got %q", page.Results[1].Snippet)
+	}
+}
+
+func testEditFact(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	admin := makeAccount(t, s, "admin@test")
+	f := makeSearchableFact(t, s, a.Id, "The platypus is venomous", "Males have a spur", "Monotremes of Australia")
+	if _, _, err := s.CastVote(a.Id, f.Id, true); err != nil {
+		t.Fatal("CastVote failed: ", err)
+	}
+
+	edited, err := s.LoadFactFromId(f.Id)
+	if err != nil {
+		t.Fatal("LoadFactFromId failed: ", err)
+	}
+	edited.Fact = "The male platypus is venomous"
+	edited.References = []fact.Reference{
+		fact.Reference{Url: "http://example.com/3", Publisher: "Another Publisher", Title: "Spurs of the echidna"},
+		fact.Reference{Url: "http://example.com/4", Publisher: "Another Publisher", Title: "Venom"},
+		fact.Reference{Url: "http://example.com/5", Publisher: "Another Publisher", Title: "Mammals"},
+	}
+	if err := s.EditFact(edited, a.Id, ""); err != nil {
+		t.Fatal("EditFact failed: ", err)
+	}
+
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil || loaded.Fact != "The male platypus is venomous" || loaded.Explain != "Males have a spur" || !loaded.EditedAt.Valid {
+		t.Fatalf("EditFact did not save the fact, got %+v, %v", loaded, err)
+	}
+	if len(loaded.References) != 3 || loaded.References[0].Title != "Spurs of the echidna" || loaded.References[0].FactId != f.Id {
+		t.Fatalf("EditFact did not replace the references, got %+v", loaded.References)
+	}
+	if loaded.GetScore(a.Id).AccountVote != 1 {
+		t.Fatalf("EditFact lost the fact's votes, got %+v", loaded.Votes)
+	}
+
+	//the search index is updated too
+	if page, err := s.SearchFacts(fact.SearchQuery{Terms: "monotremes", ViewUnmoderated: true}); err != nil || page.Total != 0 {
+		t.Fatalf("Search found the old version of an edited fact, got %+v, %v", page, err)
+	}
+	if page, err := s.SearchFacts(fact.SearchQuery{Terms: "echidna", ViewUnmoderated: true}); err != nil || page.Total != 1 {
+		t.Fatalf("Search did not find the new version of an edited fact, got %+v, %v", page, err)
+	}
+
+	revisions, err := s.ListFactRevisions(f.Id)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("ListFactRevisions did not return the two versions, got %+v, %v", revisions, err)
+	}
+	if revisions[0].Fact != "The platypus is venomous" || revisions[0].AccountId != a.Id || len(revisions[0].GetReferences()) != 2 {
+		t.Fatalf("The first revision was not the original fact, got %+v", revisions[0])
+	}
+	if revisions[1].Fact != "The male platypus is venomous" || len(revisions[1].GetReferences()) != 3 {
+		t.Fatalf("The second revision was not the edited fact, got %+v", revisions[1])
+	}
+
+	first, err := s.LoadFactRevision(revisions[0].Id)
+	if err != nil || first.Fact != revisions[0].Fact || first.FactId != f.Id {
+		t.Fatalf("LoadFactRevision did not return the revision, got %+v, %v", first, err)
+	}
+
+	if err := fact.RollbackFact(s, loaded, first, admin.Id, "Rolled back"); err != nil {
+		t.Fatal("RollbackFact failed: ", err)
+	}
+	loaded, err = s.LoadFactFromId(f.Id)
+	if err != nil || loaded.Fact != "The platypus is venomous" || len(loaded.References) != 2 || loaded.References[0].Title != "Monotremes of Australia" {
+		t.Fatalf("RollbackFact did not restore the fact, got %+v, %v", loaded, err)
+	}
+	revisions, err = s.ListFactRevisions(f.Id)
+	if err != nil || len(revisions) != 3 || revisions[2].AccountId != admin.Id || revisions[2].Comment != "Rolled back" {
+		t.Fatalf("RollbackFact was not saved as a new revision, got %+v, %v", revisions, err)
+	}
+
+	if err := s.EditFact(&fact.Fact{Id: f.Id + 100, Fact: "Missing"}, a.Id, ""); err == nil {
+		t.Fatal("EditFact of a missing fact did not fail")
+	}
+}
+
+func tagNames(tags []fact.Tag) string {
+	var names []string
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func tagCounts(t *testing.T, s Storer) map[string]int64 {
+	tags, err := s.ListTags()
+	if err != nil {
+		t.Fatal("ListTags failed: ", err)
+	}
+	counts := make(map[string]int64)
+	for _, tag := range tags {
+		counts[tag.Name] = tag.Facts
+	}
+	return counts
+}
+
+func makeTaggedFact(t *testing.T, s Storer, accountId int64, tags ...string) *fact.Fact {
+	f := makeFact(t, s, accountId)
+	for _, name := range tags {
+		f.Tags = append(f.Tags, fact.Tag{Name: name})
+	}
+	f.Votes = nil
+	if err := s.EditFact(f, accountId, ""); err != nil {
+		t.Fatal("EditFact failed: ", err)
+	}
+	return f
+}
+
+func testTags(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+
+	f := &fact.Fact{
+		Fact:           "Tagged fact",
+		Explain:        "This is the explain string",
+		ExplainFurther: "This is the explain further string",
+		AccountId:      a.Id,
+		References: []fact.Reference{
+			fact.Reference{Url: "http://example.com/1", Publisher: "example publisher", Title: "example title 1"},
+			fact.Reference{Url: "http://example.com/2", Publisher: "example publisher", Title: "example title 2"},
+		},
+		Tags: []fact.Tag{{Name: "health"}, {Name: "animals"}},
+	}
+	if err := s.CreateFact(f); err != nil {
+		t.Fatal("CreateFact failed: ", err)
+	}
+	if f.Tags[0].Id == 0 || f.Tags[1].Id == 0 {
+		t.Fatalf("CreateFact did not assign the tags Ids, got %+v", f.Tags)
+	}
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil || tagNames(loaded.Tags) != "animals,health" {
+		t.Fatalf("LoadFactFromId did not return the tags in order, got %+v, %v", loaded, err)
+	}
+
+	//existing tags are reused
+	other := makeTaggedFact(t, s, a.Id, "animals", "history")
+	if other.Tags[0].Id != loaded.Tags[0].Id {
+		t.Fatalf("A new tag was made instead of reusing the existing one, got %+v and %+v", other.Tags, loaded.Tags)
+	}
+	animals, err := s.LoadTagFromName("animals")
+	if err != nil || animals.Id != other.Tags[0].Id {
+		t.Fatalf("LoadTagFromName did not return the tag, got %+v, %v", animals, err)
+	}
+	if _, err := s.LoadTagFromName("missing"); err == nil {
+		t.Fatal("LoadTagFromName of a missing tag did not fail")
+	}
+
+	//only moderated facts are counted
+	counts := tagCounts(t, s)
+	if len(counts) != 3 || counts["animals"] != 0 || counts["health"] != 0 {
+		t.Fatalf("ListTags counted facts awaiting moderation, got %v", counts)
+	}
+	if err := s.ModerateFact(f, false); err != nil {
+		t.Fatal("ModerateFact failed: ", err)
+	}
+	counts = tagCounts(t, s)
+	if counts["animals"] != 1 || counts["health"] != 1 || counts["history"] != 0 {
+		t.Fatalf("ListTags did not count the moderated fact, got %v", counts)
+	}
+
+	page, err := s.ListFacts(fact.FactQuery{Tag: "animals", ViewUnmoderated: true})
+	if err != nil || !sameIds(factIds(page.Facts), other.Id, f.Id) {
+		t.Fatalf("ListFacts did not filter by tag, got %+v, %v", page, err)
+	}
+	page, err = s.ListFacts(fact.FactQuery{Tag: "animals"})
+	if err != nil || !sameIds(factIds(page.Facts), f.Id) {
+		t.Fatalf("ListFacts by tag listed a fact awaiting moderation, got %+v, %v", page, err)
+	}
+	page, err = s.ListFacts(fact.FactQuery{Tag: "missing", ViewUnmoderated: true})
+	if err != nil || page.Total != 0 {
+		t.Fatalf("ListFacts by a missing tag listed facts, got %+v, %v", page, err)
+	}
+
+	//editing replaces the tags
+	loaded.Tags = []fact.Tag{{Name: "history"}}
+	if err := s.EditFact(loaded, a.Id, ""); err != nil {
+		t.Fatal("EditFact failed: ", err)
+	}
+	loaded, err = s.LoadFactFromId(f.Id)
+	if err != nil || tagNames(loaded.Tags) != "history" {
+		t.Fatalf("EditFact did not replace the tags, got %+v, %v", loaded, err)
+	}
+	page, err = s.ListFacts(fact.FactQuery{Tag: "health", ViewUnmoderated: true})
+	if err != nil || page.Total != 0 {
+		t.Fatalf("ListFacts listed a fact by a tag that was removed, got %+v, %v", page, err)
+	}
+
+	//deleted facts are not counted
+	if err := s.DeleteFact(loaded); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+	if counts := tagCounts(t, s); counts["history"] != 0 {
+		t.Fatalf("ListTags counted a deleted fact, got %v", counts)
+	}
+}
+
+func testMergeAndRenameTags(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	both := makeTaggedFact(t, s, a.Id, "tech", "technology")
+	tech := makeTaggedFact(t, s, a.Id, "tech")
+	technology := makeTaggedFact(t, s, a.Id, "technology", "myths")
+	for _, f := range []*fact.Fact{both, tech, technology} {
+		if err := s.ModerateFact(f, false); err != nil {
+			t.Fatal("ModerateFact failed: ", err)
+		}
+	}
+
+	from, _ := s.LoadTagFromName("tech")
+	into, _ := s.LoadTagFromName("technology")
+	if err := s.MergeTags(from, into); err != nil {
+		t.Fatal("MergeTags failed: ", err)
+	}
+	if _, err := s.LoadTagFromName("tech"); err == nil {
+		t.Fatal("MergeTags did not delete the merged tag")
+	}
+	counts := tagCounts(t, s)
+	if len(counts) != 2 || counts["technology"] != 3 || counts["myths"] != 1 {
+		t.Fatalf("MergeTags did not move the facts to the other tag, got %v", counts)
+	}
+	loaded, err := s.LoadFactFromId(both.Id)
+	if err != nil || tagNames(loaded.Tags) != "technology" {
+		t.Fatalf("MergeTags left a fact with the tag twice, got %+v, %v", loaded, err)
+	}
+	if err := s.MergeTags(from, into); err == nil {
+		t.Fatal("MergeTags of a deleted tag did not fail")
+	}
+
+	if err := s.RenameTag(into, "myths"); err != fact.TagNameTaken {
+		t.Fatal("TagNameTaken was not returned when renaming to an existing name, got ", err)
+	}
+	if err := s.RenameTag(into, "tech-myths"); err != nil || into.Name != "tech-myths" {
+		t.Fatalf("RenameTag failed, got %+v, %v", into, err)
+	}
+	page, err := s.ListFacts(fact.FactQuery{Tag: "tech-myths"})
+	if err != nil || page.Total != 3 {
+		t.Fatalf("ListFacts did not find the facts by the new tag name, got %+v, %v", page, err)
+	}
+	if err := s.RenameTag(&fact.Tag{Id: into.Id + 100}, "missing"); err == nil {
+		t.Fatal("RenameTag of a missing tag did not fail")
+	}
+}
+
+func testComments(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+	other := makeFact(t, s, a.Id)
+
+	first := &fact.Comment{FactId: f.Id, AccountId: a.Id, Text: "Is the second source reliable?"}
+	if err := fact.CreateComment(s, first); err != nil || first.Id == 0 || !first.CreatedAt.Valid {
+		t.Fatalf("CreateComment failed, got %+v, %v", first, err)
+	}
+	reply := &fact.Comment{FactId: f.Id, AccountId: a.Id, ParentId: first.Id, Text: "Yes"}
+	if err := fact.CreateComment(s, reply); err != nil {
+		t.Fatal("CreateComment of a reply failed: ", err)
+	}
+	if err := fact.CreateComment(s, &fact.Comment{FactId: other.Id, AccountId: a.Id, ParentId: first.Id, Text: "Wrong fact"}); err != fact.ReplyToMissingComment {
+		t.Fatal("ReplyToMissingComment was not returned for a reply to another fact's comment, got ", err)
+	}
+	if err := fact.CreateComment(s, &fact.Comment{FactId: other.Id, AccountId: a.Id, Text: "On the other fact"}); err != nil {
+		t.Fatal("CreateComment failed: ", err)
+	}
+
+	loaded, err := s.LoadCommentFromId(reply.Id)
+	if err != nil || loaded.Text != "Yes" || loaded.ParentId != first.Id || loaded.FactId != f.Id {
+		t.Fatalf("LoadCommentFromId did not return the comment, got %+v, %v", loaded, err)
+	}
+
+	if err := fact.EditComment(s, loaded, "Yes, it is peer reviewed", a.Id); err != nil {
+		t.Fatal("EditComment failed: ", err)
+	}
+	if err := s.HideComment(loaded, true); err != nil || !loaded.Hidden {
+		t.Fatal("HideComment failed: ", err)
+	}
+	loaded, err = s.LoadCommentFromId(reply.Id)
+	if err != nil || loaded.Text != "Yes, it is peer reviewed" || !loaded.EditedAt.Valid || !loaded.Hidden {
+		t.Fatalf("EditComment and HideComment were not saved, got %+v, %v", loaded, err)
+	}
+
+	if err := s.DeleteComment(first); err != nil {
+		t.Fatal("DeleteComment failed: ", err)
+	}
+	if _, err := s.LoadCommentFromId(first.Id); err == nil {
+		t.Fatal("LoadCommentFromId returned a deleted comment")
+	}
+	if err := fact.CreateComment(s, &fact.Comment{FactId: f.Id, AccountId: a.Id, ParentId: first.Id, Text: "Too late"}); err != fact.ReplyToMissingComment {
+		t.Fatal("ReplyToMissingComment was not returned for a reply to a deleted comment, got ", err)
+	}
+	if err := s.EditComment(first); err == nil {
+		t.Fatal("EditComment of a deleted comment did not fail")
+	}
+
+	//deleted comments are still listed, so that their replies stay in the thread
+	comments, err := s.ListComments(f.Id)
+	if err != nil || len(comments) != 2 || comments[0].Id != first.Id || !comments[0].DeletedAt.Valid || comments[1].Id != reply.Id {
+		t.Fatalf("ListComments did not return the fact's comments in order, got %+v, %v", comments, err)
+	}
+}
+
+func testLinkChecks(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+	g := makeFact(t, s, a.Id)
+	deleted := makeFact(t, s, a.Id)
+	if err := s.DeleteFact(deleted); err != nil {
+		t.Fatal("DeleteFact failed: ", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	//references that have never been checked are listed in order, without those on deleted facts
+	references, err := s.ListReferencesToCheck(now, 10)
+	if err != nil || len(references) != 4 || references[0].Id != f.References[0].Id || references[3].Id != g.References[1].Id {
+		t.Fatalf("ListReferencesToCheck did not return the unchecked references, got %+v, %v", references, err)
+	}
+
+	checks := []fact.Reference{f.References[0], f.References[1], g.References[0]}
+	checks[0].LinkStatus, checks[0].LinkCheckedAt = 200, nullables.NullTime{Time: now.Add(-2 * time.Hour), Valid: true}
+	checks[1].LinkStatus, checks[1].LinkFailures, checks[1].LinkFinalUrl = 404, 1, "http://example.com/moved"
+	checks[1].LinkCheckedAt = nullables.NullTime{Time: now.Add(-time.Hour), Valid: true}
+	checks[2].LinkError, checks[2].LinkFailures = "timeout", 3
+	checks[2].LinkCheckedAt = nullables.NullTime{Time: now, Valid: true}
+	for i := range checks {
+		if err := s.SaveLinkCheck(&checks[i]); err != nil {
+			t.Fatal("SaveLinkCheck failed: ", err)
+		}
+	}
+	if err := s.SaveLinkCheck(&fact.Reference{Id: 1000}); err == nil {
+		t.Fatal("SaveLinkCheck of a missing reference did not fail")
+	}
+
+	//then the ones checked longest ago
+	references, err = s.ListReferencesToCheck(now.Add(-30*time.Minute), 10)
+	if err != nil || len(references) != 3 || references[0].Id != g.References[1].Id || references[1].Id != f.References[0].Id || references[2].Id != f.References[1].Id {
+		t.Fatalf("ListReferencesToCheck did not return the references due to be checked in order, got %+v, %v", references, err)
+	}
+	if references, err = s.ListReferencesToCheck(now, 1); err != nil || len(references) != 1 || references[0].Id != g.References[1].Id {
+		t.Fatalf("ListReferencesToCheck did not limit the references, got %+v, %v", references, err)
+	}
+
+	broken, err := s.ListBrokenReferences()
+	if err != nil || len(broken) != 2 || broken[0].Id != f.References[1].Id || broken[1].Id != g.References[0].Id {
+		t.Fatalf("ListBrokenReferences did not return the broken references, got %+v, %v", broken, err)
+	}
+	if broken[0].LinkStatus != 404 || broken[0].LinkFinalUrl != "http://example.com/moved" || broken[0].LinkFailures != 1 || broken[1].LinkError != "timeout" {
+		t.Fatalf("SaveLinkCheck did not save the results, got %+v", broken)
+	}
+
+	loaded, err := s.LoadFactFromId(f.Id)
+	if err != nil || loaded.References[0].LinkStatus != 200 || !loaded.References[0].LinkCheckedAt.Valid || !loaded.References[1].LinkBroken() {
+		t.Fatalf("LoadFactFromId did not load the link check results, got %+v, %v", loaded, err)
+	}
+}
+
+func testGiveOneVoteToAllAccounts(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+	b.VoteBank = 0
+	if err := s.SaveAccount(b); err != nil {
+		t.Fatal("SaveAccount failed: ", err)
+	}
+
+	if err := s.GiveOneVoteToAllAccounts(); err != nil {
+		t.Fatal("GiveOneVoteToAllAccounts failed: ", err)
+	}
+
+	if loaded, err := s.LoadAccountFromId(a.Id); err != nil || loaded.VoteBank != 11 {
+		t.Fatalf("Account A was not given a vote, got %+v, %v", loaded, err)
+	}
+	if loaded, err := s.LoadAccountFromId(b.Id); err != nil || loaded.VoteBank != 1 {
+		t.Fatalf("Account B was not given a vote, got %+v, %v", loaded, err)
+	}
+}
+
+func testCastVote(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+	a.VoteBank = 2
+	if err := s.SaveAccount(a); err != nil {
+		t.Fatal("SaveAccount failed: ", err)
+	}
+
+	//each step is a vote, and the Score and VoteBank after it
+	steps := []struct {
+		Up       bool
+		Score    int64
+		VoteBank int64
+	}{
+		{true, 1, 1},   //casting an up vote
+		{true, 2, 0},   //casting another
+		{false, 1, 1},  //retracting one, which refunds it
+		{false, 0, 2},  //and the other
+		{false, -1, 1}, //casting a down vote
+	}
+
+	for i, step := range steps {
+		v, updated, err := s.CastVote(a.Id, f.Id, step.Up)
+		if err != nil {
+			t.Fatalf("CastVote step %d failed: %v", i, err)
+		}
+		if v.Score != step.Score || v.AccountId != a.Id || v.FactId != f.Id || updated.VoteBank != step.VoteBank || updated.Id != a.Id {
+			t.Fatalf("CastVote step %d returned vote %+v and vote bank %d, expected score %d and vote bank %d", i, v, updated.VoteBank, step.Score, step.VoteBank)
+		}
+	}
+
+	loaded, err := s.LoadAccountFromId(a.Id)
+	if err != nil || loaded.VoteBank != 1 {
+		t.Fatalf("CastVote did not save the vote bank, got %+v, %v", loaded, err)
+	}
+	loadedFact, err := s.LoadFactFromId(f.Id)
+	if err != nil || len(loadedFact.Votes) != 1 || loadedFact.GetScore(a.Id).AccountVote != -1 {
+		t.Fatalf("CastVote did not save exactly one vote, got %+v, %v", loadedFact, err)
+	}
+
+	//spending the last vote, then trying to spend one more
+	if _, _, err := s.CastVote(a.Id, f.Id, false); err != nil {
+		t.Fatal("CastVote failed: ", err)
+	}
+	if _, _, err := s.CastVote(a.Id, f.Id, false); err != account.NoVotesLeft {
+		t.Fatal("CastVote with an empty vote bank did not return NoVotesLeft, got ", err)
+	}
+
+	//which must not have changed anything
+	loaded, err = s.LoadAccountFromId(a.Id)
+	if err != nil || loaded.VoteBank != 0 {
+		t.Fatalf("Failed CastVote changed the vote bank, got %+v, %v", loaded, err)
+	}
+	if v, err := s.GetVoteForFact(a.Id, f.Id); err != nil || v.Score != -2 {
+		t.Fatalf("Failed CastVote changed the vote, got %+v, %v", v, err)
+	}
+}
+
+//the number of votes an account has in its bank plus the size of every vote it has cast never changes,
+//as casting a vote costs one and retracting a vote refunds it
+func votesHeld(t *testing.T, s Storer, accountId int64, facts ...*fact.Fact) int64 {
+	a, err := s.LoadAccountFromId(accountId)
+	if err != nil {
+		t.Fatal("LoadAccountFromId failed: ", err)
+	}
+	held := a.VoteBank
+	for _, f := range facts {
+		loaded, err := s.LoadFactFromId(f.Id)
+		if err != nil {
+			t.Fatal("LoadFactFromId failed: ", err)
+		}
+		score := loaded.GetScore(accountId).AccountVote
+		if score < 0 {
+			score = -score
+		}
+		held += score
+	}
+	return held
+}
+
+func testCastVoteConcurrently(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	b := makeAccount(t, s, "other@test")
+	f1 := makeFact(t, s, a.Id)
+	f2 := makeFact(t, s, a.Id)
+
+	const votesPerAccount = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*votesPerAccount)
+
+	for _, accountId := range []int64{a.Id, b.Id} {
+		for i := 0; i < votesPerAccount; i++ {
+			wg.Add(1)
+			go func(accountId int64, seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				f := f1
+				if r.Intn(2) == 0 {
+					f = f2
+				}
+				if _, _, err := s.CastVote(accountId, f.Id, r.Intn(3) != 0); err != nil && err != account.NoVotesLeft {
+					errs <- err
+				}
+			}(accountId, int64(i))
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal("CastVote failed: ", err)
+	}
+
+	for _, accountId := range []int64{a.Id, b.Id} {
+		if held := votesHeld(t, s, accountId, f1, f2); held != 10 {
+			t.Fatalf("Account %d started with 10 votes, but has %d in its bank and votes after voting concurrently", accountId, held)
+		}
+		loaded, err := s.LoadAccountFromId(accountId)
+		if err != nil || loaded.VoteBank < 0 {
+			t.Fatalf("Account %d overspent its vote bank, got %+v, %v", accountId, loaded, err)
+		}
+	}
+}
+
+func testCastVoteCannotOverspend(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+	f := makeFact(t, s, a.Id)
+
+	const attempts = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded, refused := 0, 0
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.CastVote(a.Id, f.Id, true)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				succeeded++
+			} else if err == account.NoVotesLeft {
+				refused++
+			} else {
+				t.Error("CastVote failed: ", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 10 || refused != attempts-10 {
+		t.Fatalf("An account with 10 votes cast %d votes and was refused %d times", succeeded, refused)
+	}
+
+	loaded, err := s.LoadAccountFromId(a.Id)
+	if err != nil || loaded.VoteBank != 0 {
+		t.Fatalf("Vote bank was not emptied, got %+v, %v", loaded, err)
+	}
+	if v, err := s.GetVoteForFact(a.Id, f.Id); err != nil || v.Score != 10 {
+		t.Fatalf("Vote was not 10, got %+v, %v", v, err)
+	}
+}
+
+func testAuditEvents(t *testing.T, s Storer) {
+	a := makeAccount(t, s, "test@test")
+
+	var f *fact.Fact
+	created := &audit.AuditEvent{ActorId: a.Id, Action: audit.CreateFact, TargetType: audit.TargetFact, Ip: "192.0.2.1"}
+	err := s.Audited(created, func(tx interface{}) error {
+		//the change is made with the storage it is given
+		f = makeFact(t, tx.(Storer), a.Id)
+		created.TargetId = f.Id
+		created.After = f.Fact
+		return nil
+	})
+	if err != nil || created.Id == 0 || !created.CreatedAt.Valid {
+		t.Fatalf("Audited did not save the event, got %+v, %v", created, err)
+	}
+	if _, err := s.LoadFactFromId(f.Id); err != nil {
+		t.Fatal("The change made in Audited was not saved: ", err)
+	}
+
+	failed := errors.New("the change failed")
+	if err := s.Audited(&audit.AuditEvent{ActorId: a.Id, Action: audit.DeleteFact, TargetType: audit.TargetFact, TargetId: f.Id}, func(tx interface{}) error {
+		return failed
+	}); err != failed {
+		t.Fatal("Audited did not return the change's error, got ", err)
+	}
+
+	other := makeAccount(t, s, "other@test")
+	voted := &audit.AuditEvent{ActorId: other.Id, Action: audit.Vote, TargetType: audit.TargetFact, TargetId: f.Id}
+	if err := s.Audited(voted, func(tx interface{}) error {
+		_, _, err := tx.(Storer).CastVote(other.Id, f.Id, true)
+		return err
+	}); err != nil {
+		t.Fatal("Audited failed: ", err)
+	}
+	system := &audit.AuditEvent{Action: audit.GiveVotes, TargetType: audit.TargetAccount}
+	if err := s.Audited(system, func(tx interface{}) error {
+		return tx.(Storer).GiveOneVoteToAllAccounts()
+	}); err != nil {
+		t.Fatal("Audited failed: ", err)
+	}
+
+	page, err := s.ListAuditEvents(audit.AuditQuery{})
+	if err != nil || page.Total != 3 || len(page.Events) != 3 {
+		t.Fatalf("ListAuditEvents returned %+v, %v", page, err)
+	}
+	first := page.Events[2]
+	if first.Id != created.Id || first.ActorId != a.Id || first.Action != audit.CreateFact || first.TargetType != audit.TargetFact ||
+		first.TargetId != f.Id || first.After != f.Fact || first.Ip != "192.0.2.1" || !first.CreatedAt.Valid {
+		t.Fatalf("ListAuditEvents returned the event wrong: %+v", first)
+	}
+
+	tests := []struct {
+		Name   string
+		Query  audit.AuditQuery
+		Events []int64
+	}{
+		{"everything", audit.AuditQuery{}, []int64{system.Id, voted.Id, created.Id}},
+		{"actor", audit.AuditQuery{ActorId: other.Id}, []int64{voted.Id}},
+		{"action", audit.AuditQuery{Action: audit.CreateFact}, []int64{created.Id}},
+		{"target", audit.AuditQuery{TargetType: audit.TargetFact, TargetId: f.Id}, []int64{voted.Id, created.Id}},
+		{"target type", audit.AuditQuery{TargetType: audit.TargetAccount}, []int64{system.Id}},
+		{"created after", audit.AuditQuery{CreatedAfter: time.Now().Add(time.Hour)}, nil},
+		{"created before", audit.AuditQuery{CreatedBefore: time.Now().Add(time.Hour)}, []int64{system.Id, voted.Id, created.Id}},
+		{"page", audit.AuditQuery{Page: 2, PageSize: 2}, []int64{created.Id}},
+	}
+	for _, test := range tests {
+		page, err := s.ListAuditEvents(test.Query)
+		if err != nil {
+			t.Fatalf("ListAuditEvents by %s failed: %v", test.Name, err)
+		}
+		var ids []int64
+		for _, e := range page.Events {
+			ids = append(ids, e.Id)
+		}
+		if !sameIds(ids, test.Events...) {
+			t.Fatalf("ListAuditEvents by %s returned %v, expected %v", test.Name, ids, test.Events)
+		}
+	}
+}
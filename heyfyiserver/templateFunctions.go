@@ -2,22 +2,74 @@ package heyfyiserver
 
 import (
 	"html/template"
+	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/audit"
+	"github.com/kiwih/heyfyi/heyfyiserver/fact"
 )
 
 var funcMap = template.FuncMap{
+	"CsrfField":                  CsrfField,
 	"GetViewFactUrl":             GetViewFactUrl,
 	"GetSignUpUrl":               GetSignUpUrl,
 	"GetSignInUrl":               GetSignInUrl,
 	"GetSignOutUrl":              GetSignOutUrl,
+	"GetSignInTwoFactorUrl":      GetSignInTwoFactorUrl,
+	"GetOidcSignInUrl":           GetOidcSignInUrl,
+	"GetTwoFactorUrl":            GetTwoFactorUrl,
+	"GetEnableTwoFactorUrl":      GetEnableTwoFactorUrl,
+	"GetDisableTwoFactorUrl":     GetDisableTwoFactorUrl,
+	"GetRecoveryCodesUrl":        GetRecoveryCodesUrl,
+	"GetSessionsUrl":             GetSessionsUrl,
+	"GetRevokeSessionUrl":        GetRevokeSessionUrl,
+	"GetRevokeAllSessionsUrl":    GetRevokeAllSessionsUrl,
+	"GetApiTokensUrl":            GetApiTokensUrl,
+	"GetCreateApiTokenUrl":       GetCreateApiTokenUrl,
+	"GetRevokeApiTokenUrl":       GetRevokeApiTokenUrl,
 	"GetCreateFactUrl":           GetCreateFactUrl,
 	"GetHomeUrl":                 GetHomeUrl,
 	"GetListFactUrl":             GetListFactUrl,
+	"GetListFactPageUrl":         GetListFactPageUrl,
+	"GetListFactSortUrl":         GetListFactSortUrl,
+	"GetSearchFactUrl":           GetSearchFactUrl,
+	"GetSearchFactPageUrl":       GetSearchFactPageUrl,
 	"GetRequestPasswordResetUrl": GetRequestPasswordResetUrl,
+	"GetResendVerificationUrl":   GetResendVerificationUrl,
 	"GetDeleteFactUrl":           GetDeleteFactUrl,
+	"GetEditFactUrl":             GetEditFactUrl,
+	"GetFactHistoryUrl":          GetFactHistoryUrl,
+	"GetRollbackFactUrl":         GetRollbackFactUrl,
+	"GetCreateCommentUrl":        GetCreateCommentUrl,
+	"GetEditCommentUrl":          GetEditCommentUrl,
+	"GetDeleteCommentUrl":        GetDeleteCommentUrl,
+	"GetListTagsUrl":             GetListTagsUrl,
+	"GetViewTagUrl":              GetViewTagUrl,
+	"GetRenameTagUrl":            GetRenameTagUrl,
+	"GetMergeTagUrl":             GetMergeTagUrl,
+	"GetBrokenLinksUrl":          GetBrokenLinksUrl,
+	"GetLoginLockoutsUrl":        GetLoginLockoutsUrl,
+	"GetUnlockLoginUrl":          GetUnlockLoginUrl,
+	"GetRolesUrl":                GetRolesUrl,
+	"GetSetRoleUrl":              GetSetRoleUrl,
+	"GetAccountsUrl":             GetAccountsUrl,
+	"GetAccountsPageUrl":         GetAccountsPageUrl,
+	"GetAuditLogUrl":             GetAuditLogUrl,
+	"GetAuditLogPageUrl":         GetAuditLogPageUrl,
+	"GetAuditLogCSVUrl":          GetAuditLogCSVUrl,
+	"GetManageAccountUrl":        GetManageAccountUrl,
+	"GetModerationQueueUrl":      GetModerationQueueUrl,
+	"GetModerationQueuePageUrl":  GetModerationQueuePageUrl,
+	"GetDoModerateFactUrl":       GetDoModerateFactUrl,
+	"GetAddModerationNoteUrl":    GetAddModerationNoteUrl,
 
 	"TruncateString": TruncateString,
+	"Add":            Add,
+	"TagText":        TagText,
+	"OidcEnabled":    OidcEnabled,
+	"OidcName":       OidcName,
 } //this provides templates with the ability to run useful functions
 
 func GetViewFactUrl(factId int64) string {
@@ -35,10 +87,58 @@ func GetSignInUrl() string {
 	return SignInUrl.Make()
 }
 
+func GetOidcSignInUrl() string {
+	return OidcSignInUrl.Make()
+}
+
 func GetSignOutUrl() string {
 	return SignOutUrl.Make()
 }
 
+func GetSignInTwoFactorUrl() string {
+	return SignInTwoFactorUrl.Make()
+}
+
+func GetTwoFactorUrl() string {
+	return TwoFactorUrl.Make()
+}
+
+func GetEnableTwoFactorUrl() string {
+	return EnableTwoFactorUrl.Make()
+}
+
+func GetDisableTwoFactorUrl() string {
+	return DisableTwoFactorUrl.Make()
+}
+
+func GetRecoveryCodesUrl() string {
+	return RecoveryCodesUrl.Make()
+}
+
+func GetSessionsUrl() string {
+	return SessionsUrl.Make()
+}
+
+func GetRevokeSessionUrl(sessionId int64) string {
+	return RevokeSessionUrl.Make("sessionId", strconv.FormatInt(sessionId, 10))
+}
+
+func GetRevokeAllSessionsUrl() string {
+	return RevokeAllSessionsUrl.Make()
+}
+
+func GetApiTokensUrl() string {
+	return ApiTokensUrl.Make()
+}
+
+func GetCreateApiTokenUrl() string {
+	return CreateApiTokenUrl.Make()
+}
+
+func GetRevokeApiTokenUrl(tokenId int64) string {
+	return RevokeApiTokenUrl.Make("tokenId", strconv.FormatInt(tokenId, 10))
+}
+
 func GetCreateFactUrl() string {
 	return CreateFactUrl.Make()
 }
@@ -51,14 +151,257 @@ func GetListFactUrl() string {
 	return ListFactUrl.Make()
 }
 
+//Returns the URL of the given page of a fact listing, keeping its sort and filters
+func GetListFactPageUrl(q fact.FactQuery, page int) string {
+	q.Page = page
+	return makeListFactUrl(q)
+}
+
+//Returns the URL of the first page of a fact listing in a different order, keeping its filters
+func GetListFactSortUrl(q fact.FactQuery, sort fact.FactSort) string {
+	q.Page = 1
+	q.Sort = sort
+	return makeListFactUrl(q)
+}
+
+//the inverse of factQueryFromUrl. Anything left at its default value is left out of the URL
+//Listings of one tag are on that tag's page
+func makeListFactUrl(q fact.FactQuery) string {
+	base := ListFactUrl.Make()
+	if q.Tag != "" {
+		base = GetViewTagUrl(q.Tag)
+	}
+
+	values := url.Values{}
+	if q.Page > 1 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PageSize != fact.DefaultPageSize {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	if q.Sort != fact.SortNewest {
+		values.Set("sort", string(q.Sort))
+	}
+	if q.AuthorId > 0 {
+		values.Set("author", strconv.FormatInt(q.AuthorId, 10))
+	}
+	if q.Moderation != fact.AnyModeration {
+		values.Set("state", string(q.Moderation))
+	}
+	if !q.CreatedAfter.IsZero() {
+		values.Set("from", q.CreatedAfter.Format(listFactsDateFormat))
+	}
+	if !q.CreatedBefore.IsZero() {
+		values.Set("to", q.CreatedBefore.AddDate(0, 0, -1).Format(listFactsDateFormat))
+	}
+
+	if len(values) == 0 {
+		return base
+	}
+	return base + "?" + values.Encode()
+}
+
+func GetSearchFactUrl() string {
+	return SearchFactUrl.Make()
+}
+
+//Returns the URL of the given page of search results
+func GetSearchFactPageUrl(q fact.SearchQuery, page int) string {
+	values := url.Values{}
+	values.Set("q", q.Terms)
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if q.PageSize != fact.DefaultPageSize {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	return SearchFactUrl.Make() + "?" + values.Encode()
+}
+
 func GetRequestPasswordResetUrl() string {
 	return RequestPasswordResetUrl.Make()
 }
 
+func GetResendVerificationUrl() string {
+	return ResendVerificationUrl.Make()
+}
+
 func GetDeleteFactUrl(factId int64) string {
 	return DeleteFactUrl.Make("factId", strconv.FormatInt(factId, 10))
 }
 
+func GetEditFactUrl(factId int64) string {
+	return EditFactUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+func GetFactHistoryUrl(factId int64) string {
+	return FactHistoryUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+func GetRollbackFactUrl(factId int64, revisionId int64) string {
+	return RollbackFactUrl.Make("factId", strconv.FormatInt(factId, 10), "revisionId", strconv.FormatInt(revisionId, 10))
+}
+
+func GetCreateCommentUrl(factId int64) string {
+	return CreateCommentUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+func GetEditCommentUrl(commentId int64) string {
+	return EditCommentUrl.Make("commentId", strconv.FormatInt(commentId, 10))
+}
+
+func GetDeleteCommentUrl(commentId int64) string {
+	return DeleteCommentUrl.Make("commentId", strconv.FormatInt(commentId, 10))
+}
+
+func GetListTagsUrl() string {
+	return ListTagsUrl.Make()
+}
+
+func GetViewTagUrl(tagName string) string {
+	return ViewTagUrl.Make("tagName", tagName)
+}
+
+func GetRenameTagUrl(tagName string) string {
+	return RenameTagUrl.Make("tagName", tagName)
+}
+
+func GetMergeTagUrl(tagName string) string {
+	return MergeTagUrl.Make("tagName", tagName)
+}
+
+func GetBrokenLinksUrl() string {
+	return BrokenLinksUrl.Make()
+}
+
+func GetLoginLockoutsUrl() string {
+	return LoginLockoutsUrl.Make()
+}
+
+func GetUnlockLoginUrl() string {
+	return UnlockLoginUrl.Make()
+}
+
+func GetRolesUrl() string {
+	return RolesUrl.Make()
+}
+
+func GetSetRoleUrl() string {
+	return SetRoleUrl.Make()
+}
+
+//Returns the URL of the accounts listing, searching for search (which can be "")
+func GetAccountsUrl(search string) string {
+	return GetAccountsPageUrl(account.AccountQuery{Search: search, PageSize: account.DefaultAccountPageSize}, 1)
+}
+
+//Returns the URL of the given page of the accounts listing, keeping its search
+func GetAccountsPageUrl(q account.AccountQuery, page int) string {
+	values := url.Values{}
+	if q.Search != "" {
+		values.Set("q", q.Search)
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if q.PageSize != account.DefaultAccountPageSize {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	if len(values) == 0 {
+		return AccountsUrl.Make()
+	}
+	return AccountsUrl.Make() + "?" + values.Encode()
+}
+
+func GetAuditLogUrl() string {
+	return AuditLogUrl.Make()
+}
+
+//Returns the query string for the audit log's filters, along with extra (which may be nil)
+func auditLogValues(q audit.AuditQuery) url.Values {
+	values := url.Values{}
+	if q.ActorId != 0 {
+		values.Set("actor", strconv.FormatInt(q.ActorId, 10))
+	}
+	if q.Action != "" {
+		values.Set("action", string(q.Action))
+	}
+	if q.TargetType != audit.NoTarget {
+		values.Set("type", string(q.TargetType))
+	}
+	if q.TargetId != 0 {
+		values.Set("target", strconv.FormatInt(q.TargetId, 10))
+	}
+	if !q.CreatedAfter.IsZero() {
+		values.Set("from", q.CreatedAfter.Format(auditDateFormat))
+	}
+	if !q.CreatedBefore.IsZero() {
+		values.Set("to", q.CreatedBefore.AddDate(0, 0, -1).Format(auditDateFormat))
+	}
+	if q.PageSize != 0 && q.PageSize != audit.DefaultAuditPageSize {
+		values.Set("size", strconv.Itoa(q.PageSize))
+	}
+	return values
+}
+
+//Returns the URL of the given page of the audit log, keeping its filters
+func GetAuditLogPageUrl(q audit.AuditQuery, page int) string {
+	values := auditLogValues(q)
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return AuditLogUrl.Make()
+	}
+	return AuditLogUrl.Make() + "?" + values.Encode()
+}
+
+//Returns the URL that downloads every event in the audit log matching the filters as CSV
+func GetAuditLogCSVUrl(q audit.AuditQuery) string {
+	values := auditLogValues(q)
+	values.Del("size")
+	values.Set("format", "csv")
+	return AuditLogUrl.Make() + "?" + values.Encode()
+}
+
+func GetApiFactUrl(factId int64) string {
+	return ApiFactUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+func GetManageAccountUrl(accountId int64) string {
+	return ManageAccountUrl.Make("accountId", strconv.FormatInt(accountId, 10))
+}
+
+func GetModerationQueueUrl() string {
+	return ModerationQueueUrl.Make()
+}
+
+//Returns the URL of the given page of the moderation queue
+func GetModerationQueuePageUrl(page int) string {
+	if page <= 1 {
+		return GetModerationQueueUrl()
+	}
+	return ModerationQueueUrl.Make() + "?page=" + strconv.Itoa(page)
+}
+
+func GetDoModerateFactUrl(factId int64) string {
+	return DoModerateFactUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+func GetAddModerationNoteUrl(factId int64) string {
+	return AddModerationNoteUrl.Make("factId", strconv.FormatInt(factId, 10))
+}
+
+//Returns true if people can sign in with an OpenID Connect identity provider
+func OidcEnabled() bool {
+	return oidcProvider != nil
+}
+
+//Returns the name of the identity provider, for the sign in button
+func OidcName() string {
+	return OidcProviderName
+}
+
 //Smart truncation function
 func TruncateString(s string, charLimit int) string {
 	if len(s) < charLimit {
@@ -74,3 +417,17 @@ func TruncateString(s string, charLimit int) string {
 	return s2 + "..."
 
 }
+
+//Adds two numbers (eg to show a 0-based index as a 1-based number)
+func Add(a int, b int) int {
+	return a + b
+}
+
+//Returns the names of the tags separated by commas, as they are typed into the fact form
+func TagText(tags []fact.Tag) string {
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ", ")
+}
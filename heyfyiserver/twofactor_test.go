@@ -0,0 +1,96 @@
+package heyfyiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+	"github.com/kiwih/heyfyi/heyfyiserver/memdb"
+)
+
+//Replaying the cookie from entering the password must not allow more guesses at the second factor code
+func TestSecondFactorReplayIsLockedOut(t *testing.T) {
+	//so that every failure is counted straight away, rather than waiting out the delays
+	policy := account.SecondFactorThrottlePolicy
+	account.SecondFactorThrottlePolicy.BaseDelay = 0
+	defer func() { account.SecondFactorThrottlePolicy = policy }()
+
+	s := memdb.NewMemoryStorage()
+	router := NewRouter(s, "two factor test")
+	a := fyidb.TestAccount()
+	if err := s.CreateAccount(&a); err != nil {
+		t.Fatal("CreateAccount failed: ", err)
+	}
+	now := time.Now()
+	if err := a.BeginTwoFactorSetup(s); err != nil {
+		t.Fatal("BeginTwoFactorSetup failed: ", err)
+	}
+	code, _ := account.TotpCode(a.TotpSecret.String, now.Add(-time.Minute))
+	if _, err := a.EnableTwoFactor(s, code, now.Add(-time.Minute)); err != nil {
+		t.Fatal("EnableTwoFactor failed: ", err)
+	}
+
+	post := func(u string, form url.Values, cookie string, token string) *httptest.ResponseRecorder {
+		form.Set(csrfFormField, token)
+		req := httptest.NewRequest("POST", u, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", ApiFactsUrl.Make(), nil))
+	token, cookie := rw.Header().Get(csrfHeader), sessionCookie(rw)
+	rw = post(SignInUrl.Make(), url.Values{"Email": {"test@test"}, "Password": {"test@test"}}, cookie, token)
+	if rw.Header().Get("Location") != SignInTwoFactorUrl.Make() {
+		t.Fatalf("Signing in didn't ask for a second factor, got %d to %q", rw.Code, rw.Header().Get("Location"))
+	}
+	pending := sessionCookie(rw)
+	if changed := rw.Header().Get(csrfHeader); changed != "" {
+		token = changed
+	}
+
+	right, _ := account.TotpCode(a.TotpSecret.String, time.Now())
+	wrong := "000000"
+	if right == wrong {
+		wrong = "111111"
+	}
+	//each guess starts again from the cookie from before any had been made
+	for i := 0; i < account.SecondFactorThrottlePolicy.LockAfter; i++ {
+		if rw := post(SignInTwoFactorUrl.Make(), url.Values{"Code": {wrong}}, pending, token); rw.Header().Get("Location") != SignInTwoFactorUrl.Make() {
+			t.Fatalf("Guess %d wasn't sent back to enter the code again, got %d to %q", i+1, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+
+	//signIn redirects with 302, so a 303 home is the pending sign in being locked out
+	rw = post(SignInTwoFactorUrl.Make(), url.Values{"Code": {right}}, pending, token)
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != HomeUrl.Make() {
+		t.Fatalf("The right code wasn't locked out with a replayed cookie after %d wrong ones, got %d to %q", account.SecondFactorThrottlePolicy.LockAfter, rw.Code, rw.Header().Get("Location"))
+	}
+	req := httptest.NewRequest("GET", ApiAccountUrl.Make(), nil)
+	req.Header.Set("Cookie", sessionCookie(rw))
+	signedIn := httptest.NewRecorder()
+	router.ServeHTTP(signedIn, req)
+	if signedIn.Code != http.StatusUnauthorized {
+		t.Error("A session was started after the second factor was locked, got ", signedIn.Code)
+	}
+	if throttle, err := s.LoadLoginThrottle(account.SecondFactorThrottleKey(a.Id)); err != nil || !throttle.LockedOut {
+		t.Errorf("The second factor wasn't locked in storage, got %+v, %v", throttle, err)
+	}
+
+	//and the pending sign in is gone from the cookie it was given
+	session, err := store.Get(req, "session-security")
+	if err != nil {
+		t.Fatal("Could not decode the session cookie: ", err)
+	}
+	if _, _, ok := pendingSecondFactor(session); ok {
+		t.Error("The pending sign in wasn't cleared from the session")
+	}
+}
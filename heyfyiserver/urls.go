@@ -11,15 +11,62 @@ type URL string
 const (
 	HomeUrl                 URL = "/"
 	ListFactUrl             URL = "/fact"
+	SearchFactUrl           URL = "/fact/search"
 	CreateFactUrl           URL = "/fact/create"
 	ViewFactUrl             URL = "/fact/view/:factId"
 	DeleteFactUrl           URL = "/fact/delete/:factId"
+	EditFactUrl             URL = "/fact/edit/:factId"
+	FactHistoryUrl          URL = "/fact/history/:factId"
+	RollbackFactUrl         URL = "/fact/rollback/:factId/:revisionId"
+	CreateCommentUrl        URL = "/fact/comment/:factId"
+	EditCommentUrl          URL = "/comment/edit/:commentId"
+	DeleteCommentUrl        URL = "/comment/delete/:commentId"
+	ListTagsUrl             URL = "/tag"
+	ViewTagUrl              URL = "/tag/:tagName"
+	RenameTagUrl            URL = "/tag/rename/:tagName"
+	MergeTagUrl             URL = "/tag/merge/:tagName"
 	VoteOnFactUrl           URL = "/api/vote"
+	SearchFactApiUrl        URL = "/api/search"
 	ModerateFactUrl         URL = "/api/moderate"
+	HideCommentUrl          URL = "/api/hidecomment"
+	OpenApiUrl              URL = "/api/openapi.json"
+	ApiUrl                  URL = "/api/v1"
+	ApiFactsUrl             URL = "/api/v1/facts"
+	ApiFactUrl              URL = "/api/v1/facts/:factId"
+	ApiReferencesUrl        URL = "/api/v1/facts/:factId/references"
+	ApiReferenceUrl         URL = "/api/v1/facts/:factId/references/:referenceId"
+	ApiVotesUrl             URL = "/api/v1/facts/:factId/votes"
+	ApiModerationUrl        URL = "/api/v1/facts/:factId/moderation"
+	ApiAccountUrl           URL = "/api/v1/account"
+	ModerationQueueUrl      URL = "/moderation"
+	DoModerateFactUrl       URL = "/moderation/decide/:factId"
+	AddModerationNoteUrl    URL = "/moderation/note/:factId"
+	BrokenLinksUrl          URL = "/admin/links"
+	LoginLockoutsUrl        URL = "/admin/lockouts"
+	UnlockLoginUrl          URL = "/admin/lockouts/unlock"
+	RolesUrl                URL = "/admin/roles"
+	SetRoleUrl              URL = "/admin/roles/set"
+	AccountsUrl             URL = "/admin/accounts"
+	ManageAccountUrl        URL = "/admin/accounts/manage/:accountId"
+	AuditLogUrl             URL = "/admin/audit"
 	SignUpUrl               URL = "/signup"
 	SignInUrl               URL = "/signin"
 	SignOutUrl              URL = "/signout"
+	SignInTwoFactorUrl      URL = "/signin/twofactor"
+	OidcSignInUrl           URL = "/signin/oidc"
+	OidcCallbackUrl         URL = "/signin/oidc/callback"
+	TwoFactorUrl            URL = "/account/twofactor"
+	EnableTwoFactorUrl      URL = "/account/twofactor/enable"
+	DisableTwoFactorUrl     URL = "/account/twofactor/disable"
+	RecoveryCodesUrl        URL = "/account/twofactor/recovery"
+	SessionsUrl             URL = "/account/sessions"
+	RevokeSessionUrl        URL = "/account/sessions/revoke/:sessionId"
+	RevokeAllSessionsUrl    URL = "/account/sessions/revokeall"
+	ApiTokensUrl            URL = "/account/tokens"
+	CreateApiTokenUrl       URL = "/account/tokens/create"
+	RevokeApiTokenUrl       URL = "/account/tokens/revoke/:tokenId"
 	VerificationUrl         URL = "/verify/:accountId/:verificationCode"
+	ResendVerificationUrl   URL = "/verify/resend"
 	RequestPasswordResetUrl URL = "/reset"
 	ResetPasswordUrl        URL = "/reset/:accountId/:resetVerificationCode"
 )
@@ -50,8 +97,12 @@ func initRouter() *web.Router {
 	rootRouter.Middleware((*Context).AssignStorageMiddleware)
 	rootRouter.Middleware((*Context).AssignTemplatesAndSessionsMiddleware)
 	rootRouter.Middleware((*Context).LoadUserMiddleware)
+	rootRouter.Middleware((*Context).ApiTokenMiddleware)
+	rootRouter.Middleware((*Context).CsrfMiddleware)
 	rootRouter.Middleware((*Context).GetErrorMessagesMiddleware)
 	rootRouter.Middleware((*Context).GetNotificationMessagesMiddleware)
+	rootRouter.Middleware((*Context).TwoFactorPolicyMiddleware)
+	rootRouter.NotFound((*Context).NotFoundHandler)
 
 	//rootRouter web paths
 	rootRouter.Get(HomeUrl.String(), (*Context).HomeHandler)
@@ -60,7 +111,13 @@ func initRouter() *web.Router {
 	rootRouter.Get(SignUpUrl.String(), (*Context).SignUpHandler)
 	rootRouter.Post(SignUpUrl.String(), (*Context).DoSignUpHandler)
 	rootRouter.Post(SignInUrl.String(), (*Context).DoSignInRequestHandler)
+	rootRouter.Get(SignInTwoFactorUrl.String(), (*Context).SignInTwoFactorHandler)
+	rootRouter.Post(SignInTwoFactorUrl.String(), (*Context).DoSignInTwoFactorHandler)
+	rootRouter.Get(OidcSignInUrl.String(), (*Context).OidcSignInHandler)
+	rootRouter.Get(OidcCallbackUrl.String(), (*Context).OidcCallbackHandler)
 	rootRouter.Get(VerificationUrl.String(), (*Context).DoVerificationRequestHandler)
+	rootRouter.Get(ResendVerificationUrl.String(), (*Context).ResendVerificationHandler)
+	rootRouter.Post(ResendVerificationUrl.String(), (*Context).DoResendVerificationHandler)
 
 	//password reset handlers
 	rootRouter.Get(RequestPasswordResetUrl.String(), (*Context).BeginPasswordResetRequestHandler)
@@ -71,6 +128,35 @@ func initRouter() *web.Router {
 	//viewing and listing facts handlers
 	rootRouter.Get(ViewFactUrl.String(), (*Context).ViewFactHandler)
 	rootRouter.Get(ListFactUrl.String(), (*Context).ListFactsHandler)
+	rootRouter.Get(FactHistoryUrl.String(), (*Context).FactHistoryHandler)
+
+	//tag handlers
+	rootRouter.Get(ListTagsUrl.String(), (*Context).ListTagsHandler)
+	rootRouter.Get(ViewTagUrl.String(), (*Context).ViewTagHandler)
+
+	//searching facts handlers
+	rootRouter.Get(SearchFactUrl.String(), (*Context).SearchFactsHandler)
+	rootRouter.Get(SearchFactApiUrl.String(), (*Context).SearchFactsApiHandler)
+
+	//the OpenAPI document describing every JSON endpoint
+	rootRouter.Get(OpenApiUrl.String(), (*Context).OpenApiHandler)
+
+	//versioned JSON API handlers, which check for an account (and its API token's scopes) themselves so that they can answer with JSON
+	apiRouter := rootRouter.Subrouter(ApiContext{}, "/")
+	apiRouter.Get(ApiFactsUrl.String(), (*ApiContext).ListFactsHandler)
+	apiRouter.Post(ApiFactsUrl.String(), (*ApiContext).CreateFactHandler)
+	apiRouter.Get(ApiFactUrl.String(), (*ApiContext).ViewFactHandler)
+	apiRouter.Patch(ApiFactUrl.String(), (*ApiContext).EditFactHandler)
+	apiRouter.Delete(ApiFactUrl.String(), (*ApiContext).DeleteFactHandler)
+	apiRouter.Get(ApiReferencesUrl.String(), (*ApiContext).ListReferencesHandler)
+	apiRouter.Post(ApiReferencesUrl.String(), (*ApiContext).CreateReferenceHandler)
+	apiRouter.Get(ApiReferenceUrl.String(), (*ApiContext).ViewReferenceHandler)
+	apiRouter.Patch(ApiReferenceUrl.String(), (*ApiContext).EditReferenceHandler)
+	apiRouter.Delete(ApiReferenceUrl.String(), (*ApiContext).DeleteReferenceHandler)
+	apiRouter.Get(ApiVotesUrl.String(), (*ApiContext).ViewVotesHandler)
+	apiRouter.Post(ApiVotesUrl.String(), (*ApiContext).VoteHandler)
+	apiRouter.Post(ApiModerationUrl.String(), (*ApiContext).ModerateFactHandler)
+	apiRouter.Get(ApiAccountUrl.String(), (*ApiContext).AccountHandler)
 
 	//must be logged in for some handlers...
 	loggedInRouter := rootRouter.Subrouter(LoggedInContext{}, "/")
@@ -79,15 +165,66 @@ func initRouter() *web.Router {
 	//sign out handler
 	loggedInRouter.Post(SignOutUrl.String(), (*LoggedInContext).DoSignOutRequestHandler)
 
+	//two factor authentication handlers
+	loggedInRouter.Get(TwoFactorUrl.String(), (*LoggedInContext).TwoFactorHandler)
+	loggedInRouter.Post(EnableTwoFactorUrl.String(), (*LoggedInContext).DoEnableTwoFactorHandler)
+	loggedInRouter.Post(DisableTwoFactorUrl.String(), (*LoggedInContext).DoDisableTwoFactorHandler)
+	loggedInRouter.Post(RecoveryCodesUrl.String(), (*LoggedInContext).DoRegenerateRecoveryCodesHandler)
+
+	//session handlers
+	loggedInRouter.Get(SessionsUrl.String(), (*LoggedInContext).SessionsHandler)
+	loggedInRouter.Post(RevokeSessionUrl.String(), (*LoggedInContext).DoRevokeSessionHandler)
+	loggedInRouter.Post(RevokeAllSessionsUrl.String(), (*LoggedInContext).DoRevokeAllSessionsHandler)
+
+	//API token handlers
+	loggedInRouter.Get(ApiTokensUrl.String(), (*LoggedInContext).ApiTokensHandler)
+	loggedInRouter.Post(CreateApiTokenUrl.String(), (*LoggedInContext).DoCreateApiTokenHandler)
+	loggedInRouter.Post(RevokeApiTokenUrl.String(), (*LoggedInContext).DoRevokeApiTokenHandler)
+
 	//vote, moderate fact handlers
 	loggedInRouter.Post(VoteOnFactUrl.String(), (*LoggedInContext).VoteOnFactHandler)
 	loggedInRouter.Post(ModerateFactUrl.String(), (*LoggedInContext).ModerateFactHandler)
 
+	//moderation queue handlers
+	loggedInRouter.Get(ModerationQueueUrl.String(), (*LoggedInContext).ModerationQueueHandler)
+	loggedInRouter.Post(DoModerateFactUrl.String(), (*LoggedInContext).DoModerateFactHandler)
+	loggedInRouter.Post(AddModerationNoteUrl.String(), (*LoggedInContext).DoAddModerationNoteHandler)
+
 	//create, delete fact handlers
 	loggedInRouter.Get(CreateFactUrl.String(), (*LoggedInContext).CreateFactHandler)
 	loggedInRouter.Post(CreateFactUrl.String(), (*LoggedInContext).DoCreateFactHandler)
 	loggedInRouter.Get(DeleteFactUrl.String(), (*LoggedInContext).DeleteFactHandler)
 	loggedInRouter.Post(DeleteFactUrl.String(), (*LoggedInContext).DoDeleteFactHandler)
 
+	//edit, roll back fact handlers
+	loggedInRouter.Get(EditFactUrl.String(), (*LoggedInContext).EditFactHandler)
+	loggedInRouter.Post(EditFactUrl.String(), (*LoggedInContext).DoEditFactHandler)
+	loggedInRouter.Post(RollbackFactUrl.String(), (*LoggedInContext).DoRollbackFactHandler)
+
+	//comment handlers
+	loggedInRouter.Post(CreateCommentUrl.String(), (*LoggedInContext).DoCreateCommentHandler)
+	loggedInRouter.Get(EditCommentUrl.String(), (*LoggedInContext).EditCommentHandler)
+	loggedInRouter.Post(EditCommentUrl.String(), (*LoggedInContext).DoEditCommentHandler)
+	loggedInRouter.Post(DeleteCommentUrl.String(), (*LoggedInContext).DoDeleteCommentHandler)
+	loggedInRouter.Post(HideCommentUrl.String(), (*LoggedInContext).HideCommentHandler)
+
+	//rename, merge tag handlers
+	loggedInRouter.Post(RenameTagUrl.String(), (*LoggedInContext).DoRenameTagHandler)
+	loggedInRouter.Post(MergeTagUrl.String(), (*LoggedInContext).DoMergeTagHandler)
+
+	//admin report handlers
+	loggedInRouter.Get(BrokenLinksUrl.String(), (*LoggedInContext).BrokenLinksHandler)
+
+	//login lockout handlers
+	loggedInRouter.Get(LoginLockoutsUrl.String(), (*LoggedInContext).LoginLockoutsHandler)
+	loggedInRouter.Post(UnlockLoginUrl.String(), (*LoggedInContext).DoUnlockLoginHandler)
+	loggedInRouter.Get(RolesUrl.String(), (*LoggedInContext).RolesHandler)
+	loggedInRouter.Post(SetRoleUrl.String(), (*LoggedInContext).DoSetRoleHandler)
+	loggedInRouter.Get(AccountsUrl.String(), (*LoggedInContext).AccountsHandler)
+	loggedInRouter.Post(ManageAccountUrl.String(), (*LoggedInContext).DoManageAccountHandler)
+
+	//audit log handler
+	loggedInRouter.Get(AuditLogUrl.String(), (*LoggedInContext).AuditLogHandler)
+
 	return rootRouter
 }
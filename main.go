@@ -1,14 +1,23 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/kiwih/heyfyi/heyfyiserver"
+	"github.com/kiwih/heyfyi/heyfyiserver/account"
+	"github.com/kiwih/heyfyi/heyfyiserver/oidc"
 )
 
+var memoryStorage = flag.Bool("memory", false, "use in-memory storage instead of $DATABASE_URL (nothing is saved when the server stops)")
+
 func main() {
+	flag.Parse()
+
 	//Enable logger
 	logFileName := os.Getenv("LOG_FILE_NAME")
 	if len(logFileName) == 0 {
@@ -34,5 +43,50 @@ func main() {
 		cookieStoreSalt = "SUPER_SECRET_SALT"
 	}
 
-	heyfyiserver.StartServer(serverAddress, cookieStoreSalt)
+	databaseUrl := os.Getenv("DATABASE_URL")
+	if *memoryStorage {
+		databaseUrl = heyfyiserver.MemoryDatabaseUrl
+	} else if len(databaseUrl) == 0 {
+		log.Println("$DATABASE_URL was not set, defaulting to 'sqlite3://heyfyi.sqlite3'.")
+		databaseUrl = "sqlite3://heyfyi.sqlite3"
+	}
+
+	if interval := os.Getenv("LINK_CHECK_INTERVAL"); len(interval) > 0 {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalln("$LINK_CHECK_INTERVAL is not a valid duration (eg 10m):", err.Error())
+		}
+		heyfyiserver.LinkCheckInterval = d
+	}
+
+	if os.Getenv("REQUIRE_ADMIN_2FA") == "false" {
+		log.Println("$REQUIRE_ADMIN_2FA is false, so admins can sign in without two-factor authentication.")
+		account.RequireTwoFactorForAdmins = false
+	}
+
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		heyfyiserver.TrustProxyHeaders = true
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); len(issuer) > 0 {
+		heyfyiserver.OidcConfig = oidc.Config{
+			Issuer:       issuer,
+			ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectUrl:  os.Getenv("OIDC_REDIRECT_URL"),
+		}
+		if scopes := os.Getenv("OIDC_SCOPES"); len(scopes) > 0 {
+			heyfyiserver.OidcConfig.Scopes = strings.Fields(scopes)
+		}
+		if name := os.Getenv("OIDC_PROVIDER_NAME"); len(name) > 0 {
+			heyfyiserver.OidcProviderName = name
+		}
+	}
+
+	if flag.Arg(0) == "migrate" {
+		migrateCommand(databaseUrl, flag.Args()[1:])
+		return
+	}
+
+	heyfyiserver.StartServer(serverAddress, cookieStoreSalt, databaseUrl)
 }
@@ -1,3 +1,9 @@
+//Returns the token that requests which change something have to send, so that the server knows they came from this site
+function csrfToken() {
+	var meta = document.querySelector("meta[name='csrf-token']");
+	return meta ? meta.getAttribute("content") : "";
+}
+
 function doVote(factId, up) {
 
 	voteRequest = {FactId: factId, Up: up===true};
@@ -17,6 +23,7 @@ function doVote(factId, up) {
 
 	xmlhttp.open("POST", url, true);
 	xmlhttp.setRequestHeader("Content-Type", "application/json;charset=UTF-8");
+	xmlhttp.setRequestHeader("X-CSRF-Token", csrfToken());
 	xmlhttp.send(request);
 }
 
@@ -36,18 +43,18 @@ function processResponse(response) {
 	}
 }
 
-function doModerate(factId, enable) {
+function doHideComment(commentId, hide) {
 
-	voteRequest = {FactId: factId, Enable: enable===true};
+	hideRequest = {CommentId: commentId, Hide: hide===true};
 
-	var request = JSON.stringify(voteRequest);
+	var request = JSON.stringify(hideRequest);
 	var xmlhttp = new XMLHttpRequest();
-	var url = "/api/moderate"
+	var url = "/api/hidecomment"
 
 	xmlhttp.onreadystatechange = function() {
 		if (xmlhttp.readyState == 4 && xmlhttp.status == 200) {
 			var response = JSON.parse(xmlhttp.responseText);
-			processModerateResponse(response);
+			processHideCommentResponse(response);
 		} else if(xmlhttp.readyState == 4 && xmlhttp.status != 200) {
 			alert("Error: " + xmlhttp.responseText);
 		}
@@ -55,32 +62,26 @@ function doModerate(factId, enable) {
 
 	xmlhttp.open("POST", url, true);
 	xmlhttp.setRequestHeader("Content-Type", "application/json;charset=UTF-8");
+	xmlhttp.setRequestHeader("X-CSRF-Token", csrfToken());
 	xmlhttp.send(request);
 }
 
-function processModerateResponse(response) {
+function processHideCommentResponse(response) {
 	if(response.Response == "ok") {
-		//moderate was OK!
+		hiddenFieldId = "comment-"+response.CommentId+"-hidden";
+		hideFieldLink = "comment-"+response.CommentId+"-hidelink";
 
-		console.log("Got response: " + JSON.stringify(response));
+		if(response.NewHidden == false) {
+			document.getElementById(hideFieldLink).innerHTML = "Moderator - Hide";
+			document.getElementById(hideFieldLink).setAttribute("onclick", "doHideComment("+response.CommentId+", true)");
 
-		moderateFieldId = "fact-"+response.FactId+"-moderate";
-		
-		moderateFieldLink = "fact-"+response.FactId+"-moderatelink";
-
-		if(response.NewAwaitModeration == false) {
-			document.getElementById(moderateFieldLink).innerHTML = "Moderator - Disable";
-			document.getElementById(moderateFieldLink).setAttribute("onclick", "doModerate("+response.FactId+", true)");
-			
-			document.getElementById(moderateFieldId).style.display = "none";
+			document.getElementById(hiddenFieldId).style.display = "none";
 		} else {
-			document.getElementById(moderateFieldLink).innerHTML = "Moderator - Approve";
-			document.getElementById(moderateFieldLink).setAttribute("onclick", "doModerate("+response.FactId+", false)");
-			
-			document.getElementById(moderateFieldId).style.display = "inline";
-		}
-		
+			document.getElementById(hideFieldLink).innerHTML = "Moderator - Unhide";
+			document.getElementById(hideFieldLink).setAttribute("onclick", "doHideComment("+response.CommentId+", false)");
 
+			document.getElementById(hiddenFieldId).style.display = "inline";
+		}
 	} else {
 		alert(response.Response);
 	}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kiwih/heyfyi/heyfyiserver"
+	"github.com/kiwih/heyfyi/heyfyiserver/fyidb"
+)
+
+const migrateUsage = `usage: heyfyi migrate <command>
+
+commands:
+	status	show the schema version and which migrations have been applied
+	up	apply every pending migration
+	down	revert the most recently applied migration
+	to N	apply or revert migrations until the schema is at version N (0 is an empty database)
+`
+
+//Runs "heyfyi migrate ..." against $DATABASE_URL
+func migrateCommand(databaseUrl string, args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	if databaseUrl == heyfyiserver.MemoryDatabaseUrl {
+		fmt.Fprintln(os.Stderr, "In-memory storage doesn't need migrating.")
+		os.Exit(2)
+	}
+
+	if err := fyidb.OpenDatabase(databaseUrl); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open database connection:", err)
+		os.Exit(1)
+	}
+
+	var err error
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		err = printMigrationStatus()
+	case args[0] == "up" && len(args) == 1:
+		err = fyidb.DbStorage.MigrateUp()
+	case args[0] == "down" && len(args) == 1:
+		err = fyidb.DbStorage.MigrateDown()
+	case args[0] == "to" && len(args) == 2:
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			fmt.Fprintln(os.Stderr, "Bad schema version:", args[1])
+			os.Exit(2)
+		}
+		err = fyidb.DbStorage.MigrateTo(version)
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Migration failed:", err)
+		os.Exit(1)
+	}
+
+	if args[0] != "status" {
+		printMigrationStatus()
+	}
+}
+
+func printMigrationStatus() error {
+	version, err := fyidb.DbStorage.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	states, err := fyidb.DbStorage.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Schema version %d (latest is %d)\n", version, fyidb.LatestSchemaVersion())
+	for _, state := range states {
+		if state.Applied {
+			fmt.Printf("  [x] %4d %s (applied %s)\n", state.Version, state.Description, state.AppliedAt.Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Printf("  [ ] %4d %s\n", state.Version, state.Description)
+		}
+	}
+	return nil
+}